@@ -16,7 +16,7 @@ echo "Building OTEL enhancer plugin..."
 go build -buildmode=plugin -o tyk_otel_enhancer.so tyk_otel_enhancer.go
 
 echo "Building MCP tools plugin..."
-go build -buildmode=plugin -o tyk_mcp_tools.so tyk_mcp_tools.go
+go build -buildmode=plugin -o tyk_mcp_tools.so tyk_mcp_*.go
 
 echo "Go plugins built successfully!"
 ls -la *.so
@@ -4,10 +4,17 @@ go 1.22
 
 require (
     github.com/TykTechnologies/tyk latest
+    github.com/alicebob/miniredis/v2 v2.39.0
+    github.com/redis/go-redis/v9 v9.5.1
     github.com/sirupsen/logrus v1.9.3
+    github.com/vmihailenco/msgpack/v5 v5.4.1
     go.opentelemetry.io/otel v1.21.0
+    go.opentelemetry.io/otel/metric v1.21.0
     go.opentelemetry.io/otel/trace v1.21.0
+    golang.org/x/net v0.19.0
     golang.org/x/oauth2 v0.15.0
+    golang.org/x/sync v0.5.0
+    gopkg.in/yaml.v3 v3.0.1
 )
 
 replace (
@@ -0,0 +1,146 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+
+    "github.com/TykTechnologies/tyk/ctx"
+    "github.com/TykTechnologies/tyk/log"
+)
+
+// ToolAccessConfig decides which callers may see and call which tools.
+// Rules from the MCP config apply after any rules set in the API
+// definition's config_data under "mcp_tool_access". Anonymous callers only
+// get the tools a rule with Anonymous set grants them.
+type ToolAccessConfig struct {
+    // Default is "allow" or "deny" for built-in tools no rule matches,
+    // for identified callers
+    Default string `json:"default"`
+    // ExternalDefault takes the place of Default for tools generated from
+    // OpenAPI documents or federated from other MCP servers. Those tools
+    // are not known in advance, so it is "deny" unless set to "allow".
+    ExternalDefault string           `json:"external_default"`
+    Rules           []ToolAccessRule `json:"rules"`
+}
+
+// ToolAccessRule grants the tools matching a '*' wildcard in Tools to
+// callers holding any of the listed roles, Tyk policies, session tags or
+// OAuth scopes. The first rule matching a tool decides; a rule listing no
+// grants admits any identified caller, and anonymous ones too when
+// Anonymous is set.
+type ToolAccessRule struct {
+    Tools     []string `json:"tools"`
+    Roles     []string `json:"roles"`
+    Policies  []string `json:"policies"`
+    Tags      []string `json:"tags"`
+    Scopes    []string `json:"scopes"`
+    Anonymous bool     `json:"anonymous"`
+}
+
+// errToolForbidden is returned by runTool when the caller may not use a tool
+var errToolForbidden = errors.New("tool not permitted")
+
+// toolAccessFor combines the API definition's rules with the MCP config
+func toolAccessFor(r *http.Request) ToolAccessConfig {
+    access := ToolAccessConfig{
+        Default:         currentConfig().ToolAccess.Default,
+        ExternalDefault: currentConfig().ToolAccess.ExternalDefault,
+        Rules:           currentConfig().ToolAccess.Rules,
+    }
+    if r == nil {
+        return access
+    }
+    spec := ctx.GetDefinition(r)
+    if spec == nil || spec.ConfigData == nil {
+        return access
+    }
+    raw, ok := spec.ConfigData["mcp_tool_access"]
+    if !ok {
+        return access
+    }
+
+    var fromAPI ToolAccessConfig
+    encoded, err := json.Marshal(raw)
+    if err == nil {
+        err = json.Unmarshal(encoded, &fromAPI)
+    }
+    if err != nil {
+        // A broken policy must not open tools up: deny everything
+        log.Get().WithError(err).WithField("api_id", spec.APIID).Error("Invalid mcp_tool_access in API definition")
+        return ToolAccessConfig{Default: "deny"}
+    }
+    if fromAPI.Default != "" {
+        access.Default = fromAPI.Default
+    }
+    if fromAPI.ExternalDefault != "" {
+        access.ExternalDefault = fromAPI.ExternalDefault
+    }
+    access.Rules = append(append([]ToolAccessRule{}, fromAPI.Rules...), access.Rules...)
+    return access
+}
+
+// allows reports whether caller may list and call the named tool
+func (a ToolAccessConfig) allows(toolName string, caller mcpCaller) bool {
+    for _, rule := range a.Rules {
+        if !rule.matchesTool(toolName) {
+            continue
+        }
+        if rule.Anonymous {
+            return true
+        }
+        if caller.Anonymous() {
+            return false
+        }
+        if len(rule.Roles) == 0 && len(rule.Policies) == 0 && len(rule.Tags) == 0 && len(rule.Scopes) == 0 {
+            return true
+        }
+        return matchesAny(caller.Roles, rule.Roles) ||
+            matchesAny(caller.Policies, rule.Policies) ||
+            matchesAny(caller.Tags, rule.Tags) ||
+            matchesAny(caller.Scopes, rule.Scopes)
+    }
+    if caller.Anonymous() {
+        return false
+    }
+    if isExternalTool(toolName) {
+        return a.ExternalDefault == "allow"
+    }
+    return a.Default != "deny"
+}
+
+// isExternalTool reports whether a tool comes from an OpenAPI document or
+// a federated MCP server rather than the plugin itself
+func isExternalTool(toolName string) bool {
+    state := currentState()
+    if _, ok := state.federated[toolName]; ok {
+        return true
+    }
+    for version := range state.versions[toolName] {
+        if _, ok := state.operations[toolKey(toolName, version)]; ok {
+            return true
+        }
+    }
+    return false
+}
+
+func (rule ToolAccessRule) matchesTool(toolName string) bool {
+    for _, pattern := range rule.Tools {
+        if wildcardMatch(pattern, toolName) {
+            return true
+        }
+    }
+    return false
+}
+
+// visibleTools keeps the tools the caller may use
+func visibleTools(tools []MCPTool, caller mcpCaller, r *http.Request) []MCPTool {
+    access := toolAccessFor(r)
+    visible := tools[:0]
+    for _, tool := range tools {
+        if access.allows(tool.Name, caller) {
+            visible = append(visible, tool)
+        }
+    }
+    return visible
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestToolAccessAllows(t *testing.T) {
+    state := useConfig(t, nil)
+    state.register(MCPTool{Name: "ticketing_create"})
+    state.operations[toolKey("ticketing_create", defaultToolVersion)] = gatewayOperation{ToolName: "ticketing_create"}
+
+    anonymous := mcpCaller{}
+    ann := mcpCaller{ID: "ann"}
+    responder := mcpCaller{ID: "rob", Roles: []string{"Responder"}}
+    scoped := mcpCaller{ID: "sam", Scopes: []string{"tickets:write"}}
+
+    tests := []struct {
+        name   string
+        access ToolAccessConfig
+        tool   string
+        caller mcpCaller
+        want   bool
+    }{
+        {name: "default allows identified callers", access: ToolAccessConfig{Default: "allow"}, tool: "sentraip_threat_check", caller: ann, want: true},
+        {name: "default never admits anonymous callers", access: ToolAccessConfig{Default: "allow"}, tool: "sentraip_threat_check", caller: anonymous},
+        {name: "empty default allows", tool: "sentraip_threat_check", caller: ann, want: true},
+        {name: "default deny", access: ToolAccessConfig{Default: "deny"}, tool: "sentraip_threat_check", caller: ann},
+        {name: "external tools default to deny", access: ToolAccessConfig{Default: "allow"}, tool: "ticketing_create", caller: ann},
+        {name: "external default allow", access: ToolAccessConfig{ExternalDefault: "allow"}, tool: "ticketing_create", caller: ann, want: true},
+        {name: "external default skips anonymous callers", access: ToolAccessConfig{ExternalDefault: "allow"}, tool: "ticketing_create", caller: anonymous},
+        {
+            name:   "role grant ignores case",
+            access: ToolAccessConfig{Rules: []ToolAccessRule{{Tools: []string{"gateway_*"}, Roles: []string{"responder"}}}},
+            tool:   "gateway_block_target",
+            caller: responder,
+            want:   true,
+        },
+        {
+            name:   "rule without the caller's grant denies",
+            access: ToolAccessConfig{Default: "allow", Rules: []ToolAccessRule{{Tools: []string{"gateway_*"}, Roles: []string{"responder"}}}},
+            tool:   "gateway_block_target",
+            caller: ann,
+        },
+        {
+            name:   "scope grant",
+            access: ToolAccessConfig{Rules: []ToolAccessRule{{Tools: []string{"ticketing_*"}, Scopes: []string{"tickets:write"}}}},
+            tool:   "ticketing_create",
+            caller: scoped,
+            want:   true,
+        },
+        {
+            name:   "first matching rule decides",
+            access: ToolAccessConfig{Rules: []ToolAccessRule{{Tools: []string{"gateway_list_*"}}, {Tools: []string{"gateway_*"}, Roles: []string{"admin"}}}},
+            tool:   "gateway_list_blocks",
+            caller: ann,
+            want:   true,
+        },
+        {
+            name:   "rule without grants needs an identity",
+            access: ToolAccessConfig{Rules: []ToolAccessRule{{Tools: []string{"sentraip_*"}}}},
+            tool:   "sentraip_threat_check",
+            caller: anonymous,
+        },
+        {
+            name:   "anonymous rule",
+            access: ToolAccessConfig{Rules: []ToolAccessRule{{Tools: []string{"sentraip_*"}, Anonymous: true}}},
+            tool:   "sentraip_threat_check",
+            caller: anonymous,
+            want:   true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := tt.access.allows(tt.tool, tt.caller); got != tt.want {
+                t.Fatalf("allows(%s, %+v) = %v, want %v", tt.tool, tt.caller, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestVisibleTools(t *testing.T) {
+    useConfig(t, nil)
+    tools := []MCPTool{{Name: "sentraip_threat_check"}, {Name: "gateway_block_target"}, {Name: "tyk_api_analytics"}}
+
+    tests := []struct {
+        name   string
+        caller mcpCaller
+        want   []string
+    }{
+        {name: "anonymous", want: []string{}},
+        {name: "identified", caller: mcpCaller{ID: "ann"}, want: []string{"sentraip_threat_check", "tyk_api_analytics"}},
+        {name: "responder", caller: mcpCaller{ID: "rob", Roles: []string{"responder"}}, want: []string{"sentraip_threat_check", "gateway_block_target", "tyk_api_analytics"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            visible := visibleTools(append([]MCPTool{}, tools...), tt.caller, nil)
+            got := []string{}
+            for _, tool := range visible {
+                got = append(got, tool.Name)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("visible %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
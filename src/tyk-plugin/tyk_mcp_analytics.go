@@ -0,0 +1,433 @@
+package main
+
+import (
+    "context"
+    "crypto/sha1"
+    "encoding/hex"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/redis/go-redis/v9"
+    "github.com/sirupsen/logrus"
+    "github.com/vmihailenco/msgpack/v5"
+)
+
+// AnalyticsConfig selects where tyk_api_analytics reads from
+type AnalyticsConfig struct {
+    // Store names a registered analytics store; "redis" is built in
+    Store string `json:"store"`
+    // Keys are the gateway's raw analytics lists. List every shard when
+    // analytics_config.enable_multiple_analytics_keys is on.
+    Keys []string `json:"keys"`
+    // RollupInterval must be shorter than the gateway's purge_delay so
+    // records are aggregated before Tyk Pump drains the list
+    RollupInterval string `json:"rollup_interval"`
+    // Retention is how long hourly aggregates are kept
+    Retention string `json:"retention"`
+}
+
+// analyticsAggregate is request data for one API summed over a window
+type analyticsAggregate struct {
+    Total          int64
+    Errors         int64
+    LatencySum     int64
+    StatusCodes    map[string]int64
+    Endpoints      map[string]int64
+    LatencyBuckets []int64
+}
+
+// analyticsStore is the backend tyk_api_analytics queries. Stores are
+// registered by name with registerAnalyticsStore and selected with
+// analytics.store in the MCP config.
+type analyticsStore interface {
+    // Aggregate sums the records of apiID between from and to. found is
+    // false when the store holds no data at all for the API.
+    Aggregate(ctx context.Context, apiID string, from, to time.Time) (agg analyticsAggregate, found bool, err error)
+}
+
+// latencyBucketBounds are the upper bounds in milliseconds of the latency
+// histogram kept per hour; percentiles are reported as bucket bounds
+var latencyBucketBounds = []int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+var (
+    analyticsStoresMu sync.RWMutex
+    analyticsStores   = map[string]func(AnalyticsConfig) analyticsStore{}
+)
+
+func registerAnalyticsStore(name string, factory func(AnalyticsConfig) analyticsStore) {
+    analyticsStoresMu.Lock()
+    defer analyticsStoresMu.Unlock()
+    analyticsStores[name] = factory
+}
+
+func currentAnalyticsStore() (analyticsStore, error) {
+    cfg := currentConfig().Analytics
+    analyticsStoresMu.RLock()
+    factory, ok := analyticsStores[cfg.Store]
+    analyticsStoresMu.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("unknown analytics store %q", cfg.Store)
+    }
+    return factory(cfg), nil
+}
+
+func analyticsWindow(timeRange string) (time.Duration, error) {
+    switch timeRange {
+    case "24h":
+        return 24 * time.Hour, nil
+    case "7d":
+        return 7 * 24 * time.Hour, nil
+    case "30d":
+        return 30 * 24 * time.Hour, nil
+    }
+    return 0, fmt.Errorf("invalid time range: %s", timeRange)
+}
+
+// summarizeAnalytics builds the tyk_api_analytics result for apiID
+func summarizeAnalytics(ctx context.Context, apiID, timeRange string) (map[string]interface{}, error) {
+    window, err := analyticsWindow(timeRange)
+    if err != nil {
+        return nil, err
+    }
+    store, err := currentAnalyticsStore()
+    if err != nil {
+        return nil, err
+    }
+
+    to := time.Now().UTC()
+    from := to.Add(-window)
+    agg, found, err := store.Aggregate(ctx, apiID, from, to)
+    if err != nil {
+        return nil, &ToolError{
+            Code:    toolErrorUpstream,
+            Message: fmt.Sprintf("analytics store unavailable: %v", err),
+            Details: map[string]interface{}{"store": currentConfig().Analytics.Store},
+        }
+    }
+    if _, known := listAPIDefinitions()[apiID]; !known && !found {
+        return nil, &ToolError{
+            Code:    toolErrorNotFound,
+            Message: fmt.Sprintf("API %s does not exist", apiID),
+            Details: map[string]interface{}{"api_id": apiID},
+        }
+    }
+
+    errorRate, avgLatency := 0.0, 0.0
+    if agg.Total > 0 {
+        errorRate = float64(agg.Errors) / float64(agg.Total)
+        avgLatency = float64(agg.LatencySum) / float64(agg.Total)
+    }
+
+    return map[string]interface{}{
+        "api_id":              apiID,
+        "time_range":          timeRange,
+        "window_start":        from.Format(time.RFC3339),
+        "window_end":          to.Format(time.RFC3339),
+        "total_requests":      agg.Total,
+        "successful_requests": agg.Total - agg.Errors,
+        "error_requests":      agg.Errors,
+        "avg_response_time":   avgLatency,
+        "error_rate":          errorRate,
+        "latency_percentiles": map[string]interface{}{
+            "p50": latencyPercentile(agg.LatencyBuckets, 0.50),
+            "p95": latencyPercentile(agg.LatencyBuckets, 0.95),
+            "p99": latencyPercentile(agg.LatencyBuckets, 0.99),
+        },
+        "top_endpoints": topEndpoints(agg.Endpoints, 10),
+        "status_codes":  agg.StatusCodes,
+        "timestamp":     time.Now().Format(time.RFC3339),
+    }, nil
+}
+
+// latencyPercentile returns the upper bound of the bucket holding the p-th
+// request, or 0 when there is no data
+func latencyPercentile(buckets []int64, p float64) int64 {
+    var total int64
+    for _, n := range buckets {
+        total += n
+    }
+    if total == 0 {
+        return 0
+    }
+
+    rank := int64(float64(total)*p + 0.5)
+    if rank < 1 {
+        rank = 1
+    }
+    var seen int64
+    for i, n := range buckets {
+        seen += n
+        if seen >= rank {
+            if i < len(latencyBucketBounds) {
+                return latencyBucketBounds[i]
+            }
+            break
+        }
+    }
+    return latencyBucketBounds[len(latencyBucketBounds)-1]
+}
+
+func topEndpoints(endpoints map[string]int64, n int) []map[string]interface{} {
+    keys := make([]string, 0, len(endpoints))
+    for k := range endpoints {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        if endpoints[keys[i]] != endpoints[keys[j]] {
+            return endpoints[keys[i]] > endpoints[keys[j]]
+        }
+        return keys[i] < keys[j]
+    })
+    if len(keys) > n {
+        keys = keys[:n]
+    }
+
+    out := make([]map[string]interface{}, 0, len(keys))
+    for _, k := range keys {
+        method, path := "", k
+        if i := strings.IndexByte(k, ' '); i > 0 {
+            method, path = k[:i], k[i+1:]
+        }
+        out = append(out, map[string]interface{}{
+            "method":   method,
+            "path":     path,
+            "requests": endpoints[k],
+        })
+    }
+    return out
+}
+
+// tykAnalyticsRecord is the subset of the gateway's msgpack encoded
+// AnalyticsRecord the rollup needs
+type tykAnalyticsRecord struct {
+    Method       string
+    Path         string
+    ResponseCode int
+    APIID        string
+    TimeStamp    time.Time
+    RequestTime  int64
+}
+
+// redisAnalyticsStore reads hourly per-API aggregates that
+// rollupAnalytics folds out of the gateway's raw analytics list. The raw
+// list only holds records until Tyk Pump purges it, so the aggregates are
+// what make 7d and 30d windows possible.
+type redisAnalyticsStore struct {
+    client *redis.Client
+}
+
+func analyticsHourKey(apiID string, hour int64) string {
+    return fmt.Sprintf("mcp-analytics:%s:%d", apiID, hour)
+}
+
+func (s *redisAnalyticsStore) Aggregate(ctx context.Context, apiID string, from, to time.Time) (analyticsAggregate, bool, error) {
+    agg := analyticsAggregate{
+        StatusCodes:    map[string]int64{},
+        Endpoints:      map[string]int64{},
+        LatencyBuckets: make([]int64, len(latencyBucketBounds)+1),
+    }
+
+    pipe := s.client.Pipeline()
+    var cmds []*redis.MapStringStringCmd
+    for hour := from.Unix() / 3600; hour <= to.Unix()/3600; hour++ {
+        cmds = append(cmds, pipe.HGetAll(ctx, analyticsHourKey(apiID, hour)))
+    }
+    if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+        return agg, false, err
+    }
+
+    found := false
+    for _, cmd := range cmds {
+        for field, raw := range cmd.Val() {
+            found = true
+            n, _ := strconv.ParseInt(raw, 10, 64)
+            switch {
+            case field == "total":
+                agg.Total += n
+            case field == "errors":
+                agg.Errors += n
+            case field == "latency_sum":
+                agg.LatencySum += n
+            case strings.HasPrefix(field, "status:"):
+                agg.StatusCodes[strings.TrimPrefix(field, "status:")] += n
+            case strings.HasPrefix(field, "endpoint:"):
+                agg.Endpoints[strings.TrimPrefix(field, "endpoint:")] += n
+            case strings.HasPrefix(field, "latency:"):
+                if i, err := strconv.Atoi(strings.TrimPrefix(field, "latency:")); err == nil && i >= 0 && i < len(agg.LatencyBuckets) {
+                    agg.LatencyBuckets[i] += n
+                }
+            }
+        }
+    }
+    return agg, found, nil
+}
+
+// rollupAnalytics periodically folds new raw analytics records into hourly
+// aggregates. It only reads the raw lists, leaving them for Tyk Pump, and a
+// per-hour set of record digests stops gateways sharing Redis from counting
+// a record twice.
+func rollupAnalytics() {
+    cursors := map[string]analyticsCursor{}
+    for {
+        cfg := currentConfig().Analytics
+        if cfg.Store == "redis" {
+            ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+            if err := rollupAnalyticsOnce(ctx, redisClient(), cfg, cursors); err != nil {
+                log.Get().WithError(err).Warn("Analytics rollup failed")
+            }
+            cancel()
+        }
+        time.Sleep(durationOr(cfg.RollupInterval, 5*time.Second))
+    }
+}
+
+// analyticsFoldScript folds one record into its hourly aggregate unless
+// its digest is already in the hour's seen set. Marking the record seen and
+// counting it happen together, so a failure cannot lose or double count it.
+//
+// KEYS: seen set, hour aggregate. ARGV: digest, seen TTL, aggregate TTL,
+// is error, latency, latency bucket field, status field, endpoint field.
+var analyticsFoldScript = redis.NewScript(`
+if redis.call('SADD', KEYS[1], ARGV[1]) == 0 then
+    return 0
+end
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+redis.call('HINCRBY', KEYS[2], 'total', 1)
+if ARGV[4] == '1' then
+    redis.call('HINCRBY', KEYS[2], 'errors', 1)
+end
+redis.call('HINCRBY', KEYS[2], 'latency_sum', ARGV[5])
+redis.call('HINCRBY', KEYS[2], ARGV[6], 1)
+redis.call('HINCRBY', KEYS[2], ARGV[7], 1)
+redis.call('HINCRBY', KEYS[2], ARGV[8], 1)
+redis.call('EXPIRE', KEYS[2], ARGV[3])
+return 1
+`)
+
+// analyticsCursor is how far the rollup has read a raw list: the number of
+// items consumed and the digest of the last one. The gateway appends to the
+// tail and Tyk Pump drains from the head, so while that last item is still
+// in place only the items after it are new. Otherwise the list is read from
+// the start again and the seen sets skip what was already counted.
+type analyticsCursor struct {
+    next int64
+    last string
+}
+
+// rollupAnalyticsOnce folds the records added to the raw lists since the
+// read that left cursors, and moves cursors past them
+func rollupAnalyticsOnce(ctx context.Context, client *redis.Client, cfg AnalyticsConfig, cursors map[string]analyticsCursor) error {
+    retention := durationOr(cfg.Retention, 31*24*time.Hour)
+    folded := int64(0)
+
+    for _, key := range cfg.Keys {
+        start := int64(0)
+        if cursor, ok := cursors[key]; ok {
+            last, err := client.LIndex(ctx, key, cursor.next-1).Result()
+            if err != nil && err != redis.Nil {
+                return fmt.Errorf("read %s: %w", key, err)
+            }
+            if err == nil && recordDigest(last) == cursor.last {
+                start = cursor.next
+            }
+        }
+
+        raw, err := client.LRange(ctx, key, start, -1).Result()
+        if err != nil {
+            return fmt.Errorf("read %s: %w", key, err)
+        }
+        if len(raw) == 0 {
+            if start == 0 {
+                delete(cursors, key)
+            }
+            continue
+        }
+
+        n, err := foldAnalyticsRecords(ctx, client, raw, retention)
+        if err != nil {
+            return err
+        }
+        folded += n
+        cursors[key] = analyticsCursor{next: start + int64(len(raw)), last: recordDigest(raw[len(raw)-1])}
+    }
+
+    if folded > 0 {
+        log.Get().WithFields(logrus.Fields{"records": folded}).Debug("Analytics records aggregated")
+    }
+    return nil
+}
+
+// foldAnalyticsRecords runs analyticsFoldScript for each record in one
+// pipeline and returns how many were new
+func foldAnalyticsRecords(ctx context.Context, client *redis.Client, raw []string, retention time.Duration) (int64, error) {
+    if err := analyticsFoldScript.Load(ctx, client).Err(); err != nil {
+        return 0, err
+    }
+
+    pipe := client.Pipeline()
+    var cmds []*redis.Cmd
+    for _, item := range raw {
+        var rec tykAnalyticsRecord
+        if err := msgpack.Unmarshal([]byte(item), &rec); err != nil || rec.APIID == "" {
+            continue
+        }
+        if time.Since(rec.TimeStamp) > retention {
+            continue
+        }
+
+        hour := rec.TimeStamp.Unix() / 3600
+        isError := "0"
+        if rec.ResponseCode >= 400 {
+            isError = "1"
+        }
+        cmds = append(cmds, analyticsFoldScript.EvalSha(ctx, pipe,
+            []string{fmt.Sprintf("mcp-analytics-seen:%d", hour), analyticsHourKey(rec.APIID, hour)},
+            recordDigest(item),
+            int64((2*time.Hour).Seconds()),
+            int64(retention.Seconds()),
+            isError,
+            rec.RequestTime,
+            "latency:"+strconv.Itoa(latencyBucket(rec.RequestTime)),
+            "status:"+strconv.Itoa(rec.ResponseCode),
+            "endpoint:"+rec.Method+" "+rec.Path,
+        ))
+    }
+    if len(cmds) == 0 {
+        return 0, nil
+    }
+    if _, err := pipe.Exec(ctx); err != nil {
+        return 0, err
+    }
+
+    var folded int64
+    for _, cmd := range cmds {
+        n, _ := cmd.Int64()
+        folded += n
+    }
+    return folded, nil
+}
+
+func recordDigest(item string) string {
+    digest := sha1.Sum([]byte(item))
+    return hex.EncodeToString(digest[:])
+}
+
+func latencyBucket(ms int64) int {
+    for i, bound := range latencyBucketBounds {
+        if ms <= bound {
+            return i
+        }
+    }
+    return len(latencyBucketBounds)
+}
+
+func init() {
+    registerAnalyticsStore("redis", func(AnalyticsConfig) analyticsStore {
+        return &redisAnalyticsStore{client: redisClient()}
+    })
+}
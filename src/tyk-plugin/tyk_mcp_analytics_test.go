@@ -0,0 +1,166 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/alicebob/miniredis/v2"
+    "github.com/vmihailenco/msgpack/v5"
+)
+
+// pushAnalytics appends gateway analytics records to the raw list
+func pushAnalytics(t *testing.T, server *miniredis.Miniredis, records ...tykAnalyticsRecord) {
+    t.Helper()
+    for _, rec := range records {
+        item, err := msgpack.Marshal(rec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        server.RPush("analytics-tyk-system-analytics", string(item))
+    }
+}
+
+func TestAnalyticsRollup(t *testing.T) {
+    _, server := useRedis(t, nil)
+    cursors := map[string]analyticsCursor{}
+    ctx := context.Background()
+    now := time.Now().UTC()
+    record := func(method, path string, code int, ms int64, age time.Duration) tykAnalyticsRecord {
+        return tykAnalyticsRecord{Method: method, Path: path, ResponseCode: code, APIID: "billing", TimeStamp: now.Add(-age), RequestTime: ms}
+    }
+
+    pushAnalytics(t, server,
+        record("GET", "/invoices", 200, 20, time.Minute),
+        record("GET", "/invoices", 200, 40, 3*24*time.Hour),
+        record("POST", "/invoices", 500, 900, time.Minute),
+        record("GET", "/ancient", 200, 1, 40*24*time.Hour),
+        tykAnalyticsRecord{Method: "GET", Path: "/other", ResponseCode: 200, APIID: "orders", TimeStamp: now},
+    )
+    if err := rollupAnalyticsOnce(ctx, redisClient(), currentConfig().Analytics, cursors); err != nil {
+        t.Fatal(err)
+    }
+
+    // Records already folded are not counted again, whether the list is
+    // read after them or, once Tyk Pump has drained some of it, from the
+    // start again
+    pushAnalytics(t, server, record("GET", "/invoices/1", 404, 3, time.Minute))
+    if err := rollupAnalyticsOnce(ctx, redisClient(), currentConfig().Analytics, cursors); err != nil {
+        t.Fatal(err)
+    }
+    server.Lpop("analytics-tyk-system-analytics")
+    if err := rollupAnalyticsOnce(ctx, redisClient(), currentConfig().Analytics, cursors); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        timeRange  string
+        wantTotal  int64
+        wantErrors int64
+        wantCodes  map[string]int64
+        wantAvg    float64
+        wantTop    int64
+    }{
+        {timeRange: "24h", wantTotal: 3, wantErrors: 2, wantCodes: map[string]int64{"200": 1, "404": 1, "500": 1}, wantAvg: float64(20+900+3) / 3, wantTop: 1},
+        {timeRange: "7d", wantTotal: 4, wantErrors: 2, wantCodes: map[string]int64{"200": 2, "404": 1, "500": 1}, wantAvg: float64(20+40+900+3) / 4, wantTop: 2},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.timeRange, func(t *testing.T) {
+            summary, err := summarizeAnalytics(ctx, "billing", tt.timeRange)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if summary["total_requests"] != tt.wantTotal || summary["error_requests"] != tt.wantErrors {
+                t.Fatalf("summary %v, want %d requests and %d errors", summary, tt.wantTotal, tt.wantErrors)
+            }
+            if !reflect.DeepEqual(summary["status_codes"], tt.wantCodes) {
+                t.Fatalf("status codes %v, want %v", summary["status_codes"], tt.wantCodes)
+            }
+            if summary["avg_response_time"] != tt.wantAvg || summary["error_rate"] != float64(tt.wantErrors)/float64(tt.wantTotal) {
+                t.Fatalf("summary %v", summary)
+            }
+            top := summary["top_endpoints"].([]map[string]interface{})
+            if top[0]["method"] != "GET" || top[0]["path"] != "/invoices" || top[0]["requests"] != tt.wantTop {
+                t.Fatalf("top endpoint %v, want GET /invoices", top[0])
+            }
+        })
+    }
+}
+
+func TestSummarizeAnalyticsErrors(t *testing.T) {
+    tests := []struct {
+        name      string
+        store     string
+        timeRange string
+        wantCode  string
+        wantErr   string
+    }{
+        {name: "unknown api", store: "redis", timeRange: "24h", wantCode: toolErrorNotFound},
+        {name: "unknown time range", store: "redis", timeRange: "1y", wantErr: "invalid time range: 1y"},
+        {name: "unknown store", store: "influx", timeRange: "24h", wantErr: `unknown analytics store "influx"`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            useRedis(t, func(cfg *MCPConfig) {
+                cfg.Analytics.Store = tt.store
+                cfg.AppsPath = t.TempDir()
+            })
+            _, err := summarizeAnalytics(context.Background(), "orders", tt.timeRange)
+            if tt.wantCode != "" {
+                var toolErr *ToolError
+                if !errors.As(err, &toolErr) || toolErr.Code != tt.wantCode {
+                    t.Fatalf("summarizeAnalytics error %v, want code %s", err, tt.wantCode)
+                }
+                return
+            }
+            if err == nil || err.Error() != tt.wantErr {
+                t.Fatalf("summarizeAnalytics error %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestLatencyPercentile(t *testing.T) {
+    buckets := make([]int64, len(latencyBucketBounds)+1)
+    buckets[latencyBucket(8)] = 90
+    buckets[latencyBucket(400)] = 9
+    buckets[latencyBucket(60000)] = 1
+
+    tests := []struct {
+        buckets []int64
+        p       float64
+        want    int64
+    }{
+        {buckets: nil, p: 0.5, want: 0},
+        {buckets: buckets, p: 0.5, want: 10},
+        {buckets: buckets, p: 0.95, want: 500},
+        {buckets: buckets, p: 1, want: 30000},
+    }
+
+    for _, tt := range tests {
+        if got := latencyPercentile(tt.buckets, tt.p); got != tt.want {
+            t.Errorf("latencyPercentile(p%v) = %d, want %d", tt.p*100, got, tt.want)
+        }
+    }
+}
+
+func TestTopEndpoints(t *testing.T) {
+    endpoints := map[string]int64{"GET /a": 3, "POST /b": 5, "GET /c": 3, "odd": 1}
+
+    got := topEndpoints(endpoints, 3)
+    want := []map[string]interface{}{
+        {"method": "POST", "path": "/b", "requests": int64(5)},
+        {"method": "GET", "path": "/a", "requests": int64(3)},
+        {"method": "GET", "path": "/c", "requests": int64(3)},
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("topEndpoints = %v, want %v", got, want)
+    }
+    if odd := topEndpoints(map[string]int64{"odd": 1}, 1); odd[0]["method"] != "" || odd[0]["path"] != "odd" {
+        t.Fatalf("topEndpoints = %v, want an endpoint without a method", odd)
+    }
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
+    "github.com/sirupsen/logrus"
+)
+
+// ApprovalsConfig controls the queue that holds calls to tools flagged
+// requiresApproval until a human approves or rejects them
+type ApprovalsConfig struct {
+    // Roles may list, approve, reject and expire tickets
+    Roles []string `json:"roles"`
+    // Tools adds tools to those flagged requiresApproval in code
+    Tools []string `json:"tools"`
+    // TTL is how long a ticket waits for a decision before it expires
+    TTL string `json:"ttl"`
+    // Retention is how long decided tickets and their results are kept
+    Retention string `json:"retention"`
+    // AllowSelfApproval lets a caller approve their own tickets
+    AllowSelfApproval bool `json:"allow_self_approval"`
+}
+
+const (
+    ticketPending  = "pending"
+    ticketApproved = "approved"
+    ticketRejected = "rejected"
+    ticketExpired  = "expired"
+    ticketExecuted = "executed"
+    ticketFailed   = "failed"
+
+    approvalsIndexKey   = "mcp-approvals"
+    approvalsPendingKey = "mcp-approvals-pending"
+)
+
+// approvalTicket is a queued tool call and its outcome
+type approvalTicket struct {
+    ID        string                 `json:"id"`
+    Tool      string                 `json:"tool"`
+    Version   string                 `json:"version,omitempty"`
+    Arguments map[string]interface{} `json:"arguments"`
+    Status    string                 `json:"status"`
+    Requester ticketIdentity         `json:"requester"`
+    CreatedAt time.Time              `json:"created_at"`
+    ExpiresAt time.Time              `json:"expires_at"`
+
+    DecidedBy      string      `json:"decided_by,omitempty"`
+    DecidedAt      *time.Time  `json:"decided_at,omitempty"`
+    DecisionReason string      `json:"decision_reason,omitempty"`
+    ExecutedAt     *time.Time  `json:"executed_at,omitempty"`
+    Result         *ToolResult `json:"result,omitempty"`
+}
+
+// ticketIdentity is the caller identity a ticket runs under once approved.
+// The key itself is a credential, so only its hash is kept, along with the
+// subject its calls are rate limited by.
+type ticketIdentity struct {
+    ID       string   `json:"id"`
+    Alias    string   `json:"alias,omitempty"`
+    KeyHash  string   `json:"key_hash,omitempty"`
+    LimitKey string   `json:"limit_key,omitempty"`
+    ClientIP string   `json:"client_ip,omitempty"`
+    OrgID    string   `json:"org_id,omitempty"`
+    Roles    []string `json:"roles,omitempty"`
+    Policies []string `json:"policies,omitempty"`
+    Tags     []string `json:"tags,omitempty"`
+    Scopes   []string `json:"scopes,omitempty"`
+}
+
+// errTicketNotFound and errTicketDecided are returned for tickets that do
+// not exist or are no longer pending
+var (
+    errTicketNotFound = errors.New("approval ticket not found")
+    errTicketDecided  = errors.New("approval ticket is no longer pending")
+)
+
+// approvalPendingSchema is the structured result of a call waiting in the
+// queue, offered alongside a tool's own output schema
+var approvalPendingSchema = Property{
+    Type: "object",
+    Properties: map[string]Property{
+        "status":     {Type: "string", Const: "pending_approval"},
+        "ticket_id":  {Type: "string"},
+        "tool":       {Type: "string"},
+        "expires_at": {Type: "string", Format: "date-time"},
+        "message":    {Type: "string"},
+    },
+    Required: []string{"status", "ticket_id", "tool", "expires_at"},
+}
+
+// requiresApproval reports whether calls to tool go through the queue
+func requiresApproval(tool MCPTool) bool {
+    if tool.RequiresApproval {
+        return true
+    }
+    for _, name := range currentConfig().Approvals.Tools {
+        if name == tool.Name {
+            return true
+        }
+    }
+    return false
+}
+
+// withApprovalOutput lists tool as requiring approval, with an output
+// schema that also admits the pending result
+func withApprovalOutput(tool MCPTool) MCPTool {
+    tool.RequiresApproval = true
+    if tool.OutputSchema != nil {
+        tool.OutputSchema = withOutputAlternative(*tool.OutputSchema, approvalPendingSchema)
+    }
+    return tool
+}
+
+// queueForApproval stores a validated call as a pending ticket and returns
+// the pending result in place of the tool's output
+func queueForApproval(r *http.Request, tool MCPTool, params map[string]interface{}, session *user.SessionState) (ToolResult, error) {
+    caller := callerFromSession(session)
+    if caller.Anonymous() {
+        return toolErrorResult(&ToolError{Code: toolErrorForbidden, Message: tool.Name + " requires approval, which needs an identified caller"}), nil
+    }
+    if isOperationTool(tool) {
+        return toolErrorResult(&ToolError{Code: toolErrorForbidden, Message: tool.Name + " calls a gateway API with the caller's credentials and cannot be queued for approval"}), nil
+    }
+
+    id, err := newTicketID()
+    if err != nil {
+        return ToolResult{}, err
+    }
+    now := time.Now()
+    ticket := &approvalTicket{
+        ID:        id,
+        Tool:      tool.Name,
+        Version:   tool.Version,
+        Arguments: params,
+        Status:    ticketPending,
+        Requester: ticketIdentity{
+            ID:       caller.ID,
+            Alias:    session.Alias,
+            KeyHash:  keyHash(session.KeyID),
+            LimitKey: keySubject(session),
+            ClientIP: getClientIP(r),
+            OrgID:    caller.OrgID,
+            Roles:    caller.Roles,
+            Policies: caller.Policies,
+            Tags:     caller.Tags,
+            Scopes:   caller.Scopes,
+        },
+        CreatedAt: now,
+        ExpiresAt: now.Add(durationOr(currentConfig().Approvals.TTL, 24*time.Hour)),
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    _, err = redisClient().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        if err := saveTicket(ctx, pipe, ticket); err != nil {
+            return err
+        }
+        pipe.ZAdd(ctx, approvalsIndexKey, redis.Z{Score: float64(now.UnixMilli()), Member: id})
+        pipe.ZAdd(ctx, approvalsPendingKey, redis.Z{Score: float64(ticket.ExpiresAt.UnixMilli()), Member: id})
+        appendAudit(ctx, pipe, auditEvent{
+            Action:  "approval.request",
+            Target:  id,
+            Actor:   caller.ID,
+            Details: map[string]interface{}{"tool": tool.Name, "arguments": params},
+        })
+        return nil
+    })
+    if err != nil {
+        return toolErrorResult(&ToolError{Code: toolErrorUpstream, Message: "approval queue unavailable: " + err.Error()}), nil
+    }
+
+    log.Get().WithFields(logrus.Fields{
+        "tool_name":  tool.Name,
+        "ticket_id":  id,
+        "requester":  caller.ID,
+        "session_id": getSessionID(session),
+    }).Info("MCP tool call queued for approval")
+
+    pending := map[string]interface{}{
+        "status":     "pending_approval",
+        "ticket_id":  id,
+        "tool":       tool.Name,
+        "expires_at": ticket.ExpiresAt.Format(time.RFC3339),
+        "message":    fmt.Sprintf("%s requires approval; the call runs once an approver accepts ticket %s", tool.Name, id),
+    }
+    return ToolResult{
+        Content:           []ContentBlock{{Type: "text", Text: renderToolText(pending)}},
+        StructuredContent: pending,
+    }, nil
+}
+
+// decideTicket approves or rejects a pending ticket. An approved call runs
+// straight away under the requester's identity, subject to their tool
+// access and rate limits, and its result is stored on the ticket.
+func decideTicket(r *http.Request, id, status, reason string, approver mcpCaller) (*approvalTicket, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    ticket, err := transitionTicket(ctx, id, status, reason, approver.ID, func(t *approvalTicket) error {
+        if status == ticketApproved && t.Requester.ID == approver.ID && !currentConfig().Approvals.AllowSelfApproval {
+            return &ToolError{Code: toolErrorForbidden, Message: "tickets cannot be approved by their requester"}
+        }
+        return nil
+    })
+    if err != nil || status != ticketApproved {
+        return ticket, err
+    }
+
+    tool, ok := currentState().resolveTool(ticket.Tool, ticket.Version)
+    var result ToolResult
+    if ok {
+        // The call is detached from the approver's request: once approved
+        // it runs to completion or to the tool's deadline
+        replay := approvedRequest(r)
+        result = runApprovedCall(replay, ticket, tool)
+    } else {
+        result = toolErrorResult(&ToolError{Code: toolErrorNotFound, Message: "tool no longer exists: " + ticket.Tool})
+    }
+
+    executed := time.Now()
+    ticket.ExecutedAt = &executed
+    ticket.Result = &result
+    ticket.Status = ticketExecuted
+    if result.IsError {
+        ticket.Status = ticketFailed
+    }
+    ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    _, err = redisClient().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        return saveTicket(ctx, pipe, ticket)
+    })
+    if err != nil {
+        log.Get().WithError(err).WithField("ticket_id", id).Error("Failed to store approved call result")
+    }
+    return ticket, nil
+}
+
+// runApprovedCall runs an approved ticket's call for its requester. Access
+// rules, roles and budgets may have changed while the ticket waited, so
+// they are checked again, and the call counts against the requester's
+// limit now that it runs.
+func runApprovedCall(r *http.Request, ticket *approvalTicket, tool MCPTool) ToolResult {
+    requester := ticket.Requester.session()
+    if !toolAccessFor(r).allows(tool.Name, callerFromSession(requester)) {
+        return toolErrorResult(&ToolError{Code: toolErrorForbidden, Message: "the requester is not permitted to call " + tool.Name})
+    }
+    if limit, ok := toolLimit(tool.Name); ok {
+        usage, err := countToolCall(r.Context(), tool.Name, limit, ticket.Requester.limitSubject(limit), false)
+        var limited *rateLimitError
+        if errors.As(err, &limited) {
+            return toolErrorResult(&ToolError{
+                Code:    toolErrorRateLimited,
+                Message: err.Error(),
+                Details: map[string]interface{}{"limit": usage.Exceeded, "retry_after": retryAfterSeconds(usage.RetryAfter)},
+            })
+        }
+    }
+    return invokeTool(r.Context(), r, requester, tool, ticket.Arguments)
+}
+
+// transitionTicket moves a pending ticket to status inside a WATCH
+// transaction, so two approvers can never both decide it
+func transitionTicket(ctx context.Context, id, status, reason, actor string, check func(*approvalTicket) error) (*approvalTicket, error) {
+    client := redisClient()
+    key := approvalTicketKey(id)
+    var ticket *approvalTicket
+
+    err := client.Watch(ctx, func(tx *redis.Tx) error {
+        raw, err := tx.Get(ctx, key).Result()
+        if err == redis.Nil {
+            return errTicketNotFound
+        }
+        if err != nil {
+            return err
+        }
+        ticket = &approvalTicket{}
+        if err := json.Unmarshal([]byte(raw), ticket); err != nil {
+            return err
+        }
+        if ticket.Status != ticketPending {
+            return errTicketDecided
+        }
+        if check != nil {
+            if err := check(ticket); err != nil {
+                return err
+            }
+        }
+
+        now := time.Now()
+        ticket.Status = status
+        ticket.DecidedBy = actor
+        ticket.DecidedAt = &now
+        ticket.DecisionReason = reason
+
+        _, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+            if err := saveTicket(ctx, pipe, ticket); err != nil {
+                return err
+            }
+            pipe.ZRem(ctx, approvalsPendingKey, id)
+            appendAudit(ctx, pipe, auditEvent{
+                Action:  "approval." + status,
+                Target:  id,
+                Actor:   actor,
+                Reason:  reason,
+                Details: map[string]interface{}{"tool": ticket.Tool, "requester": ticket.Requester.ID},
+            })
+            return nil
+        })
+        return err
+    }, key)
+    if err == redis.TxFailedErr {
+        return nil, errTicketDecided
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    log.Get().WithFields(logrus.Fields{
+        "ticket_id": id,
+        "tool_name": ticket.Tool,
+        "status":    status,
+        "actor":     actor,
+    }).Info("Approval ticket decided")
+    return ticket, nil
+}
+
+// saveTicket queues the ticket write. Pending tickets live until they
+// expire plus the retention period; decided ones for the retention period.
+func saveTicket(ctx context.Context, pipe redis.Pipeliner, ticket *approvalTicket) error {
+    encoded, err := json.Marshal(ticket)
+    if err != nil {
+        return err
+    }
+    ttl := durationOr(currentConfig().Approvals.Retention, 7*24*time.Hour)
+    if ticket.Status == ticketPending {
+        ttl += time.Until(ticket.ExpiresAt)
+    }
+    pipe.Set(ctx, approvalTicketKey(ticket.ID), encoded, ttl)
+    return nil
+}
+
+func loadTicket(ctx context.Context, id string) (*approvalTicket, error) {
+    raw, err := redisClient().Get(ctx, approvalTicketKey(id)).Result()
+    if err == redis.Nil {
+        return nil, errTicketNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    var ticket approvalTicket
+    if err := json.Unmarshal([]byte(raw), &ticket); err != nil {
+        return nil, err
+    }
+    return &ticket, nil
+}
+
+// listTickets returns the newest tickets first, pruning index members whose
+// ticket has aged out
+func listTickets(ctx context.Context, status, requester string, limit int) ([]*approvalTicket, error) {
+    client := redisClient()
+    ids, err := client.ZRevRange(ctx, approvalsIndexKey, 0, -1).Result()
+    if err != nil || len(ids) == 0 {
+        return []*approvalTicket{}, err
+    }
+    keys := make([]string, len(ids))
+    for i, id := range ids {
+        keys[i] = approvalTicketKey(id)
+    }
+    values, err := client.MGet(ctx, keys...).Result()
+    if err != nil {
+        return nil, err
+    }
+
+    tickets := []*approvalTicket{}
+    var gone []interface{}
+    for i, value := range values {
+        raw, ok := value.(string)
+        if !ok {
+            gone = append(gone, ids[i])
+            continue
+        }
+        var ticket approvalTicket
+        if json.Unmarshal([]byte(raw), &ticket) != nil {
+            continue
+        }
+        if (status != "" && ticket.Status != status) || (requester != "" && ticket.Requester.ID != requester) {
+            continue
+        }
+        if len(tickets) < limit {
+            tickets = append(tickets, &ticket)
+        }
+    }
+    if len(gone) > 0 {
+        client.ZRem(ctx, approvalsIndexKey, gone...)
+    }
+    return tickets, nil
+}
+
+// expireApprovals expires tickets left pending past their deadline
+func expireApprovals() {
+    for {
+        time.Sleep(30 * time.Second)
+
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        ids, err := redisClient().ZRangeByScore(ctx, approvalsPendingKey, &redis.ZRangeBy{
+            Min: "-inf",
+            Max: fmt.Sprint(time.Now().UnixMilli()),
+        }).Result()
+        if err != nil {
+            log.Get().WithError(err).Warn("Failed to read expiring approval tickets")
+        }
+        for _, id := range ids {
+            _, err := transitionTicket(ctx, id, ticketExpired, "not decided before the deadline", "system", nil)
+            if errors.Is(err, errTicketNotFound) || errors.Is(err, errTicketDecided) {
+                redisClient().ZRem(ctx, approvalsPendingKey, id)
+            } else if err != nil {
+                log.Get().WithError(err).WithField("ticket_id", id).Warn("Failed to expire approval ticket")
+            }
+        }
+        cancel()
+    }
+}
+
+// handleApprovals serves the approval API:
+//
+//	GET  /mcp/approvals[?status=&limit=]   list tickets
+//	GET  /mcp/approvals/{id}               read a ticket and its result
+//	POST /mcp/approvals/{id}/approve       approve and run the call
+//	POST /mcp/approvals/{id}/reject        reject the call
+//	POST /mcp/approvals/{id}/expire        expire the ticket now
+//
+// Approvers (approvals.roles) see and decide every ticket; other callers
+// only see their own.
+func handleApprovals(rw http.ResponseWriter, r *http.Request, session *user.SessionState) {
+    caller := callerFromSession(session)
+    if caller.Anonymous() {
+        writeApprovalError(rw, http.StatusUnauthorized, "unauthorized", "the approval API requires an identified caller")
+        return
+    }
+    approver := caller.HasAnyRole(currentConfig().Approvals.Roles...)
+
+    parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/mcp/approvals"), "/"), "/")
+    ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+    defer cancel()
+
+    switch {
+    case parts[0] == "" && r.Method == http.MethodGet:
+        requester := ""
+        if !approver {
+            requester = caller.ID
+        }
+        limit := 50
+        if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+            limit = l
+        }
+        tickets, err := listTickets(ctx, r.URL.Query().Get("status"), requester, limit)
+        if err != nil {
+            writeApprovalError(rw, http.StatusServiceUnavailable, "queue_unavailable", err.Error())
+            return
+        }
+        writeJSON(rw, http.StatusOK, map[string]interface{}{
+            "tickets":   tickets,
+            "count":     len(tickets),
+            "timestamp": time.Now().Format(time.RFC3339),
+        })
+
+    case len(parts) == 1 && r.Method == http.MethodGet:
+        ticket, err := loadTicket(ctx, parts[0])
+        if err == nil && !approver && ticket.Requester.ID != caller.ID {
+            err = errTicketNotFound
+        }
+        if err != nil {
+            writeTicketError(rw, err)
+            return
+        }
+        writeJSON(rw, http.StatusOK, ticket)
+
+    case len(parts) == 2 && r.Method == http.MethodPost:
+        status, ok := map[string]string{
+            "approve": ticketApproved,
+            "reject":  ticketRejected,
+            "expire":  ticketExpired,
+        }[parts[1]]
+        if !ok {
+            writeApprovalError(rw, http.StatusNotFound, "not_found", "unknown approval operation: "+parts[1])
+            return
+        }
+        if !approver {
+            writeApprovalError(rw, http.StatusForbidden, "forbidden", "deciding tickets requires one of the roles: "+strings.Join(currentConfig().Approvals.Roles, ", "))
+            return
+        }
+
+        var body struct {
+            Reason string `json:"reason"`
+        }
+        if data, _ := io.ReadAll(io.LimitReader(r.Body, 64*1024)); len(data) > 0 {
+            if err := json.Unmarshal(data, &body); err != nil {
+                writeApprovalError(rw, http.StatusBadRequest, "invalid_json", "Invalid JSON in request body")
+                return
+            }
+        }
+
+        var ticket *approvalTicket
+        var err error
+        if status == ticketApproved {
+            ticket, err = decideTicket(r, parts[0], status, body.Reason, caller)
+        } else {
+            ticket, err = transitionTicket(ctx, parts[0], status, body.Reason, caller.ID, nil)
+        }
+        if err != nil {
+            writeTicketError(rw, err)
+            return
+        }
+        writeJSON(rw, http.StatusOK, ticket)
+
+    default:
+        writeApprovalError(rw, http.StatusNotFound, "not_found", "unknown approval endpoint")
+    }
+}
+
+func writeTicketError(rw http.ResponseWriter, err error) {
+    var toolErr *ToolError
+    switch {
+    case errors.Is(err, errTicketNotFound):
+        writeApprovalError(rw, http.StatusNotFound, "ticket_not_found", err.Error())
+    case errors.Is(err, errTicketDecided):
+        writeApprovalError(rw, http.StatusConflict, "ticket_decided", err.Error())
+    case errors.As(err, &toolErr):
+        writeApprovalError(rw, http.StatusForbidden, toolErr.Code, toolErr.Message)
+    default:
+        writeApprovalError(rw, http.StatusServiceUnavailable, "queue_unavailable", err.Error())
+    }
+}
+
+func writeApprovalError(rw http.ResponseWriter, status int, code, message string) {
+    writeJSON(rw, status, map[string]interface{}{"error": code, "message": message})
+}
+
+// session rebuilds a session carrying the requester's identity, so tools
+// derive the same caller as on the original call
+func (id ticketIdentity) session() *user.SessionState {
+    roles := make([]interface{}, len(id.Roles))
+    for i, role := range id.Roles {
+        roles[i] = role
+    }
+    return &user.SessionState{
+        Alias:         id.Alias,
+        OrgID:         id.OrgID,
+        ApplyPolicies: id.Policies,
+        Tags:          id.Tags,
+        MetaData: map[string]interface{}{
+            "user_id": id.ID,
+            "roles":   roles,
+            "scopes":  strings.Join(id.Scopes, ","),
+        },
+    }
+}
+
+// limitSubject is what the requester's calls are counted against under
+// limit, the same subject as on their own requests
+func (id ticketIdentity) limitSubject(limit ToolLimit) string {
+    return limitSubject(limit, callerFromSession(id.session()), id.LimitKey, id.ClientIP)
+}
+
+// approvedRequest is the request an approved call runs with. The
+// approver's credentials are stripped: the call acts for the requester,
+// whose credentials are never stored.
+func approvedRequest(r *http.Request) *http.Request {
+    replay := r.Clone(context.Background())
+    replay.Header.Del("Authorization")
+    replay.Body = http.NoBody
+    return replay
+}
+
+// isOperationTool reports whether tool was generated from an OpenAPI
+// operation. Those calls forward the caller's Authorization header, which
+// an approved replay no longer has.
+func isOperationTool(tool MCPTool) bool {
+    _, ok := currentState().operations[toolKey(tool.Name, tool.Version)]
+    return ok
+}
+
+// keyHash identifies a Tyk key without storing it
+func keyHash(keyID string) string {
+    if keyID == "" {
+        return ""
+    }
+    sum := sha256.Sum256([]byte(keyID))
+    return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func newTicketID() (string, error) {
+    b := make([]byte, 12)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return "apr_" + hex.EncodeToString(b), nil
+}
+
+func approvalTicketKey(id string) string {
+    return "mcp-approval:" + id
+}
+
+func init() {
+    registerResourceProvider(&resourceProvider{
+        Template: MCPResourceTemplate{
+            URITemplate: "mcp://approvals/{ticket_id}",
+            Name:        "Approval ticket",
+            Description: "Status and result of a tool call waiting for approval",
+            MimeType:    "application/json",
+        },
+        list: func() []MCPResource { return nil },
+        read: func(ctx context.Context, r *http.Request, session *user.SessionState, vars map[string]string) (interface{}, error) {
+            caller := callerFromSession(session)
+            ticket, err := loadTicket(ctx, vars["ticket_id"])
+            if errors.Is(err, errTicketNotFound) {
+                return nil, errResourceNotFound
+            }
+            if err != nil {
+                return nil, err
+            }
+            if ticket.Requester.ID != caller.ID && !caller.HasAnyRole(currentConfig().Approvals.Roles...) {
+                return nil, errResourceNotFound
+            }
+            return ticket, nil
+        },
+    })
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/TykTechnologies/tyk/user"
+)
+
+func TestApprovedCallChecksRequester(t *testing.T) {
+    const tool = "gateway_list_blocks"
+    ann := &user.SessionState{KeyID: "key-ann", MetaData: map[string]interface{}{"user_id": "ann", "roles": []interface{}{"responder"}}}
+    bob := &user.SessionState{Alias: "bob", MetaData: map[string]interface{}{"roles": "approver"}}
+
+    tests := []struct {
+        name  string
+        limit ToolLimit
+        // tickets is how many calls ann queues before any is approved
+        tickets int
+        // revoke takes ann's access to the tool away while they wait
+        revoke     bool
+        wantStatus []string
+        // wantCode is the error code of the last ticket's result
+        wantCode string
+    }{
+        {
+            name:       "approved call runs",
+            tickets:    1,
+            wantStatus: []string{ticketExecuted},
+        },
+        {
+            name:       "calls are counted when they run",
+            limit:      ToolLimit{Per: "key", Rate: 1},
+            tickets:    2,
+            wantStatus: []string{ticketExecuted, ticketFailed},
+            wantCode:   toolErrorRateLimited,
+        },
+        {
+            name:       "access is checked again",
+            tickets:    1,
+            revoke:     true,
+            wantStatus: []string{ticketFailed},
+            wantCode:   toolErrorForbidden,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            state, _ := useRedis(t, func(cfg *MCPConfig) {
+                cfg.Approvals.Tools = []string{tool}
+                cfg.RateLimits = RateLimitsConfig{Enabled: true, Tools: map[string]ToolLimit{tool: tt.limit}}
+            })
+            r := httptest.NewRequest("POST", "/mcp/call/"+tool, nil)
+
+            var ids []string
+            for i := 0; i < tt.tickets; i++ {
+                result, err := runTool(context.Background(), r, ann, tool, map[string]interface{}{})
+                if err != nil {
+                    t.Fatalf("queueing call %d: %v", i, err)
+                }
+                pending, _ := result.StructuredContent.(map[string]interface{})
+                id, _ := pending["ticket_id"].(string)
+                if id == "" {
+                    t.Fatalf("call %d was not queued: %+v", i, result)
+                }
+                ids = append(ids, id)
+            }
+            if tt.revoke {
+                state.config.ToolAccess.Rules = []ToolAccessRule{{Tools: []string{"gateway_*"}, Roles: []string{"admin"}}}
+            }
+
+            var ticket *approvalTicket
+            for i, id := range ids {
+                var err error
+                ticket, err = decideTicket(httptest.NewRequest("POST", "/mcp/approvals/"+id+"/approve", nil), id, ticketApproved, "", callerFromSession(bob))
+                if err != nil {
+                    t.Fatalf("approving ticket %d: %v", i, err)
+                }
+                if ticket.Status != tt.wantStatus[i] {
+                    t.Fatalf("ticket %d is %s, want %s", i, ticket.Status, tt.wantStatus[i])
+                }
+            }
+            if toolErr, _ := resultError(*ticket.Result); tt.wantCode != "" && (toolErr == nil || toolErr.Code != tt.wantCode) {
+                t.Fatalf("last ticket has error %+v, want code %s", toolErr, tt.wantCode)
+            }
+
+            // Approved calls share the bucket of ann's own calls
+            if tt.limit.Rate > 0 {
+                usage, _ := checkToolLimit(context.Background(), tool, ann, r, true)
+                if usage == nil || usage.Rate != 1 {
+                    t.Fatalf("ann's own usage is %+v, want 1 call counted", usage)
+                }
+            }
+        })
+    }
+}
+
+func TestSelfApproval(t *testing.T) {
+    const tool = "gateway_list_blocks"
+    ann := &user.SessionState{Alias: "ann", MetaData: map[string]interface{}{"roles": "responder,approver"}}
+
+    tests := []struct {
+        name       string
+        allow      bool
+        wantStatus string
+    }{
+        {name: "refused", wantStatus: ticketPending},
+        {name: "allowed", allow: true, wantStatus: ticketExecuted},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            useRedis(t, func(cfg *MCPConfig) {
+                cfg.Approvals.Tools = []string{tool}
+                cfg.Approvals.AllowSelfApproval = tt.allow
+            })
+            r := httptest.NewRequest("POST", "/mcp/call/"+tool, nil)
+            result, err := runTool(context.Background(), r, ann, tool, map[string]interface{}{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            id := result.StructuredContent.(map[string]interface{})["ticket_id"].(string)
+
+            _, err = decideTicket(r, id, ticketApproved, "", callerFromSession(ann))
+            var toolErr *ToolError
+            if refused := errors.As(err, &toolErr) && toolErr.Code == toolErrorForbidden; refused == tt.allow {
+                t.Fatalf("self approval error = %v, want refused = %v", err, !tt.allow)
+            }
+            ticket, err := loadTicket(context.Background(), id)
+            if err != nil || ticket.Status != tt.wantStatus {
+                t.Fatalf("ticket %+v, %v, want status %s", ticket, err, tt.wantStatus)
+            }
+        })
+    }
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// AuditConfig sets where changes made through MCP tools are recorded
+type AuditConfig struct {
+    // Stream is the Redis stream audit events are appended to
+    Stream string `json:"stream"`
+    // MaxLen caps the stream, dropping the oldest events
+    MaxLen int64 `json:"max_len"`
+}
+
+// auditEvent records one change made on behalf of a caller
+type auditEvent struct {
+    Action  string
+    Target  string
+    Actor   string
+    Reason  string
+    Details map[string]interface{}
+}
+
+// appendAudit queues event on pipe, so it is written in the same
+// transaction as the change it describes
+func appendAudit(ctx context.Context, pipe redis.Pipeliner, event auditEvent) {
+    details := "{}"
+    if len(event.Details) > 0 {
+        if encoded, err := json.Marshal(event.Details); err == nil {
+            details = string(encoded)
+        }
+    }
+
+    cfg := currentConfig().Audit
+    pipe.XAdd(ctx, &redis.XAddArgs{
+        Stream: cfg.Stream,
+        MaxLen: cfg.MaxLen,
+        Approx: true,
+        Values: map[string]interface{}{
+            "action":    event.Action,
+            "target":    event.Target,
+            "actor":     event.Actor,
+            "reason":    event.Reason,
+            "details":   details,
+            "timestamp": time.Now().Format(time.RFC3339),
+        },
+    })
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "net/netip"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/sirupsen/logrus"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+)
+
+// BlockingConfig drives MCPIPBlockMiddleware, which allows, challenges or
+// denies callers by the SentraIP risk of their address
+type BlockingConfig struct {
+    Enabled bool `json:"enabled"`
+    // DenyScore and ChallengeScore are the risk scores at or above which
+    // a caller is denied or challenged
+    DenyScore      float64 `json:"deny_score"`
+    ChallengeScore float64 `json:"challenge_score"`
+    // DenyTypes and ChallengeTypes act on SentraIP threat categories
+    // whatever the score, e.g. "botnet" or "tor"
+    DenyTypes      []string `json:"deny_types"`
+    ChallengeTypes []string `json:"challenge_types"`
+    // FailMode is "open" (allow) or "closed" (deny) for addresses without
+    // a verdict while SentraIP is unavailable
+    FailMode string `json:"fail_mode"`
+    // VerdictTTL is how long a decision is reused before SentraIP is asked again
+    VerdictTTL    string `json:"verdict_ttl"`
+    MaxVerdicts   int    `json:"max_verdicts"`
+    LookupTimeout string `json:"lookup_timeout"`
+    // StaleFor is how long an expired decision is still applied while it
+    // is looked up again
+    StaleFor string `json:"stale_for"`
+    // OutageFor is how long SentraIP counts as unavailable after a lookup fails
+    OutageFor string `json:"outage_for"`
+    // Exempt lists CIDR blocks that are never checked
+    Exempt []string `json:"exempt"`
+}
+
+const (
+    blockAllow     = "allow"
+    blockChallenge = "challenge"
+    blockDeny      = "deny"
+)
+
+// ipVerdict is the decision for one address
+type ipVerdict struct {
+    Action    string
+    Reason    string
+    Score     float64
+    Scored    bool
+    Types     []string
+    ExpiresAt time.Time
+}
+
+// ipBlocker caches verdicts and tracks SentraIP availability
+type ipBlocker struct {
+    mu       sync.Mutex
+    verdicts map[string]*ipVerdict
+    pending  map[string]bool
+    // unavailableUntil is set when a lookup fails for a reason other than
+    // the address being unknown to SentraIP
+    unavailableUntil time.Time
+}
+
+var (
+    ipBlocks = &ipBlocker{verdicts: map[string]*ipVerdict{}, pending: map[string]bool{}}
+
+    blockTracer = otel.Tracer("tyk-mcp-gateway")
+)
+
+// MCPIPBlockMiddleware is a pre middleware that refuses callers whose
+// address SentraIP rates as risky. Verdicts come from a local cache; a
+// miss is looked up in the background and the request is let through
+// unless SentraIP is unavailable and the fail mode is closed.
+func MCPIPBlockMiddleware(rw http.ResponseWriter, r *http.Request) {
+    cfg := currentConfig().Blocking
+    if !cfg.Enabled {
+        return
+    }
+
+    _, span := blockTracer.Start(r.Context(), "mcp.ip_block")
+    defer span.End()
+
+    clientIP := getClientIP(r)
+    verdict, source := ipBlocks.check(clientIP, cfg)
+
+    attrs := []attribute.KeyValue{
+        attribute.String("client.ip", clientIP),
+        attribute.String("ip_block.decision", verdict.Action),
+        attribute.String("ip_block.reason", verdict.Reason),
+        attribute.String("ip_block.source", source),
+        attribute.String("ip_block.fail_mode", cfg.FailMode),
+    }
+    if verdict.Scored {
+        attrs = append(attrs, attribute.Float64("ip_block.risk_score", verdict.Score))
+    }
+    if len(verdict.Types) > 0 {
+        attrs = append(attrs, attribute.StringSlice("ip_block.threat_types", verdict.Types))
+    }
+    span.SetAttributes(attrs...)
+
+    switch verdict.Action {
+    case blockDeny:
+        log.Get().WithFields(logrus.Fields{
+            "client_ip": clientIP,
+            "reason":    verdict.Reason,
+            "source":    source,
+            "path":      r.URL.Path,
+        }).Warn("Request denied by IP blocking")
+        writeBlockResponse(rw, http.StatusForbidden, "ip_blocked", "Requests from this address are blocked", verdict.Reason)
+    case blockChallenge:
+        // Callers from a suspicious address must present credentials; the
+        // auth middleware that follows then verifies them
+        if r.Header.Get("Authorization") == "" {
+            rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_request", error_description="authentication required from this address"`)
+            writeBlockResponse(rw, http.StatusUnauthorized, "authentication_required", "Requests from this address must be authenticated", verdict.Reason)
+        }
+    }
+}
+
+// writeBlockResponse writes the body every IP blocking refusal shares
+func writeBlockResponse(rw http.ResponseWriter, status int, code, message, reason string) {
+    writeJSON(rw, status, map[string]interface{}{
+        "error": map[string]interface{}{
+            "code":    code,
+            "message": message,
+            "reason":  reason,
+        },
+        "timestamp": time.Now().Format(time.RFC3339),
+    })
+}
+
+// check returns the verdict for clientIP and where it came from: exempt,
+// cache, stale (expired, being looked up again), pending (looked up in the
+// background) or unavailable
+func (b *ipBlocker) check(clientIP string, cfg BlockingConfig) (*ipVerdict, string) {
+    addr, err := netip.ParseAddr(clientIP)
+    if err != nil {
+        return b.failVerdict(cfg, "unresolved_client_ip"), "unresolved"
+    }
+    addr = addr.WithZone("").Unmap()
+    if addrInList(addr, cfg.Exempt) {
+        return &ipVerdict{Action: blockAllow, Reason: "exempt"}, "exempt"
+    }
+    ip, err := normalizeTarget(addr.String(), "ip")
+    if err != nil {
+        // Internal and reserved addresses are never sent to SentraIP
+        return &ipVerdict{Action: blockAllow, Reason: "not_public"}, "exempt"
+    }
+
+    now := time.Now()
+    b.mu.Lock()
+    verdict, cached := b.verdicts[ip]
+    if cached && now.Before(verdict.ExpiresAt) {
+        b.mu.Unlock()
+        return verdict, "cache"
+    }
+    stale := cached && now.Before(verdict.ExpiresAt.Add(durationOr(cfg.StaleFor, 10*time.Minute)))
+    unavailable := now.Before(b.unavailableUntil)
+    lookup := !b.pending[ip]
+    if lookup {
+        b.pending[ip] = true
+    }
+    b.mu.Unlock()
+
+    if lookup {
+        go b.lookup(ip, cfg)
+    }
+    // An expired verdict beats a guess: keep applying it until the lookup
+    // replaces it, even through a SentraIP outage
+    if stale {
+        return verdict, "stale"
+    }
+    if unavailable {
+        return b.failVerdict(cfg, "threat_intel_unavailable"), "unavailable"
+    }
+    return &ipVerdict{Action: blockAllow, Reason: "lookup_pending"}, "pending"
+}
+
+// failVerdict applies the fail mode to an address without a verdict
+func (b *ipBlocker) failVerdict(cfg BlockingConfig, reason string) *ipVerdict {
+    if strings.EqualFold(cfg.FailMode, "closed") {
+        return &ipVerdict{Action: blockDeny, Reason: reason}
+    }
+    return &ipVerdict{Action: blockAllow, Reason: reason}
+}
+
+// lookup asks SentraIP (through the shared threat cache) about ip and
+// stores the resulting verdict
+func (b *ipBlocker) lookup(ip string, cfg BlockingConfig) {
+    defer func() {
+        b.mu.Lock()
+        delete(b.pending, ip)
+        b.mu.Unlock()
+    }()
+
+    ctx, cancel := context.WithTimeout(context.Background(), durationOr(cfg.LookupTimeout, 5*time.Second))
+    defer cancel()
+
+    var verdict *ipVerdict
+    record, _, err := cachedLookupThreat(ctx, ip, "ip", false)
+    switch {
+    case err == nil:
+        data, _ := record["data"].(map[string]interface{})
+        verdict = decideBlock(data, cfg)
+    case unknownToSentraIP(err):
+        verdict = &ipVerdict{Action: blockAllow, Reason: "no_threat_record"}
+    default:
+        b.mu.Lock()
+        b.unavailableUntil = time.Now().Add(durationOr(cfg.OutageFor, 30*time.Second))
+        b.mu.Unlock()
+        log.Get().WithError(err).WithField("client_ip", ip).Warn("IP blocking lookup failed")
+        return
+    }
+
+    verdict.ExpiresAt = time.Now().Add(durationOr(cfg.VerdictTTL, 5*time.Minute))
+    b.store(ip, verdict, cfg)
+}
+
+func (b *ipBlocker) store(ip string, verdict *ipVerdict, cfg BlockingConfig) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.unavailableUntil = time.Time{}
+    max := cfg.MaxVerdicts
+    if max < 1 {
+        max = 1
+    }
+    if _, ok := b.verdicts[ip]; !ok && len(b.verdicts) >= max {
+        // Drop verdicts past their stale window, then stale ones if the
+        // cache is still full
+        now := time.Now()
+        staleFor := durationOr(cfg.StaleFor, 10*time.Minute)
+        for key, existing := range b.verdicts {
+            if !now.Before(existing.ExpiresAt.Add(staleFor)) {
+                delete(b.verdicts, key)
+            }
+        }
+        if len(b.verdicts) >= max {
+            for key, existing := range b.verdicts {
+                if !now.Before(existing.ExpiresAt) {
+                    delete(b.verdicts, key)
+                }
+            }
+        }
+        if len(b.verdicts) >= max {
+            // Full of live verdicts: the threat cache still spares SentraIP
+            return
+        }
+    }
+    b.verdicts[ip] = verdict
+}
+
+// decideBlock maps a SentraIP record to an action. Deny rules win over
+// challenge rules, and threat types act whatever the score.
+func decideBlock(data map[string]interface{}, cfg BlockingConfig) *ipVerdict {
+    verdict := &ipVerdict{Action: blockAllow, Reason: "below_threshold", Types: threatTypes(data)}
+    verdict.Score, verdict.Scored = threatRiskScore(data)
+    if !verdict.Scored {
+        verdict.Reason = "unscored"
+    }
+
+    if verdict.Scored && verdict.Score >= cfg.DenyScore {
+        verdict.Action, verdict.Reason = blockDeny, "risk_score"
+        return verdict
+    }
+    if t := firstMatchingType(verdict.Types, cfg.DenyTypes); t != "" {
+        verdict.Action, verdict.Reason = blockDeny, "threat_type:"+t
+        return verdict
+    }
+    if verdict.Scored && verdict.Score >= cfg.ChallengeScore {
+        verdict.Action, verdict.Reason = blockChallenge, "risk_score"
+        return verdict
+    }
+    if t := firstMatchingType(verdict.Types, cfg.ChallengeTypes); t != "" {
+        verdict.Action, verdict.Reason = blockChallenge, "threat_type:"+t
+    }
+    return verdict
+}
+
+// threatTypes collects the lower-cased threat categories of a SentraIP
+// record, which may sit at the top level or under "data"
+func threatTypes(record map[string]interface{}) []string {
+    var types []string
+    for _, key := range []string{"threat_types", "threatTypes", "categories", "threats"} {
+        values, _ := record[key].([]interface{})
+        for _, value := range values {
+            if s, ok := value.(string); ok && s != "" {
+                types = appendUnique(types, strings.ToLower(s))
+            }
+        }
+    }
+    if nested, ok := record["data"].(map[string]interface{}); ok {
+        for _, t := range threatTypes(nested) {
+            types = appendUnique(types, t)
+        }
+    }
+    return types
+}
+
+func firstMatchingType(types, wanted []string) string {
+    for _, t := range types {
+        for _, w := range wanted {
+            if strings.EqualFold(t, w) {
+                return t
+            }
+        }
+    }
+    return ""
+}
+
+// unknownToSentraIP reports whether err means SentraIP has no record of the
+// address rather than that it could not be asked
+func unknownToSentraIP(err error) bool {
+    var toolErr *ToolError
+    if !errors.As(err, &toolErr) {
+        return false
+    }
+    if toolErr.Code == toolErrorNotFound {
+        return true
+    }
+    details, _ := toolErr.Details.(map[string]interface{})
+    status, _ := details["status_code"].(int)
+    return status == http.StatusNotFound
+}
+
+// addrInList reports whether addr is one of a list of addresses and CIDR
+// blocks
+func addrInList(addr netip.Addr, list []string) bool {
+    for _, cidr := range list {
+        prefix, err := netip.ParsePrefix(cidr)
+        if err != nil {
+            if single, err := netip.ParseAddr(cidr); err == nil && single == addr {
+                return true
+            }
+            continue
+        }
+        if prefix.Contains(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// getClientIP resolves the caller address the same way as the OTEL
+// enhancer, so blocking decisions and traces agree on it. Forwarding
+// headers are only believed from a trusted proxy: X-Forwarded-For is read
+// from the right, skipping trusted hops, so a client cannot choose its
+// address by sending the header itself.
+func getClientIP(r *http.Request) string {
+    remote := r.RemoteAddr
+    if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+        remote = ip
+    }
+    trusted := currentConfig().TrustedProxies
+    if !trustedHop(remote, trusted) {
+        return remote
+    }
+
+    if xff := strings.Join(r.Header.Values("X-Forwarded-For"), ","); xff != "" {
+        hops := strings.Split(xff, ",")
+        for i := len(hops) - 1; i >= 0; i-- {
+            hop := strings.TrimSpace(hops[i])
+            if hop != "" && (i == 0 || !trustedHop(hop, trusted)) {
+                return hop
+            }
+        }
+    }
+    if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+        return xri
+    }
+    return remote
+}
+
+// trustedHop reports whether ip belongs to a trusted proxy
+func trustedHop(ip string, trusted []string) bool {
+    addr, err := netip.ParseAddr(ip)
+    if err != nil {
+        return false
+    }
+    return addrInList(addr.WithZone("").Unmap(), trusted)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+    "net/http/httptest"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestGetClientIP(t *testing.T) {
+    tests := []struct {
+        name    string
+        remote  string
+        headers map[string][]string
+        want    string
+    }{
+        {
+            name:   "direct",
+            remote: "198.51.100.7:4321",
+            want:   "198.51.100.7",
+        },
+        {
+            name:    "untrusted peer cannot forward",
+            remote:  "198.51.100.7:4321",
+            headers: map[string][]string{"X-Forwarded-For": {"203.0.113.9"}, "X-Real-Ip": {"203.0.113.10"}},
+            want:    "198.51.100.7",
+        },
+        {
+            name:    "trusted proxy",
+            remote:  "10.0.0.2:80",
+            headers: map[string][]string{"X-Forwarded-For": {"203.0.113.9"}},
+            want:    "203.0.113.9",
+        },
+        {
+            name:    "rightmost untrusted hop",
+            remote:  "10.0.0.2:80",
+            headers: map[string][]string{"X-Forwarded-For": {"1.2.3.4, 203.0.113.9, 10.0.0.3"}},
+            want:    "203.0.113.9",
+        },
+        {
+            name:    "repeated headers",
+            remote:  "10.0.0.2:80",
+            headers: map[string][]string{"X-Forwarded-For": {"1.2.3.4", "203.0.113.9"}},
+            want:    "203.0.113.9",
+        },
+        {
+            name:    "only trusted hops",
+            remote:  "10.0.0.2:80",
+            headers: map[string][]string{"X-Forwarded-For": {"10.0.0.5, 10.0.0.4"}},
+            want:    "10.0.0.5",
+        },
+        {
+            name:    "real ip from a trusted proxy",
+            remote:  "[::1]:80",
+            headers: map[string][]string{"X-Real-Ip": {"203.0.113.9"}},
+            want:    "203.0.113.9",
+        },
+        {
+            name:   "trusted proxy without headers",
+            remote: "10.0.0.2:80",
+            want:   "10.0.0.2",
+        },
+    }
+
+    useConfig(t, func(cfg *MCPConfig) { cfg.TrustedProxies = []string{"10.0.0.0/8", "::1"} })
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "/", nil)
+            r.RemoteAddr = tt.remote
+            for name, values := range tt.headers {
+                for _, value := range values {
+                    r.Header.Add(name, value)
+                }
+            }
+            if got := getClientIP(r); got != tt.want {
+                t.Fatalf("getClientIP = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestIPBlockerCheck(t *testing.T) {
+    const ip = "203.0.113.1"
+    now := time.Now()
+    denied := func(expiresAt time.Time) *ipVerdict {
+        return &ipVerdict{Action: blockDeny, Reason: "risk_score", ExpiresAt: expiresAt}
+    }
+
+    tests := []struct {
+        name        string
+        clientIP    string
+        cached      *ipVerdict
+        unavailable bool
+        failMode    string
+        wantAction  string
+        wantSource  string
+    }{
+        {name: "cached", clientIP: "8.8.4.4", cached: denied(now.Add(time.Minute)), wantAction: blockDeny, wantSource: "cache"},
+        {name: "miss is looked up", clientIP: "8.8.4.4", wantAction: blockAllow, wantSource: "pending"},
+        {name: "expired verdict still applies", clientIP: "8.8.4.4", cached: denied(now.Add(-time.Minute)), wantAction: blockDeny, wantSource: "stale"},
+        {name: "stale through an outage", clientIP: "8.8.4.4", cached: denied(now.Add(-time.Minute)), unavailable: true, wantAction: blockDeny, wantSource: "stale"},
+        {name: "past the stale window", clientIP: "8.8.4.4", cached: denied(now.Add(-time.Hour)), wantAction: blockAllow, wantSource: "pending"},
+        {name: "outage fails open", clientIP: "8.8.4.4", unavailable: true, wantAction: blockAllow, wantSource: "unavailable"},
+        {name: "outage fails closed", clientIP: "8.8.4.4", unavailable: true, failMode: "closed", wantAction: blockDeny, wantSource: "unavailable"},
+        {name: "exempt", clientIP: ip, cached: denied(now.Add(time.Minute)), wantAction: blockAllow, wantSource: "exempt"},
+        {name: "not public", clientIP: "192.168.0.9", wantAction: blockAllow, wantSource: "exempt"},
+        {name: "unresolved fails closed", clientIP: "unknown", failMode: "closed", wantAction: blockDeny, wantSource: "unresolved"},
+    }
+
+    useConfig(t, nil)
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            // The address is marked pending so no real lookup starts
+            b := &ipBlocker{verdicts: map[string]*ipVerdict{}, pending: map[string]bool{tt.clientIP: true}}
+            if tt.cached != nil {
+                b.verdicts[tt.clientIP] = tt.cached
+            }
+            if tt.unavailable {
+                b.unavailableUntil = now.Add(time.Minute)
+            }
+            cfg := BlockingConfig{FailMode: tt.failMode, StaleFor: "10m", Exempt: []string{ip + "/32"}}
+
+            verdict, source := b.check(tt.clientIP, cfg)
+            if verdict.Action != tt.wantAction || source != tt.wantSource {
+                t.Fatalf("check(%s) = %s from %s, want %s from %s", tt.clientIP, verdict.Action, source, tt.wantAction, tt.wantSource)
+            }
+        })
+    }
+}
+
+func TestIPBlockerStoreEviction(t *testing.T) {
+    now := time.Now()
+    live := now.Add(time.Minute)
+    stale := now.Add(-time.Minute)
+    gone := now.Add(-time.Hour)
+
+    tests := []struct {
+        name     string
+        existing map[string]time.Time
+        max      int
+        want     []string
+    }{
+        {
+            name:     "room left",
+            existing: map[string]time.Time{"a": live},
+            max:      2,
+            want:     []string{"a", "new"},
+        },
+        {
+            name:     "verdicts past their stale window go first",
+            existing: map[string]time.Time{"a": gone, "b": stale},
+            max:      2,
+            want:     []string{"b", "new"},
+        },
+        {
+            name:     "stale verdicts go when still full",
+            existing: map[string]time.Time{"a": stale, "b": live},
+            max:      2,
+            want:     []string{"b", "new"},
+        },
+        {
+            name:     "live verdicts are kept",
+            existing: map[string]time.Time{"a": live, "b": live},
+            max:      2,
+            want:     []string{"a", "b"},
+        },
+        {
+            name:     "known address is updated when full",
+            existing: map[string]time.Time{"new": stale, "b": live},
+            max:      2,
+            want:     []string{"b", "new"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := &ipBlocker{verdicts: map[string]*ipVerdict{}, pending: map[string]bool{}}
+            for ip, expiresAt := range tt.existing {
+                b.verdicts[ip] = &ipVerdict{Action: blockAllow, ExpiresAt: expiresAt}
+            }
+            b.store("new", &ipVerdict{Action: blockDeny, ExpiresAt: live}, BlockingConfig{MaxVerdicts: tt.max, StaleFor: "10m"})
+
+            var got []string
+            for ip := range b.verdicts {
+                got = append(got, ip)
+            }
+            sort.Strings(got)
+            if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+                t.Fatalf("cached %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestDecideBlock(t *testing.T) {
+    cfg := BlockingConfig{DenyScore: 80, ChallengeScore: 50, DenyTypes: []string{"botnet"}, ChallengeTypes: []string{"tor"}}
+
+    tests := []struct {
+        name       string
+        data       map[string]interface{}
+        wantAction string
+        wantReason string
+    }{
+        {name: "low score", data: map[string]interface{}{"risk_score": 10.0}, wantAction: blockAllow, wantReason: "below_threshold"},
+        {name: "unscored", data: map[string]interface{}{}, wantAction: blockAllow, wantReason: "unscored"},
+        {name: "deny score", data: map[string]interface{}{"risk_score": 80.0}, wantAction: blockDeny, wantReason: "risk_score"},
+        {name: "challenge score", data: map[string]interface{}{"score": 60.0}, wantAction: blockChallenge, wantReason: "risk_score"},
+        {name: "deny type beats challenge score", data: map[string]interface{}{"score": 60.0, "threat_types": []interface{}{"Botnet"}}, wantAction: blockDeny, wantReason: "threat_type:botnet"},
+        {name: "challenge type", data: map[string]interface{}{"risk_score": 5.0, "categories": []interface{}{"tor"}}, wantAction: blockChallenge, wantReason: "threat_type:tor"},
+        {name: "nested record", data: map[string]interface{}{"data": map[string]interface{}{"riskScore": 95.0}}, wantAction: blockDeny, wantReason: "risk_score"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            verdict := decideBlock(tt.data, cfg)
+            if verdict.Action != tt.wantAction || verdict.Reason != tt.wantReason {
+                t.Fatalf("decideBlock = %s (%s), want %s (%s)", verdict.Action, verdict.Reason, tt.wantAction, tt.wantReason)
+            }
+        })
+    }
+}
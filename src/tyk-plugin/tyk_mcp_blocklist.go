@@ -0,0 +1,589 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/netip"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
+    "github.com/sirupsen/logrus"
+    "go.opentelemetry.io/otel/attribute"
+)
+
+// BlocklistConfig controls the dynamic blocklist managed through the
+// gateway_block_target and gateway_unblock_target tools
+type BlocklistConfig struct {
+    // Roles may change the blocklist; reading it needs an identified caller
+    Roles      []string `json:"roles"`
+    DefaultTTL string   `json:"default_ttl"`
+    MaxTTL     string   `json:"max_ttl"`
+    // SyncInterval is how often each gateway checks Redis for changes
+    // made by the others
+    SyncInterval string `json:"sync_interval"`
+}
+
+const (
+    blocklistIndexKey   = "mcp-blocklist"
+    blocklistVersionKey = "mcp-blocklist-version"
+)
+
+// blockEntry is one blocked address or CIDR block
+type blockEntry struct {
+    Target    string    `json:"target"`
+    Reason    string    `json:"reason"`
+    Actor     string    `json:"actor"`
+    CreatedAt time.Time `json:"created_at"`
+    ExpiresAt time.Time `json:"expires_at"`
+
+    prefix netip.Prefix
+}
+
+// blocklistSnapshot is the local copy of the blocklist the middleware
+// enforces; it is replaced whenever the Redis version changes
+type blocklistSnapshot struct {
+    mu      sync.RWMutex
+    entries map[string]*blockEntry
+    version int64
+}
+
+var blocklist = &blocklistSnapshot{entries: map[string]*blockEntry{}}
+
+var (
+    blockTargetTool = MCPTool{
+        Name:        "gateway_block_target",
+        Title:       "Block target",
+        Description: "Block an IP address or CIDR block on every API of the gateway for a limited time",
+        InputSchema: InputSchema{
+            Type: "object",
+            Properties: map[string]Property{
+                "target": {
+                    Type:        "string",
+                    Description: "IP address or CIDR block to block",
+                    MinLength:   intPtr(1),
+                    MaxLength:   intPtr(43),
+                },
+                "reason": {
+                    Type:        "string",
+                    Description: "Why the target is blocked, e.g. the threat check that found it",
+                    MinLength:   intPtr(3),
+                    MaxLength:   intPtr(500),
+                },
+                "ttl": {
+                    Type:        "string",
+                    Description: "How long the block lasts as a duration such as 30m or 24h",
+                    Pattern:     `^([0-9]+(\.[0-9]+)?(ms|s|m|h))+$`,
+                },
+            },
+            Required: []string{"target", "reason"},
+        },
+        OutputSchema:     blockEntryOutputSchema(),
+        Annotations:      gatewayWriteAnnotations,
+        Version:          "1.0.0",
+        RequiresApproval: true,
+    }
+
+    unblockTargetTool = MCPTool{
+        Name:        "gateway_unblock_target",
+        Title:       "Unblock target",
+        Description: "Remove an IP address or CIDR block from the gateway blocklist",
+        InputSchema: InputSchema{
+            Type: "object",
+            Properties: map[string]Property{
+                "target": {
+                    Type:        "string",
+                    Description: "Blocked IP address or CIDR block",
+                    MinLength:   intPtr(1),
+                    MaxLength:   intPtr(43),
+                },
+                "reason": {
+                    Type:        "string",
+                    Description: "Why the block is lifted",
+                    MaxLength:   intPtr(500),
+                },
+            },
+            Required: []string{"target"},
+        },
+        OutputSchema:     blockEntryOutputSchema(),
+        Annotations:      gatewayWriteAnnotations,
+        Version:          "1.0.0",
+        RequiresApproval: true,
+    }
+
+    listBlocksTool = MCPTool{
+        Name:        "gateway_list_blocks",
+        Title:       "List blocks",
+        Description: "List the active entries of the gateway blocklist",
+        InputSchema: InputSchema{
+            Type: "object",
+            Properties: map[string]Property{
+                "address": {
+                    Type:        "string",
+                    Description: "Only list entries that block this IP address",
+                    MaxLength:   intPtr(45),
+                },
+            },
+        },
+        OutputSchema: &Property{
+            Type: "object",
+            Properties: map[string]Property{
+                "entries": {
+                    Type:  "array",
+                    Items: &Property{Ref: "#/$defs/entry"},
+                },
+                "count":     {Type: "integer", Minimum: floatPtr(0)},
+                "timestamp": {Type: "string", Format: "date-time"},
+            },
+            Required: []string{"entries", "count", "timestamp"},
+            Defs:     map[string]Property{"entry": blockEntrySchema()},
+        },
+        Annotations: gatewayReadAnnotations,
+        Version:     "1.0.0",
+    }
+)
+
+func blockEntrySchema() Property {
+    return Property{
+        Type: "object",
+        Properties: map[string]Property{
+            "target":      {Type: "string", Description: "Blocked address or CIDR block"},
+            "reason":      {Type: "string"},
+            "actor":       {Type: "string", Description: "Caller who added the entry"},
+            "created_at":  {Type: "string", Format: "date-time"},
+            "expires_at":  {Type: "string", Format: "date-time"},
+            "ttl_seconds": {Type: "integer", Description: "Seconds until the entry expires"},
+        },
+        Required: []string{"target", "reason", "actor", "created_at", "expires_at"},
+    }
+}
+
+func blockEntryOutputSchema() *Property {
+    schema := blockEntrySchema()
+    schema.Properties["action"] = Property{Type: "string", Enum: []interface{}{"block", "update", "unblock"}}
+    schema.Required = append(schema.Required, "action")
+    return &schema
+}
+
+// MCPBlocklistMiddleware is a pre middleware refusing callers whose address
+// is on the blocklist. Attach it to every API.
+func MCPBlocklistMiddleware(rw http.ResponseWriter, r *http.Request) {
+    _, span := blockTracer.Start(r.Context(), "mcp.blocklist")
+    defer span.End()
+
+    clientIP := getClientIP(r)
+    entry := blocklist.match(clientIP)
+
+    decision := blockAllow
+    if entry != nil {
+        decision = blockDeny
+    }
+    span.SetAttributes(
+        attribute.String("client.ip", clientIP),
+        attribute.String("ip_block.decision", decision),
+        attribute.String("ip_block.source", "blocklist"),
+    )
+    if entry == nil {
+        return
+    }
+    span.SetAttributes(attribute.String("ip_block.blocklist_entry", entry.Target))
+
+    log.Get().WithFields(logrus.Fields{
+        "client_ip": clientIP,
+        "entry":     entry.Target,
+        "path":      r.URL.Path,
+    }).Warn("Request denied by blocklist")
+    writeBlockResponse(rw, http.StatusForbidden, "ip_blocked", "Requests from this address are blocked", "blocklist")
+}
+
+// match returns the live entry covering clientIP, if any
+func (b *blocklistSnapshot) match(clientIP string) *blockEntry {
+    addr, err := netip.ParseAddr(clientIP)
+    if err != nil {
+        return nil
+    }
+    addr = addr.WithZone("").Unmap()
+
+    now := time.Now()
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    for _, entry := range b.entries {
+        if entry.prefix.Contains(addr) && now.Before(entry.ExpiresAt) {
+            return entry
+        }
+    }
+    return nil
+}
+
+func (b *blocklistSnapshot) set(entry *blockEntry) {
+    b.mu.Lock()
+    b.entries[entry.Target] = entry
+    b.mu.Unlock()
+}
+
+func (b *blocklistSnapshot) remove(target string) {
+    b.mu.Lock()
+    delete(b.entries, target)
+    b.mu.Unlock()
+}
+
+// syncBlocklist keeps the local snapshot in step with Redis, reloading it
+// when another gateway bumps the blocklist version
+func syncBlocklist() {
+    for {
+        interval := durationOr(currentConfig().Blocklist.SyncInterval, 5*time.Second)
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        version, err := redisClient().Get(ctx, blocklistVersionKey).Int64()
+        if err == nil || err == redis.Nil {
+            blocklist.mu.RLock()
+            changed := version != blocklist.version
+            blocklist.mu.RUnlock()
+            if changed {
+                err = reloadBlocklist(ctx, version)
+            }
+        }
+        cancel()
+        if err != nil && err != redis.Nil {
+            log.Get().WithError(err).Warn("Failed to sync blocklist")
+        }
+        time.Sleep(interval)
+    }
+}
+
+func reloadBlocklist(ctx context.Context, version int64) error {
+    entries, err := readBlockEntries(ctx)
+    if err != nil {
+        return err
+    }
+    byTarget := make(map[string]*blockEntry, len(entries))
+    for _, entry := range entries {
+        byTarget[entry.Target] = entry
+    }
+
+    blocklist.mu.Lock()
+    blocklist.entries = byTarget
+    blocklist.version = version
+    blocklist.mu.Unlock()
+
+    log.Get().WithField("entries", len(byTarget)).Debug("Blocklist reloaded")
+    return nil
+}
+
+// readBlockEntries loads every live entry from Redis, pruning index members
+// whose entry has expired
+func readBlockEntries(ctx context.Context) ([]*blockEntry, error) {
+    client := redisClient()
+    targets, err := client.SMembers(ctx, blocklistIndexKey).Result()
+    if err != nil || len(targets) == 0 {
+        return nil, err
+    }
+    keys := make([]string, len(targets))
+    for i, target := range targets {
+        keys[i] = blockEntryKey(target)
+    }
+    values, err := client.MGet(ctx, keys...).Result()
+    if err != nil {
+        return nil, err
+    }
+
+    var entries []*blockEntry
+    var expired []interface{}
+    for i, value := range values {
+        raw, ok := value.(string)
+        if !ok {
+            expired = append(expired, targets[i])
+            continue
+        }
+        entry, err := decodeBlockEntry(raw)
+        if err != nil {
+            log.Get().WithError(err).WithField("target", targets[i]).Warn("Skipping invalid blocklist entry")
+            continue
+        }
+        entries = append(entries, entry)
+    }
+    if len(expired) > 0 {
+        client.SRem(ctx, blocklistIndexKey, expired...)
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.After(entries[j].CreatedAt) })
+    return entries, nil
+}
+
+func decodeBlockEntry(raw string) (*blockEntry, error) {
+    var entry blockEntry
+    if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+        return nil, err
+    }
+    prefix, err := blockTargetPrefix(entry.Target)
+    if err != nil {
+        return nil, err
+    }
+    entry.prefix = prefix
+    return &entry, nil
+}
+
+// normalizeBlockTarget accepts an IP address or CIDR block under the same
+// rules as threat lookups, so internal ranges cannot be blocked by mistake
+func normalizeBlockTarget(target string) (string, error) {
+    target = strings.TrimSpace(target)
+    if strings.Contains(target, "/") {
+        return normalizeTarget(target, "cidr")
+    }
+    return normalizeTarget(target, "ip")
+}
+
+func blockTargetPrefix(target string) (netip.Prefix, error) {
+    if strings.Contains(target, "/") {
+        return netip.ParsePrefix(target)
+    }
+    addr, err := netip.ParseAddr(target)
+    if err != nil {
+        return netip.Prefix{}, err
+    }
+    return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func blockEntryKey(target string) string {
+    return "mcp-blocklist:" + target
+}
+
+// blocklistCaller returns the caller if they may change the blocklist
+func blocklistCaller(session *user.SessionState) (mcpCaller, error) {
+    caller := callerFromSession(session)
+    if caller.Anonymous() {
+        return caller, &ToolError{Code: toolErrorForbidden, Message: "changing the blocklist requires an identified caller"}
+    }
+    if roles := currentConfig().Blocklist.Roles; len(roles) > 0 && !caller.HasAnyRole(roles...) {
+        return caller, &ToolError{
+            Code:    toolErrorForbidden,
+            Message: "changing the blocklist requires one of the roles: " + strings.Join(roles, ", "),
+        }
+    }
+    return caller, nil
+}
+
+func blockTarget(ctx context.Context, params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
+    target, ok := params["target"].(string)
+    if !ok {
+        return nil, fmt.Errorf("missing or invalid 'target' parameter")
+    }
+    reason, _ := params["reason"].(string)
+    caller, err := blocklistCaller(session)
+    if err != nil {
+        return nil, err
+    }
+
+    cfg := currentConfig().Blocklist
+    ttl := durationOr(cfg.DefaultTTL, 24*time.Hour)
+    if value, ok := params["ttl"].(string); ok && value != "" {
+        ttl, _ = time.ParseDuration(value)
+    }
+
+    prefix, err := blockTargetPrefix(target)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    entry := &blockEntry{
+        Target:    target,
+        Reason:    reason,
+        Actor:     caller.ID,
+        CreatedAt: now,
+        ExpiresAt: now.Add(ttl),
+        prefix:    prefix,
+    }
+    encoded, err := json.Marshal(entry)
+    if err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    client := redisClient()
+    existed, err := client.Exists(ctx, blockEntryKey(target)).Result()
+    if err != nil {
+        return nil, &ToolError{Code: toolErrorUpstream, Message: "blocklist store unavailable: " + err.Error()}
+    }
+    action := "block"
+    if existed > 0 {
+        action = "update"
+    }
+
+    _, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        pipe.Set(ctx, blockEntryKey(target), encoded, ttl)
+        pipe.SAdd(ctx, blocklistIndexKey, target)
+        pipe.Incr(ctx, blocklistVersionKey)
+        appendAudit(ctx, pipe, auditEvent{
+            Action:  "blocklist." + action,
+            Target:  target,
+            Actor:   caller.ID,
+            Reason:  reason,
+            Details: map[string]interface{}{"ttl": ttl.String(), "expires_at": entry.ExpiresAt.Format(time.RFC3339)},
+        })
+        return nil
+    })
+    if err != nil {
+        return nil, &ToolError{Code: toolErrorUpstream, Message: "failed to update blocklist: " + err.Error()}
+    }
+    blocklist.set(entry)
+
+    log.Get().WithFields(logrus.Fields{
+        "target":     target,
+        "action":     action,
+        "actor":      caller.ID,
+        "ttl":        ttl.String(),
+        "session_id": getSessionID(session),
+    }).Info("Blocklist entry saved")
+
+    result := blockEntryResult(entry)
+    result["action"] = action
+    return result, nil
+}
+
+func unblockTarget(ctx context.Context, params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
+    target, ok := params["target"].(string)
+    if !ok {
+        return nil, fmt.Errorf("missing or invalid 'target' parameter")
+    }
+    reason, _ := params["reason"].(string)
+    caller, err := blocklistCaller(session)
+    if err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    client := redisClient()
+    raw, err := client.Get(ctx, blockEntryKey(target)).Result()
+    if err == redis.Nil {
+        return nil, &ToolError{Code: toolErrorNotFound, Message: fmt.Sprintf("%s is not on the blocklist", target)}
+    }
+    if err != nil {
+        return nil, &ToolError{Code: toolErrorUpstream, Message: "blocklist store unavailable: " + err.Error()}
+    }
+    entry, err := decodeBlockEntry(raw)
+    if err != nil {
+        return nil, err
+    }
+
+    _, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        pipe.Del(ctx, blockEntryKey(target))
+        pipe.SRem(ctx, blocklistIndexKey, target)
+        pipe.Incr(ctx, blocklistVersionKey)
+        appendAudit(ctx, pipe, auditEvent{
+            Action:  "blocklist.unblock",
+            Target:  target,
+            Actor:   caller.ID,
+            Reason:  reason,
+            Details: map[string]interface{}{"blocked_by": entry.Actor, "block_reason": entry.Reason},
+        })
+        return nil
+    })
+    if err != nil {
+        return nil, &ToolError{Code: toolErrorUpstream, Message: "failed to update blocklist: " + err.Error()}
+    }
+    blocklist.remove(target)
+
+    log.Get().WithFields(logrus.Fields{
+        "target":     target,
+        "actor":      caller.ID,
+        "session_id": getSessionID(session),
+    }).Info("Blocklist entry removed")
+
+    result := blockEntryResult(entry)
+    result["action"] = "unblock"
+    return result, nil
+}
+
+func listBlocks(ctx context.Context, params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
+    if callerFromSession(session).Anonymous() {
+        return nil, &ToolError{Code: toolErrorForbidden, Message: "listing the blocklist requires an identified caller"}
+    }
+
+    var addr netip.Addr
+    if value, ok := params["address"].(string); ok && value != "" {
+        parsed, err := netip.ParseAddr(value)
+        if err != nil {
+            return nil, fmt.Errorf("invalid 'address' parameter: %q is not an IP address", value)
+        }
+        addr = parsed.Unmap()
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    entries, err := readBlockEntries(ctx)
+    if err != nil {
+        return nil, &ToolError{Code: toolErrorUpstream, Message: "blocklist store unavailable: " + err.Error()}
+    }
+
+    results := []map[string]interface{}{}
+    for _, entry := range entries {
+        if addr.IsValid() && !entry.prefix.Contains(addr) {
+            continue
+        }
+        results = append(results, blockEntryResult(entry))
+    }
+    return map[string]interface{}{
+        "entries":   results,
+        "count":     len(results),
+        "timestamp": time.Now().Format(time.RFC3339),
+    }, nil
+}
+
+func blockEntryResult(entry *blockEntry) map[string]interface{} {
+    ttl := int64(time.Until(entry.ExpiresAt).Seconds())
+    if ttl < 0 {
+        ttl = 0
+    }
+    return map[string]interface{}{
+        "target":      entry.Target,
+        "reason":      entry.Reason,
+        "actor":       entry.Actor,
+        "created_at":  entry.CreatedAt.Format(time.RFC3339),
+        "expires_at":  entry.ExpiresAt.Format(time.RFC3339),
+        "ttl_seconds": ttl,
+    }
+}
+
+// normalizeBlockArgs canonicalizes the target of the blocklist tools and
+// checks the requested TTL against the configured maximum
+func normalizeBlockArgs(params map[string]interface{}) (map[string]interface{}, error) {
+    target, _ := params["target"].(string)
+    normalized, err := normalizeBlockTarget(target)
+    if err != nil {
+        return nil, ValidationErrors{{Pointer: "/target", Message: err.Error()}}
+    }
+    params["target"] = normalized
+
+    if value, ok := params["ttl"].(string); ok && value != "" {
+        ttl, err := time.ParseDuration(value)
+        maxTTL := durationOr(currentConfig().Blocklist.MaxTTL, 30*24*time.Hour)
+        switch {
+        case err != nil || ttl <= 0:
+            return nil, ValidationErrors{{Pointer: "/ttl", Message: fmt.Sprintf("%q is not a positive duration", value)}}
+        case ttl > maxTTL:
+            return nil, ValidationErrors{{Pointer: "/ttl", Message: fmt.Sprintf("%s is longer than the maximum of %s", ttl, maxTTL)}}
+        }
+    }
+    return params, nil
+}
+
+func init() {
+    MCPToolsRegistry[blockTargetTool.Name] = blockTargetTool
+    MCPToolsRegistry[unblockTargetTool.Name] = unblockTargetTool
+    MCPToolsRegistry[listBlocksTool.Name] = listBlocksTool
+    toolArgumentNormalizers[blockTargetTool.Name] = normalizeBlockArgs
+    toolArgumentNormalizers[unblockTargetTool.Name] = func(params map[string]interface{}) (map[string]interface{}, error) {
+        // Entries are keyed by their normalized form, so only normalize here
+        target, _ := params["target"].(string)
+        if normalized, err := normalizeBlockTarget(target); err == nil {
+            params["target"] = normalized
+        }
+        return params, nil
+    }
+}
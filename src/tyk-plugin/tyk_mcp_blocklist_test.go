@@ -0,0 +1,177 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/alicebob/miniredis/v2"
+)
+
+// useBlocklist is useRedis with an empty local blocklist
+func useBlocklist(t *testing.T) *miniredis.Miniredis {
+    t.Helper()
+    _, server := useRedis(t, nil)
+    previous := blocklist
+    blocklist = &blocklistSnapshot{entries: map[string]*blockEntry{}}
+    t.Cleanup(func() { blocklist = previous })
+    return server
+}
+
+func TestNormalizeBlockArgs(t *testing.T) {
+    useConfig(t, nil)
+
+    tests := []struct {
+        name       string
+        target     string
+        ttl        string
+        wantTarget string
+        wantErr    string
+    }{
+        {name: "address", target: " 8.8.8.8 ", wantTarget: "8.8.8.8"},
+        {name: "mapped address", target: "::ffff:8.8.8.8", wantTarget: "8.8.8.8"},
+        {name: "cidr block", target: "8.8.8.9/24", wantTarget: "8.8.8.0/24"},
+        {name: "private address", target: "192.168.1.1", wantErr: "/target"},
+        {name: "not an address", target: "example.com", wantErr: "/target"},
+        {name: "ttl", target: "8.8.8.8", ttl: "2h", wantTarget: "8.8.8.8"},
+        {name: "invalid ttl", target: "8.8.8.8", ttl: "-1h", wantErr: "not a positive duration"},
+        {name: "ttl over the maximum", target: "8.8.8.8", ttl: "721h", wantErr: "longer than the maximum of 720h0m0s"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            params, err := normalizeBlockArgs(map[string]interface{}{"target": tt.target, "ttl": tt.ttl})
+            if tt.wantErr != "" {
+                var verrs ValidationErrors
+                if !errors.As(err, &verrs) || !strings.Contains(verrs.Error(), tt.wantErr) {
+                    t.Fatalf("normalizeBlockArgs error = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil || params["target"] != tt.wantTarget {
+                t.Fatalf("normalizeBlockArgs = %v, %v, want target %s", params, err, tt.wantTarget)
+            }
+        })
+    }
+}
+
+func TestBlocklistCaller(t *testing.T) {
+    useConfig(t, nil)
+
+    tests := []struct {
+        name    string
+        session *user.SessionState
+        wantErr bool
+    }{
+        {name: "anonymous", wantErr: true},
+        {name: "without a role", session: &user.SessionState{Alias: "ann"}, wantErr: true},
+        {name: "responder", session: &user.SessionState{Alias: "rob", MetaData: map[string]interface{}{"roles": "responder"}}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := blocklistCaller(tt.session)
+            var toolErr *ToolError
+            if refused := errors.As(err, &toolErr) && toolErr.Code == toolErrorForbidden; refused != tt.wantErr {
+                t.Fatalf("blocklistCaller error = %v, want refused = %v", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestBlocklistLifecycle(t *testing.T) {
+    useBlocklist(t)
+    ctx := context.Background()
+    rob := &user.SessionState{Alias: "rob", MetaData: map[string]interface{}{"roles": "responder"}}
+    denied := func(addr string) bool {
+        r := httptest.NewRequest(http.MethodGet, "/api", nil)
+        r.RemoteAddr = addr + ":4711"
+        w := httptest.NewRecorder()
+        MCPBlocklistMiddleware(w, r)
+        return w.Code == http.StatusForbidden
+    }
+
+    result, err := blockTarget(ctx, map[string]interface{}{"target": "8.8.8.0/24", "reason": "scanning", "ttl": "1h"}, rob)
+    if err != nil || result["action"] != "block" || result["actor"] != "rob" {
+        t.Fatalf("blockTarget = %v, %v", result, err)
+    }
+    if !denied("8.8.8.9") || denied("8.8.4.4") {
+        t.Fatal("the middleware does not enforce the new block")
+    }
+    if result, err = blockTarget(ctx, map[string]interface{}{"target": "8.8.8.0/24", "reason": "still scanning"}, rob); err != nil || result["action"] != "update" {
+        t.Fatalf("blocking again = %v, %v, want an update", result, err)
+    }
+
+    // Another gateway picks the block up from Redis
+    blocklist = &blocklistSnapshot{entries: map[string]*blockEntry{}}
+    if err := reloadBlocklist(ctx, 2); err != nil {
+        t.Fatal(err)
+    }
+    if entry := blocklist.match("::ffff:8.8.8.9"); entry == nil || entry.Reason != "still scanning" {
+        t.Fatalf("reloaded entry %+v, want the updated block", entry)
+    }
+
+    listed, err := listBlocks(ctx, map[string]interface{}{"address": "8.8.8.200"}, rob)
+    if err != nil || listed["count"] != 1 {
+        t.Fatalf("listBlocks = %v, %v, want the block covering the address", listed, err)
+    }
+    if listed, _ = listBlocks(ctx, map[string]interface{}{"address": "1.1.1.1"}, rob); listed["count"] != 0 {
+        t.Fatalf("listBlocks = %v, want no block for an address outside it", listed)
+    }
+
+    if result, err = unblockTarget(ctx, map[string]interface{}{"target": "8.8.8.0/24", "reason": "cleared"}, rob); err != nil || result["action"] != "unblock" {
+        t.Fatalf("unblockTarget = %v, %v", result, err)
+    }
+    if denied("8.8.8.9") {
+        t.Fatal("the middleware still enforces the removed block")
+    }
+    var toolErr *ToolError
+    if _, err = unblockTarget(ctx, map[string]interface{}{"target": "8.8.8.0/24"}, rob); !errors.As(err, &toolErr) || toolErr.Code != toolErrorNotFound {
+        t.Fatalf("unblocking again: %v, want not found", err)
+    }
+
+    // Every change is audited with its actor
+    events, err := redisClient().XRange(ctx, currentConfig().Audit.Stream, "-", "+").Result()
+    if err != nil || len(events) != 3 {
+        t.Fatalf("%d audit events, %v, want 3", len(events), err)
+    }
+    for i, action := range []string{"blocklist.block", "blocklist.update", "blocklist.unblock"} {
+        if events[i].Values["action"] != action || events[i].Values["actor"] != "rob" {
+            t.Fatalf("audit event %d = %v, want %s by rob", i, events[i].Values, action)
+        }
+    }
+}
+
+func TestBlocklistExpiry(t *testing.T) {
+    server := useBlocklist(t)
+    ctx := context.Background()
+    rob := &user.SessionState{Alias: "rob", MetaData: map[string]interface{}{"roles": "admin"}}
+
+    if _, err := blockTarget(ctx, map[string]interface{}{"target": "8.8.8.8", "ttl": "1m"}, rob); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := blockTarget(ctx, map[string]interface{}{"target": "1.1.1.1", "ttl": "1h"}, rob); err != nil {
+        t.Fatal(err)
+    }
+
+    // The local copy stops enforcing at the expiry time
+    blocklist.entries["8.8.8.8"].ExpiresAt = time.Now().Add(-time.Second)
+    if blocklist.match("8.8.8.8") != nil {
+        t.Fatal("expired entry still matches")
+    }
+
+    // Expired entries leave the Redis index on the next read
+    server.FastForward(2 * time.Minute)
+    listed, err := listBlocks(ctx, map[string]interface{}{}, rob)
+    if err != nil || listed["count"] != 1 {
+        t.Fatalf("listBlocks = %v, %v, want only the live block", listed, err)
+    }
+    if members, _ := server.SMembers(blocklistIndexKey); len(members) != 1 || members[0] != "1.1.1.1" {
+        t.Fatalf("index %v, want the expired target pruned", members)
+    }
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/netip"
+    "net/url"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/sirupsen/logrus"
+)
+
+// SentraIPConfig tunes the SentraIP tools
+type SentraIPConfig struct {
+    // BulkMaxTargets caps the targets of one sentraip_bulk_threat_check
+    // call after CIDRs are expanded and duplicates removed
+    BulkMaxTargets int `json:"bulk_max_targets"`
+    // BulkWorkers is how many lookups of one bulk call run at once
+    BulkWorkers int `json:"bulk_workers"`
+    // BulkTargetTimeout bounds each lookup of a bulk call
+    BulkTargetTimeout string `json:"bulk_target_timeout"`
+    // BulkMaxCIDRHosts is the largest CIDR a bulk call expands
+    BulkMaxCIDRHosts int `json:"bulk_max_cidr_hosts"`
+    // Cache holds lookup results to save the SentraIP rate limit
+    Cache ThreatCacheConfig `json:"cache"`
+    // AllowPrivateTargets permits lookups of private, loopback and
+    // reserved addresses and of domains outside the public suffix list
+    AllowPrivateTargets bool `json:"allow_private_targets"`
+    // Upstream controls retries and the circuit breaker of lookups
+    Upstream UpstreamConfig `json:"upstream"`
+}
+
+const bulkHighestRiskCount = 5
+
+// bulkTarget is one normalized lookup and the inputs that produced it
+type bulkTarget struct {
+    Target string
+    Type   string
+    Inputs []string
+}
+
+var sentraipBulkTool = MCPTool{
+    Name:        "sentraip_bulk_threat_check",
+    Title:       "SentraIP bulk threat check",
+    Description: "Check the reputation of many IP addresses, domains and CIDR ranges in one call",
+    InputSchema: InputSchema{
+        Type: "object",
+        Properties: map[string]Property{
+            "targets": {
+                Type:        "array",
+                Description: "IP addresses, domains or CIDR ranges; duplicates are checked once",
+                MinItems:    intPtr(1),
+                MaxItems:    intPtr(500),
+                Items: &Property{
+                    Type:      "string",
+                    MinLength: intPtr(1),
+                    MaxLength: intPtr(253),
+                },
+            },
+            "bypass_cache": {
+                Type:        "boolean",
+                Description: "Query SentraIP even for targets with cached results",
+                Default:     false,
+            },
+        },
+        Required: []string{"targets"},
+    },
+    OutputSchema: &Property{
+        Type: "object",
+        Properties: map[string]Property{
+            "results": {
+                Type: "array",
+                Items: &Property{
+                    Type: "object",
+                    Properties: map[string]Property{
+                        "target":     {Type: "string"},
+                        "type":       {Type: "string", Enum: []interface{}{"ip", "domain"}},
+                        "inputs":     {Type: "array", Description: "Inputs normalized to this target", Items: &Property{Type: "string"}},
+                        "status":     {Type: "string", Enum: []interface{}{"ok", "error"}},
+                        "risk_score": {Type: "number"},
+                        "cached":     {Type: "boolean", Description: "Served from the threat cache"},
+                        "data":       {Type: "object", Description: "Threat intelligence record returned by SentraIP"},
+                        "error":      {Ref: "#/$defs/error"},
+                    },
+                    Required: []string{"target", "status"},
+                },
+            },
+            "rejected": {
+                Type:        "array",
+                Description: "Inputs that could not be checked",
+                Items: &Property{
+                    Type: "object",
+                    Properties: map[string]Property{
+                        "input": {Type: "string"},
+                        "error": {Ref: "#/$defs/error"},
+                    },
+                    Required: []string{"input", "error"},
+                },
+            },
+            "summary": {
+                Type: "object",
+                Properties: map[string]Property{
+                    "requested": {Type: "integer"},
+                    "checked":   {Type: "integer"},
+                    "succeeded": {Type: "integer"},
+                    "failed":    {Type: "integer"},
+                    "highest_risk": {
+                        Type: "array",
+                        Items: &Property{
+                            Type: "object",
+                            Properties: map[string]Property{
+                                "target":     {Type: "string"},
+                                "type":       {Type: "string"},
+                                "risk_score": {Type: "number"},
+                            },
+                        },
+                    },
+                },
+            },
+            "timestamp": {Type: "string", Format: "date-time"},
+        },
+        Required: []string{"results", "summary", "timestamp"},
+        Defs: map[string]Property{
+            "error": {
+                Type: "object",
+                Properties: map[string]Property{
+                    "code":    {Type: "string"},
+                    "message": {Type: "string"},
+                },
+                Required: []string{"code", "message"},
+            },
+        },
+    },
+    Annotations: externalLookupAnnotations,
+    Version:     "1.0.0",
+    Async:       true,
+}
+
+// normalizeBulkInput turns one input into the lookups it stands for: an
+// IP, a domain (taken from a URL when one is given) or every address of a
+// small CIDR range, each normalized with normalizeTarget
+func normalizeBulkInput(input string, maxCIDRHosts int) ([]bulkTarget, error) {
+    value := strings.TrimSpace(input)
+
+    if prefix, err := netip.ParsePrefix(value); err == nil {
+        if prefix.Addr().Zone() != "" {
+            return nil, &targetError{input, "has an IPv6 zone identifier, which is not allowed"}
+        }
+        prefix = prefix.Masked()
+        hostBits := prefix.Addr().BitLen() - prefix.Bits()
+        if hostBits > 30 || 1<<hostBits > maxCIDRHosts {
+            return nil, &targetError{input, fmt.Sprintf("has more than %d addresses", maxCIDRHosts)}
+        }
+        var targets []bulkTarget
+        for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+            ip, err := normalizeTarget(addr.String(), "ip")
+            if err != nil {
+                return nil, err
+            }
+            targets = append(targets, bulkTarget{Target: ip, Type: "ip"})
+        }
+        return targets, nil
+    }
+
+    if strings.Contains(value, "://") {
+        u, err := url.Parse(value)
+        if err != nil || u.Hostname() == "" {
+            return nil, &targetError{input, "is not a valid URL"}
+        }
+        return normalizeBulkInput(u.Hostname(), maxCIDRHosts)
+    }
+
+    unbracketed := strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+    if _, err := netip.ParseAddr(unbracketed); err == nil || strings.Contains(unbracketed, "%") {
+        ip, err := normalizeTarget(unbracketed, "ip")
+        if err != nil {
+            return nil, err
+        }
+        return []bulkTarget{{Target: ip, Type: "ip"}}, nil
+    }
+
+    domain, err := normalizeTarget(value, "domain")
+    if err != nil {
+        return nil, err
+    }
+    return []bulkTarget{{Target: domain, Type: "domain"}}, nil
+}
+
+// threatRiskScore finds the risk score in a SentraIP record, which may sit
+// at the top level or under "data"
+func threatRiskScore(record map[string]interface{}) (float64, bool) {
+    for _, key := range []string{"risk_score", "riskScore", "threat_score", "score"} {
+        if score, ok := record[key].(float64); ok {
+            return score, true
+        }
+    }
+    if nested, ok := record["data"].(map[string]interface{}); ok {
+        return threatRiskScore(nested)
+    }
+    return 0, false
+}
+
+func bulkThreatCheck(ctx context.Context, params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
+    rawTargets, ok := params["targets"].([]interface{})
+    if !ok {
+        return nil, fmt.Errorf("missing or invalid 'targets' parameter")
+    }
+    bypass, _ := params["bypass_cache"].(bool)
+    cfg := currentConfig().SentraIP
+
+    // Normalize and deduplicate, remembering which inputs map to each target
+    var targets []*bulkTarget
+    byKey := map[string]*bulkTarget{}
+    var rejected []map[string]interface{}
+    for _, raw := range rawTargets {
+        input, _ := raw.(string)
+        expanded, err := normalizeBulkInput(input, cfg.BulkMaxCIDRHosts)
+        if err != nil {
+            rejected = append(rejected, map[string]interface{}{
+                "input": input,
+                "error": map[string]interface{}{"code": "invalid_target", "message": err.Error()},
+            })
+            continue
+        }
+        for _, t := range expanded {
+            key := t.Type + ":" + t.Target
+            if existing, ok := byKey[key]; ok {
+                existing.Inputs = appendUnique(existing.Inputs, input)
+                continue
+            }
+            t := t
+            t.Inputs = []string{input}
+            byKey[key] = &t
+            targets = append(targets, &t)
+        }
+    }
+    if len(targets) > cfg.BulkMaxTargets {
+        return nil, &ToolError{
+            Code:    toolErrorExecutionFailed,
+            Message: fmt.Sprintf("%d targets after expansion and deduplication, the limit is %d", len(targets), cfg.BulkMaxTargets),
+            Details: map[string]interface{}{"targets": len(targets), "limit": cfg.BulkMaxTargets},
+        }
+    }
+
+    workers := cfg.BulkWorkers
+    if workers < 1 {
+        workers = 1
+    }
+    timeout := durationOr(cfg.BulkTargetTimeout, 10*time.Second)
+
+    results := make([]map[string]interface{}, len(targets))
+    sem := make(chan struct{}, workers)
+    var wg sync.WaitGroup
+    var progress sync.Mutex
+    checked := 0
+    for i, t := range targets {
+        if ctx.Err() != nil {
+            break
+        }
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(i int, t *bulkTarget) {
+            defer wg.Done()
+            defer func() { <-sem }()
+
+            ctx, cancel := context.WithTimeout(ctx, timeout)
+            defer cancel()
+            results[i] = bulkLookup(ctx, t, bypass)
+
+            // Reported under the lock so progress never goes backwards
+            progress.Lock()
+            checked++
+            reportProgress(ctx, float64(checked), float64(len(targets)), fmt.Sprintf("%d of %d targets checked", checked, len(targets)))
+            progress.Unlock()
+        }(i, t)
+    }
+    wg.Wait()
+    // A call stopped part way has no complete result to report
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    succeeded := 0
+    var scored []map[string]interface{}
+    for _, result := range results {
+        if result["status"] != "ok" {
+            continue
+        }
+        succeeded++
+        if _, ok := result["risk_score"]; ok {
+            scored = append(scored, result)
+        }
+    }
+    sort.SliceStable(scored, func(i, j int) bool {
+        return scored[i]["risk_score"].(float64) > scored[j]["risk_score"].(float64)
+    })
+    if len(scored) > bulkHighestRiskCount {
+        scored = scored[:bulkHighestRiskCount]
+    }
+    highest := make([]map[string]interface{}, 0, len(scored))
+    for _, result := range scored {
+        highest = append(highest, map[string]interface{}{
+            "target":     result["target"],
+            "type":       result["type"],
+            "risk_score": result["risk_score"],
+        })
+    }
+
+    if rejected == nil {
+        rejected = []map[string]interface{}{}
+    }
+
+    log.Get().WithFields(logrus.Fields{
+        "requested":  len(rawTargets),
+        "checked":    len(targets),
+        "failed":     len(targets) - succeeded,
+        "session_id": getSessionID(session),
+    }).Info("SentraIP bulk threat check completed")
+
+    return map[string]interface{}{
+        "results":  results,
+        "rejected": rejected,
+        "summary": map[string]interface{}{
+            "requested":    len(rawTargets),
+            "checked":      len(targets),
+            "succeeded":    succeeded,
+            "failed":       len(targets) - succeeded,
+            "highest_risk": highest,
+        },
+        "timestamp": time.Now().Format(time.RFC3339),
+    }, nil
+}
+
+// bulkLookup checks one target, turning failures into a per-item error
+func bulkLookup(ctx context.Context, t *bulkTarget, bypass bool) map[string]interface{} {
+    result := map[string]interface{}{
+        "target": t.Target,
+        "type":   t.Type,
+        "inputs": t.Inputs,
+    }
+
+    record, cacheStatus, err := cachedLookupThreat(ctx, t.Target, t.Type, bypass)
+    if err != nil {
+        code := toolErrorExecutionFailed
+        var toolErr *ToolError
+        switch {
+        case errors.As(err, &toolErr):
+            code = toolErr.Code
+        case errors.Is(err, context.DeadlineExceeded):
+            code = toolErrorTimeout
+        case errors.Is(err, context.Canceled):
+            code = toolErrorCancelled
+        }
+        result["status"] = "error"
+        result["error"] = map[string]interface{}{"code": code, "message": err.Error()}
+        return result
+    }
+
+    data, _ := record["data"].(map[string]interface{})
+    result["status"] = "ok"
+    result["cached"] = cacheStatus == cacheHit || cacheStatus == cacheStale
+    result["data"] = data
+    if score, ok := threatRiskScore(data); ok {
+        result["risk_score"] = score
+    }
+    return result
+}
+
+func appendUnique(list []string, value string) []string {
+    for _, existing := range list {
+        if existing == value {
+            return list
+        }
+    }
+    return append(list, value)
+}
+
+func init() {
+    MCPToolsRegistry[sentraipBulkTool.Name] = sentraipBulkTool
+}
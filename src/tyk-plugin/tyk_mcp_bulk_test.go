@@ -0,0 +1,187 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "path"
+    "reflect"
+    "strings"
+    "sync/atomic"
+    "testing"
+)
+
+// useSentraIP serves SentraIP lookups through a fake gateway. Targets in
+// scores are found with that risk score, others are not found. The cache is
+// emptied and the number of lookups that reached the server is returned.
+func useSentraIP(t *testing.T, scores map[string]float64, edit func(cfg *MCPConfig)) *atomic.Int32 {
+    t.Helper()
+    var hits atomic.Int32
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        hits.Add(1)
+        score, ok := scores[path.Base(r.URL.Path)]
+        if !strings.HasPrefix(r.URL.Path, "/sentraip/threat-intel/") || !ok {
+            w.WriteHeader(http.StatusNotFound)
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"risk_score": score})
+    }))
+    t.Cleanup(server.Close)
+    t.Setenv("TYK_GATEWAY_URL", server.URL)
+
+    useRedis(t, edit)
+    previous := threatResults
+    threatResults = newThreatCache()
+    t.Cleanup(func() { threatResults = previous })
+    return &hits
+}
+
+func TestNormalizeBulkInput(t *testing.T) {
+    useConfig(t, nil)
+
+    tests := []struct {
+        input   string
+        want    []string
+        wantErr string
+    }{
+        {input: " 8.8.8.8 ", want: []string{"ip:8.8.8.8"}},
+        {input: "[2606:4700::1111]", want: []string{"ip:2606:4700::1111"}},
+        {input: "https://Example.COM:8443/path", want: []string{"domain:example.com"}},
+        {input: "http://8.8.4.4/", want: []string{"ip:8.8.4.4"}},
+        {input: "8.8.8.1/30", want: []string{"ip:8.8.8.0", "ip:8.8.8.1", "ip:8.8.8.2", "ip:8.8.8.3"}},
+        {input: "8.8.0.0/16", wantErr: "has more than 256 addresses"},
+        {input: "10.0.0.0/30", wantErr: "10.0.0.0"},
+        {input: "fe80::1%eth0", wantErr: "zone"},
+        {input: "http://", wantErr: "is not a valid URL"},
+        {input: "not a target", wantErr: "not a target"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.input, func(t *testing.T) {
+            targets, err := normalizeBulkInput(tt.input, 256)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("normalizeBulkInput error = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            var got []string
+            for _, target := range targets {
+                got = append(got, target.Type+":"+target.Target)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("targets %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestThreatRiskScore(t *testing.T) {
+    tests := []struct {
+        name   string
+        record string
+        want   float64
+        wantOK bool
+    }{
+        {name: "top level", record: `{"risk_score": 7.5}`, want: 7.5, wantOK: true},
+        {name: "alternate key", record: `{"threat_score": 3}`, want: 3, wantOK: true},
+        {name: "nested", record: `{"data": {"score": 9}}`, want: 9, wantOK: true},
+        {name: "not a number", record: `{"risk_score": "high"}`},
+        {name: "missing", record: `{}`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            score, ok := threatRiskScore(decodeJSON(t, tt.record).(map[string]interface{}))
+            if score != tt.want || ok != tt.wantOK {
+                t.Fatalf("threatRiskScore = %v, %v, want %v, %v", score, ok, tt.want, tt.wantOK)
+            }
+        })
+    }
+}
+
+func TestBulkThreatCheck(t *testing.T) {
+    hits := useSentraIP(t, map[string]float64{"8.8.8.8": 2, "8.8.4.4": 9, "example.com": 5}, nil)
+
+    targets := []interface{}{"8.8.8.8", "http://8.8.8.8/", "8.8.4.4", "Example.com", "example.com", "1.1.1.1", "10.0.0.1"}
+    result, err := bulkThreatCheck(context.Background(), map[string]interface{}{"targets": targets}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    byTarget := map[string]map[string]interface{}{}
+    for _, r := range result["results"].([]map[string]interface{}) {
+        byTarget[r["target"].(string)] = r
+    }
+    if len(byTarget) != 4 || hits.Load() != 4 {
+        t.Fatalf("checked %d targets with %d lookups, want 4 of each", len(byTarget), hits.Load())
+    }
+    if inputs := byTarget["8.8.8.8"]["inputs"]; !reflect.DeepEqual(inputs, []string{"8.8.8.8", "http://8.8.8.8/"}) {
+        t.Fatalf("8.8.8.8 inputs %v, want both spellings", inputs)
+    }
+    if inputs := byTarget["example.com"]["inputs"]; !reflect.DeepEqual(inputs, []string{"Example.com", "example.com"}) {
+        t.Fatalf("example.com inputs %v, want both spellings", inputs)
+    }
+    failed := byTarget["1.1.1.1"]
+    if failed["status"] != "error" || failed["error"].(map[string]interface{})["code"] != toolErrorUpstream {
+        t.Fatalf("1.1.1.1 = %v, want an upstream error", failed)
+    }
+
+    rejected := result["rejected"].([]map[string]interface{})
+    if len(rejected) != 1 || rejected[0]["input"] != "10.0.0.1" {
+        t.Fatalf("rejected %v, want the private address", rejected)
+    }
+
+    summary := result["summary"].(map[string]interface{})
+    if summary["requested"] != 7 || summary["checked"] != 4 || summary["succeeded"] != 3 || summary["failed"] != 1 {
+        t.Fatalf("summary %v", summary)
+    }
+    var order []string
+    for _, r := range summary["highest_risk"].([]map[string]interface{}) {
+        order = append(order, r["target"].(string))
+    }
+    if want := []string{"8.8.4.4", "example.com", "8.8.8.8"}; !reflect.DeepEqual(order, want) {
+        t.Fatalf("highest risk %v, want %v", order, want)
+    }
+}
+
+func TestBulkThreatCheckRefused(t *testing.T) {
+    tests := []struct {
+        name     string
+        targets  []interface{}
+        cancel   bool
+        wantCode string
+        wantErr  error
+    }{
+        {name: "too many targets", targets: []interface{}{"8.8.8.0/30"}, wantCode: toolErrorExecutionFailed},
+        {name: "cancelled", targets: []interface{}{"8.8.8.8"}, cancel: true, wantErr: context.Canceled},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            hits := useSentraIP(t, nil, func(cfg *MCPConfig) { cfg.SentraIP.BulkMaxTargets = 3 })
+            ctx, cancel := context.WithCancel(context.Background())
+            if tt.cancel {
+                cancel()
+            }
+            defer cancel()
+
+            _, err := bulkThreatCheck(ctx, map[string]interface{}{"targets": tt.targets}, nil)
+            var toolErr *ToolError
+            if tt.wantCode != "" && (!errors.As(err, &toolErr) || toolErr.Code != tt.wantCode) {
+                t.Fatalf("bulkThreatCheck error %v, want code %s", err, tt.wantCode)
+            }
+            if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+                t.Fatalf("bulkThreatCheck error %v, want %v", err, tt.wantErr)
+            }
+            if hits.Load() != 0 {
+                t.Fatalf("%d lookups made, want none", hits.Load())
+            }
+        })
+    }
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "encoding/json"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/metric"
+    "golang.org/x/sync/singleflight"
+)
+
+// ThreatCacheConfig controls caching of SentraIP lookups. TTLs depend on
+// the risk score of the result; a stale entry is served for StaleFor past
+// its TTL while it is refreshed in the background.
+type ThreatCacheConfig struct {
+    Enabled    bool `json:"enabled"`
+    MaxEntries int  `json:"max_entries"`
+    // Redis adds a tier shared by every gateway behind the memory LRU
+    Redis bool `json:"redis"`
+
+    HighRiskScore   float64 `json:"high_risk_score"`
+    MediumRiskScore float64 `json:"medium_risk_score"`
+
+    HighRiskTTL   string `json:"high_risk_ttl"`
+    MediumRiskTTL string `json:"medium_risk_ttl"`
+    LowRiskTTL    string `json:"low_risk_ttl"`
+    UnscoredTTL   string `json:"unscored_ttl"`
+    StaleFor      string `json:"stale_for"`
+}
+
+const (
+    cacheMiss   = "miss"
+    cacheHit    = "hit"
+    cacheStale  = "stale"
+    cacheBypass = "bypass"
+)
+
+// threatCacheEntry holds the encoded lookup so every caller gets its own copy
+type threatCacheEntry struct {
+    Key        string          `json:"key"`
+    Value      json.RawMessage `json:"value"`
+    StoredAt   time.Time       `json:"stored_at"`
+    FreshUntil time.Time       `json:"fresh_until"`
+    StaleUntil time.Time       `json:"stale_until"`
+}
+
+// threatCacheStats are the counters behind the OTEL metrics, also served as
+// the sentraip://cache/stats resource
+type threatCacheStats struct {
+    MemoryHits   atomic.Int64
+    RedisHits    atomic.Int64
+    StaleServed  atomic.Int64
+    Misses       atomic.Int64
+    Bypassed     atomic.Int64
+    Refreshes    atomic.Int64
+    FetchErrors  atomic.Int64
+    Evictions    atomic.Int64
+    CoalescedOps atomic.Int64
+}
+
+// threatCache is an LRU of lookups in front of an optional Redis tier
+type threatCache struct {
+    mu      sync.Mutex
+    order   *list.List
+    entries map[string]*list.Element
+
+    flight singleflight.Group
+    stats  threatCacheStats
+
+    lookups metric.Int64Counter
+}
+
+var threatResults = newThreatCache()
+
+func newThreatCache() *threatCache {
+    c := &threatCache{order: list.New(), entries: map[string]*list.Element{}}
+
+    counter, err := otel.Meter("tyk-mcp-gateway").Int64Counter(
+        "mcp.threat_cache.lookups",
+        metric.WithDescription("SentraIP lookups by cache result (hit, stale, miss, bypass) and tier"),
+    )
+    if err != nil {
+        log.Get().WithError(err).Warn("Failed to create threat cache metrics")
+    }
+    c.lookups = counter
+    return c
+}
+
+func (c *threatCache) record(ctx context.Context, status, tier string) {
+    if c.lookups == nil {
+        return
+    }
+    c.lookups.Add(ctx, 1, metric.WithAttributes(
+        attribute.String("cache.status", status),
+        attribute.String("cache.tier", tier),
+    ))
+}
+
+// cachedLookupThreat returns the SentraIP record for target, from cache
+// when possible. Concurrent misses for one target share a single upstream
+// request. The returned status is hit, stale, miss or bypass.
+func cachedLookupThreat(ctx context.Context, target, targetType string, bypass bool) (map[string]interface{}, string, error) {
+    target, err := normalizeTarget(target, targetType)
+    if err != nil {
+        return nil, "", err
+    }
+    cfg := currentConfig().SentraIP.Cache
+    if !cfg.Enabled {
+        record, err := lookupThreat(ctx, target, targetType)
+        return record, cacheBypass, err
+    }
+
+    c := threatResults
+    key := targetType + ":" + target
+
+    if bypass {
+        c.stats.Bypassed.Add(1)
+        c.record(ctx, cacheBypass, "none")
+    } else if entry, tier := c.get(ctx, key, cfg); entry != nil {
+        record, err := decodeCacheEntry(entry)
+        if err == nil {
+            now := time.Now()
+            if now.Before(entry.FreshUntil) {
+                if tier == "redis" {
+                    c.stats.RedisHits.Add(1)
+                } else {
+                    c.stats.MemoryHits.Add(1)
+                }
+                c.record(ctx, cacheHit, tier)
+                return record, cacheHit, nil
+            }
+            if now.Before(entry.StaleUntil) {
+                c.stats.StaleServed.Add(1)
+                c.record(ctx, cacheStale, tier)
+                c.refresh(key, target, targetType)
+                return record, cacheStale, nil
+            }
+        }
+    }
+
+    if !bypass {
+        c.stats.Misses.Add(1)
+        c.record(ctx, cacheMiss, "none")
+    }
+
+    result := c.flight.DoChan(key, func() (interface{}, error) {
+        return c.fetch(key, target, targetType)
+    })
+    select {
+    case res := <-result:
+        if res.Shared {
+            c.stats.CoalescedOps.Add(1)
+        }
+        if res.Err != nil {
+            return nil, "", res.Err
+        }
+        record, err := decodeCacheEntry(res.Val.(*threatCacheEntry))
+        status := cacheMiss
+        if bypass {
+            status = cacheBypass
+        }
+        return record, status, err
+    case <-ctx.Done():
+        return nil, "", ctx.Err()
+    }
+}
+
+// fetch looks target up and stores it. It runs detached from any one
+// caller, so a caller giving up does not fail the others sharing it.
+func (c *threatCache) fetch(key, target, targetType string) (*threatCacheEntry, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+    defer cancel()
+
+    record, err := lookupThreat(ctx, target, targetType)
+    if err != nil {
+        c.stats.FetchErrors.Add(1)
+        return nil, err
+    }
+
+    encoded, err := json.Marshal(record)
+    if err != nil {
+        return nil, err
+    }
+    cfg := currentConfig().SentraIP.Cache
+    data, _ := record["data"].(map[string]interface{})
+    ttl := threatTTL(data, cfg)
+    now := time.Now()
+    entry := &threatCacheEntry{
+        Key:        key,
+        Value:      encoded,
+        StoredAt:   now,
+        FreshUntil: now.Add(ttl),
+        StaleUntil: now.Add(ttl + durationOr(cfg.StaleFor, 10*time.Minute)),
+    }
+    c.put(ctx, entry, cfg)
+    return entry, nil
+}
+
+// refresh revalidates a stale entry in the background
+func (c *threatCache) refresh(key, target, targetType string) {
+    go func() {
+        _, err, shared := c.flight.Do(key, func() (interface{}, error) {
+            c.stats.Refreshes.Add(1)
+            return c.fetch(key, target, targetType)
+        })
+        if err != nil && !shared {
+            log.Get().WithError(err).WithField("target", target).Warn("Threat cache refresh failed")
+        }
+    }()
+}
+
+// threatTTL picks the freshness lifetime for a record by its risk level
+func threatTTL(data map[string]interface{}, cfg ThreatCacheConfig) time.Duration {
+    score, ok := threatRiskScore(data)
+    switch {
+    case !ok:
+        return durationOr(cfg.UnscoredTTL, 5*time.Minute)
+    case score >= cfg.HighRiskScore:
+        return durationOr(cfg.HighRiskTTL, 6*time.Hour)
+    case score >= cfg.MediumRiskScore:
+        return durationOr(cfg.MediumRiskTTL, time.Hour)
+    }
+    return durationOr(cfg.LowRiskTTL, 30*time.Minute)
+}
+
+func (c *threatCache) get(ctx context.Context, key string, cfg ThreatCacheConfig) (*threatCacheEntry, string) {
+    c.mu.Lock()
+    if el, ok := c.entries[key]; ok {
+        entry := el.Value.(*threatCacheEntry)
+        if time.Now().Before(entry.StaleUntil) {
+            c.order.MoveToFront(el)
+            c.mu.Unlock()
+            return entry, "memory"
+        }
+        c.order.Remove(el)
+        delete(c.entries, key)
+    }
+    c.mu.Unlock()
+
+    if !cfg.Redis {
+        return nil, ""
+    }
+    raw, err := redisClient().Get(ctx, threatCacheRedisKey(key)).Bytes()
+    if err != nil {
+        if err != redis.Nil {
+            log.Get().WithError(err).Debug("Threat cache Redis read failed")
+        }
+        return nil, ""
+    }
+    var entry threatCacheEntry
+    if json.Unmarshal(raw, &entry) != nil {
+        return nil, ""
+    }
+    c.putMemory(&entry, cfg)
+    return &entry, "redis"
+}
+
+func (c *threatCache) put(ctx context.Context, entry *threatCacheEntry, cfg ThreatCacheConfig) {
+    c.putMemory(entry, cfg)
+    if !cfg.Redis {
+        return
+    }
+    encoded, err := json.Marshal(entry)
+    if err != nil {
+        return
+    }
+    if err := redisClient().Set(ctx, threatCacheRedisKey(entry.Key), encoded, time.Until(entry.StaleUntil)).Err(); err != nil {
+        log.Get().WithError(err).Debug("Threat cache Redis write failed")
+    }
+}
+
+func (c *threatCache) putMemory(entry *threatCacheEntry, cfg ThreatCacheConfig) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if el, ok := c.entries[entry.Key]; ok {
+        el.Value = entry
+        c.order.MoveToFront(el)
+        return
+    }
+    c.entries[entry.Key] = c.order.PushFront(entry)
+
+    max := cfg.MaxEntries
+    if max < 1 {
+        max = 1
+    }
+    for c.order.Len() > max {
+        oldest := c.order.Back()
+        c.order.Remove(oldest)
+        delete(c.entries, oldest.Value.(*threatCacheEntry).Key)
+        c.stats.Evictions.Add(1)
+    }
+}
+
+// snapshot reports the cache counters and size
+func (c *threatCache) snapshot() map[string]interface{} {
+    c.mu.Lock()
+    size := c.order.Len()
+    c.mu.Unlock()
+
+    hits := c.stats.MemoryHits.Load() + c.stats.RedisHits.Load() + c.stats.StaleServed.Load()
+    lookups := hits + c.stats.Misses.Load()
+    hitRatio := 0.0
+    if lookups > 0 {
+        hitRatio = float64(hits) / float64(lookups)
+    }
+
+    return map[string]interface{}{
+        "enabled":      currentConfig().SentraIP.Cache.Enabled,
+        "entries":      size,
+        "memory_hits":  c.stats.MemoryHits.Load(),
+        "redis_hits":   c.stats.RedisHits.Load(),
+        "stale_served": c.stats.StaleServed.Load(),
+        "misses":       c.stats.Misses.Load(),
+        "bypassed":     c.stats.Bypassed.Load(),
+        "refreshes":    c.stats.Refreshes.Load(),
+        "fetch_errors": c.stats.FetchErrors.Load(),
+        "evictions":    c.stats.Evictions.Load(),
+        "coalesced":    c.stats.CoalescedOps.Load(),
+        "hit_ratio":    hitRatio,
+        "timestamp":    time.Now().Format(time.RFC3339),
+    }
+}
+
+func threatCacheRedisKey(key string) string {
+    return "mcp-threat-cache:" + key
+}
+
+func decodeCacheEntry(entry *threatCacheEntry) (map[string]interface{}, error) {
+    var record map[string]interface{}
+    err := json.Unmarshal(entry.Value, &record)
+    return record, err
+}
+
+func init() {
+    registerResourceProvider(&resourceProvider{
+        Template: MCPResourceTemplate{
+            URITemplate: "sentraip://cache/stats",
+            Name:        "SentraIP cache statistics",
+            Description: "Hit, miss and refresh counters of the threat intelligence cache",
+            MimeType:    "application/json",
+        },
+        list: func() []MCPResource {
+            return []MCPResource{{
+                URI:         "sentraip://cache/stats",
+                Name:        "SentraIP cache statistics",
+                Description: "Hit, miss and refresh counters of the threat intelligence cache",
+                MimeType:    "application/json",
+            }}
+        },
+        read: func(ctx context.Context, r *http.Request, session *user.SessionState, vars map[string]string) (interface{}, error) {
+            return threatResults.snapshot(), nil
+        },
+    })
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestThreatTTL(t *testing.T) {
+    cfg := defaultMCPConfig().SentraIP.Cache
+
+    tests := []struct {
+        name string
+        data map[string]interface{}
+        want time.Duration
+    }{
+        {name: "unscored", data: map[string]interface{}{}, want: 5 * time.Minute},
+        {name: "low", data: map[string]interface{}{"risk_score": 1.0}, want: 30 * time.Minute},
+        {name: "medium", data: map[string]interface{}{"risk_score": 4.0}, want: time.Hour},
+        {name: "high", data: map[string]interface{}{"risk_score": 9.5}, want: 6 * time.Hour},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := threatTTL(tt.data, cfg); got != tt.want {
+                t.Fatalf("threatTTL = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestCachedLookupThreat(t *testing.T) {
+    // Each lookup of 8.8.8.8 is made after the previous one, then checks
+    // the cache status and how many lookups reached SentraIP in total
+    type lookup struct {
+        // before changes the cache first: "expire" makes the entry stale
+        // and "forget" empties the memory tier
+        before     string
+        bypass     bool
+        wantStatus string
+        wantHits   int32
+    }
+    tests := []struct {
+        name    string
+        edit    func(cfg *MCPConfig)
+        lookups []lookup
+    }{
+        {
+            name: "hit after miss",
+            lookups: []lookup{
+                {wantStatus: cacheMiss, wantHits: 1},
+                {wantStatus: cacheHit, wantHits: 1},
+            },
+        },
+        {
+            name: "bypass refreshes the entry",
+            lookups: []lookup{
+                {wantStatus: cacheMiss, wantHits: 1},
+                {bypass: true, wantStatus: cacheBypass, wantHits: 2},
+                {wantStatus: cacheHit, wantHits: 2},
+            },
+        },
+        {
+            name: "stale entry is served and refreshed",
+            lookups: []lookup{
+                {wantStatus: cacheMiss, wantHits: 1},
+                {before: "expire", wantStatus: cacheStale, wantHits: 2},
+                {wantStatus: cacheHit, wantHits: 2},
+            },
+        },
+        {
+            name: "redis tier",
+            lookups: []lookup{
+                {wantStatus: cacheMiss, wantHits: 1},
+                {before: "forget", wantStatus: cacheHit, wantHits: 1},
+            },
+        },
+        {
+            name: "memory only",
+            edit: func(cfg *MCPConfig) { cfg.SentraIP.Cache.Redis = false },
+            lookups: []lookup{
+                {wantStatus: cacheMiss, wantHits: 1},
+                {before: "forget", wantStatus: cacheMiss, wantHits: 2},
+            },
+        },
+        {
+            name: "disabled",
+            edit: func(cfg *MCPConfig) { cfg.SentraIP.Cache.Enabled = false },
+            lookups: []lookup{
+                {wantStatus: cacheBypass, wantHits: 1},
+                {wantStatus: cacheBypass, wantHits: 2},
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            hits := useSentraIP(t, map[string]float64{"8.8.8.8": 2}, tt.edit)
+
+            for i, l := range tt.lookups {
+                switch l.before {
+                case "expire":
+                    threatResults.mu.Lock()
+                    threatResults.entries["ip:8.8.8.8"].Value.(*threatCacheEntry).FreshUntil = time.Now().Add(-time.Second)
+                    threatResults.mu.Unlock()
+                case "forget":
+                    threatResults = newThreatCache()
+                }
+
+                record, status, err := cachedLookupThreat(context.Background(), "8.8.8.8", "ip", l.bypass)
+                if err != nil {
+                    t.Fatalf("lookup %d: %v", i, err)
+                }
+                if status != l.wantStatus || record["target"] != "8.8.8.8" {
+                    t.Fatalf("lookup %d: status %s, record %v, want %s", i, status, record, l.wantStatus)
+                }
+
+                // Stale entries are refreshed in the background
+                for deadline := time.Now().Add(2 * time.Second); hits.Load() < l.wantHits && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+                }
+                if hits.Load() != l.wantHits {
+                    t.Fatalf("lookup %d: %d lookups reached SentraIP, want %d", i, hits.Load(), l.wantHits)
+                }
+                if l.before == "expire" {
+                    // Wait for the refresh to store its entry
+                    for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+                        if entry, _ := threatResults.get(context.Background(), "ip:8.8.8.8", currentConfig().SentraIP.Cache); entry != nil && time.Now().Before(entry.FreshUntil) {
+                            break
+                        }
+                    }
+                }
+            }
+        })
+    }
+}
+
+func TestCachedLookupThreatErrors(t *testing.T) {
+    hits := useSentraIP(t, nil, nil)
+
+    for i := 0; i < 2; i++ {
+        if _, _, err := cachedLookupThreat(context.Background(), "1.1.1.1", "ip", false); err == nil {
+            t.Fatalf("lookup %d of an unknown target succeeded", i)
+        }
+    }
+    if hits.Load() != 2 {
+        t.Fatalf("%d lookups reached SentraIP, want failures not to be cached", hits.Load())
+    }
+    if _, _, err := cachedLookupThreat(context.Background(), "10.0.0.1", "ip", false); err == nil || hits.Load() != 2 {
+        t.Fatalf("private target error %v after %d lookups, want it refused before any lookup", err, hits.Load())
+    }
+
+    stats := threatResults.snapshot()
+    if stats["misses"] != int64(2) || stats["fetch_errors"] != int64(2) || stats["entries"] != 0 {
+        t.Fatalf("stats %v, want 2 misses and 2 fetch errors", stats)
+    }
+}
+
+func TestThreatCacheEviction(t *testing.T) {
+    useSentraIP(t, map[string]float64{"8.8.8.8": 1, "8.8.4.4": 1, "1.1.1.1": 1}, func(cfg *MCPConfig) {
+        cfg.SentraIP.Cache.MaxEntries = 2
+        cfg.SentraIP.Cache.Redis = false
+    })
+
+    for _, target := range []string{"8.8.8.8", "8.8.4.4", "8.8.8.8", "1.1.1.1"} {
+        if _, _, err := cachedLookupThreat(context.Background(), target, "ip", false); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // 8.8.4.4 was used least recently
+    threatResults.mu.Lock()
+    _, kept := threatResults.entries["ip:8.8.8.8"]
+    _, evicted := threatResults.entries["ip:8.8.4.4"]
+    threatResults.mu.Unlock()
+    if !kept || evicted {
+        t.Fatalf("8.8.8.8 kept = %v, 8.8.4.4 kept = %v, want the least recently used evicted", kept, evicted)
+    }
+
+    stats := threatResults.snapshot()
+    if stats["entries"] != 2 || stats["evictions"] != int64(1) || stats["memory_hits"] != int64(1) || stats["hit_ratio"] != 0.25 {
+        t.Fatalf("stats %v", stats)
+    }
+}
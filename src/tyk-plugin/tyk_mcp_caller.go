@@ -0,0 +1,117 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/TykTechnologies/tyk/user"
+)
+
+// mcpCaller is who is calling the MCP endpoint, derived from the Tyk
+// session the gateway authenticated
+type mcpCaller struct {
+    ID       string
+    OrgID    string
+    Roles    []string
+    Policies []string
+    Tags     []string
+    Scopes   []string
+}
+
+// callerFromSession builds the caller identity. The user ID comes from the
+// session's user_id metadata, then its alias, then its key; roles come from
+// the "roles" metadata as a list or a comma separated string, tags from the
+// session and its "tags" metadata, and OAuth scopes from the "scopes" or
+// space separated "scope" metadata.
+func callerFromSession(session *user.SessionState) mcpCaller {
+    if session == nil {
+        return mcpCaller{}
+    }
+
+    caller := mcpCaller{
+        OrgID:    session.OrgID,
+        Policies: session.ApplyPolicies,
+    }
+
+    switch {
+    case metadataString(session, "user_id") != "":
+        caller.ID = metadataString(session, "user_id")
+    case session.Alias != "":
+        caller.ID = session.Alias
+    case session.KeyID != "":
+        caller.ID = session.KeyID
+    }
+
+    caller.Roles = metadataList(session, "roles")
+    caller.Tags = append(append([]string{}, session.Tags...), metadataList(session, "tags")...)
+    caller.Scopes = metadataList(session, "scopes")
+    if len(caller.Scopes) == 0 {
+        caller.Scopes = strings.Fields(metadataString(session, "scope"))
+    }
+    return caller
+}
+
+// Anonymous reports whether the gateway did not identify the caller
+func (c mcpCaller) Anonymous() bool {
+    return c.ID == ""
+}
+
+// HasAnyRole reports whether the caller holds at least one of roles
+func (c mcpCaller) HasAnyRole(roles ...string) bool {
+    for _, want := range roles {
+        for _, have := range c.Roles {
+            if strings.EqualFold(want, have) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// matchesAny reports whether any of have equals any of want, ignoring case
+func matchesAny(have, want []string) bool {
+    for _, w := range want {
+        for _, h := range have {
+            if strings.EqualFold(w, h) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func metadataString(session *user.SessionState, key string) string {
+    if session == nil || session.MetaData == nil {
+        return ""
+    }
+    if value, ok := session.MetaData[key]; ok && value != nil {
+        return fmt.Sprint(value)
+    }
+    return ""
+}
+
+func metadataList(session *user.SessionState, key string) []string {
+    if session == nil || session.MetaData == nil {
+        return nil
+    }
+
+    var values []string
+    switch v := session.MetaData[key].(type) {
+    case []string:
+        values = v
+    case []interface{}:
+        for _, item := range v {
+            values = append(values, fmt.Sprint(item))
+        }
+    case string:
+        values = strings.Split(v, ",")
+    }
+
+    out := make([]string, 0, len(values))
+    for _, value := range values {
+        if value = strings.TrimSpace(value); value != "" {
+            out = append(out, value)
+        }
+    }
+    return out
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/sirupsen/logrus"
+)
+
+// ToolTimeoutsConfig bounds how long a tool call may run. Durations are Go
+// duration strings.
+type ToolTimeoutsConfig struct {
+    // Default applies to tools without an entry in Tools
+    Default string            `json:"default"`
+    Tools   map[string]string `json:"tools"`
+}
+
+// upstreamClient makes the HTTP calls tools depend on. It has no timeout
+// of its own: deadlines come from the context of the tool call.
+var upstreamClient = &http.Client{}
+
+// toolTimeout returns the deadline configured for a tool
+func toolTimeout(toolName string) time.Duration {
+    cfg := currentConfig().ToolTimeouts
+    if timeout, ok := cfg.Tools[toolName]; ok {
+        return durationOr(timeout, 30*time.Second)
+    }
+    return durationOr(cfg.Default, 30*time.Second)
+}
+
+// contextToolError describes a tool call stopped by its context, keeping
+// timeouts and cancellations apart from upstream failures
+func contextToolError(ctx context.Context, toolName string, timeout time.Duration) *ToolError {
+    if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+        return &ToolError{
+            Code:    toolErrorTimeout,
+            Message: fmt.Sprintf("tool %s did not finish within %s", toolName, timeout),
+            Details: map[string]interface{}{"timeout": timeout.String()},
+        }
+    }
+    reason := "client disconnected"
+    if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+        reason = cause.Error()
+    }
+    return &ToolError{
+        Code:    toolErrorCancelled,
+        Message: fmt.Sprintf("tool %s was cancelled: %s", toolName, reason),
+        Details: map[string]interface{}{"reason": reason},
+    }
+}
+
+// inflightRequest is a JSON-RPC request that notifications/cancelled can stop
+type inflightRequest struct {
+    cancel context.CancelCauseFunc
+}
+
+var inflightRequests = struct {
+    sync.Mutex
+    byKey map[string]*inflightRequest
+}{byKey: map[string]*inflightRequest{}}
+
+// requestScope is what a JSON-RPC request ID is unique within: the MCP
+// session, or the caller when there is none. Anonymous callers without a
+// session cannot cancel requests.
+func requestScope(req *mcpRequest) string {
+    if req.mcpSession != nil {
+        return "session:" + req.mcpSession.ID
+    }
+    if !req.caller.Anonymous() {
+        return "caller:" + req.caller.ID
+    }
+    return ""
+}
+
+func inflightKey(scope string, id json.RawMessage) string {
+    return scope + "|" + string(bytes.TrimSpace(id))
+}
+
+// trackRequest returns the context a JSON-RPC request runs with. It is
+// cancelled when the client disconnects or sends notifications/cancelled
+// for the request's ID. The returned function must be called once the
+// request is served.
+func trackRequest(req *mcpRequest, id json.RawMessage) (context.Context, func()) {
+    ctx, cancel := context.WithCancelCause(req.r.Context())
+    scope := requestScope(req)
+    if scope == "" {
+        return ctx, func() { cancel(nil) }
+    }
+
+    key := inflightKey(scope, id)
+    entry := &inflightRequest{cancel: cancel}
+    inflightRequests.Lock()
+    inflightRequests.byKey[key] = entry
+    inflightRequests.Unlock()
+
+    return ctx, func() {
+        inflightRequests.Lock()
+        if inflightRequests.byKey[key] == entry {
+            delete(inflightRequests.byKey, key)
+        }
+        inflightRequests.Unlock()
+        cancel(nil)
+    }
+}
+
+// handleCancelled stops an in-flight request of the same session or caller
+func handleCancelled(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    var p struct {
+        RequestID json.RawMessage `json:"requestId"`
+        Reason    string          `json:"reason"`
+    }
+    if rpcErr := decodeParams(params, &p); rpcErr != nil {
+        return nil, rpcErr
+    }
+    scope := requestScope(req)
+    if scope == "" || len(p.RequestID) == 0 {
+        return nil, nil
+    }
+
+    inflightRequests.Lock()
+    entry := inflightRequests.byKey[inflightKey(scope, p.RequestID)]
+    inflightRequests.Unlock()
+    if entry == nil {
+        // Already finished, or never seen by this gateway
+        return nil, nil
+    }
+
+    reason := "cancelled by the client"
+    if p.Reason != "" {
+        reason += ": " + p.Reason
+    }
+    entry.cancel(errors.New(reason))
+
+    log.Get().WithFields(logrus.Fields{
+        "request_id": string(p.RequestID),
+        "reason":     p.Reason,
+        "session_id": getSessionID(req.session),
+    }).Info("MCP request cancelled by client")
+    return nil, nil
+}
+
+func init() {
+    registerMCPMethod("notifications/cancelled", handleCancelled)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/TykTechnologies/tyk/user"
+)
+
+// useSlowEchoTool is useEchoTool with an upstream that only answers once
+// the call gives up
+func useSlowEchoTool(t *testing.T) MCPTool {
+    t.Helper()
+    var status atomic.Int32
+    useEchoTool(t, &status)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        <-r.Context().Done()
+    }))
+    t.Cleanup(server.Close)
+    t.Setenv("TYK_GATEWAY_URL", server.URL)
+
+    tool, _ := currentState().resolveTool("echo_items", "")
+    return tool
+}
+
+func TestToolTimeout(t *testing.T) {
+    useConfig(t, func(cfg *MCPConfig) { cfg.ToolTimeouts.Tools["tyk_api_analytics"] = "soon" })
+
+    tests := []struct {
+        tool string
+        want time.Duration
+    }{
+        {tool: "sentraip_threat_check", want: 30 * time.Second},
+        {tool: "sentraip_bulk_threat_check", want: 2 * time.Minute},
+        {tool: "tyk_api_analytics", want: 30 * time.Second},
+    }
+
+    for _, tt := range tests {
+        if got := toolTimeout(tt.tool); got != tt.want {
+            t.Errorf("toolTimeout(%s) = %v, want %v", tt.tool, got, tt.want)
+        }
+    }
+}
+
+func TestContextToolError(t *testing.T) {
+    tests := []struct {
+        name       string
+        stop       func() context.Context
+        wantCode   string
+        wantReason string
+    }{
+        {
+            name: "deadline",
+            stop: func() context.Context {
+                ctx, cancel := context.WithTimeout(context.Background(), 0)
+                t.Cleanup(cancel)
+                return ctx
+            },
+            wantCode: toolErrorTimeout,
+        },
+        {
+            name: "disconnect",
+            stop: func() context.Context {
+                ctx, cancel := context.WithCancel(context.Background())
+                cancel()
+                return ctx
+            },
+            wantCode:   toolErrorCancelled,
+            wantReason: "client disconnected",
+        },
+        {
+            name: "cancel notification",
+            stop: func() context.Context {
+                ctx, cancel := context.WithCancelCause(context.Background())
+                cancel(errors.New("cancelled by the client: user aborted"))
+                return ctx
+            },
+            wantCode:   toolErrorCancelled,
+            wantReason: "cancelled by the client: user aborted",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            toolErr := contextToolError(tt.stop(), "sentraip_threat_check", time.Second)
+            if toolErr.Code != tt.wantCode {
+                t.Fatalf("code %s, want %s", toolErr.Code, tt.wantCode)
+            }
+            if tt.wantReason != "" && toolErr.Details.(map[string]interface{})["reason"] != tt.wantReason {
+                t.Fatalf("reason %v, want %q", toolErr.Details.(map[string]interface{})["reason"], tt.wantReason)
+            }
+        })
+    }
+}
+
+func TestInvokeToolTimeout(t *testing.T) {
+    tool := useSlowEchoTool(t)
+    currentConfig().ToolTimeouts.Tools["echo_items"] = "50ms"
+    r := httptest.NewRequest(http.MethodPost, "/mcp", nil)
+
+    result := invokeTool(context.Background(), r, &user.SessionState{Alias: "ann"}, tool, map[string]interface{}{"q": "a"})
+    toolErr, ok := resultError(result)
+    if !ok || toolErr.Code != toolErrorTimeout || toolErr.Details.(map[string]interface{})["timeout"] != "50ms" {
+        t.Fatalf("result %+v, want a 50ms timeout", result.StructuredContent)
+    }
+}
+
+func TestHandleCancelled(t *testing.T) {
+    useConfig(t, nil)
+    ann := mcpCaller{ID: "ann"}
+    session := newMCPSession(ann, nil)
+    other := newMCPSession(ann, nil)
+    t.Cleanup(func() {
+        deleteMCPSession(session.ID)
+        deleteMCPSession(other.ID)
+    })
+
+    tests := []struct {
+        name string
+        // running is the request being served, cancelling sends the
+        // notification
+        running    *mcpRequest
+        cancelling *mcpRequest
+        params     string
+        wantCause  string
+    }{
+        {
+            name:       "same session",
+            running:    &mcpRequest{caller: ann, mcpSession: session},
+            cancelling: &mcpRequest{caller: ann, mcpSession: session},
+            params:     `{"requestId": 7, "reason": "user aborted"}`,
+            wantCause:  "cancelled by the client: user aborted",
+        },
+        {
+            name:       "same caller without a session",
+            running:    &mcpRequest{caller: ann},
+            cancelling: &mcpRequest{caller: ann},
+            params:     `{"requestId": 7}`,
+            wantCause:  "cancelled by the client",
+        },
+        {
+            name:       "other session",
+            running:    &mcpRequest{caller: ann, mcpSession: session},
+            cancelling: &mcpRequest{caller: ann, mcpSession: other},
+            params:     `{"requestId": 7}`,
+        },
+        {
+            name:       "other request",
+            running:    &mcpRequest{caller: ann, mcpSession: session},
+            cancelling: &mcpRequest{caller: ann, mcpSession: session},
+            params:     `{"requestId": "7"}`,
+        },
+        {
+            name:       "anonymous",
+            running:    &mcpRequest{},
+            cancelling: &mcpRequest{},
+            params:     `{"requestId": 7}`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tt.running.r = httptest.NewRequest(http.MethodPost, "/mcp", nil)
+            ctx, done := trackRequest(tt.running, json.RawMessage(" 7 "))
+            defer done()
+
+            if _, rpcErr := handleCancelled(tt.cancelling, json.RawMessage(tt.params)); rpcErr != nil {
+                t.Fatal(rpcErr)
+            }
+            if tt.wantCause == "" {
+                if ctx.Err() != nil {
+                    t.Fatalf("request cancelled by %s", tt.params)
+                }
+                return
+            }
+            if cause := context.Cause(ctx); cause == nil || cause.Error() != tt.wantCause {
+                t.Fatalf("cause %v, want %q", cause, tt.wantCause)
+            }
+        })
+    }
+
+    inflightRequests.Lock()
+    defer inflightRequests.Unlock()
+    if len(inflightRequests.byKey) != 0 {
+        t.Fatalf("%d requests still tracked after they were served", len(inflightRequests.byKey))
+    }
+}
+
+func TestCancelRunningTool(t *testing.T) {
+    tool := useSlowEchoTool(t)
+    ann := &user.SessionState{Alias: "ann"}
+    req := &mcpRequest{r: httptest.NewRequest(http.MethodPost, "/mcp", nil), caller: callerFromSession(ann)}
+    ctx, done := trackRequest(req, json.RawMessage(`"call-1"`))
+    defer done()
+
+    results := make(chan ToolResult, 1)
+    go func() { results <- invokeTool(ctx, req.r, ann, tool, map[string]interface{}{"q": "a"}) }()
+    time.Sleep(20 * time.Millisecond)
+    handleCancelled(req, json.RawMessage(`{"requestId": "call-1", "reason": "wrong target"}`))
+
+    select {
+    case result := <-results:
+        toolErr, ok := resultError(result)
+        if !ok || toolErr.Code != toolErrorCancelled || !strings.HasSuffix(toolErr.Message, "wrong target") {
+            t.Fatalf("result %+v, want it cancelled", result.StructuredContent)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("the tool call kept running after it was cancelled")
+    }
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "gopkg.in/yaml.v3"
+)
+
+// MCPConfig is the tools plugin configuration, read from the file named by
+// MCP_CONFIG_FILE (JSON or YAML). Every section is optional.
+type MCPConfig struct {
+    // AppsPath is the Tyk app_path holding API definitions
+    AppsPath  string          `json:"apps_path"`
+    Redis     RedisConfig     `json:"redis"`
+    SentraIP  SentraIPConfig  `json:"sentraip"`
+    Blocking  BlockingConfig  `json:"blocking"`
+    Blocklist BlocklistConfig `json:"blocklist"`
+    Audit     AuditConfig     `json:"audit"`
+    Approvals ApprovalsConfig `json:"approvals"`
+    Jobs      JobsConfig      `json:"jobs"`
+    // RateLimits budgets tool calls per caller
+    RateLimits RateLimitsConfig `json:"rate_limits"`
+    ToolAccess ToolAccessConfig `json:"tool_access"`
+    // ToolTimeouts are the deadlines tool calls run with
+    ToolTimeouts ToolTimeoutsConfig `json:"tool_timeouts"`
+    Idempotency  IdempotencyConfig  `json:"idempotency"`
+    // Output redacts and bounds tool results returned to the LLM
+    Output    OutputConfig    `json:"output"`
+    Analytics AnalyticsConfig `json:"analytics"`
+    // Conversations configures the store searched by claude_context_search
+    Conversations ConversationsConfig `json:"conversations"`
+    Resources     ResourcesConfig     `json:"resources"`
+    // Prompts are the MCP prompt templates offered by prompts/list
+    Prompts []PromptConfig `json:"prompts"`
+    // Reload controls reloading this file and the OpenAPI sources at runtime
+    Reload ReloadConfig `json:"reload"`
+    // Federation lists upstream MCP servers whose tools are served too
+    Federation FederationConfig `json:"federation"`
+    // TrustedProxies are the addresses and CIDR blocks of the proxies in
+    // front of the gateway. X-Forwarded-For and X-Real-IP are only believed
+    // when they come from one of them (see getClientIP).
+    TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// ResourcesConfig controls the MCP resources exposed by the plugin
+type ResourcesConfig struct {
+    // PollInterval is how often subscribed resources are re-read to detect changes
+    PollInterval string `json:"poll_interval"`
+    // Access rules are checked in order; the first rule whose URI pattern
+    // matches decides which roles may read or subscribe to the resource
+    Access []AccessRule `json:"access"`
+}
+
+// AccessRule restricts URIs (or names) matching a '*' wildcard pattern to
+// callers holding at least one of Roles. An empty Roles list allows any
+// authenticated caller.
+type AccessRule struct {
+    URI   string   `json:"uri"`
+    Roles []string `json:"roles"`
+}
+
+var wildcardCache sync.Map
+
+func defaultMCPConfig() MCPConfig {
+    return MCPConfig{
+        AppsPath: "/opt/tyk-gateway/apps",
+        Redis:    defaultRedisConfig(),
+        SentraIP: SentraIPConfig{
+            BulkMaxTargets:    100,
+            BulkWorkers:       8,
+            BulkTargetTimeout: "10s",
+            BulkMaxCIDRHosts:  256,
+            Cache: ThreatCacheConfig{
+                Enabled:         true,
+                MaxEntries:      10000,
+                Redis:           true,
+                HighRiskScore:   7,
+                MediumRiskScore: 4,
+                HighRiskTTL:     "6h",
+                MediumRiskTTL:   "1h",
+                LowRiskTTL:      "30m",
+                UnscoredTTL:     "5m",
+                StaleFor:        "10m",
+            },
+            Upstream: UpstreamConfig{
+                MaxAttempts:      3,
+                BaseDelay:        "200ms",
+                MaxDelay:         "5s",
+                MaxRetryAfter:    "10s",
+                FailureThreshold: 5,
+                OpenFor:          "30s",
+                HalfOpenProbes:   1,
+            },
+        },
+        Blocking: BlockingConfig{
+            Enabled:        true,
+            DenyScore:      8,
+            ChallengeScore: 5,
+            DenyTypes:      []string{"botnet", "c2"},
+            FailMode:       "open",
+            VerdictTTL:     "5m",
+            MaxVerdicts:    50000,
+            LookupTimeout:  "5s",
+            StaleFor:       "10m",
+            OutageFor:      "30s",
+        },
+        Blocklist: BlocklistConfig{
+            Roles:        []string{"admin", "responder"},
+            DefaultTTL:   "24h",
+            MaxTTL:       "720h",
+            SyncInterval: "5s",
+        },
+        Audit: AuditConfig{
+            Stream: "mcp-audit",
+            MaxLen: 100000,
+        },
+        Approvals: ApprovalsConfig{
+            Roles:     []string{"admin", "approver"},
+            TTL:       "24h",
+            Retention: "168h",
+        },
+        Jobs: JobsConfig{
+            Timeout:         "15m",
+            Retention:       "24h",
+            CleanupInterval: "1m",
+        },
+        RateLimits: RateLimitsConfig{
+            Enabled: true,
+            Default: ToolLimit{Per: "user", Rate: 120, Window: "1m"},
+            Tools: map[string]ToolLimit{
+                "sentraip_threat_check":      {Per: "user", Rate: 30, Window: "1m", Daily: 2000},
+                "sentraip_bulk_threat_check": {Per: "user", Rate: 5, Window: "1m", Daily: 200},
+            },
+        },
+        ToolAccess: ToolAccessConfig{
+            Default:         "allow",
+            ExternalDefault: "deny",
+            Rules: []ToolAccessRule{
+                {Tools: []string{"gateway_*"}, Roles: []string{"admin", "responder"}},
+            },
+        },
+        ToolTimeouts: ToolTimeoutsConfig{
+            Default: "30s",
+            Tools: map[string]string{
+                "sentraip_bulk_threat_check": "120s",
+            },
+        },
+        Idempotency: IdempotencyConfig{
+            Window: "24h",
+        },
+        Output: OutputConfig{
+            Default: OutputPolicy{
+                Detectors: []string{"api_key", "token"},
+                MaxTokens: 25000,
+            },
+            Tools: map[string]OutputPolicy{
+                "sentraip_*": {
+                    Detectors: []string{"email", "api_key", "token"},
+                    MaxTokens: 25000,
+                },
+            },
+        },
+        Analytics: AnalyticsConfig{
+            Store:          "redis",
+            Keys:           []string{"analytics-tyk-system-analytics"},
+            RollupInterval: "5s",
+            Retention:      "744h",
+        },
+        Conversations: ConversationsConfig{
+            Stream:    "mcp-conversations",
+            Retention: "720h",
+        },
+        Reload: ReloadConfig{
+            Watch:         true,
+            WatchInterval: "10s",
+            Roles:         []string{"admin"},
+        },
+        Federation: FederationConfig{
+            Upstream: UpstreamConfig{
+                MaxAttempts:      1,
+                MaxRetryAfter:    "10s",
+                FailureThreshold: 5,
+                OpenFor:          "30s",
+                HalfOpenProbes:   1,
+            },
+        },
+        Resources: ResourcesConfig{
+            PollInterval: "60s",
+            Access: []AccessRule{
+                {URI: "tyk://api/*/definition", Roles: []string{"admin"}},
+                {URI: "*", Roles: nil},
+            },
+        },
+        TrustedProxies: []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+    }
+}
+
+// loadMCPConfig reads the config file over the defaults. A missing file is
+// not an error: the defaults are used.
+func loadMCPConfig(path string) (MCPConfig, error) {
+    cfg := defaultMCPConfig()
+    if path == "" {
+        return cfg, nil
+    }
+
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return cfg, nil
+    }
+    if err != nil {
+        return cfg, err
+    }
+
+    if err := decodeConfigDocument(data, path, &cfg); err != nil {
+        return cfg, fmt.Errorf("invalid MCP config %s: %w", path, err)
+    }
+    if err := validatePrompts(cfg.Prompts, cfg.Approvals); err != nil {
+        return defaultMCPConfig(), fmt.Errorf("invalid MCP config %s: %w", path, err)
+    }
+    return cfg, nil
+}
+
+// decodeConfigDocument decodes JSON, or YAML when the file extension says
+// so, using the json tags of v
+func decodeConfigDocument(data []byte, path string, v interface{}) error {
+    ext := strings.ToLower(filepath.Ext(path))
+    if ext == ".yaml" || ext == ".yml" {
+        var raw interface{}
+        if err := yaml.Unmarshal(data, &raw); err != nil {
+            return err
+        }
+        converted, err := json.Marshal(raw)
+        if err != nil {
+            return err
+        }
+        data = converted
+    }
+    return json.Unmarshal(data, v)
+}
+
+// durationOr parses a Go duration string, falling back to def when it is
+// empty or invalid
+func durationOr(value string, def time.Duration) time.Duration {
+    if value == "" {
+        return def
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil || d <= 0 {
+        log.Get().WithField("value", value).Warn("Invalid duration in MCP config, using default")
+        return def
+    }
+    return d
+}
+
+// accessAllowed applies the first matching access rule to caller
+func accessAllowed(rules []AccessRule, target string, caller mcpCaller) bool {
+    for _, rule := range rules {
+        if !wildcardMatch(rule.URI, target) {
+            continue
+        }
+        if caller.Anonymous() {
+            return false
+        }
+        return len(rule.Roles) == 0 || caller.HasAnyRole(rule.Roles...)
+    }
+    return false
+}
+
+// wildcardMatch reports whether s matches pattern, where '*' matches any
+// run of characters (including '/')
+func wildcardMatch(pattern, s string) bool {
+    if pattern == "*" {
+        return true
+    }
+    var re *regexp.Regexp
+    if cached, ok := wildcardCache.Load(pattern); ok {
+        re = cached.(*regexp.Regexp)
+    } else {
+        parts := strings.Split(pattern, "*")
+        for i, part := range parts {
+            parts[i] = regexp.QuoteMeta(part)
+        }
+        re = regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+        wildcardCache.Store(pattern, re)
+    }
+    return re.MatchString(s)
+}
+
+func getEnv(key, defaultValue string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return defaultValue
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/redis/go-redis/v9"
+    "github.com/sirupsen/logrus"
+)
+
+// ConversationsConfig controls the conversation store behind
+// claude_context_search
+type ConversationsConfig struct {
+    // Stream is the Redis stream the OTEL enhancer publishes Claude turns to
+    Stream string `json:"stream"`
+    // Retention is how long messages stay searchable
+    Retention string `json:"retention"`
+}
+
+const (
+    bm25K1 = 1.2
+    bm25B  = 0.75
+
+    snippetRadius = 80
+)
+
+var searchStopWords = map[string]bool{
+    "a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+    "for": true, "from": true, "in": true, "is": true, "it": true, "of": true, "on": true, "or": true,
+    "that": true, "the": true, "this": true, "to": true, "was": true, "with": true,
+}
+
+// conversationMessage is one captured turn of a Claude conversation
+type conversationMessage struct {
+    ID             string
+    ConversationID string
+    UserID         string
+    Role           string
+    Text           string
+    Tools          []string
+    Timestamp      time.Time
+
+    terms  map[string]int
+    length int
+}
+
+// conversationIndex is the BM25 full-text index of one user's messages.
+// Every user has their own index, so term statistics and results never
+// mix conversations of different users.
+type conversationIndex struct {
+    docs     map[string]*conversationMessage
+    postings map[string]map[string]int
+    totalLen int
+}
+
+// conversationStore holds the per-user indexes, fed from the Redis stream
+type conversationStore struct {
+    mu     sync.RWMutex
+    users  map[string]*conversationIndex
+    lastID string
+}
+
+var conversations = &conversationStore{users: map[string]*conversationIndex{}}
+
+// searchFilter narrows a search beyond the query terms
+type searchFilter struct {
+    UserID string
+    Since  time.Time
+    Until  time.Time
+    Tool   string
+}
+
+type searchHit struct {
+    Message   *conversationMessage
+    Score     float64
+    Snippet   string
+    MatchedOn []string
+}
+
+// tokenize lower-cases text and splits it into terms. Dots, dashes and
+// underscores inside a term are kept so IPs, domains and tool names stay
+// searchable as one term.
+func tokenize(text string) []string {
+    fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '-' && r != '_'
+    })
+
+    terms := make([]string, 0, len(fields))
+    for _, f := range fields {
+        f = strings.Trim(f, ".-_")
+        if f == "" || searchStopWords[f] {
+            continue
+        }
+        terms = append(terms, f)
+    }
+    return terms
+}
+
+func (s *conversationStore) add(msg *conversationMessage) {
+    msg.terms = map[string]int{}
+    for _, term := range tokenize(msg.Text) {
+        msg.terms[term]++
+        msg.length++
+    }
+    for _, tool := range msg.Tools {
+        msg.terms[strings.ToLower(tool)]++
+        msg.length++
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    idx, ok := s.users[msg.UserID]
+    if !ok {
+        idx = &conversationIndex{docs: map[string]*conversationMessage{}, postings: map[string]map[string]int{}}
+        s.users[msg.UserID] = idx
+    }
+    if _, exists := idx.docs[msg.ID]; exists {
+        return
+    }
+    idx.docs[msg.ID] = msg
+    idx.totalLen += msg.length
+    for term, tf := range msg.terms {
+        if idx.postings[term] == nil {
+            idx.postings[term] = map[string]int{}
+        }
+        idx.postings[term][msg.ID] = tf
+    }
+}
+
+// purge drops every message older than cutoff and returns how many went
+func (s *conversationStore) purge(cutoff time.Time) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    purged := 0
+    for userID, idx := range s.users {
+        for id, msg := range idx.docs {
+            if !msg.Timestamp.Before(cutoff) {
+                continue
+            }
+            for term := range msg.terms {
+                delete(idx.postings[term], id)
+                if len(idx.postings[term]) == 0 {
+                    delete(idx.postings, term)
+                }
+            }
+            idx.totalLen -= msg.length
+            delete(idx.docs, id)
+            purged++
+        }
+        if len(idx.docs) == 0 {
+            delete(s.users, userID)
+        }
+    }
+    return purged
+}
+
+// search ranks filter.UserID's messages against query with BM25
+func (s *conversationStore) search(query string, filter searchFilter, limit int) ([]searchHit, int) {
+    queryTerms := tokenize(query)
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    idx, ok := s.users[filter.UserID]
+    if !ok || len(queryTerms) == 0 {
+        return nil, 0
+    }
+
+    n := float64(len(idx.docs))
+    avgLen := float64(idx.totalLen) / n
+    scores := map[string]float64{}
+    matched := map[string][]string{}
+    seen := map[string]bool{}
+
+    for _, term := range queryTerms {
+        if seen[term] {
+            continue
+        }
+        seen[term] = true
+
+        postings := idx.postings[term]
+        df := float64(len(postings))
+        if df == 0 {
+            continue
+        }
+        idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+        for id, tf := range postings {
+            msg := idx.docs[id]
+            if !filter.matches(msg) {
+                continue
+            }
+            f := float64(tf)
+            scores[id] += idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*float64(msg.length)/avgLen))
+            matched[id] = append(matched[id], term)
+        }
+    }
+
+    hits := make([]searchHit, 0, len(scores))
+    for id, score := range scores {
+        hits = append(hits, searchHit{Message: idx.docs[id], Score: score, MatchedOn: matched[id]})
+    }
+    sort.Slice(hits, func(i, j int) bool {
+        if hits[i].Score != hits[j].Score {
+            return hits[i].Score > hits[j].Score
+        }
+        return hits[i].Message.Timestamp.After(hits[j].Message.Timestamp)
+    })
+
+    total := len(hits)
+    if len(hits) > limit {
+        hits = hits[:limit]
+    }
+    for i := range hits {
+        hits[i].Snippet = highlightSnippet(hits[i].Message.Text, hits[i].MatchedOn)
+    }
+    return hits, total
+}
+
+func (f searchFilter) matches(msg *conversationMessage) bool {
+    if !f.Since.IsZero() && msg.Timestamp.Before(f.Since) {
+        return false
+    }
+    if !f.Until.IsZero() && msg.Timestamp.After(f.Until) {
+        return false
+    }
+    if f.Tool != "" {
+        for _, tool := range msg.Tools {
+            if strings.EqualFold(tool, f.Tool) {
+                return true
+            }
+        }
+        return false
+    }
+    return true
+}
+
+// highlightSnippet cuts a window of text around the first matched term and
+// wraps every matched term in the window in ** markers
+func highlightSnippet(text string, terms []string) string {
+    want := map[string]bool{}
+    for _, t := range terms {
+        want[t] = true
+    }
+
+    type span struct{ start, end int }
+    var spans []span
+    start := -1
+    for i, r := range text + " " {
+        inWord := unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_'
+        if inWord && start < 0 {
+            start = i
+        }
+        if !inWord && start >= 0 {
+            word := text[start:i]
+            trimmedStart := start + len(word) - len(strings.TrimLeft(word, ".-_"))
+            word = strings.Trim(word, ".-_")
+            if want[strings.ToLower(word)] {
+                spans = append(spans, span{trimmedStart, trimmedStart + len(word)})
+            }
+            start = -1
+        }
+    }
+
+    from, to := 0, len(text)
+    if len(spans) > 0 {
+        from = spans[0].start - snippetRadius
+        to = spans[0].end + snippetRadius
+    } else {
+        to = 2 * snippetRadius
+    }
+    if from < 0 {
+        from = 0
+    }
+    if to > len(text) {
+        to = len(text)
+    }
+    for from > 0 && !utf8Start(text[from]) {
+        from--
+    }
+    for to < len(text) && !utf8Start(text[to]) {
+        to++
+    }
+
+    var b strings.Builder
+    if from > 0 {
+        b.WriteString("…")
+    }
+    pos := from
+    for _, sp := range spans {
+        if sp.start < from || sp.end > to {
+            continue
+        }
+        b.WriteString(text[pos:sp.start])
+        b.WriteString("**" + text[sp.start:sp.end] + "**")
+        pos = sp.end
+    }
+    b.WriteString(text[pos:to])
+    if to < len(text) {
+        b.WriteString("…")
+    }
+    return b.String()
+}
+
+func utf8Start(b byte) bool {
+    return b&0xC0 != 0x80
+}
+
+// consumeConversations replays the stream from the retention cutoff, then
+// tails it for new turns and periodically enforces retention
+func consumeConversations() {
+    lastPurge := time.Time{}
+    for {
+        cfg := currentConfig().Conversations
+        retention := durationOr(cfg.Retention, 30*24*time.Hour)
+        client := redisClient()
+
+        if time.Since(lastPurge) > time.Hour {
+            cutoff := time.Now().Add(-retention)
+            ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+            err := client.XTrimMinID(ctx, cfg.Stream, fmt.Sprintf("%d-0", cutoff.UnixMilli())).Err()
+            cancel()
+            if err != nil {
+                log.Get().WithError(err).Warn("Failed to trim conversation stream")
+            }
+            if purged := conversations.purge(cutoff); purged > 0 {
+                log.Get().WithField("messages", purged).Info("Purged expired conversation messages")
+            }
+            lastPurge = time.Now()
+        }
+
+        conversations.mu.RLock()
+        from := conversations.lastID
+        conversations.mu.RUnlock()
+        if from == "" {
+            from = fmt.Sprintf("%d-0", time.Now().Add(-retention).UnixMilli())
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        streams, err := client.XRead(ctx, &redis.XReadArgs{
+            Streams: []string{cfg.Stream, from},
+            Count:   1000,
+            Block:   5 * time.Second,
+        }).Result()
+        cancel()
+        if err != nil && err != redis.Nil {
+            log.Get().WithError(err).Warn("Failed to read conversation stream")
+            time.Sleep(5 * time.Second)
+            continue
+        }
+
+        for _, stream := range streams {
+            for _, entry := range stream.Messages {
+                if msg := messageFromStream(entry); msg != nil {
+                    conversations.add(msg)
+                }
+                conversations.mu.Lock()
+                conversations.lastID = entry.ID
+                conversations.mu.Unlock()
+            }
+        }
+    }
+}
+
+func messageFromStream(entry redis.XMessage) *conversationMessage {
+    field := func(name string) string {
+        value, _ := entry.Values[name].(string)
+        return value
+    }
+
+    msg := &conversationMessage{
+        ID:             entry.ID,
+        ConversationID: field("conversation_id"),
+        UserID:         field("user_id"),
+        Role:           field("role"),
+        Text:           field("text"),
+    }
+    if msg.UserID == "" || msg.ConversationID == "" {
+        return nil
+    }
+    if tools := field("tools"); tools != "" {
+        msg.Tools = strings.Split(tools, ",")
+    }
+
+    ts, err := time.Parse(time.RFC3339Nano, field("timestamp"))
+    if err != nil {
+        log.Get().WithFields(logrus.Fields{"entry_id": entry.ID}).Debug("Conversation entry without a valid timestamp")
+        ts = time.Now()
+    }
+    msg.Timestamp = ts
+    return msg
+}
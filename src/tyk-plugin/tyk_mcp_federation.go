@@ -0,0 +1,1219 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "net/url"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
+    "github.com/sirupsen/logrus"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// FederationConfig lists the upstream MCP servers whose tools the gateway
+// serves alongside its own
+type FederationConfig struct {
+    Servers []FederatedServerConfig `json:"servers"`
+    // Upstream is the circuit breaker of requests to the servers. Tool
+    // calls are POSTs and so are never retried.
+    Upstream UpstreamConfig `json:"upstream"`
+}
+
+// FederatedServerConfig is one upstream MCP server
+type FederatedServerConfig struct {
+    // Name identifies the server in logs, audit events and /mcp/health
+    Name string `json:"name"`
+    // URL is the server's MCP endpoint, or its event stream for the sse
+    // transport
+    URL string `json:"url"`
+    // Transport is streamable_http (the default) or sse, the HTTP+SSE
+    // transport of protocol version 2024-11-05
+    Transport string `json:"transport"`
+    // Prefix namespaces the server's tools as <prefix>_<tool>; it defaults
+    // to Name
+    Prefix string `json:"prefix"`
+    // Headers are sent with every request, typically the server's
+    // credentials. ${VAR} in a value is read from the environment.
+    Headers map[string]string `json:"headers"`
+    // ForwardCaller sends the caller's ID and roles to the server as
+    // X-MCP-Caller-ID and X-MCP-Caller-Roles
+    ForwardCaller bool `json:"forward_caller"`
+    // Tools limits which of the server's tools are served, as '*'
+    // wildcard patterns of upstream names. Empty serves all of them.
+    Tools []string `json:"tools"`
+    // RefreshInterval is how often the server's tool list is fetched again
+    RefreshInterval string `json:"refresh_interval"`
+}
+
+const (
+    federationStreamableHTTP = "streamable_http"
+    federationSSE            = "sse"
+
+    // federationMaxPages bounds paging through an upstream tools/list
+    federationMaxPages = 50
+    // federationMaxMessage bounds one message read from an upstream server
+    federationMaxMessage = 16 << 20
+)
+
+// federatedTool is where calls to a federated tool are sent
+type federatedTool struct {
+    Server string
+    // Tool is the tool's name on the upstream server
+    Tool string
+}
+
+var (
+    // federationClient sends messages to upstream MCP servers through a
+    // circuit breaker per host
+    federationClient = newResilientClient("federation", func() UpstreamConfig { return currentConfig().Federation.Upstream })
+
+    // federationStreamClient holds SSE streams open; they have no deadline
+    federationStreamClient = &http.Client{}
+
+    federationTracer = otel.Tracer("tyk-mcp-gateway")
+
+    // federation holds the configured servers by name
+    federation = struct {
+        sync.Mutex
+        servers map[string]*federatedServer
+    }{servers: map[string]*federatedServer{}}
+
+    errUpstreamSessionExpired = errors.New("upstream MCP session expired")
+    errUpstreamStreamClosed   = errors.New("upstream MCP event stream closed")
+)
+
+// federatedServer is a configured upstream server: its connection and the
+// tools it last listed
+type federatedServer struct {
+    config FederatedServerConfig
+    conn   mcpUpstream
+    stop   context.CancelFunc
+    // refresh asks for the tools to be listed again now
+    refresh chan struct{}
+
+    mu        sync.Mutex
+    tools     []MCPTool
+    listedAt  time.Time
+    lastError string
+}
+
+// mcpUpstream is a client connection to an upstream MCP server. It
+// initializes the MCP session on first use and again when the server loses
+// it.
+type mcpUpstream interface {
+    // request sends a JSON-RPC request and returns its result. Progress the
+    // server reports while answering is passed to onProgress, when set.
+    request(ctx context.Context, method string, params map[string]interface{}, header http.Header, onProgress func(json.RawMessage)) (json.RawMessage, error)
+    close()
+}
+
+// upstreamMessage is any JSON-RPC message received from an upstream server
+type upstreamMessage struct {
+    ID     json.RawMessage `json:"id,omitempty"`
+    Method string          `json:"method,omitempty"`
+    Params json.RawMessage `json:"params,omitempty"`
+    Result json.RawMessage `json:"result,omitempty"`
+    Error  *jsonRPCError   `json:"error,omitempty"`
+}
+
+func (m upstreamMessage) result() (json.RawMessage, error) {
+    if m.Error != nil {
+        return nil, m.Error
+    }
+    return m.Result, nil
+}
+
+// federationPrefix is the namespace of a server's tools
+func federationPrefix(server FederatedServerConfig) string {
+    if server.Prefix != "" {
+        return server.Prefix
+    }
+    return server.Name
+}
+
+// federatedToolName is the name a server's tool is served under
+func federatedToolName(server FederatedServerConfig, upstreamName string) string {
+    return federationPrefix(server) + "_" + strings.Trim(toolNameCleaner.ReplaceAllString(upstreamName, "_"), "_")
+}
+
+func federatedToolAllowed(server FederatedServerConfig, upstreamName string) bool {
+    if len(server.Tools) == 0 {
+        return true
+    }
+    for _, pattern := range server.Tools {
+        if wildcardMatch(pattern, upstreamName) {
+            return true
+        }
+    }
+    return false
+}
+
+// validateFederation checks that servers can be told apart and reached
+func validateFederation(cfg FederationConfig) error {
+    names := map[string]bool{}
+    prefixes := map[string]bool{}
+    for i, server := range cfg.Servers {
+        if server.Name == "" {
+            return fmt.Errorf("federation.servers[%d]: name is required", i)
+        }
+        if names[server.Name] {
+            return fmt.Errorf("federation.servers: duplicate server %s", server.Name)
+        }
+        names[server.Name] = true
+
+        u, err := url.Parse(server.URL)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return fmt.Errorf("federation.servers.%s: url must be an http or https URL", server.Name)
+        }
+        switch server.Transport {
+        case "", federationStreamableHTTP, federationSSE:
+        default:
+            return fmt.Errorf("federation.servers.%s: transport must be streamable_http or sse, got %q", server.Name, server.Transport)
+        }
+        prefix := federationPrefix(server)
+        if toolNameCleaner.MatchString(prefix) {
+            return fmt.Errorf("federation.servers.%s: prefix %q may only hold letters, digits, _ and -", server.Name, prefix)
+        }
+        if prefixes[prefix] {
+            return fmt.Errorf("federation.servers.%s: prefix %s is used by another server", server.Name, prefix)
+        }
+        prefixes[prefix] = true
+    }
+    return nil
+}
+
+// syncFederation connects to servers added to the config and disconnects
+// from removed or changed ones. It returns without waiting for them.
+func syncFederation(servers []FederatedServerConfig) {
+    federation.Lock()
+    defer federation.Unlock()
+
+    wanted := map[string]FederatedServerConfig{}
+    for _, server := range servers {
+        wanted[server.Name] = server
+    }
+    for name, fs := range federation.servers {
+        if server, ok := wanted[name]; !ok || !reflect.DeepEqual(server, fs.config) {
+            fs.stop()
+            delete(federation.servers, name)
+        }
+    }
+    for _, server := range servers {
+        if _, ok := federation.servers[server.Name]; ok {
+            continue
+        }
+        fs := newFederatedServer(server)
+        ctx, cancel := context.WithCancel(context.Background())
+        fs.stop = cancel
+        federation.servers[server.Name] = fs
+        go fs.run(ctx)
+    }
+}
+
+func federatedServerNamed(name string) *federatedServer {
+    federation.Lock()
+    defer federation.Unlock()
+    return federation.servers[name]
+}
+
+func newFederatedServer(server FederatedServerConfig) *federatedServer {
+    fs := &federatedServer{config: server, refresh: make(chan struct{}, 1)}
+    listChanged := func() {
+        select {
+        case fs.refresh <- struct{}{}:
+        default:
+        }
+    }
+    if server.Transport == federationSSE {
+        fs.conn = &sseUpstream{server: server, onListChanged: listChanged, pending: map[string]*sseCall{}}
+    } else {
+        fs.conn = &streamableUpstream{server: server, onListChanged: listChanged}
+    }
+    return fs
+}
+
+// run keeps the server's tool list current until ctx is done. A failed
+// listing is retried sooner than the refresh interval, backing off.
+func (fs *federatedServer) run(ctx context.Context) {
+    defer fs.conn.close()
+    interval := durationOr(fs.config.RefreshInterval, 5*time.Minute)
+    failures := 0
+    for {
+        wait := interval
+        if err := fs.listTools(ctx); err != nil && ctx.Err() == nil {
+            failures++
+            log.Get().WithError(err).WithField("server", fs.config.Name).Warn("Failed to list federated MCP tools")
+            if retry := (5 * time.Second) << min(failures-1, 6); retry < wait {
+                wait = retry
+            }
+        } else {
+            failures = 0
+        }
+
+        timer := time.NewTimer(wait)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return
+        case <-fs.refresh:
+            timer.Stop()
+        case <-timer.C:
+        }
+    }
+}
+
+// listTools fetches the server's tools, following pagination, and serves
+// them. The last listing stays in use when it fails.
+func (fs *federatedServer) listTools(ctx context.Context) error {
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+
+    var tools []MCPTool
+    cursor := ""
+    for page := 0; page < federationMaxPages; page++ {
+        params := map[string]interface{}{}
+        if cursor != "" {
+            params["cursor"] = cursor
+        }
+        raw, err := fs.conn.request(ctx, "tools/list", params, nil, nil)
+        if err == nil {
+            var listing struct {
+                Tools      []json.RawMessage `json:"tools"`
+                NextCursor string            `json:"nextCursor"`
+            }
+            if err = json.Unmarshal(raw, &listing); err == nil {
+                tools = append(tools, fs.decodeTools(listing.Tools)...)
+                cursor = listing.NextCursor
+            }
+        }
+        if err != nil {
+            fs.mu.Lock()
+            fs.lastError = err.Error()
+            fs.mu.Unlock()
+            return err
+        }
+        if cursor == "" {
+            break
+        }
+    }
+
+    fs.mu.Lock()
+    fs.tools = tools
+    fs.listedAt = time.Now()
+    fs.lastError = ""
+    fs.mu.Unlock()
+
+    applyFederatedTools()
+    return nil
+}
+
+// decodeTools reads a page of tools/list. A tool the gateway cannot read
+// is skipped on its own rather than failing the whole listing.
+func (fs *federatedServer) decodeTools(raw []json.RawMessage) []MCPTool {
+    tools := make([]MCPTool, 0, len(raw))
+    for _, entry := range raw {
+        var tool MCPTool
+        if err := json.Unmarshal(entry, &tool); err != nil {
+            var named struct {
+                Name string `json:"name"`
+            }
+            json.Unmarshal(entry, &named)
+            log.Get().WithError(err).WithFields(logrus.Fields{
+                "server":    fs.config.Name,
+                "tool_name": named.Name,
+            }).Warn("Skipping federated MCP tool with an unreadable definition")
+            continue
+        }
+        tools = append(tools, tool)
+    }
+    return tools
+}
+
+// listedTools returns the tools server last listed, if the running
+// connection is for that configuration
+func listedTools(server FederatedServerConfig) ([]MCPTool, bool) {
+    fs := federatedServerNamed(server.Name)
+    if fs == nil || !reflect.DeepEqual(fs.config, server) {
+        return nil, false
+    }
+    fs.mu.Lock()
+    defer fs.mu.Unlock()
+    return fs.tools, fs.tools != nil
+}
+
+// addFederatedTools registers the tools each configured server last
+// listed under the server's prefix. A name already taken is skipped, as
+// are tools without an object input schema.
+func (s *mcpState) addFederatedTools() {
+    s.federated = map[string]federatedTool{}
+    for _, server := range s.config.Federation.Servers {
+        tools, ok := listedTools(server)
+        if !ok {
+            continue
+        }
+        for _, tool := range tools {
+            if !federatedToolAllowed(server, tool.Name) {
+                continue
+            }
+            name := federatedToolName(server, tool.Name)
+            fields := logrus.Fields{"server": server.Name, "upstream_tool": tool.Name, "tool_name": name}
+            if _, taken := s.versions[name]; taken {
+                log.Get().WithFields(fields).Warn("Federated MCP tool name is already taken, skipping")
+                continue
+            }
+            if tool.InputSchema.Type != "object" {
+                log.Get().WithFields(fields).Warn("Federated MCP tool has no object input schema, skipping")
+                continue
+            }
+
+            s.federated[name] = federatedTool{Server: server.Name, Tool: tool.Name}
+            // Gateway metadata is the gateway's to set, not the server's
+            tool.Name = name
+            tool.Version = ""
+            tool.Versions = nil
+            tool.Deprecated = nil
+            tool.RequiresApproval = false
+            tool.Async = false
+            tool.Meta = nil
+            s.register(tool)
+        }
+    }
+}
+
+// withFederatedTools returns a copy of s serving the tools the servers
+// last listed in place of those it has
+func (s *mcpState) withFederatedTools() *mcpState {
+    next := *s
+    next.tools = make(map[string]MCPTool, len(s.tools))
+    next.versions = make(map[string]map[string]MCPTool, len(s.versions))
+    for name, tool := range s.tools {
+        if _, ok := s.federated[name]; !ok {
+            next.tools[name] = tool
+        }
+    }
+    for name, versions := range s.versions {
+        if _, ok := s.federated[name]; ok {
+            continue
+        }
+        copied := make(map[string]MCPTool, len(versions))
+        for version, tool := range versions {
+            copied[version] = tool
+        }
+        next.versions[name] = copied
+    }
+    next.addFederatedTools()
+    return &next
+}
+
+// applyFederatedTools activates a state serving the servers' current tool
+// lists, and tells clients when the listing changed
+func applyFederatedTools() {
+    reloads.Lock()
+    defer reloads.Unlock()
+
+    previous := currentState()
+    next := previous.withFederatedTools()
+    if reflect.DeepEqual(previous.federated, next.federated) && toolListing(previous) == toolListing(next) {
+        return
+    }
+    activeState.Store(next)
+    announceChanges(previous, next)
+    log.Get().WithFields(logrus.Fields{
+        "federated_count": len(next.federated),
+        "tools_count":     len(next.tools),
+    }).Info("Federated MCP tools updated")
+}
+
+// callFederatedTool proxies a tool call to the server the tool came from.
+// Its result is passed through, with structuredContent checked against the
+// tool's output schema and upstream failures reported the gateway's way.
+func callFederatedTool(ctx context.Context, target federatedTool, tool MCPTool, params map[string]interface{}, session *user.SessionState) (ToolResult, error) {
+    ctx, span := federationTracer.Start(ctx, "mcp.federated_call",
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(
+            attribute.String("mcp.tool", tool.Name),
+            attribute.String("mcp.federation.server", target.Server),
+            attribute.String("mcp.federation.tool", target.Tool),
+        ))
+    defer span.End()
+
+    caller := callerFromSession(session)
+    result, err := proxyToolCall(ctx, target, tool, params, caller)
+    if err != nil {
+        span.RecordError(err)
+        span.SetStatus(codes.Error, err.Error())
+    }
+    span.SetAttributes(attribute.Bool("mcp.is_error", err != nil || result.IsError))
+    auditFederatedCall(ctx, caller, tool, target, result, err)
+    return result, err
+}
+
+func proxyToolCall(ctx context.Context, target federatedTool, tool MCPTool, params map[string]interface{}, caller mcpCaller) (ToolResult, error) {
+    fs := federatedServerNamed(target.Server)
+    if fs == nil {
+        return ToolResult{}, &ToolError{
+            Code:    toolErrorUpstream,
+            Message: fmt.Sprintf("MCP server %s is not connected", target.Server),
+        }
+    }
+
+    header := http.Header{}
+    header.Set("X-MCP-Tool", tool.Name)
+    header.Set("X-MCP-Tool-Version", tool.Version)
+    if fs.config.ForwardCaller && !caller.Anonymous() {
+        header.Set("X-MCP-Caller-ID", caller.ID)
+        header.Set("X-MCP-Caller-Roles", strings.Join(caller.Roles, ","))
+    }
+    onProgress := func(raw json.RawMessage) {
+        var progress struct {
+            Progress float64 `json:"progress"`
+            Total    float64 `json:"total"`
+            Message  string  `json:"message"`
+        }
+        if json.Unmarshal(raw, &progress) == nil {
+            reportProgress(ctx, progress.Progress, progress.Total, progress.Message)
+        }
+    }
+
+    raw, err := fs.conn.request(ctx, "tools/call", map[string]interface{}{
+        "name":      target.Tool,
+        "arguments": params,
+    }, header, onProgress)
+    if err != nil {
+        if ctx.Err() != nil {
+            return ToolResult{}, err
+        }
+        toolErr := &ToolError{
+            Code:    toolErrorUpstream,
+            Message: fmt.Sprintf("MCP server %s failed: %v", target.Server, err),
+            Details: map[string]interface{}{"server": target.Server},
+        }
+        var rpcErr *jsonRPCError
+        if errors.As(err, &rpcErr) {
+            toolErr.Message = fmt.Sprintf("MCP server %s rejected the call: %s", target.Server, rpcErr.Message)
+            toolErr.Details = map[string]interface{}{"server": target.Server, "code": rpcErr.Code, "data": rpcErr.Data}
+        }
+        return ToolResult{}, toolErr
+    }
+    return federatedResult(tool, target, raw)
+}
+
+// federatedResult checks an upstream CallToolResult and converts it to the
+// gateway's: a failure reported by the tool becomes an execution_failed
+// error carrying the upstream output
+func federatedResult(tool MCPTool, target federatedTool, raw json.RawMessage) (ToolResult, error) {
+    var upstream struct {
+        Content           []ContentBlock `json:"content"`
+        StructuredContent interface{}    `json:"structuredContent"`
+        IsError           bool           `json:"isError"`
+    }
+    if err := json.Unmarshal(raw, &upstream); err != nil {
+        return ToolResult{}, &ToolError{
+            Code:    toolErrorInvalidOutput,
+            Message: fmt.Sprintf("MCP server %s returned a malformed tool result", target.Server),
+            Details: err.Error(),
+        }
+    }
+
+    if upstream.IsError {
+        var text []string
+        for _, block := range upstream.Content {
+            if block.Type == "text" && block.Text != "" {
+                text = append(text, block.Text)
+            }
+        }
+        message := strings.Join(text, "\n")
+        if message == "" {
+            message = fmt.Sprintf("tool %s failed on MCP server %s", target.Tool, target.Server)
+        }
+        details := map[string]interface{}{"server": target.Server}
+        if upstream.StructuredContent != nil {
+            details["structuredContent"] = upstream.StructuredContent
+        }
+        result := toolErrorResult(&ToolError{
+            Code:    toolErrorExecutionFailed,
+            Message: message,
+            Details: details,
+        })
+        if len(upstream.Content) > 0 {
+            result.Content = upstream.Content
+        }
+        return result, nil
+    }
+
+    structured := normalizeJSONValue(upstream.StructuredContent)
+    if tool.OutputSchema != nil && structured == nil {
+        return ToolResult{}, &ToolError{
+            Code:    toolErrorInvalidOutput,
+            Message: fmt.Sprintf("tool %s declares an outputSchema but returned no structuredContent", tool.Name),
+        }
+    }
+    if tool.OutputSchema != nil {
+        if err := validateToolOutput(*tool.OutputSchema, structured); err != nil {
+            return ToolResult{}, &ToolError{
+                Code:    toolErrorInvalidOutput,
+                Message: fmt.Sprintf("tool %s returned output that does not match its outputSchema", tool.Name),
+                Details: err,
+            }
+        }
+    }
+    content := upstream.Content
+    if len(content) == 0 && structured != nil {
+        content = []ContentBlock{{Type: "text", Text: renderToolText(structured)}}
+    }
+    if content == nil {
+        content = []ContentBlock{}
+    }
+    return ToolResult{Content: content, StructuredContent: structured}, nil
+}
+
+// auditFederatedCall records a call proxied to an upstream server
+func auditFederatedCall(ctx context.Context, caller mcpCaller, tool MCPTool, target federatedTool, result ToolResult, callErr error) {
+    details := map[string]interface{}{
+        "server":        target.Server,
+        "upstream_tool": target.Tool,
+        "is_error":      callErr != nil || result.IsError,
+    }
+    if callErr != nil {
+        details["error"] = callErr.Error()
+    }
+    event := auditEvent{
+        Action:  "federated_call",
+        Target:  tool.Name,
+        Actor:   caller.ID,
+        Details: details,
+    }
+    auditCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+    defer cancel()
+    _, err := redisClient().TxPipelined(auditCtx, func(pipe redis.Pipeliner) error {
+        appendAudit(auditCtx, pipe, event)
+        return nil
+    })
+    if err != nil {
+        log.Get().WithError(err).WithField("tool_name", tool.Name).Warn("Failed to audit federated MCP tool call")
+    }
+}
+
+// federationStatus describes each server for /mcp/health
+func federationStatus() map[string]map[string]interface{} {
+    federation.Lock()
+    servers := make([]*federatedServer, 0, len(federation.servers))
+    for _, fs := range federation.servers {
+        servers = append(servers, fs)
+    }
+    federation.Unlock()
+
+    out := make(map[string]map[string]interface{}, len(servers))
+    for _, fs := range servers {
+        fs.mu.Lock()
+        status := map[string]interface{}{
+            "url":         fs.config.URL,
+            "transport":   fs.config.Transport,
+            "tools_count": len(fs.tools),
+        }
+        if status["transport"] == "" {
+            status["transport"] = federationStreamableHTTP
+        }
+        if !fs.listedAt.IsZero() {
+            status["listed_at"] = fs.listedAt.Format(time.RFC3339)
+        }
+        if fs.lastError != "" {
+            status["last_error"] = fs.lastError
+        }
+        fs.mu.Unlock()
+        out[fs.config.Name] = status
+    }
+    return out
+}
+
+// upstreamHeaders sets what every request to server carries: its
+// configured headers, the trace context and any per-call headers
+func upstreamHeaders(ctx context.Context, req *http.Request, server FederatedServerConfig, header http.Header) {
+    for name, value := range server.Headers {
+        req.Header.Set(name, os.ExpandEnv(value))
+    }
+    for name, values := range header {
+        req.Header[name] = values
+    }
+    req.Header.Set("User-Agent", "Tyk-MCP-Gateway/1.0")
+    otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// upstreamInitialize is the initialize request sent to upstream servers
+func upstreamInitialize() map[string]interface{} {
+    return map[string]interface{}{
+        "protocolVersion": mcpProtocolVersion,
+        "capabilities":    map[string]interface{}{},
+        "clientInfo": map[string]interface{}{
+            "name":    "tyk-mcp-gateway",
+            "version": "1.0.0",
+        },
+    }
+}
+
+// negotiatedVersion reads the protocol version from an initialize result
+func negotiatedVersion(raw json.RawMessage) (string, error) {
+    var result struct {
+        ProtocolVersion string `json:"protocolVersion"`
+    }
+    if err := json.Unmarshal(raw, &result); err != nil {
+        return "", fmt.Errorf("malformed initialize result: %w", err)
+    }
+    for _, supported := range mcpSupportedProtocolVersions {
+        if result.ProtocolVersion == supported {
+            return supported, nil
+        }
+    }
+    return "", fmt.Errorf("unsupported protocol version %q", result.ProtocolVersion)
+}
+
+// withProgressToken asks for progress on a request, identified by its id
+func withProgressToken(params map[string]interface{}, id int64) map[string]interface{} {
+    out := make(map[string]interface{}, len(params)+1)
+    for k, v := range params {
+        out[k] = v
+    }
+    out["_meta"] = map[string]interface{}{"progressToken": id}
+    return out
+}
+
+func encodeRequest(id int64, method string, params map[string]interface{}) ([]byte, error) {
+    encoded, err := json.Marshal(params)
+    if err != nil {
+        return nil, err
+    }
+    return json.Marshal(jsonRPCRequest{
+        JSONRPC: "2.0",
+        ID:      json.RawMessage(strconv.FormatInt(id, 10)),
+        Method:  method,
+        Params:  encoded,
+    })
+}
+
+func upstreamStatusError(resp *http.Response) error {
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+    if text := strings.TrimSpace(string(body)); text != "" {
+        return fmt.Errorf("status %d: %s", resp.StatusCode, text)
+    }
+    return fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// cancelUpstream tells a server to stop working on a request the caller
+// gave up on
+func cancelUpstream(ctx context.Context, send func(ctx context.Context, method string, params interface{}) error, id int64) {
+    cancelCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+    defer cancel()
+    send(cancelCtx, "notifications/cancelled", map[string]interface{}{
+        "requestId": id,
+        "reason":    ctx.Err().Error(),
+    })
+}
+
+// readSSE calls fn with the event name and data of each server-sent event
+// in r, until fn returns false or r ends
+func readSSE(r io.Reader, fn func(event, data string) bool) error {
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64<<10), federationMaxMessage)
+    event := ""
+    var data []string
+    for scanner.Scan() {
+        line := scanner.Text()
+        if line == "" {
+            if len(data) > 0 && !fn(event, strings.Join(data, "\n")) {
+                return nil
+            }
+            event, data = "", nil
+            continue
+        }
+        field, value, _ := strings.Cut(line, ":")
+        value = strings.TrimPrefix(value, " ")
+        switch field {
+        case "event":
+            event = value
+        case "data":
+            data = append(data, value)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+    return io.EOF
+}
+
+// streamableUpstream speaks the Streamable HTTP transport: each message is
+// a POST, answered with JSON or with an event stream that ends with the
+// response
+type streamableUpstream struct {
+    server        FederatedServerConfig
+    onListChanged func()
+    ids           atomic.Int64
+
+    // initMu serializes initializing the session
+    initMu sync.Mutex
+
+    mu        sync.Mutex
+    sessionID string
+    version   string
+    ready     bool
+}
+
+func (c *streamableUpstream) request(ctx context.Context, method string, params map[string]interface{}, header http.Header, onProgress func(json.RawMessage)) (json.RawMessage, error) {
+    if err := c.initialize(ctx); err != nil {
+        return nil, err
+    }
+    result, err := c.call(ctx, method, params, header, onProgress)
+    if errors.Is(err, errUpstreamSessionExpired) {
+        // The server lost the session, e.g. in a restart; start a new one
+        c.mu.Lock()
+        c.ready = false
+        c.mu.Unlock()
+        if err := c.initialize(ctx); err != nil {
+            return nil, err
+        }
+        result, err = c.call(ctx, method, params, header, onProgress)
+    }
+    return result, err
+}
+
+func (c *streamableUpstream) initialize(ctx context.Context) error {
+    c.initMu.Lock()
+    defer c.initMu.Unlock()
+    c.mu.Lock()
+    ready := c.ready
+    if !ready {
+        c.sessionID, c.version = "", ""
+    }
+    c.mu.Unlock()
+    if ready {
+        return nil
+    }
+
+    raw, err := c.call(ctx, "initialize", upstreamInitialize(), nil, nil)
+    if err != nil {
+        return fmt.Errorf("initialize: %w", err)
+    }
+    version, err := negotiatedVersion(raw)
+    if err != nil {
+        return err
+    }
+    c.mu.Lock()
+    c.version = version
+    c.mu.Unlock()
+    if err := c.send(ctx, "notifications/initialized", nil); err != nil {
+        return fmt.Errorf("initialized: %w", err)
+    }
+    c.mu.Lock()
+    c.ready = true
+    c.mu.Unlock()
+    return nil
+}
+
+// post sends one message. A 404 for a request carrying a session means
+// the server no longer knows the session.
+func (c *streamableUpstream) post(ctx context.Context, body []byte, header http.Header) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server.URL, bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    upstreamHeaders(ctx, req, c.server, header)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Accept", "application/json, text/event-stream")
+    c.mu.Lock()
+    sessionID, version := c.sessionID, c.version
+    c.mu.Unlock()
+    if sessionID != "" {
+        req.Header.Set(mcpSessionHeader, sessionID)
+    }
+    if version != "" {
+        req.Header.Set("MCP-Protocol-Version", version)
+    }
+
+    resp, err := federationClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode == http.StatusNotFound && sessionID != "" {
+        resp.Body.Close()
+        return nil, errUpstreamSessionExpired
+    }
+    if resp.StatusCode >= 400 {
+        defer resp.Body.Close()
+        return nil, upstreamStatusError(resp)
+    }
+    return resp, nil
+}
+
+func (c *streamableUpstream) send(ctx context.Context, method string, params interface{}) error {
+    body, err := json.Marshal(jsonRPCNotification{JSONRPC: "2.0", Method: method, Params: params})
+    if err != nil {
+        return err
+    }
+    resp, err := c.post(ctx, body, nil)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+func (c *streamableUpstream) call(ctx context.Context, method string, params map[string]interface{}, header http.Header, onProgress func(json.RawMessage)) (json.RawMessage, error) {
+    id := c.ids.Add(1)
+    if onProgress != nil {
+        params = withProgressToken(params, id)
+    }
+    body, err := encodeRequest(id, method, params)
+    if err != nil {
+        return nil, err
+    }
+    var result json.RawMessage
+    resp, err := c.post(ctx, body, header)
+    if err == nil {
+        defer resp.Body.Close()
+        if method == "initialize" {
+            c.mu.Lock()
+            c.sessionID = resp.Header.Get(mcpSessionHeader)
+            c.mu.Unlock()
+        }
+        result, err = c.readResponse(resp, id, onProgress)
+    }
+    if ctx.Err() != nil && method != "initialize" {
+        go cancelUpstream(ctx, c.send, id)
+        return nil, ctx.Err()
+    }
+    return result, err
+}
+
+// readResponse reads the response to request id, from a JSON body or an
+// event stream. Notifications sent on the stream before it are handled.
+func (c *streamableUpstream) readResponse(resp *http.Response, id int64, onProgress func(json.RawMessage)) (json.RawMessage, error) {
+    wanted := strconv.FormatInt(id, 10)
+    mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+    if mediaType != "text/event-stream" {
+        var msg upstreamMessage
+        if err := json.NewDecoder(io.LimitReader(resp.Body, federationMaxMessage)).Decode(&msg); err != nil {
+            return nil, fmt.Errorf("malformed response: %w", err)
+        }
+        if string(msg.ID) != wanted {
+            return nil, fmt.Errorf("response id %s does not match request %s", msg.ID, wanted)
+        }
+        return msg.result()
+    }
+
+    var response *upstreamMessage
+    err := readSSE(resp.Body, func(_, data string) bool {
+        var msg upstreamMessage
+        if json.Unmarshal([]byte(data), &msg) != nil {
+            return true
+        }
+        switch {
+        case msg.Method == "notifications/progress" && onProgress != nil:
+            onProgress(msg.Params)
+        case msg.Method == "notifications/tools/list_changed":
+            c.onListChanged()
+        case msg.Method == "" && string(msg.ID) == wanted:
+            response = &msg
+            return false
+        }
+        return true
+    })
+    if response == nil {
+        if err == nil || err == io.EOF {
+            err = errUpstreamStreamClosed
+        }
+        return nil, err
+    }
+    return response.result()
+}
+
+// close ends the session on the server
+func (c *streamableUpstream) close() {
+    c.mu.Lock()
+    sessionID := c.sessionID
+    c.ready = false
+    c.mu.Unlock()
+    if sessionID == "" {
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.server.URL, nil)
+    if err != nil {
+        return
+    }
+    upstreamHeaders(ctx, req, c.server, nil)
+    req.Header.Set(mcpSessionHeader, sessionID)
+    if resp, err := upstreamClient.Do(req); err == nil {
+        resp.Body.Close()
+    }
+}
+
+// sseUpstream speaks the HTTP+SSE transport: a long-lived GET stream
+// carries the server's messages, and requests are POSTed to the endpoint
+// the stream announces
+type sseUpstream struct {
+    server        FederatedServerConfig
+    onListChanged func()
+    ids           atomic.Int64
+
+    initMu sync.Mutex
+
+    mu       sync.Mutex
+    endpoint string
+    stop     context.CancelFunc
+    // done is closed when the stream ends
+    done    chan struct{}
+    ready   bool
+    pending map[string]*sseCall
+}
+
+// sseCall is a request waiting for its response on the stream
+type sseCall struct {
+    response   chan upstreamMessage
+    onProgress func(json.RawMessage)
+}
+
+func (c *sseUpstream) request(ctx context.Context, method string, params map[string]interface{}, header http.Header, onProgress func(json.RawMessage)) (json.RawMessage, error) {
+    if err := c.initialize(ctx); err != nil {
+        return nil, err
+    }
+    return c.call(ctx, method, params, header, onProgress)
+}
+
+func (c *sseUpstream) initialize(ctx context.Context) error {
+    c.initMu.Lock()
+    defer c.initMu.Unlock()
+    c.mu.Lock()
+    ready := c.ready
+    c.mu.Unlock()
+    if ready {
+        return nil
+    }
+
+    if err := c.connect(ctx); err != nil {
+        return err
+    }
+    raw, err := c.call(ctx, "initialize", upstreamInitialize(), nil, nil)
+    if err == nil {
+        _, err = negotiatedVersion(raw)
+    }
+    if err == nil {
+        err = c.send(ctx, "notifications/initialized", nil)
+    }
+    if err != nil {
+        c.close()
+        return fmt.Errorf("initialize: %w", err)
+    }
+    c.mu.Lock()
+    c.ready = true
+    c.mu.Unlock()
+    return nil
+}
+
+// connect opens the event stream and waits for the server to announce
+// where messages are posted
+func (c *sseUpstream) connect(ctx context.Context) error {
+    c.close()
+    streamCtx, stop := context.WithCancel(context.Background())
+    req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, c.server.URL, nil)
+    if err != nil {
+        stop()
+        return err
+    }
+    upstreamHeaders(ctx, req, c.server, nil)
+    req.Header.Set("Accept", "text/event-stream")
+    resp, err := federationStreamClient.Do(req)
+    if err != nil {
+        stop()
+        return err
+    }
+    if resp.StatusCode != http.StatusOK {
+        defer resp.Body.Close()
+        stop()
+        return upstreamStatusError(resp)
+    }
+
+    done := make(chan struct{})
+    endpoint := make(chan string, 1)
+    c.mu.Lock()
+    c.stop, c.done = stop, done
+    c.mu.Unlock()
+    go c.readStream(resp, endpoint, done)
+
+    select {
+    case e := <-endpoint:
+        c.mu.Lock()
+        c.endpoint = e
+        c.mu.Unlock()
+        return nil
+    case <-done:
+        return errors.New("event stream closed before announcing the message endpoint")
+    case <-ctx.Done():
+        stop()
+        return ctx.Err()
+    }
+}
+
+// readStream dispatches the messages on the event stream until it ends
+func (c *sseUpstream) readStream(resp *http.Response, endpoint chan<- string, done chan struct{}) {
+    defer close(done)
+    defer resp.Body.Close()
+
+    base := resp.Request.URL
+    err := readSSE(resp.Body, func(event, data string) bool {
+        switch event {
+        case "endpoint":
+            if ref, err := url.Parse(strings.TrimSpace(data)); err == nil {
+                select {
+                case endpoint <- base.ResolveReference(ref).String():
+                default:
+                }
+            }
+        case "", "message":
+            c.dispatch(data)
+        }
+        return true
+    })
+
+    c.mu.Lock()
+    if c.done == done {
+        c.ready = false
+    }
+    c.mu.Unlock()
+    if err != nil && err != io.EOF && !errors.Is(err, context.Canceled) {
+        log.Get().WithError(err).WithField("server", c.server.Name).Warn("Federated MCP event stream failed")
+    }
+}
+
+func (c *sseUpstream) dispatch(data string) {
+    var msg upstreamMessage
+    if json.Unmarshal([]byte(data), &msg) != nil {
+        return
+    }
+    switch msg.Method {
+    case "":
+        c.mu.Lock()
+        call := c.pending[string(msg.ID)]
+        c.mu.Unlock()
+        if call != nil {
+            select {
+            case call.response <- msg:
+            default:
+            }
+        }
+    case "notifications/progress":
+        var progress struct {
+            Token json.RawMessage `json:"progressToken"`
+        }
+        if json.Unmarshal(msg.Params, &progress) != nil {
+            return
+        }
+        c.mu.Lock()
+        call := c.pending[string(progress.Token)]
+        c.mu.Unlock()
+        if call != nil && call.onProgress != nil {
+            call.onProgress(msg.Params)
+        }
+    case "notifications/tools/list_changed":
+        c.onListChanged()
+    }
+}
+
+func (c *sseUpstream) post(ctx context.Context, body []byte, header http.Header) error {
+    c.mu.Lock()
+    endpoint := c.endpoint
+    c.mu.Unlock()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    upstreamHeaders(ctx, req, c.server, header)
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := federationClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 400 {
+        return upstreamStatusError(resp)
+    }
+    return nil
+}
+
+func (c *sseUpstream) send(ctx context.Context, method string, params interface{}) error {
+    body, err := json.Marshal(jsonRPCNotification{JSONRPC: "2.0", Method: method, Params: params})
+    if err != nil {
+        return err
+    }
+    return c.post(ctx, body, nil)
+}
+
+func (c *sseUpstream) call(ctx context.Context, method string, params map[string]interface{}, header http.Header, onProgress func(json.RawMessage)) (json.RawMessage, error) {
+    id := c.ids.Add(1)
+    if onProgress != nil {
+        params = withProgressToken(params, id)
+    }
+    body, err := encodeRequest(id, method, params)
+    if err != nil {
+        return nil, err
+    }
+
+    key := strconv.FormatInt(id, 10)
+    call := &sseCall{response: make(chan upstreamMessage, 1), onProgress: onProgress}
+    c.mu.Lock()
+    c.pending[key] = call
+    done := c.done
+    c.mu.Unlock()
+    defer func() {
+        c.mu.Lock()
+        delete(c.pending, key)
+        c.mu.Unlock()
+    }()
+
+    if err := c.post(ctx, body, header); err != nil {
+        if ctx.Err() != nil && method != "initialize" {
+            go cancelUpstream(ctx, c.send, id)
+        }
+        return nil, err
+    }
+    select {
+    case msg := <-call.response:
+        return msg.result()
+    case <-done:
+        return nil, errUpstreamStreamClosed
+    case <-ctx.Done():
+        if method != "initialize" {
+            go cancelUpstream(ctx, c.send, id)
+        }
+        return nil, ctx.Err()
+    }
+}
+
+// close ends the event stream
+func (c *sseUpstream) close() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.stop != nil {
+        c.stop()
+    }
+    c.ready = false
+}
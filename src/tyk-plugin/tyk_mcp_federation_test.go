@@ -0,0 +1,493 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/TykTechnologies/tyk/user"
+)
+
+// fakeMCPServer is an upstream MCP server speaking Streamable HTTP. It
+// lists its tools two to a page and answers tools/call with an event
+// stream that reports progress first.
+type fakeMCPServer struct {
+    *httptest.Server
+    // tools are the JSON definitions it lists
+    tools []string
+
+    mu       sync.Mutex
+    session  string
+    sessions int
+    // called holds the headers of the last tools/call
+    called http.Header
+}
+
+func newFakeMCPServer(t *testing.T, tools ...string) *fakeMCPServer {
+    t.Helper()
+    s := &fakeMCPServer{tools: tools}
+    s.Server = httptest.NewServer(s)
+    t.Cleanup(s.Close)
+    return s
+}
+
+// expire forgets the session, as a restarted server would
+func (s *fakeMCPServer) expire() {
+    s.mu.Lock()
+    s.session = ""
+    s.mu.Unlock()
+}
+
+func (s *fakeMCPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var msg upstreamMessage
+    if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if msg.Method != "initialize" && (s.session == "" || r.Header.Get(mcpSessionHeader) != s.session) {
+        http.Error(w, "unknown session", http.StatusNotFound)
+        return
+    }
+    if msg.ID == nil {
+        w.WriteHeader(http.StatusAccepted)
+        return
+    }
+
+    respond := func(result interface{}, rpcErr *jsonRPCError) {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "result": result, "error": rpcErr})
+    }
+    switch msg.Method {
+    case "initialize":
+        s.sessions++
+        s.session = fmt.Sprintf("session-%d", s.sessions)
+        w.Header().Set(mcpSessionHeader, s.session)
+        respond(map[string]interface{}{"protocolVersion": mcpProtocolVersion, "capabilities": map[string]interface{}{}}, nil)
+
+    case "tools/list":
+        var params struct {
+            Cursor string `json:"cursor"`
+        }
+        json.Unmarshal(msg.Params, &params)
+        start, _ := strconv.Atoi(params.Cursor)
+        end := min(start+2, len(s.tools))
+        page := map[string]interface{}{"tools": json.RawMessage("[" + strings.Join(s.tools[start:end], ",") + "]")}
+        if end < len(s.tools) {
+            page["nextCursor"] = strconv.Itoa(end)
+        }
+        respond(page, nil)
+
+    case "tools/call":
+        s.called = r.Header.Clone()
+        var params struct {
+            Name      string                 `json:"name"`
+            Arguments map[string]interface{} `json:"arguments"`
+            Meta      struct {
+                ProgressToken json.RawMessage `json:"progressToken"`
+            } `json:"_meta"`
+        }
+        json.Unmarshal(msg.Params, &params)
+        var result map[string]interface{}
+        switch params.Name {
+        case "lookup":
+            structured := map[string]interface{}{"target": params.Arguments["target"], "score": 3}
+            if params.Arguments["target"] == "unscored" {
+                delete(structured, "score")
+            }
+            result = map[string]interface{}{"structuredContent": structured}
+        case "fail":
+            result = map[string]interface{}{
+                "isError": true,
+                "content": []map[string]interface{}{{"type": "text", "text": "lookup quota exhausted"}},
+            }
+        default:
+            respond(nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "unknown tool " + params.Name})
+            return
+        }
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        progress, _ := json.Marshal(map[string]interface{}{
+            "jsonrpc": "2.0",
+            "method":  "notifications/progress",
+            "params":  map[string]interface{}{"progressToken": params.Meta.ProgressToken, "progress": 1, "total": 2},
+        })
+        response, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID, "result": result})
+        fmt.Fprintf(w, "event: message\ndata: %s\n\nevent: message\ndata: %s\n\n", progress, response)
+
+    default:
+        respond(nil, &jsonRPCError{Code: jsonRPCMethodNotFound, Message: "method not found"})
+    }
+}
+
+func TestValidateFederation(t *testing.T) {
+    tests := []struct {
+        name    string
+        servers []FederatedServerConfig
+        wantErr string
+    }{
+        {
+            name: "valid",
+            servers: []FederatedServerConfig{
+                {Name: "intel", URL: "https://intel.example.com/mcp"},
+                {Name: "legacy", URL: "http://legacy.example.com/sse", Transport: federationSSE, Prefix: "old-intel"},
+            },
+        },
+        {
+            name:    "missing name",
+            servers: []FederatedServerConfig{{URL: "https://intel.example.com/mcp"}},
+            wantErr: "federation.servers[0]: name is required",
+        },
+        {
+            name: "duplicate name",
+            servers: []FederatedServerConfig{
+                {Name: "intel", URL: "https://intel.example.com/mcp"},
+                {Name: "intel", URL: "https://other.example.com/mcp"},
+            },
+            wantErr: "duplicate server intel",
+        },
+        {
+            name:    "not an http url",
+            servers: []FederatedServerConfig{{Name: "intel", URL: "ws://intel.example.com/mcp"}},
+            wantErr: "url must be an http or https URL",
+        },
+        {
+            name:    "unknown transport",
+            servers: []FederatedServerConfig{{Name: "intel", URL: "https://intel.example.com/mcp", Transport: "stdio"}},
+            wantErr: `transport must be streamable_http or sse, got "stdio"`,
+        },
+        {
+            name:    "name unusable as a prefix",
+            servers: []FederatedServerConfig{{Name: "threat intel", URL: "https://intel.example.com/mcp"}},
+            wantErr: `prefix "threat intel" may only hold letters, digits, _ and -`,
+        },
+        {
+            name: "shared prefix",
+            servers: []FederatedServerConfig{
+                {Name: "intel", URL: "https://intel.example.com/mcp"},
+                {Name: "legacy", URL: "https://legacy.example.com/mcp", Prefix: "intel"},
+            },
+            wantErr: "prefix intel is used by another server",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := validateFederation(FederationConfig{Servers: tt.servers})
+            if tt.wantErr == "" {
+                if err != nil {
+                    t.Fatal(err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Fatalf("validateFederation error = %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestFederatedToolName(t *testing.T) {
+    tests := []struct {
+        server FederatedServerConfig
+        tool   string
+        want   string
+    }{
+        {server: FederatedServerConfig{Name: "intel"}, tool: "lookup", want: "intel_lookup"},
+        {server: FederatedServerConfig{Name: "intel", Prefix: "ti"}, tool: "lookup", want: "ti_lookup"},
+        {server: FederatedServerConfig{Name: "intel"}, tool: "legacy.search v2", want: "intel_legacy_search_v2"},
+        {server: FederatedServerConfig{Name: "intel"}, tool: "/reports/", want: "intel_reports"},
+    }
+
+    for _, tt := range tests {
+        if got := federatedToolName(tt.server, tt.tool); got != tt.want {
+            t.Errorf("federatedToolName(%s) = %s, want %s", tt.tool, got, tt.want)
+        }
+    }
+}
+
+func TestFederatedToolAllowed(t *testing.T) {
+    tests := []struct {
+        patterns []string
+        tool     string
+        want     bool
+    }{
+        {tool: "lookup", want: true},
+        {patterns: []string{"lookup"}, tool: "lookup", want: true},
+        {patterns: []string{"report_*"}, tool: "report_daily", want: true},
+        {patterns: []string{"lookup", "report_*"}, tool: "admin_reset"},
+        {patterns: []string{"look"}, tool: "lookup"},
+    }
+
+    for _, tt := range tests {
+        if got := federatedToolAllowed(FederatedServerConfig{Tools: tt.patterns}, tt.tool); got != tt.want {
+            t.Errorf("federatedToolAllowed(%v, %s) = %v, want %v", tt.patterns, tt.tool, got, tt.want)
+        }
+    }
+}
+
+func TestReadSSE(t *testing.T) {
+    stream := "event: endpoint\ndata: /messages\n\n" +
+        ": keep-alive\n\n" +
+        "data: {\"a\":\ndata:1}\n\n" +
+        "event: message\ndata: last\n\n" +
+        "data: unread\n\n"
+
+    var got []string
+    err := readSSE(strings.NewReader(stream), func(event, data string) bool {
+        got = append(got, event+"|"+data)
+        return data != "last"
+    })
+    if err != nil {
+        t.Fatalf("readSSE = %v, want it stopped by the callback", err)
+    }
+    if want := []string{"endpoint|/messages", "|{\"a\":\n1}", "message|last"}; strings.Join(got, ",") != strings.Join(want, ",") {
+        t.Fatalf("events %q, want %q", got, want)
+    }
+
+    if err := readSSE(strings.NewReader("data: partial"), func(string, string) bool { return true }); err != io.EOF {
+        t.Fatalf("readSSE of an ended stream = %v, want io.EOF", err)
+    }
+}
+
+func TestFederatedResult(t *testing.T) {
+    tool := MCPTool{Name: "intel_lookup"}
+    var schema Property
+    if err := json.Unmarshal([]byte(`{"type": "object", "properties": {"score": {"type": "number"}}, "required": ["score"]}`), &schema); err != nil {
+        t.Fatal(err)
+    }
+    tool.OutputSchema = &schema
+    target := federatedTool{Server: "intel", Tool: "lookup"}
+
+    tests := []struct {
+        name     string
+        raw      string
+        wantCode string
+        // wantText is the error message, or the first content block's text
+        // of a result
+        wantText    string
+        wantDetails bool
+    }{
+        {name: "passed through", raw: `{"content": [{"type": "text", "text": "score 3"}], "structuredContent": {"score": 3}}`, wantText: "score 3"},
+        {name: "content rendered", raw: `{"structuredContent": {"score": 3}}`, wantText: renderToolText(map[string]interface{}{"score": 3.0})},
+        {name: "tool failure", raw: `{"isError": true, "content": [{"type": "text", "text": "quota exhausted"}], "structuredContent": {"retry_after": 60}}`, wantCode: toolErrorExecutionFailed, wantText: "quota exhausted", wantDetails: true},
+        {name: "failure without text", raw: `{"isError": true}`, wantCode: toolErrorExecutionFailed, wantText: "tool lookup failed on MCP server intel"},
+        {name: "missing structured content", raw: `{"content": []}`, wantCode: toolErrorInvalidOutput, wantText: "returned no structuredContent"},
+        {name: "output not matching", raw: `{"structuredContent": {"score": "high"}}`, wantCode: toolErrorInvalidOutput, wantText: "does not match its outputSchema"},
+        {name: "malformed", raw: `[1]`, wantCode: toolErrorInvalidOutput, wantText: "malformed tool result"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            result, err := federatedResult(tool, target, json.RawMessage(tt.raw))
+            if err == nil && result.IsError {
+                err, _ = resultError(result)
+            }
+            if tt.wantCode == "" {
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if result.Content[0].Text != tt.wantText {
+                    t.Fatalf("content %+v, want %q", result.Content, tt.wantText)
+                }
+                return
+            }
+
+            toolErr, ok := err.(*ToolError)
+            if !ok || toolErr.Code != tt.wantCode || !strings.Contains(toolErr.Message, tt.wantText) {
+                t.Fatalf("error %v, want %s %q", err, tt.wantCode, tt.wantText)
+            }
+            if details, _ := toolErr.Details.(map[string]interface{}); tt.wantDetails && details["structuredContent"] == nil {
+                t.Fatalf("details %v, want the upstream structuredContent", toolErr.Details)
+            }
+        })
+    }
+}
+
+func TestFederation(t *testing.T) {
+    upstream := newFakeMCPServer(t,
+        `{"name": "lookup", "inputSchema": {"type": "object", "properties": {"target": {"type": "string"}}},
+          "outputSchema": {"type": "object", "properties": {"score": {"type": "number"}}, "required": ["score"]},
+          "version": "9", "requiresApproval": true, "_meta": {"owner": "intel"}}`,
+        `{"name": "fail", "inputSchema": {"type": "object"}}`,
+        `{"name": "legacy.search", "inputSchema": {"type": "object"}}`,
+        `{"name": "stringly", "inputSchema": {"type": "string"}}`,
+        `{"name": "broken", "inputSchema": "none"}`,
+        `{"name": "admin_reset", "inputSchema": {"type": "object"}}`,
+        `{"name": "gone", "inputSchema": {"type": "object"}}`,
+    )
+    t.Setenv("INTEL_TOKEN", "s3cret")
+    server := FederatedServerConfig{
+        Name:          "intel",
+        URL:           upstream.URL,
+        Headers:       map[string]string{"Authorization": "Bearer ${INTEL_TOKEN}"},
+        ForwardCaller: true,
+        Tools:         []string{"lookup", "fail", "legacy.*", "stringly", "broken", "gone"},
+    }
+    useRedis(t, func(cfg *MCPConfig) { cfg.Federation.Servers = []FederatedServerConfig{server} })
+    syncFederation([]FederatedServerConfig{server})
+    t.Cleanup(func() { syncFederation(nil) })
+
+    for deadline := time.Now().Add(5 * time.Second); len(currentState().federated) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+    }
+    federated := currentState().federated
+    for _, name := range []string{"intel_lookup", "intel_fail", "intel_legacy_search", "intel_gone"} {
+        if _, ok := federated[name]; !ok {
+            t.Fatalf("federated tools %v, want %s", federated, name)
+        }
+    }
+    if len(federated) != 4 {
+        t.Fatalf("federated tools %v, want only the allowed tools with object input schemas", federated)
+    }
+    if status := federationStatus()["intel"]; status["tools_count"] != 6 || status["listed_at"] == nil || status["last_error"] != nil {
+        t.Fatalf("status %v, want the readable tools listed", status)
+    }
+
+    // Gateway metadata from the server is dropped
+    lookup, _ := currentState().resolveTool("intel_lookup", "")
+    if lookup.Version != defaultToolVersion || lookup.RequiresApproval || lookup.Meta != nil || lookup.OutputSchema == nil {
+        t.Fatalf("intel_lookup = %+v, want the server's schemas without its gateway metadata", lookup)
+    }
+
+    ann := &user.SessionState{Alias: "ann", MetaData: map[string]interface{}{"roles": "analyst"}}
+    tests := []struct {
+        name        string
+        tool        string
+        target      string
+        wantCode    string
+        wantMessage string
+    }{
+        {name: "call", tool: "intel_lookup", target: "8.8.8.8"},
+        {name: "output not matching", tool: "intel_lookup", target: "unscored", wantCode: toolErrorInvalidOutput, wantMessage: "returned output that does not match its outputSchema"},
+        {name: "tool failure", tool: "intel_fail", wantCode: toolErrorExecutionFailed, wantMessage: "lookup quota exhausted"},
+        {name: "rejected", tool: "intel_gone", wantCode: toolErrorUpstream, wantMessage: "MCP server intel rejected the call: unknown tool gone"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var reports atomic.Int32
+            ctx := withProgress(context.Background(), func(progress, total float64, message string) { reports.Add(1) })
+            tool, _ := currentState().resolveTool(tt.tool, "")
+            r := httptest.NewRequest(http.MethodPost, "/mcp", nil)
+            result := invokeTool(ctx, r, ann, tool, map[string]interface{}{"target": tt.target})
+
+            if tt.wantCode != "" {
+                toolErr, ok := resultError(result)
+                if !ok || toolErr.Code != tt.wantCode || !strings.Contains(toolErr.Message, tt.wantMessage) {
+                    t.Fatalf("result %+v, want %s %q", result.StructuredContent, tt.wantCode, tt.wantMessage)
+                }
+                return
+            }
+            if structured, _ := result.StructuredContent.(map[string]interface{}); result.IsError || structured["score"] != 3.0 {
+                t.Fatalf("result %+v, want the server's output", result.StructuredContent)
+            }
+            if reports.Load() != 1 {
+                t.Fatalf("%d progress reports, want the server's one", reports.Load())
+            }
+
+            upstream.mu.Lock()
+            called := upstream.called
+            upstream.mu.Unlock()
+            for header, want := range map[string]string{
+                "Authorization":      "Bearer s3cret",
+                "X-MCP-Tool":         "intel_lookup",
+                "X-MCP-Caller-ID":    "ann",
+                "X-MCP-Caller-Roles": "analyst",
+            } {
+                if got := called.Get(header); got != want {
+                    t.Errorf("%s = %q, want %q", header, got, want)
+                }
+            }
+        })
+    }
+
+    // A server that lost the session is initialized again
+    upstream.expire()
+    result := invokeTool(context.Background(), httptest.NewRequest(http.MethodPost, "/mcp", nil), ann, lookup, map[string]interface{}{"target": "8.8.4.4"})
+    upstream.mu.Lock()
+    sessions := upstream.sessions
+    upstream.mu.Unlock()
+    if result.IsError || sessions != 2 {
+        t.Fatalf("result %+v after %d sessions, want the call made in a new session", result.StructuredContent, sessions)
+    }
+
+    events, err := redisClient().XRange(context.Background(), currentConfig().Audit.Stream, "-", "+").Result()
+    if err != nil || len(events) != len(tests)+1 {
+        t.Fatalf("%d audit events, %v, want one per call", len(events), err)
+    }
+    for _, event := range events {
+        if event.Values["action"] != "federated_call" || event.Values["actor"] != "ann" {
+            t.Fatalf("audit event %v, want a federated call by ann", event.Values)
+        }
+    }
+
+    syncFederation(nil)
+    toolErr, ok := resultError(invokeTool(context.Background(), httptest.NewRequest(http.MethodPost, "/mcp", nil), ann, lookup, nil))
+    if !ok || toolErr.Code != toolErrorUpstream || toolErr.Message != "MCP server intel is not connected" {
+        t.Fatalf("error %+v, want the server reported as not connected", toolErr)
+    }
+}
+
+func TestSSEUpstream(t *testing.T) {
+    // Responses are sent on the event stream, not in answer to the POST
+    messages := make(chan string, 8)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodGet {
+            w.Header().Set("Content-Type", "text/event-stream")
+            fmt.Fprint(w, "event: endpoint\ndata: /messages?session=1\n\n")
+            w.(http.Flusher).Flush()
+            for {
+                select {
+                case msg := <-messages:
+                    fmt.Fprintf(w, "event: message\ndata: %s\n\n", msg)
+                    w.(http.Flusher).Flush()
+                case <-r.Context().Done():
+                    return
+                }
+            }
+        }
+
+        var msg upstreamMessage
+        if r.URL.Path != "/messages" || json.NewDecoder(r.Body).Decode(&msg) != nil {
+            http.Error(w, "bad request", http.StatusBadRequest)
+            return
+        }
+        w.WriteHeader(http.StatusAccepted)
+        switch msg.Method {
+        case "initialize":
+            messages <- `{"jsonrpc": "2.0", "id": ` + string(msg.ID) + `, "result": {"protocolVersion": "2024-11-05"}}`
+        case "tools/list":
+            messages <- `{"jsonrpc": "2.0", "method": "notifications/progress", "params": {"progressToken": ` + string(msg.ID) + `, "progress": 1}}`
+            messages <- `{"jsonrpc": "2.0", "method": "notifications/tools/list_changed"}`
+            messages <- `{"jsonrpc": "2.0", "id": ` + string(msg.ID) + `, "result": {"tools": []}}`
+        }
+    }))
+    t.Cleanup(server.Close)
+
+    fs := newFederatedServer(FederatedServerConfig{Name: "legacy", URL: server.URL + "/sse", Transport: federationSSE})
+    t.Cleanup(fs.conn.close)
+
+    var reports atomic.Int32
+    raw, err := fs.conn.request(context.Background(), "tools/list", map[string]interface{}{}, nil, func(json.RawMessage) { reports.Add(1) })
+    if err != nil || string(raw) != `{"tools": []}` {
+        t.Fatalf("tools/list = %s, %v", raw, err)
+    }
+    if reports.Load() != 1 {
+        t.Fatalf("%d progress reports, want 1", reports.Load())
+    }
+    select {
+    case <-fs.refresh:
+    default:
+        t.Fatal("tools/list_changed did not ask for the tools to be listed again")
+    }
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
+    "github.com/sirupsen/logrus"
+)
+
+// IdempotencyConfig controls replaying tool calls made with an idempotency
+// key
+type IdempotencyConfig struct {
+    // Window is how long the first result for a key is kept and replayed
+    Window string `json:"window"`
+}
+
+const (
+    idempotencyPending = "pending"
+    idempotencyDone    = "done"
+
+    // idempotencyMaxKeyLength bounds keys, which are client supplied
+    idempotencyMaxKeyLength = 255
+)
+
+var (
+    errIdempotencyKeyReused   = errors.New("idempotency key was already used with a different request")
+    errIdempotencyInProgress  = errors.New("a request with this idempotency key is still running")
+    errIdempotencyInvalidKey  = errors.New("idempotency keys must be 1 to 255 printable ASCII characters")
+    errIdempotencyAnonymous   = errors.New("idempotency keys need an identified caller")
+    errIdempotencyUnavailable = errors.New("idempotency store unavailable")
+)
+
+// idempotencyRecord is what is stored for a key: a marker while the first
+// call runs, then its result
+type idempotencyRecord struct {
+    Status string `json:"status"`
+    // Fingerprint identifies the request the key was first used with
+    Fingerprint string `json:"fingerprint"`
+    // Token identifies the call holding a pending key
+    Token  string      `json:"token,omitempty"`
+    Result *ToolResult `json:"result,omitempty"`
+    JobID  string      `json:"job_id,omitempty"`
+    // Deprecated and Usage bring back the headers of the first call
+    Deprecated *ToolDeprecation `json:"deprecated,omitempty"`
+    Usage      *toolUsage       `json:"usage,omitempty"`
+}
+
+// idempotencySettleScript replaces a pending record, or deletes it when
+// ARGV[2] is empty, unless another call has taken the key over since
+var idempotencySettleScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+    return 0
+end
+local record = cjson.decode(current)
+if record.token ~= ARGV[1] then
+    return 0
+end
+if ARGV[2] == '' then
+    redis.call('DEL', KEYS[1])
+else
+    redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+end
+return 1
+`)
+
+// idempotencyKey returns the key a tool call carries, from the
+// Idempotency-Key header or else the MCP _meta field
+func idempotencyKey(r *http.Request, meta string) string {
+    if r != nil {
+        if key := r.Header.Get("Idempotency-Key"); key != "" {
+            return key
+        }
+    }
+    return meta
+}
+
+func validIdempotencyKey(key string) bool {
+    if key == "" || len(key) > idempotencyMaxKeyLength {
+        return false
+    }
+    for i := 0; i < len(key); i++ {
+        if key[i] < 0x20 || key[i] > 0x7e {
+            return false
+        }
+    }
+    return true
+}
+
+// idempotencyStoreKey scopes a key to the caller that sent it
+func idempotencyStoreKey(caller mcpCaller, key string) string {
+    sum := sha256.Sum256([]byte(caller.ID + "\x00" + key))
+    return "mcp-idempotency:" + hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint identifies what a call asks for: the tool, the pinned
+// version and the arguments. Object keys are sorted when encoding, so
+// argument order does not matter.
+func requestFingerprint(r *http.Request, toolName string, params map[string]interface{}) string {
+    encoded, _ := json.Marshal(map[string]interface{}{
+        "tool":      toolName,
+        "version":   versionPin(r),
+        "arguments": params,
+    })
+    sum := sha256.Sum256(encoded)
+    return hex.EncodeToString(sum[:])
+}
+
+// runToolOnce runs a tool call at most once per idempotency key. The first
+// call with a key runs and its result is kept for the configured window;
+// repeats of the same request get that result back instead of running the
+// tool again, waiting for it if the first call is still running. Without
+// a key the call simply runs. Keys are scoped to the caller, so anonymous
+// callers cannot use them.
+func runToolOnce(ctx context.Context, r *http.Request, session *user.SessionState, toolName string, params map[string]interface{}, key string) (ToolResult, error) {
+    caller := callerFromSession(session)
+    if key == "" {
+        return runTool(ctx, r, session, toolName, params)
+    }
+    if !validIdempotencyKey(key) {
+        return ToolResult{}, errIdempotencyInvalidKey
+    }
+    if caller.Anonymous() {
+        return ToolResult{}, errIdempotencyAnonymous
+    }
+
+    client := redisClient()
+    storeKey := idempotencyStoreKey(caller, key)
+    fingerprint := requestFingerprint(r, toolName, params)
+
+    // A pending marker outlives the call's deadline a little, so a crashed
+    // gateway does not hold the key for the whole window
+    pendingTTL := 30 * time.Second
+    if tool, ok := currentState().resolveTool(toolName, versionPin(r)); ok {
+        pendingTTL += toolTimeout(tool.Name)
+    }
+
+    for {
+        token := newIdempotencyToken()
+        pending, _ := json.Marshal(idempotencyRecord{Status: idempotencyPending, Fingerprint: fingerprint, Token: token})
+        claimed, err := client.SetNX(ctx, storeKey, pending, pendingTTL).Result()
+        if err != nil {
+            return ToolResult{}, errIdempotencyUnavailable
+        }
+        if claimed {
+            return runClaimed(ctx, r, session, toolName, params, storeKey, fingerprint, token)
+        }
+
+        record, err := awaitIdempotentResult(ctx, client, storeKey, fingerprint, pendingTTL)
+        if err != nil {
+            return ToolResult{}, err
+        }
+        if record == nil {
+            // The first call ended without a result to keep; try again
+            continue
+        }
+        result := *record.Result
+        result.jobID = record.JobID
+        result.deprecated = record.Deprecated
+        result.usage = record.Usage
+        result.replayed = true
+        if result.Meta == nil {
+            result.Meta = map[string]interface{}{}
+        }
+        result.Meta["idempotency"] = map[string]interface{}{"key": key, "replayed": true}
+        log.Get().WithFields(logrus.Fields{
+            "tool_name":  toolName,
+            "session_id": getSessionID(session),
+        }).Info("MCP tool call replayed from idempotency key")
+        return result, nil
+    }
+}
+
+// runClaimed runs a call whose idempotency key this gateway holds, then
+// stores the result. Requests rejected before the tool ran, and failures a
+// retry may fix, release the key instead so the retry runs the tool.
+func runClaimed(ctx context.Context, r *http.Request, session *user.SessionState, toolName string, params map[string]interface{}, storeKey, fingerprint, token string) (ToolResult, error) {
+    result, err := runTool(ctx, r, session, toolName, params)
+
+    // Settle the key even if the client went away
+    settleCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+    defer cancel()
+
+    value := ""
+    if err == nil && !retryableToolError(errorCode(result)) {
+        encoded, _ := json.Marshal(idempotencyRecord{
+            Status:      idempotencyDone,
+            Fingerprint: fingerprint,
+            Result:      &result,
+            JobID:       result.jobID,
+            Deprecated:  result.deprecated,
+            Usage:       result.usage,
+        })
+        value = string(encoded)
+    }
+    window := durationOr(currentConfig().Idempotency.Window, 24*time.Hour)
+    if serr := idempotencySettleScript.Run(settleCtx, redisClient(), []string{storeKey}, token, value, window.Milliseconds()).Err(); serr != nil {
+        log.Get().WithError(serr).WithField("tool_name", toolName).Warn("Failed to store idempotent tool result")
+    }
+    return result, err
+}
+
+// idempotencyErrorStatus maps idempotency failures to an HTTP status and
+// error code
+func idempotencyErrorStatus(err error) (int, string, bool) {
+    switch err {
+    case errIdempotencyInvalidKey:
+        return http.StatusBadRequest, "invalid_idempotency_key", true
+    case errIdempotencyAnonymous:
+        return http.StatusUnauthorized, "idempotency_requires_identity", true
+    case errIdempotencyKeyReused:
+        return http.StatusUnprocessableEntity, "idempotency_key_reused", true
+    case errIdempotencyInProgress:
+        return http.StatusConflict, "idempotency_in_progress", true
+    case errIdempotencyUnavailable:
+        return http.StatusServiceUnavailable, "idempotency_unavailable", true
+    }
+    return 0, "", false
+}
+
+// retryableToolError reports whether a failed call should run again when
+// retried, rather than have its failure replayed
+func retryableToolError(code string) bool {
+    switch code {
+    case toolErrorUpstream, toolErrorTimeout, toolErrorCancelled:
+        return true
+    }
+    return false
+}
+
+// awaitIdempotentResult waits up to wait for the call holding a key to
+// finish. It returns nil when the key was released without a result.
+func awaitIdempotentResult(ctx context.Context, client *redis.Client, storeKey, fingerprint string, wait time.Duration) (*idempotencyRecord, error) {
+    ctx, cancel := context.WithTimeout(ctx, wait)
+    defer cancel()
+    ticker := time.NewTicker(100 * time.Millisecond)
+    defer ticker.Stop()
+    for {
+        raw, err := client.Get(ctx, storeKey).Result()
+        if err == redis.Nil {
+            return nil, nil
+        }
+        if err != nil && ctx.Err() != nil {
+            return nil, errIdempotencyInProgress
+        }
+        if err != nil {
+            return nil, errIdempotencyUnavailable
+        }
+        var record idempotencyRecord
+        if err := json.Unmarshal([]byte(raw), &record); err != nil {
+            return nil, errIdempotencyUnavailable
+        }
+        if record.Fingerprint != fingerprint {
+            return nil, errIdempotencyKeyReused
+        }
+        if record.Status == idempotencyDone && record.Result != nil {
+            return &record, nil
+        }
+
+        select {
+        case <-ctx.Done():
+            return nil, errIdempotencyInProgress
+        case <-ticker.C:
+        }
+    }
+}
+
+func newIdempotencyToken() string {
+    buf := make([]byte, 12)
+    rand.Read(buf)
+    return hex.EncodeToString(buf)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+
+    "github.com/TykTechnologies/tyk/user"
+)
+
+// useEchoTool registers a generated tool, echo_items, whose gateway
+// operation is served by a test server answering with status. It returns
+// the number of calls that reached the server.
+func useEchoTool(t *testing.T, status *atomic.Int32) *atomic.Int32 {
+    t.Helper()
+    var hits atomic.Int32
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        hits.Add(1)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(int(status.Load()))
+        w.Write([]byte(`{"q":"` + r.URL.Query().Get("q") + `"}`))
+    }))
+    t.Cleanup(server.Close)
+    t.Setenv("TYK_GATEWAY_URL", server.URL)
+
+    state, _ := useRedis(t, func(cfg *MCPConfig) { cfg.ToolAccess.ExternalDefault = "allow" })
+    state.register(MCPTool{
+        Name: "echo_items",
+        InputSchema: InputSchema{
+            Type:       "object",
+            Properties: map[string]Property{"q": {Type: "string"}},
+        },
+    })
+    state.operations[toolKey("echo_items", defaultToolVersion)] = gatewayOperation{
+        ToolName:   "echo_items",
+        Version:    defaultToolVersion,
+        Method:     http.MethodGet,
+        ListenPath: "/echo/",
+        Path:       "/items",
+        Parameters: []openAPIParameter{{Name: "q", In: "query"}},
+    }
+    return &hits
+}
+
+func TestRunToolOnce(t *testing.T) {
+    ann := &user.SessionState{Alias: "ann"}
+    bob := &user.SessionState{Alias: "bob"}
+
+    // Each call is made with key by session; want is the error it fails
+    // with and replayed whether its result came from the first call
+    type call struct {
+        session  *user.SessionState
+        key      string
+        q        string
+        want     error
+        replayed bool
+    }
+    tests := []struct {
+        name string
+        // status is what the upstream answers with
+        status   int
+        calls    []call
+        wantHits int32
+    }{
+        {
+            name:     "without a key every call runs",
+            status:   http.StatusOK,
+            calls:    []call{{session: ann, q: "a"}, {session: ann, q: "a"}},
+            wantHits: 2,
+        },
+        {
+            name:     "repeat is replayed",
+            status:   http.StatusOK,
+            calls:    []call{{session: ann, key: "k1", q: "a"}, {session: ann, key: "k1", q: "a", replayed: true}},
+            wantHits: 1,
+        },
+        {
+            name:     "key reused for another request",
+            status:   http.StatusOK,
+            calls:    []call{{session: ann, key: "k1", q: "a"}, {session: ann, key: "k1", q: "b", want: errIdempotencyKeyReused}},
+            wantHits: 1,
+        },
+        {
+            name:     "keys are scoped to the caller",
+            status:   http.StatusOK,
+            calls:    []call{{session: ann, key: "k1", q: "a"}, {session: bob, key: "k1", q: "a"}},
+            wantHits: 2,
+        },
+        {
+            name:     "anonymous caller",
+            status:   http.StatusOK,
+            calls:    []call{{key: "k1", q: "a", want: errIdempotencyAnonymous}},
+            wantHits: 0,
+        },
+        {
+            name:     "invalid key",
+            status:   http.StatusOK,
+            calls:    []call{{session: ann, key: "bad\nkey", q: "a", want: errIdempotencyInvalidKey}},
+            wantHits: 0,
+        },
+        {
+            name:     "retryable failure releases the key",
+            status:   http.StatusServiceUnavailable,
+            calls:    []call{{session: ann, key: "k1", q: "a"}, {session: ann, key: "k1", q: "a"}},
+            wantHits: 2,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var status atomic.Int32
+            status.Store(int32(tt.status))
+            hits := useEchoTool(t, &status)
+
+            for i, c := range tt.calls {
+                r := httptest.NewRequest("POST", "/mcp", nil)
+                result, err := runToolOnce(context.Background(), r, c.session, "echo_items", map[string]interface{}{"q": c.q}, c.key)
+                if !errors.Is(err, c.want) {
+                    t.Fatalf("call %d: error %v, want %v", i, err, c.want)
+                }
+                if err != nil {
+                    continue
+                }
+                if result.replayed != c.replayed {
+                    t.Fatalf("call %d: replayed = %v, want %v", i, result.replayed, c.replayed)
+                }
+                if _, marked := result.Meta["idempotency"]; marked != c.replayed {
+                    t.Fatalf("call %d: _meta.idempotency set = %v, want %v", i, marked, c.replayed)
+                }
+            }
+            if got := hits.Load(); got != tt.wantHits {
+                t.Fatalf("upstream called %d times, want %d", got, tt.wantHits)
+            }
+        })
+    }
+}
+
+func TestRunToolOnceStoreUnavailable(t *testing.T) {
+    var status atomic.Int32
+    status.Store(http.StatusOK)
+    hits := useEchoTool(t, &status)
+    currentState().config.Redis.Addr = "127.0.0.1:1"
+
+    r := httptest.NewRequest("POST", "/mcp", nil)
+    _, err := runToolOnce(context.Background(), r, &user.SessionState{Alias: "ann"}, "echo_items", map[string]interface{}{"q": "a"}, "k1")
+    if !errors.Is(err, errIdempotencyUnavailable) {
+        t.Fatalf("error %v, want %v", err, errIdempotencyUnavailable)
+    }
+    if hits.Load() != 0 {
+        t.Fatalf("the tool ran without its key being claimed")
+    }
+}
+
+func TestValidIdempotencyKey(t *testing.T) {
+    tests := []struct {
+        key  string
+        want bool
+    }{
+        {key: "order-42", want: true},
+        {key: "a b~", want: true},
+        {key: "", want: false},
+        {key: "tab\there", want: false},
+        {key: "clé", want: false},
+        {key: string(make([]byte, idempotencyMaxKeyLength+1)), want: false},
+    }
+
+    for _, tt := range tests {
+        if got := validIdempotencyKey(tt.key); got != tt.want {
+            t.Errorf("validIdempotencyKey(%q) = %v, want %v", tt.key, got, tt.want)
+        }
+    }
+}
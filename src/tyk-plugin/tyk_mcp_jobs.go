@@ -0,0 +1,641 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
+    "github.com/sirupsen/logrus"
+)
+
+// JobsConfig controls tool calls run as background jobs. A call to an
+// async tool runs as a job when the client sends Prefer: respond-async.
+type JobsConfig struct {
+    // Tools adds tools to those flagged async in code
+    Tools []string `json:"tools"`
+    // Timeout is the deadline of a job, in place of the tool's own
+    Timeout string `json:"timeout"`
+    // Retention is how long finished jobs and their results are kept
+    Retention string `json:"retention"`
+    // CleanupInterval is how often expired jobs are removed
+    CleanupInterval string `json:"cleanup_interval"`
+}
+
+const (
+    jobRunning   = "running"
+    jobCompleted = "completed"
+    jobFailed    = "failed"
+    jobCancelled = "cancelled"
+
+    jobsExpiryKey = "mcp-jobs-expiry"
+
+    // jobGrace is how long past its deadline a running job is left to its
+    // gateway before it is presumed abandoned
+    jobGrace = time.Minute
+)
+
+// toolJob is a tool call running in the background and its outcome
+type toolJob struct {
+    ID         string       `json:"id"`
+    Tool       string       `json:"tool"`
+    Status     string       `json:"status"`
+    Owner      string       `json:"owner"`
+    CreatedAt  time.Time    `json:"created_at"`
+    UpdatedAt  time.Time    `json:"updated_at"`
+    Deadline   time.Time    `json:"deadline"`
+    FinishedAt *time.Time   `json:"finished_at,omitempty"`
+    ExpiresAt  *time.Time   `json:"expires_at,omitempty"`
+    Progress   *jobProgress `json:"progress,omitempty"`
+    Result     *ToolResult  `json:"result,omitempty"`
+}
+
+type jobProgress struct {
+    Progress float64 `json:"progress"`
+    Total    float64 `json:"total,omitempty"`
+    Message  string  `json:"message,omitempty"`
+}
+
+// errJobNotFound and errJobFinished are returned for jobs that do not
+// exist or have already finished
+var (
+    errJobNotFound = errors.New("job not found")
+    errJobFinished = errors.New("job has already finished")
+)
+
+// jobAcceptedSchema is the structured result of a call started as a job,
+// offered alongside a tool's own output schema
+var jobAcceptedSchema = Property{
+    Type: "object",
+    Properties: map[string]Property{
+        "status":     {Type: "string", Const: "running"},
+        "job_id":     {Type: "string"},
+        "tool":       {Type: "string"},
+        "status_url": {Type: "string"},
+        "deadline":   {Type: "string", Format: "date-time"},
+        "message":    {Type: "string"},
+    },
+    Required: []string{"status", "job_id", "tool", "status_url"},
+}
+
+// progressFunc reports how far a tool call has got. Total is 0 when it is
+// not known.
+type progressFunc func(progress, total float64, message string)
+
+type progressKey struct{}
+
+func withProgress(ctx context.Context, report progressFunc) context.Context {
+    return context.WithValue(ctx, progressKey{}, report)
+}
+
+// reportProgress is called by tools as they work. It does nothing unless
+// the call is a job or the client asked for progress.
+func reportProgress(ctx context.Context, progress, total float64, message string) {
+    if report, ok := ctx.Value(progressKey{}).(progressFunc); ok {
+        report(progress, total, message)
+    }
+}
+
+// sessionProgress sends notifications/progress for token over an MCP
+// session's stream
+func sessionProgress(sess *mcpSession, token interface{}) progressFunc {
+    return func(progress, total float64, message string) {
+        params := map[string]interface{}{"progressToken": token, "progress": progress}
+        if total > 0 {
+            params["total"] = total
+        }
+        if message != "" {
+            params["message"] = message
+        }
+        sess.notify("notifications/progress", params)
+    }
+}
+
+// isAsync reports whether tool may run as a job
+func isAsync(tool MCPTool) bool {
+    if tool.Async {
+        return true
+    }
+    for _, name := range currentConfig().Jobs.Tools {
+        if name == tool.Name {
+            return true
+        }
+    }
+    return false
+}
+
+// withJobOutput lists tool as async, with an output schema that also
+// admits the job accepted result
+func withJobOutput(tool MCPTool) MCPTool {
+    tool.Async = true
+    if tool.OutputSchema != nil {
+        tool.OutputSchema = withOutputAlternative(*tool.OutputSchema, jobAcceptedSchema)
+    }
+    return tool
+}
+
+// runsAsJob reports whether a call should be started in the background.
+// Jobs belong to their caller, so anonymous calls always run inline.
+func runsAsJob(tool MCPTool, r *http.Request, session *user.SessionState) bool {
+    if r == nil || !isAsync(tool) || callerFromSession(session).Anonymous() {
+        return false
+    }
+    for _, value := range r.Header.Values("Prefer") {
+        for _, pref := range strings.Split(value, ",") {
+            if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// jobRunner is a job running on this gateway
+type jobRunner struct {
+    cancel context.CancelCauseFunc
+    notify progressFunc
+
+    mu        sync.Mutex
+    job       *toolJob
+    lastSaved time.Time
+}
+
+var localJobs = struct {
+    sync.Mutex
+    byID map[string]*jobRunner
+}{byID: map[string]*jobRunner{}}
+
+// startJob stores a validated call as a running job, starts it in the
+// background and returns the accepted result in place of the tool's output.
+// Progress is also sent to the client when ctx carries a progress token.
+func startJob(ctx context.Context, r *http.Request, session *user.SessionState, tool MCPTool, params map[string]interface{}) (ToolResult, error) {
+    caller := callerFromSession(session)
+    id, err := newJobID()
+    if err != nil {
+        return ToolResult{}, err
+    }
+    timeout := durationOr(currentConfig().Jobs.Timeout, 15*time.Minute)
+    now := time.Now()
+    job := &toolJob{
+        ID:        id,
+        Tool:      tool.Name,
+        Status:    jobRunning,
+        Owner:     caller.ID,
+        CreatedAt: now,
+        UpdatedAt: now,
+        Deadline:  now.Add(timeout),
+    }
+
+    storeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    _, err = redisClient().TxPipelined(storeCtx, func(pipe redis.Pipeliner) error {
+        if err := saveJob(storeCtx, pipe, job); err != nil {
+            return err
+        }
+        pipe.ZAdd(storeCtx, jobsOwnerKey(caller.ID), redis.Z{Score: float64(now.UnixMilli()), Member: id})
+        return nil
+    })
+    if err != nil {
+        return toolErrorResult(&ToolError{Code: toolErrorUpstream, Message: "job store unavailable: " + err.Error()}), nil
+    }
+
+    runCtx, cancelRun := context.WithCancelCause(context.Background())
+    runner := &jobRunner{cancel: cancelRun, job: job, lastSaved: now}
+    if report, ok := ctx.Value(progressKey{}).(progressFunc); ok {
+        runner.notify = report
+    }
+    localJobs.Lock()
+    localJobs.byID[id] = runner
+    localJobs.Unlock()
+
+    // The job outlives the request; the caller's credentials stay in
+    // memory for generated tools that forward them, and are never stored
+    replay := r.Clone(context.Background())
+    replay.Body = http.NoBody
+    go runner.run(runCtx, replay, session, tool, params, timeout)
+
+    log.Get().WithFields(logrus.Fields{
+        "tool_name":  tool.Name,
+        "job_id":     id,
+        "owner":      caller.ID,
+        "session_id": getSessionID(session),
+    }).Info("MCP tool call started as a job")
+
+    accepted := map[string]interface{}{
+        "status":     jobRunning,
+        "job_id":     id,
+        "tool":       tool.Name,
+        "status_url": "/mcp/jobs/" + id,
+        "deadline":   job.Deadline.Format(time.RFC3339),
+        "message":    fmt.Sprintf("%s is running as job %s; poll the status URL or read mcp://jobs/%s for the result", tool.Name, id, id),
+    }
+    return ToolResult{
+        Content:           []ContentBlock{{Type: "text", Text: renderToolText(accepted)}},
+        StructuredContent: accepted,
+        jobID:             id,
+    }, nil
+}
+
+func (j *jobRunner) run(ctx context.Context, r *http.Request, session *user.SessionState, tool MCPTool, params map[string]interface{}, timeout time.Duration) {
+    defer func() {
+        localJobs.Lock()
+        delete(localJobs.byID, j.job.ID)
+        localJobs.Unlock()
+        j.cancel(nil)
+    }()
+    go j.watchCancel(ctx)
+
+    result := invokeToolWithin(withProgress(ctx, j.progress), r, session, tool, params, timeout)
+
+    status := jobCompleted
+    if result.IsError {
+        status = jobFailed
+        if errorCode(result) == toolErrorCancelled {
+            status = jobCancelled
+        }
+    }
+    j.finish(status, &result)
+}
+
+// progress records the job's progress, persisting it at most once a second,
+// and forwards it to the client that started the job
+func (j *jobRunner) progress(progress, total float64, message string) {
+    j.mu.Lock()
+    j.job.Progress = &jobProgress{Progress: progress, Total: total, Message: message}
+    if time.Since(j.lastSaved) >= time.Second {
+        j.lastSaved = time.Now()
+        j.save()
+    }
+    j.mu.Unlock()
+
+    if j.notify != nil {
+        j.notify(progress, total, message)
+    }
+}
+
+func (j *jobRunner) finish(status string, result *ToolResult) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+
+    now := time.Now()
+    expires := now.Add(durationOr(currentConfig().Jobs.Retention, 24*time.Hour))
+    j.job.Status = status
+    j.job.FinishedAt = &now
+    j.job.ExpiresAt = &expires
+    j.job.Result = result
+    j.save()
+    notifyResourceUpdated("mcp://jobs/" + j.job.ID)
+
+    log.Get().WithFields(logrus.Fields{
+        "tool_name": j.job.Tool,
+        "job_id":    j.job.ID,
+        "status":    status,
+        "duration":  now.Sub(j.job.CreatedAt).String(),
+    }).Info("MCP job finished")
+}
+
+// save writes the job; callers hold j.mu
+func (j *jobRunner) save() {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    j.job.UpdatedAt = time.Now()
+    _, err := redisClient().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        return saveJob(ctx, pipe, j.job)
+    })
+    if err != nil {
+        log.Get().WithError(err).WithField("job_id", j.job.ID).Warn("Failed to store job")
+    }
+}
+
+// watchCancel stops the job when a cancel request for it arrives on
+// another gateway
+func (j *jobRunner) watchCancel(ctx context.Context) {
+    ticker := time.NewTicker(2 * time.Second)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            check, cancel := context.WithTimeout(ctx, 2*time.Second)
+            actor, err := redisClient().Get(check, jobCancelKey(j.job.ID)).Result()
+            cancel()
+            if err == nil {
+                j.cancel(errors.New("cancelled by " + actor))
+                return
+            }
+        }
+    }
+}
+
+// cancelJob stops a running job, here or on whichever gateway runs it
+func cancelJob(ctx context.Context, job *toolJob, actor string) error {
+    if job.Status != jobRunning {
+        return errJobFinished
+    }
+    localJobs.Lock()
+    runner := localJobs.byID[job.ID]
+    localJobs.Unlock()
+    if runner != nil {
+        runner.cancel(errors.New("cancelled by " + actor))
+        return nil
+    }
+    return redisClient().Set(ctx, jobCancelKey(job.ID), actor, time.Until(job.Deadline)+jobGrace).Err()
+}
+
+// saveJob queues the job write. Running jobs live until their deadline plus
+// the retention period, finished ones for the retention period; the expiry
+// index lets expireJobs clean up after both.
+func saveJob(ctx context.Context, pipe redis.Pipeliner, job *toolJob) error {
+    encoded, err := json.Marshal(job)
+    if err != nil {
+        return err
+    }
+    retention := durationOr(currentConfig().Jobs.Retention, 24*time.Hour)
+    expires := job.Deadline.Add(jobGrace)
+    ttl := time.Until(expires) + retention
+    if job.ExpiresAt != nil {
+        expires = *job.ExpiresAt
+        ttl = time.Until(expires)
+    }
+    pipe.Set(ctx, jobKey(job.ID), encoded, ttl)
+    pipe.ZAdd(ctx, jobsExpiryKey, redis.Z{Score: float64(expires.UnixMilli()), Member: job.ID})
+    return nil
+}
+
+func loadJob(ctx context.Context, id string) (*toolJob, error) {
+    raw, err := redisClient().Get(ctx, jobKey(id)).Result()
+    if err == redis.Nil {
+        return nil, errJobNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    var job toolJob
+    if err := json.Unmarshal([]byte(raw), &job); err != nil {
+        return nil, err
+    }
+    return &job, nil
+}
+
+// listJobs returns the owner's newest jobs first, pruning index members
+// whose job has expired
+func listJobs(ctx context.Context, owner, status string, limit int) ([]*toolJob, error) {
+    client := redisClient()
+    ids, err := client.ZRevRange(ctx, jobsOwnerKey(owner), 0, -1).Result()
+    if err != nil || len(ids) == 0 {
+        return []*toolJob{}, err
+    }
+    keys := make([]string, len(ids))
+    for i, id := range ids {
+        keys[i] = jobKey(id)
+    }
+    values, err := client.MGet(ctx, keys...).Result()
+    if err != nil {
+        return nil, err
+    }
+
+    jobs := []*toolJob{}
+    var gone []interface{}
+    for i, value := range values {
+        raw, ok := value.(string)
+        if !ok {
+            gone = append(gone, ids[i])
+            continue
+        }
+        var job toolJob
+        if json.Unmarshal([]byte(raw), &job) != nil {
+            continue
+        }
+        if status != "" && job.Status != status {
+            continue
+        }
+        if len(jobs) < limit {
+            jobs = append(jobs, &job)
+        }
+    }
+    if len(gone) > 0 {
+        client.ZRem(ctx, jobsOwnerKey(owner), gone...)
+    }
+    return jobs, nil
+}
+
+// expireJobs removes finished jobs past their retention and fails running
+// jobs whose gateway went away before finishing them
+func expireJobs() {
+    for {
+        time.Sleep(durationOr(currentConfig().Jobs.CleanupInterval, time.Minute))
+
+        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+        client := redisClient()
+        ids, err := client.ZRangeByScore(ctx, jobsExpiryKey, &redis.ZRangeBy{
+            Min: "-inf",
+            Max: fmt.Sprint(time.Now().UnixMilli()),
+        }).Result()
+        if err != nil {
+            log.Get().WithError(err).Warn("Failed to read expiring jobs")
+        }
+        for _, id := range ids {
+            job, err := loadJob(ctx, id)
+            switch {
+            case errors.Is(err, errJobNotFound):
+                client.ZRem(ctx, jobsExpiryKey, id)
+            case err != nil:
+                log.Get().WithError(err).WithField("job_id", id).Warn("Failed to expire job")
+            case job.Status == jobRunning:
+                abandonJob(ctx, job)
+            default:
+                _, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+                    pipe.Del(ctx, jobKey(id), jobCancelKey(id))
+                    pipe.ZRem(ctx, jobsExpiryKey, id)
+                    pipe.ZRem(ctx, jobsOwnerKey(job.Owner), id)
+                    return nil
+                })
+                if err != nil {
+                    log.Get().WithError(err).WithField("job_id", id).Warn("Failed to expire job")
+                }
+            }
+        }
+        cancel()
+    }
+}
+
+func abandonJob(ctx context.Context, job *toolJob) {
+    now := time.Now()
+    expires := now.Add(durationOr(currentConfig().Jobs.Retention, 24*time.Hour))
+    result := toolErrorResult(&ToolError{
+        Code:    toolErrorTimeout,
+        Message: fmt.Sprintf("job %s did not finish by its deadline; the gateway running it may have stopped", job.ID),
+    })
+    job.Status = jobFailed
+    job.FinishedAt = &now
+    job.ExpiresAt = &expires
+    job.UpdatedAt = now
+    job.Result = &result
+    _, err := redisClient().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        return saveJob(ctx, pipe, job)
+    })
+    if err != nil {
+        log.Get().WithError(err).WithField("job_id", job.ID).Warn("Failed to fail abandoned job")
+        return
+    }
+    log.Get().WithFields(logrus.Fields{
+        "job_id":    job.ID,
+        "tool_name": job.Tool,
+    }).Warn("MCP job abandoned past its deadline")
+}
+
+// handleJobs serves the job API for clients not following progress over
+// an MCP session:
+//
+//	GET  /mcp/jobs[?status=&limit=]   list the caller's jobs
+//	GET  /mcp/jobs/{id}               read a job and, once finished, its result
+//	POST /mcp/jobs/{id}/cancel        cancel a running job
+//
+// Callers only ever see their own jobs.
+func handleJobs(rw http.ResponseWriter, r *http.Request, session *user.SessionState) {
+    caller := callerFromSession(session)
+    if caller.Anonymous() {
+        writeJobError(rw, http.StatusUnauthorized, "unauthorized", "the job API requires an identified caller")
+        return
+    }
+
+    parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/mcp/jobs"), "/"), "/")
+    ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+    defer cancel()
+
+    switch {
+    case parts[0] == "" && r.Method == http.MethodGet:
+        limit := 50
+        if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+            limit = l
+        }
+        jobs, err := listJobs(ctx, caller.ID, r.URL.Query().Get("status"), limit)
+        if err != nil {
+            writeJobError(rw, http.StatusServiceUnavailable, "job_store_unavailable", err.Error())
+            return
+        }
+        writeJSON(rw, http.StatusOK, map[string]interface{}{
+            "jobs":      jobs,
+            "count":     len(jobs),
+            "timestamp": time.Now().Format(time.RFC3339),
+        })
+
+    case len(parts) == 1 && r.Method == http.MethodGet:
+        job, err := loadJob(ctx, parts[0])
+        if err == nil && job.Owner != caller.ID {
+            err = errJobNotFound
+        }
+        if err != nil {
+            writeJobLookupError(rw, err)
+            return
+        }
+        writeJSON(rw, http.StatusOK, job)
+
+    case len(parts) == 2 && parts[1] == "cancel" && r.Method == http.MethodPost:
+        job, err := loadJob(ctx, parts[0])
+        if err == nil && job.Owner != caller.ID {
+            err = errJobNotFound
+        }
+        if err == nil {
+            err = cancelJob(ctx, job, caller.ID)
+        }
+        if err != nil {
+            writeJobLookupError(rw, err)
+            return
+        }
+        log.Get().WithFields(logrus.Fields{
+            "job_id":    job.ID,
+            "tool_name": job.Tool,
+            "actor":     caller.ID,
+        }).Info("MCP job cancellation requested")
+        writeJSON(rw, http.StatusAccepted, map[string]interface{}{
+            "job_id":  job.ID,
+            "status":  "cancelling",
+            "message": "the job stops at its next cancellation point",
+        })
+
+    default:
+        writeJobError(rw, http.StatusNotFound, "not_found", "unknown job endpoint")
+    }
+}
+
+func writeJobLookupError(rw http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, errJobNotFound):
+        writeJobError(rw, http.StatusNotFound, "job_not_found", err.Error())
+    case errors.Is(err, errJobFinished):
+        writeJobError(rw, http.StatusConflict, "job_finished", err.Error())
+    default:
+        writeJobError(rw, http.StatusServiceUnavailable, "job_store_unavailable", err.Error())
+    }
+}
+
+func writeJobError(rw http.ResponseWriter, status int, code, message string) {
+    writeJSON(rw, status, map[string]interface{}{"error": code, "message": message})
+}
+
+// errorCode returns the code of a failed result's error
+func errorCode(result ToolResult) string {
+    if structured, ok := result.StructuredContent.(map[string]interface{}); ok {
+        if toolErr, ok := structured["error"].(*ToolError); ok {
+            return toolErr.Code
+        }
+    }
+    return ""
+}
+
+func newJobID() (string, error) {
+    b := make([]byte, 12)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return "job_" + hex.EncodeToString(b), nil
+}
+
+func jobKey(id string) string {
+    return "mcp-job:" + id
+}
+
+func jobCancelKey(id string) string {
+    return "mcp-job-cancel:" + id
+}
+
+func jobsOwnerKey(owner string) string {
+    return "mcp-jobs:" + owner
+}
+
+func init() {
+    registerResourceProvider(&resourceProvider{
+        Template: MCPResourceTemplate{
+            URITemplate: "mcp://jobs/{job_id}",
+            Name:        "Tool job",
+            Description: "Status, progress and result of a tool call running as a job",
+            MimeType:    "application/json",
+        },
+        list: func() []MCPResource { return nil },
+        read: func(ctx context.Context, r *http.Request, session *user.SessionState, vars map[string]string) (interface{}, error) {
+            job, err := loadJob(ctx, vars["job_id"])
+            if errors.Is(err, errJobNotFound) {
+                return nil, errResourceNotFound
+            }
+            if err != nil {
+                return nil, err
+            }
+            if job.Owner != callerFromSession(session).ID {
+                return nil, errResourceNotFound
+            }
+            return job, nil
+        },
+    })
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
+)
+
+// startTestJob calls tool for session asking for it to run as a job, and
+// returns the job's ID
+func startTestJob(t *testing.T, session *user.SessionState, tool string, params map[string]interface{}) string {
+    t.Helper()
+    r := httptest.NewRequest(http.MethodPost, "/mcp/call/"+tool, nil)
+    r.Header.Set("Prefer", "wait=5, respond-async")
+    result, err := runTool(context.Background(), r, session, tool, params)
+    if err != nil {
+        t.Fatal(err)
+    }
+    accepted, _ := result.StructuredContent.(map[string]interface{})
+    id, _ := accepted["job_id"].(string)
+    if id == "" || accepted["status"] != jobRunning {
+        t.Fatalf("%s did not start as a job: %+v", tool, result.StructuredContent)
+    }
+    return id
+}
+
+// waitForJob waits for a job to finish and returns it
+func waitForJob(t *testing.T, id string) *toolJob {
+    t.Helper()
+    for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        job, err := loadJob(context.Background(), id)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if job.Status != jobRunning {
+            return job
+        }
+    }
+    t.Fatalf("job %s is still running", id)
+    return nil
+}
+
+// callJobAPI makes a request to the job API for session
+func callJobAPI(session *user.SessionState, method, path string) (int, map[string]interface{}) {
+    w := httptest.NewRecorder()
+    handleJobs(w, httptest.NewRequest(method, path, nil), session)
+    var body map[string]interface{}
+    json.Unmarshal(w.Body.Bytes(), &body)
+    return w.Code, body
+}
+
+func TestRunsAsJob(t *testing.T) {
+    useConfig(t, func(cfg *MCPConfig) { cfg.Jobs.Tools = []string{"tyk_api_analytics"} })
+    ann := &user.SessionState{Alias: "ann"}
+
+    tests := []struct {
+        name    string
+        tool    MCPTool
+        prefer  []string
+        session *user.SessionState
+        want    bool
+    }{
+        {name: "async tool", tool: sentraipBulkTool, prefer: []string{"respond-async"}, session: ann, want: true},
+        {name: "among other preferences", tool: sentraipBulkTool, prefer: []string{"return=minimal", "wait=10, Respond-Async"}, session: ann, want: true},
+        {name: "async by config", tool: MCPTool{Name: "tyk_api_analytics"}, prefer: []string{"respond-async"}, session: ann, want: true},
+        {name: "not asked for", tool: sentraipBulkTool, session: ann},
+        {name: "not async", tool: MCPTool{Name: "sentraip_threat_check"}, prefer: []string{"respond-async"}, session: ann},
+        {name: "anonymous", tool: sentraipBulkTool, prefer: []string{"respond-async"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodPost, "/mcp", nil)
+            for _, value := range tt.prefer {
+                r.Header.Add("Prefer", value)
+            }
+            if got := runsAsJob(tt.tool, r, tt.session); got != tt.want {
+                t.Fatalf("runsAsJob = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestJobLifecycle(t *testing.T) {
+    var status atomic.Int32
+    status.Store(http.StatusOK)
+    hits := useEchoTool(t, &status)
+    currentConfig().Jobs.Tools = []string{"echo_items"}
+    ann := &user.SessionState{Alias: "ann"}
+    bob := &user.SessionState{Alias: "bob"}
+
+    id := startTestJob(t, ann, "echo_items", map[string]interface{}{"q": "a"})
+    job := waitForJob(t, id)
+    if job.Status != jobCompleted || job.Owner != "ann" || job.FinishedAt == nil || job.ExpiresAt == nil || hits.Load() != 1 {
+        t.Fatalf("job %+v after %d calls, want it completed once", job, hits.Load())
+    }
+    if data := job.Result.StructuredContent.(map[string]interface{})["data"]; data.(map[string]interface{})["q"] != "a" {
+        t.Fatalf("job result %+v, want the tool's output", job.Result.StructuredContent)
+    }
+
+    tests := []struct {
+        name       string
+        session    *user.SessionState
+        method     string
+        path       string
+        wantStatus int
+        wantError  string
+    }{
+        {name: "read", session: ann, method: http.MethodGet, path: "/mcp/jobs/" + id, wantStatus: http.StatusOK},
+        {name: "list", session: ann, method: http.MethodGet, path: "/mcp/jobs?status=completed", wantStatus: http.StatusOK},
+        {name: "read another caller's job", session: bob, method: http.MethodGet, path: "/mcp/jobs/" + id, wantStatus: http.StatusNotFound, wantError: "job_not_found"},
+        {name: "cancel finished job", session: ann, method: http.MethodPost, path: "/mcp/jobs/" + id + "/cancel", wantStatus: http.StatusConflict, wantError: "job_finished"},
+        {name: "unknown job", session: ann, method: http.MethodGet, path: "/mcp/jobs/job_0", wantStatus: http.StatusNotFound, wantError: "job_not_found"},
+        {name: "anonymous", method: http.MethodGet, path: "/mcp/jobs", wantStatus: http.StatusUnauthorized, wantError: "unauthorized"},
+        {name: "unknown endpoint", session: ann, method: http.MethodDelete, path: "/mcp/jobs/" + id, wantStatus: http.StatusNotFound, wantError: "not_found"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            code, body := callJobAPI(tt.session, tt.method, tt.path)
+            if errCode, _ := body["error"].(string); code != tt.wantStatus || errCode != tt.wantError {
+                t.Fatalf("%s %s = %d %v, want %d %s", tt.method, tt.path, code, body, tt.wantStatus, tt.wantError)
+            }
+        })
+    }
+
+    if _, body := callJobAPI(bob, http.MethodGet, "/mcp/jobs"); body["count"] != 0.0 {
+        t.Fatalf("bob's jobs %v, want none", body)
+    }
+    if _, body := callJobAPI(ann, http.MethodGet, "/mcp/jobs?status=running"); body["count"] != 0.0 {
+        t.Fatalf("ann's running jobs %v, want none", body)
+    }
+}
+
+func TestJobCancel(t *testing.T) {
+    useSlowEchoTool(t)
+    currentConfig().Jobs.Tools = []string{"echo_items"}
+    ann := &user.SessionState{Alias: "ann"}
+
+    id := startTestJob(t, ann, "echo_items", map[string]interface{}{"q": "a"})
+    if code, body := callJobAPI(ann, http.MethodPost, "/mcp/jobs/"+id+"/cancel"); code != http.StatusAccepted {
+        t.Fatalf("cancel = %d %v, want it accepted", code, body)
+    }
+
+    job := waitForJob(t, id)
+    toolErr, _ := job.Result.StructuredContent.(map[string]interface{})["error"].(map[string]interface{})
+    if job.Status != jobCancelled || toolErr["message"] != "tool echo_items was cancelled: cancelled by ann" {
+        t.Fatalf("job %+v, want it cancelled by ann", job)
+    }
+}
+
+func TestJobProgress(t *testing.T) {
+    useSentraIP(t, map[string]float64{"8.8.8.8": 1, "8.8.4.4": 1, "1.1.1.1": 1}, nil)
+    ann := &user.SessionState{Alias: "ann"}
+
+    var mu sync.Mutex
+    var reports []float64
+    ctx := withProgress(context.Background(), func(progress, total float64, message string) {
+        mu.Lock()
+        reports = append(reports, progress/total)
+        mu.Unlock()
+    })
+    tool, _ := currentState().resolveTool(sentraipBulkTool.Name, "")
+    params := map[string]interface{}{"targets": []interface{}{"8.8.8.8", "8.8.4.4", "1.1.1.1"}}
+    result, err := startJob(ctx, httptest.NewRequest(http.MethodPost, "/mcp", nil), ann, tool, params)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    job := waitForJob(t, result.jobID)
+    if job.Status != jobCompleted || job.Progress == nil || job.Progress.Progress != 3 || job.Progress.Total != 3 {
+        t.Fatalf("job %+v, want it completed with all targets checked", job)
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    if len(reports) != 3 || reports[2] != 1 {
+        t.Fatalf("progress reports %v, want one per target", reports)
+    }
+}
+
+func TestAbandonJob(t *testing.T) {
+    useRedis(t, nil)
+    ctx := context.Background()
+    past := time.Now().Add(-time.Hour)
+    job := &toolJob{ID: "job_1", Tool: "echo_items", Status: jobRunning, Owner: "ann", CreatedAt: past, Deadline: past}
+    if _, err := redisClient().TxPipelined(ctx, func(pipe redis.Pipeliner) error { return saveJob(ctx, pipe, job) }); err != nil {
+        t.Fatal(err)
+    }
+
+    abandonJob(ctx, job)
+    stored, err := loadJob(ctx, "job_1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    toolErr, _ := stored.Result.StructuredContent.(map[string]interface{})["error"].(map[string]interface{})
+    if stored.Status != jobFailed || toolErr["code"] != toolErrorTimeout || stored.ExpiresAt == nil {
+        t.Fatalf("job %+v, want it failed with a timeout", stored)
+    }
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/sirupsen/logrus"
+)
+
+// JSON-RPC 2.0 error codes, plus the MCP specific ones
+const (
+    jsonRPCParseError     = -32700
+    jsonRPCInvalidRequest = -32600
+    jsonRPCMethodNotFound = -32601
+    jsonRPCInvalidParams  = -32602
+    jsonRPCInternalError  = -32603
+
+    // jsonRPCRateLimited is a server error for calls over a tool's rate
+    // limit or quota
+    jsonRPCRateLimited = -32029
+    // jsonRPCInProgress is a server error for repeats of a call, by
+    // idempotency key, that is still running
+    jsonRPCInProgress = -32009
+
+    // mcpResourceNotFound is the code MCP defines for unknown resources
+    mcpResourceNotFound = -32002
+    // mcpForbidden is used when the caller may not use a tool or resource
+    mcpForbidden = -32003
+)
+
+const (
+    mcpProtocolVersion  = "2025-06-18"
+    mcpSessionHeader    = "Mcp-Session-Id"
+    mcpSessionIdleTTL   = 30 * time.Minute
+    mcpStreamHeartbeat  = 25 * time.Second
+    mcpOutboxBufferSize = 64
+)
+
+var mcpSupportedProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+type jsonRPCRequest struct {
+    JSONRPC string          `json:"jsonrpc"`
+    ID      json.RawMessage `json:"id,omitempty"`
+    Method  string          `json:"method"`
+    Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type jsonRPCResponse struct {
+    JSONRPC string          `json:"jsonrpc"`
+    ID      json.RawMessage `json:"id"`
+    Result  interface{}     `json:"result,omitempty"`
+    Error   *jsonRPCError   `json:"error,omitempty"`
+}
+
+type jsonRPCError struct {
+    Code    int         `json:"code"`
+    Message string      `json:"message"`
+    Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *jsonRPCError) Error() string {
+    return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+type jsonRPCNotification struct {
+    JSONRPC string      `json:"jsonrpc"`
+    Method  string      `json:"method"`
+    Params  interface{} `json:"params,omitempty"`
+}
+
+// mcpRequest is the context a JSON-RPC method handler runs with. ctx is
+// cancelled when the client goes away or cancels the request.
+type mcpRequest struct {
+    ctx        context.Context
+    r          *http.Request
+    header     http.Header
+    session    *user.SessionState
+    caller     mcpCaller
+    mcpSession *mcpSession
+}
+
+// mcpMethodHandler handles one JSON-RPC method. Notifications are handled
+// by the same functions; their result is discarded.
+type mcpMethodHandler func(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError)
+
+var (
+    // mcpMethods maps JSON-RPC method names to handlers. Each feature file
+    // registers its methods from init.
+    mcpMethods = map[string]mcpMethodHandler{}
+
+    // mcpCapabilities is advertised from initialize; features add their
+    // capability entries from init
+    mcpCapabilities = map[string]interface{}{}
+)
+
+func registerMCPMethod(method string, handler mcpMethodHandler) {
+    mcpMethods[method] = handler
+}
+
+// mcpSession is a Streamable HTTP session created by initialize. It carries
+// the caller it was created for and the queue of server-to-client messages
+// delivered over the session's GET stream.
+type mcpSession struct {
+    ID         string
+    Caller     mcpCaller
+    TykSession *user.SessionState
+
+    mu            sync.Mutex
+    subscriptions map[string]bool
+    lastSeen      time.Time
+    outbox        chan jsonRPCNotification
+}
+
+var mcpSessions = struct {
+    sync.RWMutex
+    byID map[string]*mcpSession
+}{byID: map[string]*mcpSession{}}
+
+func newMCPSession(caller mcpCaller, session *user.SessionState) *mcpSession {
+    buf := make([]byte, 16)
+    rand.Read(buf)
+
+    s := &mcpSession{
+        ID:            hex.EncodeToString(buf),
+        Caller:        caller,
+        TykSession:    session,
+        subscriptions: map[string]bool{},
+        lastSeen:      time.Now(),
+        outbox:        make(chan jsonRPCNotification, mcpOutboxBufferSize),
+    }
+
+    mcpSessions.Lock()
+    mcpSessions.byID[s.ID] = s
+    mcpSessions.Unlock()
+    return s
+}
+
+func getMCPSession(id string) *mcpSession {
+    mcpSessions.RLock()
+    defer mcpSessions.RUnlock()
+    return mcpSessions.byID[id]
+}
+
+func deleteMCPSession(id string) {
+    mcpSessions.Lock()
+    delete(mcpSessions.byID, id)
+    mcpSessions.Unlock()
+}
+
+// allMCPSessions returns a snapshot of the live sessions
+func allMCPSessions() []*mcpSession {
+    mcpSessions.RLock()
+    defer mcpSessions.RUnlock()
+    out := make([]*mcpSession, 0, len(mcpSessions.byID))
+    for _, s := range mcpSessions.byID {
+        out = append(out, s)
+    }
+    return out
+}
+
+func (s *mcpSession) touch() {
+    s.mu.Lock()
+    s.lastSeen = time.Now()
+    s.mu.Unlock()
+}
+
+// notify queues a notification for the session's stream. It never blocks:
+// if the client is not draining its stream the notification is dropped.
+func (s *mcpSession) notify(method string, params interface{}) {
+    select {
+    case s.outbox <- jsonRPCNotification{JSONRPC: "2.0", Method: method, Params: params}:
+    default:
+        log.Get().WithFields(logrus.Fields{
+            "mcp_session": s.ID,
+            "method":      method,
+        }).Warn("MCP session outbox full, dropping notification")
+    }
+}
+
+// broadcastNotification sends a notification to every live session
+func broadcastNotification(method string, params interface{}) {
+    for _, s := range allMCPSessions() {
+        s.notify(method, params)
+    }
+}
+
+// handleMCPEndpoint serves the MCP Streamable HTTP transport: POST carries
+// JSON-RPC messages, GET opens the session's notification stream and
+// DELETE ends the session
+func handleMCPEndpoint(rw http.ResponseWriter, r *http.Request, session *user.SessionState) {
+    caller := callerFromSession(session)
+
+    var sess *mcpSession
+    if id := r.Header.Get(mcpSessionHeader); id != "" {
+        sess = getMCPSession(id)
+        if sess == nil || sess.Caller.ID != caller.ID {
+            http.Error(rw, `{"error":"session_not_found","message":"Unknown or expired MCP session"}`, http.StatusNotFound)
+            return
+        }
+        sess.touch()
+    }
+
+    switch r.Method {
+    case http.MethodPost:
+        handleJSONRPC(rw, r, &mcpRequest{r: r, header: rw.Header(), session: session, caller: caller, mcpSession: sess})
+    case http.MethodGet:
+        if sess == nil {
+            http.Error(rw, `{"error":"session_required","message":"Mcp-Session-Id header is required"}`, http.StatusBadRequest)
+            return
+        }
+        streamMCPSession(rw, r, sess)
+    case http.MethodDelete:
+        if sess == nil {
+            http.Error(rw, `{"error":"session_required","message":"Mcp-Session-Id header is required"}`, http.StatusBadRequest)
+            return
+        }
+        deleteMCPSession(sess.ID)
+        rw.WriteHeader(http.StatusNoContent)
+    default:
+        rw.Header().Set("Allow", "GET, POST, DELETE")
+        http.Error(rw, `{"error":"method_not_allowed"}`, http.StatusMethodNotAllowed)
+    }
+}
+
+func handleJSONRPC(rw http.ResponseWriter, r *http.Request, req *mcpRequest) {
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        writeJSONRPC(rw, nil, nil, &jsonRPCError{Code: jsonRPCParseError, Message: "Failed to read request body"})
+        return
+    }
+    if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+        writeJSONRPC(rw, nil, nil, &jsonRPCError{Code: jsonRPCInvalidRequest, Message: "JSON-RPC batches are not supported"})
+        return
+    }
+
+    var msg jsonRPCRequest
+    if err := json.Unmarshal(body, &msg); err != nil {
+        writeJSONRPC(rw, nil, nil, &jsonRPCError{Code: jsonRPCParseError, Message: "Invalid JSON"})
+        return
+    }
+    if msg.JSONRPC != "2.0" || msg.Method == "" {
+        writeJSONRPC(rw, msg.ID, nil, &jsonRPCError{Code: jsonRPCInvalidRequest, Message: "Not a JSON-RPC 2.0 request"})
+        return
+    }
+
+    handler, known := mcpMethods[msg.Method]
+
+    // Notifications carry no id and get no response body
+    req.ctx = r.Context()
+    if len(msg.ID) == 0 {
+        if known {
+            if _, rpcErr := handler(req, msg.Params); rpcErr != nil {
+                log.Get().WithError(rpcErr).WithField("method", msg.Method).Warn("MCP notification failed")
+            }
+        }
+        rw.WriteHeader(http.StatusAccepted)
+        return
+    }
+
+    if !known {
+        writeJSONRPC(rw, msg.ID, nil, &jsonRPCError{Code: jsonRPCMethodNotFound, Message: "Method not found: " + msg.Method})
+        return
+    }
+    ctx, done := trackRequest(req, msg.ID)
+    defer done()
+    req.ctx = ctx
+    result, rpcErr := handler(req, msg.Params)
+
+    log.Get().WithFields(logrus.Fields{
+        "method":     msg.Method,
+        "session_id": getSessionID(req.session),
+        "error":      rpcErr != nil,
+    }).Info("MCP JSON-RPC request served")
+
+    if msg.Method == "initialize" && rpcErr == nil && req.mcpSession != nil {
+        rw.Header().Set(mcpSessionHeader, req.mcpSession.ID)
+    }
+    writeJSONRPC(rw, msg.ID, result, rpcErr)
+}
+
+func writeJSONRPC(rw http.ResponseWriter, id json.RawMessage, result interface{}, rpcErr *jsonRPCError) {
+    if len(id) == 0 {
+        id = json.RawMessage("null")
+    }
+    resp := jsonRPCResponse{JSONRPC: "2.0", ID: id, Error: rpcErr}
+    if rpcErr == nil {
+        if result == nil {
+            result = struct{}{}
+        }
+        resp.Result = result
+    }
+    writeJSON(rw, http.StatusOK, resp)
+}
+
+// streamMCPSession holds the GET stream open and writes queued
+// notifications as server-sent events until the client goes away
+func streamMCPSession(rw http.ResponseWriter, r *http.Request, sess *mcpSession) {
+    flusher, ok := rw.(http.Flusher)
+    if !ok {
+        http.Error(rw, `{"error":"streaming_unsupported"}`, http.StatusInternalServerError)
+        return
+    }
+
+    rw.Header().Set("Content-Type", "text/event-stream")
+    rw.Header().Set("Cache-Control", "no-cache")
+    rw.Header().Set(mcpSessionHeader, sess.ID)
+    rw.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    heartbeat := time.NewTicker(mcpStreamHeartbeat)
+    defer heartbeat.Stop()
+
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case n := <-sess.outbox:
+            encoded, err := json.Marshal(n)
+            if err != nil {
+                continue
+            }
+            fmt.Fprintf(rw, "event: message\ndata: %s\n\n", encoded)
+            flusher.Flush()
+            sess.touch()
+        case <-heartbeat.C:
+            if getMCPSession(sess.ID) == nil {
+                return
+            }
+            fmt.Fprint(rw, ": keep-alive\n\n")
+            flusher.Flush()
+            sess.touch()
+        }
+    }
+}
+
+// expireMCPSessions drops sessions that have been idle for too long
+func expireMCPSessions() {
+    for range time.Tick(time.Minute) {
+        cutoff := time.Now().Add(-mcpSessionIdleTTL)
+        for _, s := range allMCPSessions() {
+            s.mu.Lock()
+            idle := s.lastSeen.Before(cutoff)
+            s.mu.Unlock()
+            if idle {
+                deleteMCPSession(s.ID)
+            }
+        }
+    }
+}
+
+// decodeParams unmarshals JSON-RPC params, mapping failures to -32602
+func decodeParams(params json.RawMessage, v interface{}) *jsonRPCError {
+    if len(params) == 0 {
+        params = json.RawMessage("{}")
+    }
+    if err := json.Unmarshal(params, v); err != nil {
+        return &jsonRPCError{Code: jsonRPCInvalidParams, Message: "Invalid params: " + err.Error()}
+    }
+    return nil
+}
+
+func handleInitialize(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    var p struct {
+        ProtocolVersion string `json:"protocolVersion"`
+    }
+    if rpcErr := decodeParams(params, &p); rpcErr != nil {
+        return nil, rpcErr
+    }
+
+    version := mcpProtocolVersion
+    for _, supported := range mcpSupportedProtocolVersions {
+        if p.ProtocolVersion == supported {
+            version = supported
+            break
+        }
+    }
+
+    req.mcpSession = newMCPSession(req.caller, req.session)
+
+    return map[string]interface{}{
+        "protocolVersion": version,
+        "capabilities":    mcpCapabilities,
+        "serverInfo": map[string]interface{}{
+            "name":    "tyk-mcp-gateway",
+            "version": "1.0.0",
+        },
+    }, nil
+}
+
+func handlePing(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    return struct{}{}, nil
+}
+
+func handleToolsListRPC(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    tools := visibleTools(listTools(), req.caller, req.r)
+    return map[string]interface{}{"tools": withRateLimitMeta(tools, req.session, req.r)}, nil
+}
+
+func handleToolsCallRPC(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    var p struct {
+        Name      string                 `json:"name"`
+        Arguments map[string]interface{} `json:"arguments"`
+        Meta      struct {
+            ProgressToken  interface{} `json:"progressToken"`
+            IdempotencyKey string      `json:"idempotencyKey"`
+        } `json:"_meta"`
+    }
+    if rpcErr := decodeParams(params, &p); rpcErr != nil {
+        return nil, rpcErr
+    }
+
+    // Progress goes out over the session's stream, so it needs a session
+    ctx := req.ctx
+    if p.Meta.ProgressToken != nil && req.mcpSession != nil {
+        ctx = withProgress(ctx, sessionProgress(req.mcpSession, p.Meta.ProgressToken))
+    }
+    result, err := runToolOnce(ctx, req.r, req.session, p.Name, p.Arguments, idempotencyKey(req.r, p.Meta.IdempotencyKey))
+    if limited, ok := err.(*rateLimitError); ok {
+        if req.header != nil {
+            setRateLimitHeaders(req.header, limited.usage)
+        }
+        return nil, &jsonRPCError{Code: jsonRPCRateLimited, Message: err.Error(), Data: map[string]interface{}{
+            "limit":      limited.usage.Exceeded,
+            "retryAfter": retryAfterSeconds(limited.usage.RetryAfter),
+        }}
+    }
+    if result.usage != nil && req.header != nil {
+        setRateLimitHeaders(req.header, result.usage)
+    }
+    if result.deprecated != nil && req.header != nil {
+        setDeprecationHeaders(req.header, result.deprecated)
+    }
+    if result.replayed && req.header != nil {
+        req.header.Set("Idempotent-Replayed", "true")
+    }
+    if verrs, ok := err.(ValidationErrors); ok {
+        return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: verrs.Error(), Data: map[string]interface{}{"errors": verrs}}
+    }
+    if err == errToolNotFound {
+        return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "Unknown tool: " + p.Name}
+    }
+    if err == errToolForbidden {
+        return nil, &jsonRPCError{Code: mcpForbidden, Message: "Tool not permitted: " + p.Name}
+    }
+    switch err {
+    case errIdempotencyInvalidKey, errIdempotencyKeyReused, errIdempotencyAnonymous:
+        return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: err.Error()}
+    case errIdempotencyInProgress:
+        return nil, &jsonRPCError{Code: jsonRPCInProgress, Message: err.Error()}
+    }
+    if err != nil {
+        return nil, &jsonRPCError{Code: jsonRPCInternalError, Message: err.Error()}
+    }
+    return result, nil
+}
+
+// listTools returns the registry sorted by tool name
+func listTools() []MCPTool {
+    state := currentState()
+    tools := make([]MCPTool, 0, len(state.tools))
+    for _, tool := range state.tools {
+        switch {
+        case requiresApproval(tool):
+            tool = withApprovalOutput(tool)
+        case isAsync(tool):
+            tool = withJobOutput(tool)
+        }
+        tool.Versions = state.listedVersions(tool.Name)
+        tools = append(tools, tool)
+    }
+    sort.Slice(tools, func(i, j int) bool { return tools[i].Name < tools[j].Name })
+    return tools
+}
+
+func init() {
+    registerMCPMethod("initialize", handleInitialize)
+    registerMCPMethod("ping", handlePing)
+    registerMCPMethod("notifications/initialized", handlePing)
+    registerMCPMethod("tools/list", handleToolsListRPC)
+    registerMCPMethod("tools/call", handleToolsCallRPC)
+    mcpCapabilities["tools"] = map[string]interface{}{"listChanged": true}
+
+    go expireMCPSessions()
+}
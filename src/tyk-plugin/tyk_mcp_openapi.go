@@ -0,0 +1,721 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/sirupsen/logrus"
+)
+
+// openAPIDocument is the subset of an OpenAPI 3 document (or Tyk OAS API
+// definition) needed to generate MCP tools
+type openAPIDocument struct {
+    OpenAPI string `json:"openapi"`
+    Info    struct {
+        Title   string `json:"title"`
+        Version string `json:"version"`
+    } `json:"info"`
+    Paths      map[string]map[string]json.RawMessage `json:"paths"`
+    Components struct {
+        Schemas    map[string]Property         `json:"schemas"`
+        Parameters map[string]openAPIParameter `json:"parameters"`
+    } `json:"components"`
+    Tyk *tykOASExtension `json:"x-tyk-api-gateway,omitempty"`
+    MCP *mcpExtension    `json:"x-mcp,omitempty"`
+}
+
+// tykOASExtension is the part of x-tyk-api-gateway that tells us where the
+// API is mounted on the gateway
+type tykOASExtension struct {
+    Info struct {
+        ID    string `json:"id"`
+        Name  string `json:"name"`
+        State struct {
+            Active bool `json:"active"`
+        } `json:"state"`
+    } `json:"info"`
+    Server struct {
+        ListenPath struct {
+            Value string `json:"value"`
+        } `json:"listenPath"`
+    } `json:"server"`
+}
+
+// mcpExtension is the x-mcp vendor extension. At document level it sets the
+// defaults for every operation; at operation level it overrides them.
+type mcpExtension struct {
+    Include     *bool  `json:"include,omitempty"`
+    Exclude     bool   `json:"exclude,omitempty"`
+    Name        string `json:"name,omitempty"`
+    Description string `json:"description,omitempty"`
+    Prefix      string `json:"prefix,omitempty"`
+    ListenPath  string `json:"listenPath,omitempty"`
+    // ReplacedBy and Sunset describe a deprecated operation's successor
+    // tool and removal date
+    ReplacedBy string `json:"replacedBy,omitempty"`
+    Sunset     string `json:"sunset,omitempty"`
+}
+
+type openAPIOperation struct {
+    OperationID string             `json:"operationId"`
+    Summary     string             `json:"summary"`
+    Description string             `json:"description"`
+    Parameters  []openAPIParameter `json:"parameters"`
+    RequestBody *struct {
+        Description string `json:"description"`
+        Required    bool   `json:"required"`
+        Content     map[string]struct {
+            Schema *Property `json:"schema"`
+        } `json:"content"`
+    } `json:"requestBody"`
+    Responses map[string]struct {
+        Content map[string]struct {
+            Schema *Property `json:"schema"`
+        } `json:"content"`
+    } `json:"responses"`
+    Deprecated bool          `json:"deprecated"`
+    MCP        *mcpExtension `json:"x-mcp,omitempty"`
+}
+
+type openAPIParameter struct {
+    Ref         string    `json:"$ref,omitempty"`
+    Name        string    `json:"name"`
+    In          string    `json:"in"`
+    Description string    `json:"description"`
+    Required    bool      `json:"required"`
+    Schema      *Property `json:"schema"`
+    // Argument is the tool argument that carries the parameter: its name,
+    // or <in>_<name> when the name is shared with another parameter or
+    // with the request body
+    Argument string `json:"-"`
+}
+
+// gatewayOperation is everything needed to replay a generated tool call
+// against the gateway
+type gatewayOperation struct {
+    ToolName    string
+    Version     string
+    Method      string
+    ListenPath  string
+    Path        string
+    Parameters  []openAPIParameter
+    HasBody     bool
+    Source      string
+    OperationID string
+}
+
+var (
+    openAPIMethods  = []string{"get", "put", "post", "delete", "patch", "head", "options"}
+    pathParamRegex  = regexp.MustCompile(`\{([^}]+)\}`)
+    toolNameCleaner = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+// loadOpenAPITools reads every OpenAPI document found under the given
+// comma separated list of files and directories and registers one MCP tool
+// per operation. Sources and documents that cannot be read are skipped and
+// returned as errors.
+func (s *mcpState) loadOpenAPITools(sources string) []error {
+    var problems []error
+    for _, source := range splitSources(sources) {
+        files, err := openAPISourceFiles(source)
+        if err != nil {
+            problems = append(problems, fmt.Errorf("OpenAPI source %s: %w", source, err))
+            continue
+        }
+
+        for _, file := range files {
+            tools, ops, err := generateToolsFromFile(file)
+            if err != nil {
+                problems = append(problems, fmt.Errorf("OpenAPI document %s: %w", file, err))
+                continue
+            }
+            for name, tool := range tools {
+                // Documents for other versions of an API add versions of
+                // its tools; anything else is a collision
+                if existing, exists := s.tools[name]; exists {
+                    _, generated := s.operations[toolKey(name, existing.Version)]
+                    _, sameVersion := s.versions[name][tool.Version]
+                    if !generated || sameVersion {
+                        log.Get().WithFields(logrus.Fields{
+                            "tool_name":    name,
+                            "tool_version": tool.Version,
+                            "file":         file,
+                        }).Warn("Generated MCP tool name collides with an existing tool, skipping")
+                        continue
+                    }
+                }
+                s.register(tool)
+                s.operations[toolKey(name, tool.Version)] = ops[name]
+            }
+            if len(tools) == 0 {
+                continue
+            }
+            log.Get().WithFields(logrus.Fields{
+                "file":        file,
+                "tools_count": len(tools),
+            }).Info("MCP tools generated from OpenAPI document")
+        }
+    }
+    return problems
+}
+
+// splitSources splits a comma separated list of OpenAPI sources
+func splitSources(sources string) []string {
+    var out []string
+    for _, source := range strings.Split(sources, ",") {
+        if source = strings.TrimSpace(source); source != "" {
+            out = append(out, source)
+        }
+    }
+    return out
+}
+
+func openAPISourceFiles(source string) ([]string, error) {
+    info, err := os.Stat(source)
+    if err != nil {
+        return nil, err
+    }
+    if !info.IsDir() {
+        return []string{source}, nil
+    }
+
+    entries, err := os.ReadDir(source)
+    if err != nil {
+        return nil, err
+    }
+
+    var files []string
+    for _, entry := range entries {
+        if entry.IsDir() {
+            continue
+        }
+        switch strings.ToLower(filepath.Ext(entry.Name())) {
+        case ".json", ".yaml", ".yml":
+            files = append(files, filepath.Join(source, entry.Name()))
+        }
+    }
+    sort.Strings(files)
+    return files, nil
+}
+
+// parseOpenAPIDocument decodes a JSON or YAML document. Classic Tyk API
+// definitions and anything that is not OpenAPI 3 return a nil document.
+func parseOpenAPIDocument(data []byte, file string) (*openAPIDocument, error) {
+    var doc openAPIDocument
+    if err := decodeConfigDocument(data, file, &doc); err != nil {
+        return nil, fmt.Errorf("invalid document: %w", err)
+    }
+    if !strings.HasPrefix(doc.OpenAPI, "3.") {
+        return nil, nil
+    }
+    return &doc, nil
+}
+
+func generateToolsFromFile(file string) (map[string]MCPTool, map[string]gatewayOperation, error) {
+    data, err := os.ReadFile(file)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    doc, err := parseOpenAPIDocument(data, file)
+    if err != nil || doc == nil {
+        return nil, nil, err
+    }
+    return generateTools(doc, file)
+}
+
+// generateTools turns every included operation of doc into an MCP tool
+func generateTools(doc *openAPIDocument, source string) (map[string]MCPTool, map[string]gatewayOperation, error) {
+    docExt := mcpExtension{}
+    if doc.MCP != nil {
+        docExt = *doc.MCP
+    }
+
+    if doc.Tyk != nil && !doc.Tyk.Info.State.Active {
+        return map[string]MCPTool{}, map[string]gatewayOperation{}, nil
+    }
+
+    listenPath := docExt.ListenPath
+    if doc.Tyk != nil && doc.Tyk.Server.ListenPath.Value != "" {
+        listenPath = doc.Tyk.Server.ListenPath.Value
+    }
+    if listenPath == "" {
+        return nil, nil, fmt.Errorf("no gateway listen path (set x-tyk-api-gateway.server.listenPath or x-mcp.listenPath)")
+    }
+
+    tools := map[string]MCPTool{}
+    ops := map[string]gatewayOperation{}
+
+    paths := make([]string, 0, len(doc.Paths))
+    for path := range doc.Paths {
+        paths = append(paths, path)
+    }
+    sort.Strings(paths)
+
+    for _, path := range paths {
+        item := doc.Paths[path]
+
+        var shared []openAPIParameter
+        if raw, ok := item["parameters"]; ok {
+            if err := json.Unmarshal(raw, &shared); err != nil {
+                return nil, nil, fmt.Errorf("invalid parameters for %s: %w", path, err)
+            }
+        }
+
+        for _, method := range openAPIMethods {
+            raw, ok := item[method]
+            if !ok {
+                continue
+            }
+
+            var op openAPIOperation
+            if err := json.Unmarshal(raw, &op); err != nil {
+                return nil, nil, fmt.Errorf("invalid operation %s %s: %w", strings.ToUpper(method), path, err)
+            }
+
+            opExt := mcpExtension{}
+            if op.MCP != nil {
+                opExt = *op.MCP
+            }
+            if !operationIncluded(docExt, opExt) {
+                continue
+            }
+
+            name := toolNameFor(docExt.Prefix, opExt.Name, op.OperationID, method, path)
+            if _, dup := tools[name]; dup {
+                return nil, nil, fmt.Errorf("duplicate tool name %q for %s %s", name, strings.ToUpper(method), path)
+            }
+
+            params := mergeParameters(doc, shared, op.Parameters)
+            defs := map[string]Property{}
+            tool := MCPTool{
+                Name:        name,
+                Title:       op.Summary,
+                Description: operationDescription(doc, opExt, op, method, path),
+                Annotations: operationAnnotations(method),
+                Version:     doc.Info.Version,
+                InputSchema: InputSchema{
+                    Type:       "object",
+                    Properties: map[string]Property{},
+                    Required:   []string{},
+                },
+            }
+
+            hasBody := false
+            if op.RequestBody != nil {
+                if media, ok := op.RequestBody.Content["application/json"]; ok {
+                    hasBody = true
+                    prop := importOpenAPISchema(doc, media.Schema, op.RequestBody.Description, defs)
+                    if prop.Description == "" {
+                        prop.Description = "JSON request body"
+                    }
+                    tool.InputSchema.Properties["body"] = prop
+                    if op.RequestBody.Required {
+                        tool.InputSchema.Required = append(tool.InputSchema.Required, "body")
+                    }
+                }
+            }
+
+            if err := assignArguments(params, hasBody); err != nil {
+                return nil, nil, fmt.Errorf("operation %s %s: %w", strings.ToUpper(method), path, err)
+            }
+            for _, p := range params {
+                if p.In == "cookie" {
+                    continue
+                }
+                tool.InputSchema.Properties[p.Argument] = importOpenAPISchema(doc, p.Schema, p.Description, defs)
+                if p.Required || p.In == "path" {
+                    tool.InputSchema.Required = append(tool.InputSchema.Required, p.Argument)
+                }
+            }
+
+            if len(defs) > 0 {
+                tool.InputSchema.Defs = defs
+            }
+            tool.OutputSchema = operationOutputSchema(doc, op)
+            if tool.Version == "" {
+                tool.Version = defaultToolVersion
+            }
+            if op.Deprecated {
+                tool.Deprecated = &ToolDeprecation{
+                    Message:    "the operation is deprecated in its OpenAPI document",
+                    ReplacedBy: opExt.ReplacedBy,
+                    Sunset:     opExt.Sunset,
+                }
+            }
+
+            tools[name] = tool
+            ops[name] = gatewayOperation{
+                ToolName:    name,
+                Version:     tool.Version,
+                Method:      strings.ToUpper(method),
+                ListenPath:  listenPath,
+                Path:        path,
+                Parameters:  params,
+                HasBody:     hasBody,
+                Source:      source,
+                OperationID: op.OperationID,
+            }
+        }
+    }
+
+    return tools, ops, nil
+}
+
+// operationAnnotations derives MCP hints from the HTTP method's semantics
+func operationAnnotations(method string) *ToolAnnotations {
+    switch method {
+    case "get", "head", "options":
+        return &ToolAnnotations{ReadOnlyHint: boolPtr(true)}
+    case "put", "delete":
+        return &ToolAnnotations{ReadOnlyHint: boolPtr(false), DestructiveHint: boolPtr(true), IdempotentHint: boolPtr(true)}
+    default:
+        return &ToolAnnotations{ReadOnlyHint: boolPtr(false), IdempotentHint: boolPtr(false)}
+    }
+}
+
+// operationIncluded applies the x-mcp include/exclude rules. Documents are
+// opt-out by default; x-mcp.include=false on the document makes them opt-in.
+func operationIncluded(docExt, opExt mcpExtension) bool {
+    if opExt.Exclude {
+        return false
+    }
+    if opExt.Include != nil {
+        return *opExt.Include
+    }
+    if docExt.Include != nil {
+        return *docExt.Include
+    }
+    return true
+}
+
+func toolNameFor(prefix, rename, operationID, method, path string) string {
+    name := rename
+    if name == "" {
+        name = operationID
+    }
+    if name == "" {
+        name = method + "_" + strings.Trim(pathParamRegex.ReplaceAllString(path, "by_$1"), "/")
+    }
+    if rename == "" && prefix != "" {
+        name = prefix + "_" + name
+    }
+
+    name = strings.Trim(toolNameCleaner.ReplaceAllString(name, "_"), "_")
+    if len(name) > 64 {
+        name = name[:64]
+    }
+    return name
+}
+
+func operationDescription(doc *openAPIDocument, opExt mcpExtension, op openAPIOperation, method, path string) string {
+    description := opExt.Description
+    if description == "" {
+        description = op.Summary
+    }
+    if description == "" {
+        description = op.Description
+    }
+    if description == "" {
+        description = fmt.Sprintf("%s %s", strings.ToUpper(method), path)
+    }
+    if doc.Info.Title != "" {
+        description = fmt.Sprintf("%s (%s)", description, doc.Info.Title)
+    }
+    if op.Deprecated {
+        description = "[Deprecated] " + description
+    }
+    return description
+}
+
+// mergeParameters resolves $refs and lets operation parameters override
+// path-level parameters with the same name and location
+func mergeParameters(doc *openAPIDocument, shared, own []openAPIParameter) []openAPIParameter {
+    merged := []openAPIParameter{}
+    index := map[string]int{}
+
+    for _, list := range [][]openAPIParameter{shared, own} {
+        for _, p := range list {
+            p = resolveParameter(doc, p)
+            if p.Name == "" {
+                continue
+            }
+            key := p.In + ":" + p.Name
+            if i, exists := index[key]; exists {
+                merged[i] = p
+                continue
+            }
+            index[key] = len(merged)
+            merged = append(merged, p)
+        }
+    }
+    return merged
+}
+
+// assignArguments sets the tool argument of each parameter. A name shared
+// by parameters in different locations, or a parameter named body when the
+// operation takes a JSON body, is prefixed with the location on every
+// parameter that uses it (path_id and query_id), so no argument is
+// silently dropped.
+func assignArguments(params []openAPIParameter, hasBody bool) error {
+    uses := map[string]int{}
+    if hasBody {
+        uses["body"]++
+    }
+    for _, p := range params {
+        if p.In != "cookie" {
+            uses[p.Name]++
+        }
+    }
+
+    taken := map[string]bool{}
+    if hasBody {
+        taken["body"] = true
+    }
+    for i, p := range params {
+        if p.In == "cookie" {
+            continue
+        }
+        argument := p.Name
+        if uses[p.Name] > 1 {
+            argument = p.In + "_" + p.Name
+        }
+        if taken[argument] {
+            return fmt.Errorf("parameter %q in %s cannot be given a unique argument name (%q is taken)", p.Name, p.In, argument)
+        }
+        taken[argument] = true
+        params[i].Argument = argument
+    }
+    return nil
+}
+
+func resolveParameter(doc *openAPIDocument, p openAPIParameter) openAPIParameter {
+    if p.Ref == "" {
+        return p
+    }
+    name := strings.TrimPrefix(p.Ref, "#/components/parameters/")
+    if resolved, ok := doc.Components.Parameters[name]; ok {
+        return resolved
+    }
+    return openAPIParameter{}
+}
+
+// importOpenAPISchema copies an OpenAPI schema into a tool input schema.
+// References to #/components/schemas are rewritten to #/$defs and the
+// referenced components (and anything they reference) are added to defs.
+func importOpenAPISchema(doc *openAPIDocument, s *Property, description string, defs map[string]Property) Property {
+    if s == nil {
+        return Property{Type: "string", Description: description}
+    }
+
+    var pending []string
+    rewrite := func(schema *Property) {
+        walkSchema(schema, func(node *Property) {
+            if strings.HasPrefix(node.Ref, "#/components/schemas/") {
+                name := strings.TrimPrefix(node.Ref, "#/components/schemas/")
+                node.Ref = "#/$defs/" + name
+                pending = append(pending, name)
+            }
+        })
+    }
+
+    prop := cloneSchema(*s)
+    rewrite(&prop)
+    if prop.Description == "" {
+        prop.Description = description
+    }
+
+    for len(pending) > 0 {
+        name := pending[0]
+        pending = pending[1:]
+        if _, done := defs[name]; done {
+            continue
+        }
+        component, ok := doc.Components.Schemas[name]
+        if !ok {
+            continue
+        }
+        def := cloneSchema(component)
+        defs[name] = def
+        rewrite(&def)
+        defs[name] = def
+    }
+    return prop
+}
+
+// operationOutputSchema describes the structured content of a generated
+// tool: the status code plus the JSON body of the operation's success
+// response, typed from the lowest documented 2xx response when there is one
+func operationOutputSchema(doc *openAPIDocument, op openAPIOperation) *Property {
+    data := Property{Description: "Response body returned by the API"}
+    defs := map[string]Property{}
+
+    codes := make([]string, 0, len(op.Responses))
+    for code := range op.Responses {
+        if strings.HasPrefix(code, "2") {
+            codes = append(codes, code)
+        }
+    }
+    sort.Strings(codes)
+    for _, code := range codes {
+        if media, ok := op.Responses[code].Content["application/json"]; ok && media.Schema != nil {
+            data = importOpenAPISchema(doc, media.Schema, data.Description, defs)
+            break
+        }
+    }
+
+    schema := &Property{
+        Type: "object",
+        Properties: map[string]Property{
+            "status_code": {Type: "integer"},
+            "data":        data,
+            "timestamp":   {Type: "string", Format: "date-time"},
+        },
+        Required: []string{"status_code", "timestamp"},
+    }
+    if len(defs) > 0 {
+        schema.Defs = defs
+    }
+    return schema
+}
+
+// cloneSchema deep-copies a schema so rewriting it cannot touch the source
+func cloneSchema(s Property) Property {
+    var out Property
+    encoded, err := json.Marshal(s)
+    if err == nil && json.Unmarshal(encoded, &out) == nil {
+        return out
+    }
+    return s
+}
+
+// callGatewayOperation executes a generated tool by calling the API back
+// through the gateway, forwarding the caller's credentials so the API's own
+// auth, quotas and rate limits apply
+func callGatewayOperation(ctx context.Context, op gatewayOperation, params map[string]interface{}, session *user.SessionState, authorization string) (map[string]interface{}, error) {
+    path := op.Path
+    query := url.Values{}
+    headers := http.Header{}
+
+    for _, p := range op.Parameters {
+        argument := p.Argument
+        if argument == "" {
+            argument = p.Name
+        }
+        value, present := params[argument]
+        if !present || value == nil {
+            if p.Required || p.In == "path" {
+                return nil, fmt.Errorf("missing required parameter '%s'", argument)
+            }
+            continue
+        }
+
+        switch p.In {
+        case "path":
+            path = strings.ReplaceAll(path, "{"+p.Name+"}", url.PathEscape(fmt.Sprint(value)))
+        case "query":
+            if list, ok := value.([]interface{}); ok {
+                for _, item := range list {
+                    query.Add(p.Name, fmt.Sprint(item))
+                }
+            } else {
+                query.Set(p.Name, fmt.Sprint(value))
+            }
+        case "header":
+            headers.Set(p.Name, fmt.Sprint(value))
+        }
+    }
+
+    var body io.Reader
+    if op.HasBody {
+        if payload, ok := params["body"]; ok {
+            encoded, err := json.Marshal(payload)
+            if err != nil {
+                return nil, fmt.Errorf("failed to encode request body: %w", err)
+            }
+            body = bytes.NewReader(encoded)
+        }
+    }
+
+    target := strings.TrimRight(gatewayURL(), "/") + "/" + strings.Trim(op.ListenPath, "/") + path
+    if len(query) > 0 {
+        target += "?" + query.Encode()
+    }
+
+    req, err := http.NewRequestWithContext(ctx, op.Method, target, body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create gateway request: %w", err)
+    }
+    req.Header = headers
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    if authorization != "" {
+        req.Header.Set("Authorization", authorization)
+    }
+    req.Header.Set("User-Agent", "Tyk-MCP-Gateway/1.0")
+    req.Header.Set("X-MCP-Tool", op.ToolName)
+    req.Header.Set("X-MCP-Tool-Version", op.Version)
+
+    resp, err := upstreamClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("gateway request failed: %w", err)
+    }
+    defer resp.Body.Close()
+
+    raw, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read gateway response: %w", err)
+    }
+
+    var data interface{}
+    if err := json.Unmarshal(raw, &data); err != nil {
+        data = string(raw)
+    }
+
+    log.Get().WithFields(logrus.Fields{
+        "tool_name":   op.ToolName,
+        "method":      op.Method,
+        "path":        op.Path,
+        "status_code": resp.StatusCode,
+        "session_id":  getSessionID(session),
+    }).Info("Generated MCP tool called gateway")
+
+    if resp.StatusCode >= 400 {
+        return nil, &ToolError{
+            Code:    toolErrorUpstream,
+            Message: fmt.Sprintf("gateway returned status %d", resp.StatusCode),
+            Details: map[string]interface{}{
+                "status_code": resp.StatusCode,
+                "body":        data,
+            },
+        }
+    }
+
+    return map[string]interface{}{
+        "status_code": resp.StatusCode,
+        "data":        data,
+        "timestamp":   time.Now().Format(time.RFC3339),
+    }, nil
+}
+
+// gatewayURL is the internal base URL tools use to call back into Tyk
+func gatewayURL() string {
+    if u := os.Getenv("TYK_GATEWAY_URL"); u != "" {
+        return u
+    }
+    return "http://tyk-gateway:8080"
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+)
+
+// parseTestDocument decodes an OpenAPI document given as JSON
+func parseTestDocument(t *testing.T, document string) *openAPIDocument {
+    t.Helper()
+    doc, err := parseOpenAPIDocument([]byte(document), "api.json")
+    if err != nil || doc == nil {
+        t.Fatalf("parseOpenAPIDocument = %v, %v", doc, err)
+    }
+    return doc
+}
+
+func TestGenerateTools(t *testing.T) {
+    doc := parseTestDocument(t, `{
+        "openapi": "3.0.3",
+        "info": {"title": "Tickets", "version": "2.1.0"},
+        "x-tyk-api-gateway": {"info": {"state": {"active": true}}, "server": {"listenPath": {"value": "/tickets/"}}},
+        "x-mcp": {"prefix": "tk"},
+        "paths": {
+            "/tickets/{id}": {
+                "parameters": [{"$ref": "#/components/parameters/TicketID"}],
+                "get": {
+                    "operationId": "getTicket",
+                    "summary": "Read a ticket",
+                    "responses": {"200": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ticket"}}}}}
+                },
+                "put": {
+                    "summary": "Replace a ticket",
+                    "deprecated": true,
+                    "x-mcp": {"replacedBy": "tk_patchTicket", "sunset": "2027-01-01"},
+                    "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Ticket"}}}}
+                },
+                "delete": {"operationId": "deleteTicket", "x-mcp": {"exclude": true}}
+            },
+            "/tickets": {
+                "post": {"operationId": "createTicket", "x-mcp": {"name": "open_ticket", "description": "Open a new ticket"}}
+            }
+        },
+        "components": {
+            "parameters": {"TicketID": {"name": "id", "in": "path", "schema": {"type": "integer"}}},
+            "schemas": {
+                "Ticket": {"type": "object", "properties": {"owner": {"$ref": "#/components/schemas/User"}}},
+                "User": {"type": "object", "properties": {"name": {"type": "string"}}}
+            }
+        }
+    }`)
+
+    tools, ops, err := generateTools(doc, "tickets.json")
+    if err != nil {
+        t.Fatalf("generateTools: %v", err)
+    }
+
+    var names []string
+    for name := range tools {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    if want := []string{"open_ticket", "tk_getTicket", "tk_put_tickets_by_id"}; !reflect.DeepEqual(names, want) {
+        t.Fatalf("tools %v, want %v", names, want)
+    }
+
+    get := tools["tk_getTicket"]
+    if get.Version != "2.1.0" || get.Description != "Read a ticket (Tickets)" || !*get.Annotations.ReadOnlyHint {
+        t.Fatalf("tk_getTicket = %+v", get)
+    }
+    if get.InputSchema.Properties["id"].Type != "integer" || !reflect.DeepEqual(get.InputSchema.Required, []string{"id"}) {
+        t.Fatalf("tk_getTicket input schema %+v, want a required integer id", get.InputSchema)
+    }
+    data := get.OutputSchema.Properties["data"]
+    if data.Ref != "#/$defs/Ticket" || get.OutputSchema.Defs["Ticket"].Properties["owner"].Ref != "#/$defs/User" || get.OutputSchema.Defs["User"].Type != "object" {
+        t.Fatalf("tk_getTicket output schema %+v, want Ticket and User under $defs", get.OutputSchema)
+    }
+    if op := ops["tk_getTicket"]; op.Method != http.MethodGet || op.ListenPath != "/tickets/" || op.Path != "/tickets/{id}" || op.Version != "2.1.0" {
+        t.Fatalf("tk_getTicket operation %+v", op)
+    }
+
+    put := tools["tk_put_tickets_by_id"]
+    if put.Deprecated == nil || put.Deprecated.ReplacedBy != "tk_patchTicket" || !strings.HasPrefix(put.Description, "[Deprecated] ") {
+        t.Fatalf("tk_put_tickets_by_id = %+v, want it deprecated", put)
+    }
+    if put.InputSchema.Properties["body"].Ref != "#/$defs/Ticket" || put.InputSchema.Defs["User"].Type != "object" || !*put.Annotations.DestructiveHint {
+        t.Fatalf("tk_put_tickets_by_id = %+v, want a Ticket body", put)
+    }
+    if !ops["tk_put_tickets_by_id"].HasBody {
+        t.Fatal("tk_put_tickets_by_id does not send its body")
+    }
+
+    if open := tools["open_ticket"]; open.Description != "Open a new ticket (Tickets)" || *open.Annotations.IdempotentHint {
+        t.Fatalf("open_ticket = %+v", open)
+    }
+}
+
+func TestGenerateToolsDocuments(t *testing.T) {
+    tests := []struct {
+        name      string
+        document  string
+        wantTools int
+        wantErr   string
+    }{
+        {
+            name:      "inactive api",
+            document:  `{"openapi":"3.0.0","x-tyk-api-gateway":{"info":{"state":{"active":false}},"server":{"listenPath":{"value":"/a/"}}},"paths":{"/a":{"get":{}}}}`,
+            wantTools: 0,
+        },
+        {
+            name:     "no listen path",
+            document: `{"openapi":"3.0.0","paths":{"/a":{"get":{}}}}`,
+            wantErr:  "no gateway listen path",
+        },
+        {
+            name:      "opt in",
+            document:  `{"openapi":"3.0.0","x-mcp":{"listenPath":"/a/","include":false},"paths":{"/a":{"get":{},"post":{"x-mcp":{"include":true}}}}}`,
+            wantTools: 1,
+        },
+        {
+            name:     "duplicate tool name",
+            document: `{"openapi":"3.0.0","x-mcp":{"listenPath":"/a/"},"paths":{"/a":{"get":{"operationId":"same"},"post":{"operationId":"same"}}}}`,
+            wantErr:  `duplicate tool name "same"`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tools, _, err := generateTools(parseTestDocument(t, tt.document), "api.json")
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("generateTools error = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil || len(tools) != tt.wantTools {
+                t.Fatalf("generateTools = %d tools, %v, want %d tools", len(tools), err, tt.wantTools)
+            }
+        })
+    }
+}
+
+func TestParseOpenAPIDocument(t *testing.T) {
+    tests := []struct {
+        name    string
+        file    string
+        data    string
+        wantDoc bool
+    }{
+        {name: "json", file: "api.json", data: `{"openapi":"3.1.0"}`, wantDoc: true},
+        {name: "yaml", file: "api.yaml", data: "openapi: 3.0.3\npaths: {}\n", wantDoc: true},
+        {name: "swagger 2", file: "api.json", data: `{"swagger":"2.0"}`},
+        {name: "classic tyk definition", file: "api.json", data: `{"api_id":"a","proxy":{"listen_path":"/a/"}}`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            doc, err := parseOpenAPIDocument([]byte(tt.data), tt.file)
+            if err != nil || (doc != nil) != tt.wantDoc {
+                t.Fatalf("parseOpenAPIDocument = %v, %v, want a document = %v", doc, err, tt.wantDoc)
+            }
+        })
+    }
+}
+
+func TestToolNameFor(t *testing.T) {
+    tests := []struct {
+        prefix, rename, operationID, method, path string
+        want                                      string
+    }{
+        {operationID: "getTicket", method: "get", path: "/tickets/{id}", want: "getTicket"},
+        {prefix: "tk", operationID: "getTicket", want: "tk_getTicket"},
+        {prefix: "tk", rename: "read_ticket", operationID: "getTicket", want: "read_ticket"},
+        {method: "get", path: "/tickets/{id}/notes", want: "get_tickets_by_id_notes"},
+        {operationID: "list tickets.v2", want: "list_tickets_v2"},
+        {operationID: strings.Repeat("a", 70), want: strings.Repeat("a", 64)},
+    }
+
+    for _, tt := range tests {
+        if got := toolNameFor(tt.prefix, tt.rename, tt.operationID, tt.method, tt.path); got != tt.want {
+            t.Errorf("toolNameFor(%q, %q, %q, %q, %q) = %q, want %q", tt.prefix, tt.rename, tt.operationID, tt.method, tt.path, got, tt.want)
+        }
+    }
+}
+
+func TestMergeParameters(t *testing.T) {
+    doc := &openAPIDocument{}
+    doc.Components.Parameters = map[string]openAPIParameter{"Limit": {Name: "limit", In: "query"}}
+
+    shared := []openAPIParameter{{Name: "id", In: "path", Description: "shared"}, {Ref: "#/components/parameters/Limit"}}
+    own := []openAPIParameter{{Name: "id", In: "path", Description: "own"}, {Ref: "#/components/parameters/Missing"}}
+    got := mergeParameters(doc, shared, own)
+    if len(got) != 2 || got[0].Description != "own" || got[1].Name != "limit" {
+        t.Fatalf("mergeParameters = %+v, want the operation's id and the shared limit", got)
+    }
+}
+
+func TestGenerateToolsArguments(t *testing.T) {
+    tests := []struct {
+        name         string
+        operation    string
+        wantArgs     []string
+        wantRequired []string
+        wantErr      string
+    }{
+        {
+            name:         "distinct names",
+            operation:    `"get":{"operationId":"op","parameters":[{"name":"id","in":"path"},{"name":"q","in":"query"}]}`,
+            wantArgs:     []string{"id", "q"},
+            wantRequired: []string{"id"},
+        },
+        {
+            name:         "path and query share a name",
+            operation:    `"get":{"operationId":"op","parameters":[{"name":"id","in":"path"},{"name":"id","in":"query","required":true}]}`,
+            wantArgs:     []string{"path_id", "query_id"},
+            wantRequired: []string{"path_id", "query_id"},
+        },
+        {
+            name:         "parameter named body",
+            operation:    `"post":{"operationId":"op","parameters":[{"name":"id","in":"path"},{"name":"body","in":"query"}],"requestBody":{"required":true,"content":{"application/json":{"schema":{"type":"object"}}}}}`,
+            wantArgs:     []string{"body", "id", "query_body"},
+            wantRequired: []string{"body", "id"},
+        },
+        {
+            name:         "body without a request body",
+            operation:    `"get":{"operationId":"op","parameters":[{"name":"id","in":"path"},{"name":"body","in":"query"}]}`,
+            wantArgs:     []string{"body", "id"},
+            wantRequired: []string{"id"},
+        },
+        {
+            name:         "cookies are not arguments",
+            operation:    `"get":{"operationId":"op","parameters":[{"name":"id","in":"path"},{"name":"id","in":"cookie"}]}`,
+            wantArgs:     []string{"id"},
+            wantRequired: []string{"id"},
+        },
+        {
+            name:      "namespaced name taken",
+            operation: `"get":{"operationId":"op","parameters":[{"name":"id","in":"path"},{"name":"query_id","in":"query"},{"name":"id","in":"query"}]}`,
+            wantErr:   `"query_id" is taken`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            doc := parseTestDocument(t, `{"openapi":"3.0.3","x-mcp":{"listenPath":"/api/"},"paths":{"/items/{id}":{`+tt.operation+`}}}`)
+            tools, ops, err := generateTools(doc, "api.json")
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("generateTools error = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("generateTools: %v", err)
+            }
+
+            schema := tools["op"].InputSchema
+            var args []string
+            for name := range schema.Properties {
+                args = append(args, name)
+            }
+            sort.Strings(args)
+            if !reflect.DeepEqual(args, tt.wantArgs) {
+                t.Fatalf("arguments %v, want %v", args, tt.wantArgs)
+            }
+            required := append([]string{}, schema.Required...)
+            sort.Strings(required)
+            if len(required) == 0 {
+                required = nil
+            }
+            if !reflect.DeepEqual(required, tt.wantRequired) {
+                t.Fatalf("required %v, want %v", required, tt.wantRequired)
+            }
+            for _, p := range ops["op"].Parameters {
+                if _, ok := schema.Properties[p.Argument]; p.In != "cookie" && !ok {
+                    t.Fatalf("parameter %s in %s maps to %q, which is not an argument", p.Name, p.In, p.Argument)
+                }
+            }
+        })
+    }
+}
+
+func TestCallGatewayOperationArguments(t *testing.T) {
+    var got *http.Request
+    var gotBody map[string]interface{}
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got = r
+        json.NewDecoder(r.Body).Decode(&gotBody)
+        w.Header().Set("Content-Type", "application/json")
+        w.Write([]byte(`{}`))
+    }))
+    defer server.Close()
+    t.Setenv("TYK_GATEWAY_URL", server.URL)
+
+    doc := parseTestDocument(t, `{"openapi":"3.0.3","x-mcp":{"listenPath":"/api/"},"paths":{"/items/{id}":{"post":{
+        "operationId":"op",
+        "parameters":[{"name":"id","in":"path"},{"name":"id","in":"query"},{"name":"body","in":"query"}],
+        "requestBody":{"content":{"application/json":{"schema":{"type":"object"}}}}}}}}`)
+    _, ops, err := generateTools(doc, "api.json")
+    if err != nil {
+        t.Fatalf("generateTools: %v", err)
+    }
+
+    args := map[string]interface{}{"path_id": "a b", "query_id": "7", "query_body": "x", "body": map[string]interface{}{"n": 1}}
+    if _, err := callGatewayOperation(context.Background(), ops["op"], args, nil, ""); err != nil {
+        t.Fatalf("callGatewayOperation: %v", err)
+    }
+    if got.URL.EscapedPath() != "/api/items/a%20b" {
+        t.Fatalf("path %s, want /api/items/a%%20b", got.URL.EscapedPath())
+    }
+    if q := got.URL.Query(); q.Get("id") != "7" || q.Get("body") != "x" {
+        t.Fatalf("query %s, want id=7 and body=x", got.URL.RawQuery)
+    }
+    if gotBody["n"] != float64(1) {
+        t.Fatalf("body %v, want {\"n\":1}", gotBody)
+    }
+
+    delete(args, "path_id")
+    if _, err := callGatewayOperation(context.Background(), ops["op"], args, nil, ""); err == nil || !strings.Contains(err.Error(), "path_id") {
+        t.Fatalf("error = %v, want missing path_id", err)
+    }
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "unicode/utf8"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/sirupsen/logrus"
+)
+
+// OutputConfig controls how tool results are processed before they are
+// returned to the LLM
+type OutputConfig struct {
+    // Default applies to tools without a policy of their own
+    Default OutputPolicy `json:"default"`
+    // Tools maps tool names, or '*' wildcard patterns, to a policy that
+    // replaces the default. An exact name wins over patterns, and a longer
+    // pattern over a shorter one.
+    Tools map[string]OutputPolicy `json:"tools"`
+}
+
+// OutputPolicy is how one tool's results are redacted and bounded
+type OutputPolicy struct {
+    // Detectors are built-in redactions: email, api_key and token
+    Detectors []string `json:"detectors"`
+    // Patterns are regular expressions whose matches are redacted
+    Patterns []RedactionPattern `json:"patterns"`
+    // Paths are JSON paths into structuredContent whose values are
+    // redacted, such as $.data.owner, $.items[*].contact or $..email
+    Paths []string `json:"paths"`
+    // MaxBytes bounds the result returned; MaxTokens does the same in
+    // estimated tokens of four bytes each. Zero is no limit.
+    MaxBytes  int `json:"max_bytes"`
+    MaxTokens int `json:"max_tokens"`
+}
+
+// RedactionPattern replaces matches of a regular expression
+type RedactionPattern struct {
+    Pattern string `json:"pattern"`
+    // Replacement defaults to [REDACTED] and may refer to groups as ${1}
+    Replacement string `json:"replacement"`
+}
+
+const (
+    redactedValue = "[REDACTED]"
+
+    // outputBytesPerToken estimates the tokens in a result from its size
+    outputBytesPerToken = 4
+    // outputMinString is the shortest a string is cut to
+    outputMinString = 32
+    // outputMaxTrims bounds the passes made to fit a result in its budget
+    outputMaxTrims = 64
+)
+
+// outputDetector is a built-in redaction. Only the part of a match in
+// group is replaced, so the name in front of a secret stays readable.
+type outputDetector struct {
+    re    *regexp.Regexp
+    group int
+}
+
+var (
+    outputDetectors = map[string][]outputDetector{
+        "email": {
+            {re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+        },
+        "api_key": {
+            {re: regexp.MustCompile(`\b(?:sk|pk|rk)_(?:live|test)_[A-Za-z0-9]{16,}`)},
+            {re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+            {re: regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}`)},
+            {re: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+            {re: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`)},
+            {re: regexp.MustCompile(`(?i)\b(?:api[_-]?key|x-api-key|secret|secret[_-]?key|access[_-]?key|client[_-]?secret)["']?\s*[:=]\s*["']?([A-Za-z0-9._~+/-]{12,})`), group: 1},
+        },
+        "token": {
+            // JSON Web Tokens
+            {re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]{4,}`)},
+            {re: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/-]{16,}=*)`), group: 1},
+            {re: regexp.MustCompile(`(?i)\b(?:access_token|refresh_token|id_token|token|password|passwd)["']?\s*[:=]\s*["']?([^\s"'&,;]{8,})`), group: 1},
+        },
+    }
+
+    // outputProcessors caches compiled policies by their encoding
+    outputProcessors sync.Map
+)
+
+// textRedaction is one compiled redaction of strings
+type textRedaction struct {
+    re          *regexp.Regexp
+    group       int
+    replacement string
+}
+
+// outputPathStep is one step of a JSON path: a key, an index, every child
+// ('*'), or with descend, a key at any depth below
+type outputPathStep struct {
+    key      string
+    index    int
+    wildcard bool
+    descend  bool
+}
+
+// outputProcessor is a compiled OutputPolicy
+type outputProcessor struct {
+    redactions []textRedaction
+    paths      [][]outputPathStep
+    // budget is the byte limit, 0 when there is none
+    budget int
+}
+
+// outputCut records something removed to fit a result in its budget
+type outputCut struct {
+    Path  string `json:"path"`
+    Kept  int    `json:"kept"`
+    Total int    `json:"total"`
+    Unit  string `json:"unit"`
+}
+
+func (c outputCut) String() string {
+    path := c.Path
+    if path == "" {
+        path = "/"
+    }
+    return fmt.Sprintf("%s kept %d of %d %s", path, c.Kept, c.Total, c.Unit)
+}
+
+// outputPolicyFor returns the policy for a tool's results
+func outputPolicyFor(toolName string) OutputPolicy {
+    cfg := currentConfig().Output
+    if policy, ok := cfg.Tools[toolName]; ok {
+        return policy
+    }
+    best := ""
+    for pattern := range cfg.Tools {
+        if strings.Contains(pattern, "*") && wildcardMatch(pattern, toolName) &&
+            (len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best)) {
+            best = pattern
+        }
+    }
+    if best != "" {
+        return cfg.Tools[best]
+    }
+    return cfg.Default
+}
+
+// validateOutputConfig compiles every policy, so a bad one fails the load
+func validateOutputConfig(cfg OutputConfig) error {
+    if _, err := compileOutputPolicy(cfg.Default); err != nil {
+        return fmt.Errorf("output.default: %w", err)
+    }
+    for name, policy := range cfg.Tools {
+        if _, err := compileOutputPolicy(policy); err != nil {
+            return fmt.Errorf("output.tools.%s: %w", name, err)
+        }
+    }
+    return nil
+}
+
+func compileOutputPolicy(policy OutputPolicy) (*outputProcessor, error) {
+    key, _ := json.Marshal(policy)
+    if cached, ok := outputProcessors.Load(string(key)); ok {
+        return cached.(*outputProcessor), nil
+    }
+
+    p := &outputProcessor{}
+    for _, name := range policy.Detectors {
+        detectors, ok := outputDetectors[name]
+        if !ok {
+            return nil, fmt.Errorf("unknown detector %q", name)
+        }
+        for _, d := range detectors {
+            p.redactions = append(p.redactions, textRedaction{re: d.re, group: d.group, replacement: "[REDACTED:" + name + "]"})
+        }
+    }
+    for _, pattern := range policy.Patterns {
+        re, err := compilePattern(pattern.Pattern)
+        if err != nil {
+            return nil, fmt.Errorf("invalid pattern %q: %w", pattern.Pattern, err)
+        }
+        replacement := pattern.Replacement
+        if replacement == "" {
+            replacement = redactedValue
+        }
+        p.redactions = append(p.redactions, textRedaction{re: re, group: -1, replacement: replacement})
+    }
+    for _, path := range policy.Paths {
+        steps, err := parseOutputPath(path)
+        if err != nil {
+            return nil, fmt.Errorf("invalid path %q: %w", path, err)
+        }
+        p.paths = append(p.paths, steps)
+    }
+
+    if policy.MaxBytes < 0 || policy.MaxTokens < 0 {
+        return nil, fmt.Errorf("max_bytes and max_tokens may not be negative")
+    }
+    p.budget = policy.MaxBytes
+    if tokens := policy.MaxTokens * outputBytesPerToken; tokens > 0 && (p.budget == 0 || tokens < p.budget) {
+        p.budget = tokens
+    }
+
+    outputProcessors.Store(string(key), p)
+    return p, nil
+}
+
+// parseOutputPath parses the JSON path subset policies use: $ followed by
+// .key, ['key'], [index], [*], .* and ..key
+func parseOutputPath(path string) ([]outputPathStep, error) {
+    if !strings.HasPrefix(path, "$") {
+        return nil, fmt.Errorf("must start with $")
+    }
+    var steps []outputPathStep
+    rest := path[1:]
+    for rest != "" {
+        step := outputPathStep{index: -1}
+        switch {
+        case strings.HasPrefix(rest, ".."):
+            step.descend = true
+            rest = rest[2:]
+            fallthrough
+        case strings.HasPrefix(rest, "."):
+            if !step.descend {
+                rest = rest[1:]
+            }
+            end := strings.IndexAny(rest, ".[")
+            if end < 0 {
+                end = len(rest)
+            }
+            if end == 0 {
+                return nil, fmt.Errorf("empty key")
+            }
+            step.key, step.wildcard = rest[:end], rest[:end] == "*"
+            rest = rest[end:]
+        case strings.HasPrefix(rest, "["):
+            end := strings.Index(rest, "]")
+            if end < 0 {
+                return nil, fmt.Errorf("unclosed [")
+            }
+            inner := rest[1:end]
+            rest = rest[end+1:]
+            switch {
+            case inner == "*":
+                step.wildcard = true
+            case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+                step.key = inner[1 : len(inner)-1]
+            default:
+                index, err := strconv.Atoi(inner)
+                if err != nil || index < 0 {
+                    return nil, fmt.Errorf("invalid index %q", inner)
+                }
+                step.index = index
+            }
+        default:
+            return nil, fmt.Errorf("unexpected %q", rest)
+        }
+        steps = append(steps, step)
+    }
+    if len(steps) == 0 {
+        return nil, fmt.Errorf("redacting the whole result is not supported")
+    }
+    return steps, nil
+}
+
+// processToolResult applies the tool's output policy to a result: values
+// are redacted, then the result is trimmed to the budget. What was done is
+// reported in _meta.redactions and _meta.truncated, and truncated text
+// ends with a marker saying what was left out. Structured content that no
+// longer matches the tool's outputSchema is dropped, leaving the text.
+func processToolResult(tool MCPTool, result ToolResult) ToolResult {
+    toolName := tool.Name
+    p, err := compileOutputPolicy(outputPolicyFor(toolName))
+    if err != nil {
+        log.Get().WithError(err).WithField("tool_name", toolName).Error("Invalid MCP output policy")
+        return result
+    }
+    if len(p.redactions) == 0 && len(p.paths) == 0 && p.budget == 0 {
+        return result
+    }
+
+    derived := len(result.Content) == 1 && result.Content[0].Type == "text" && result.Content[0].Text == resultText(result)
+    redactions := 0
+    if toolErr, ok := resultError(result); ok {
+        redacted := *toolErr
+        redacted.Message = p.redactString(toolErr.Message, &redactions)
+        if toolErr.Details != nil {
+            redacted.Details = p.redactValue(normalizeJSONValue(toolErr.Details), &redactions)
+        }
+        result.StructuredContent = map[string]interface{}{"error": &redacted}
+    } else if result.StructuredContent != nil {
+        // A round trip copies the content, which is then changed in place
+        structured := normalizeJSONValue(result.StructuredContent)
+        for _, path := range p.paths {
+            structured = redactPath(structured, path, &redactions)
+        }
+        result.StructuredContent = p.redactValue(structured, &redactions)
+    }
+
+    var cuts []outputCut
+    originalBytes := 0
+    if p.budget > 0 && result.StructuredContent != nil {
+        if _, isError := resultError(result); !isError {
+            originalBytes = jsonSize(result.StructuredContent)
+            result.StructuredContent, cuts = shrinkJSON(result.StructuredContent, p.budget)
+        }
+    }
+
+    truncated := len(cuts) > 0
+    if derived {
+        text := resultText(result)
+        if _, isError := resultError(result); p.budget > 0 && len(text) > p.budget && !isError {
+            // Indenting may be what pushes the text over budget
+            if compact, err := json.Marshal(result.StructuredContent); err == nil && len(compact) <= p.budget {
+                text = string(compact)
+            }
+        }
+        if p.budget > 0 && len(text) > p.budget {
+            if originalBytes == 0 {
+                originalBytes = len(text)
+            }
+            text = cutString(text, p.budget)
+            truncated = true
+        }
+        if len(cuts) > 0 {
+            text += "\n" + truncationMarker(p.budget, cuts)
+        }
+        result.Content = []ContentBlock{{Type: "text", Text: text}}
+    } else {
+        content := make([]ContentBlock, len(result.Content))
+        for i, block := range result.Content {
+            block.Text = p.redactString(block.Text, &redactions)
+            content[i] = block
+        }
+        if p.budget > 0 {
+            var size int
+            var fitted bool
+            if content, size, fitted = fitContent(content, p.budget); !fitted {
+                truncated = true
+                if originalBytes == 0 {
+                    originalBytes = size
+                }
+            }
+        }
+        result.Content = content
+    }
+
+    dropped := false
+    if _, isError := resultError(result); !isError && tool.OutputSchema != nil && (redactions > 0 || len(cuts) > 0) {
+        if err := validateToolOutput(*tool.OutputSchema, result.StructuredContent); err != nil {
+            log.Get().WithError(err).WithField("tool_name", toolName).Info("Processed MCP tool result no longer matches its outputSchema, dropping structuredContent")
+            result.StructuredContent = nil
+            dropped = true
+        }
+    }
+
+    if redactions > 0 || truncated || dropped {
+        if result.Meta == nil {
+            result.Meta = map[string]interface{}{}
+        }
+    }
+    if dropped {
+        result.Meta["structuredContentDropped"] = true
+    }
+    if redactions > 0 {
+        result.Meta["redactions"] = redactions
+    }
+    if truncated {
+        info := map[string]interface{}{"maxBytes": p.budget, "originalBytes": originalBytes}
+        if len(cuts) > 0 {
+            info["cuts"] = cuts
+        }
+        result.Meta["truncated"] = info
+        log.Get().WithFields(logrus.Fields{
+            "tool_name":      toolName,
+            "max_bytes":      p.budget,
+            "original_bytes": originalBytes,
+        }).Info("MCP tool result truncated")
+    }
+    return result
+}
+
+// resultError returns the error a failed result carries
+func resultError(result ToolResult) (*ToolError, bool) {
+    if structured, ok := result.StructuredContent.(map[string]interface{}); ok {
+        toolErr, ok := structured["error"].(*ToolError)
+        return toolErr, ok
+    }
+    return nil, false
+}
+
+// resultText is the text the gateway renders for a result's structured
+// content
+func resultText(result ToolResult) string {
+    if toolErr, ok := resultError(result); ok {
+        return fmt.Sprintf("Error (%s): %s", toolErr.Code, toolErr.Message)
+    }
+    return renderToolText(result.StructuredContent)
+}
+
+func (p *outputProcessor) redactString(s string, count *int) string {
+    for _, r := range p.redactions {
+        if r.group < 0 {
+            if n := len(r.re.FindAllStringIndex(s, -1)); n > 0 {
+                *count += n
+                s = r.re.ReplaceAllString(s, r.replacement)
+            }
+            continue
+        }
+        matches := r.re.FindAllStringSubmatchIndex(s, -1)
+        if len(matches) == 0 {
+            continue
+        }
+        var b strings.Builder
+        last := 0
+        for _, m := range matches {
+            start, end := m[2*r.group], m[2*r.group+1]
+            if start < 0 {
+                continue
+            }
+            b.WriteString(s[last:start])
+            b.WriteString(r.replacement)
+            last = end
+            *count++
+        }
+        b.WriteString(s[last:])
+        s = b.String()
+    }
+    return s
+}
+
+// redactValue redacts every string in a decoded JSON value, in place
+func (p *outputProcessor) redactValue(v interface{}, count *int) interface{} {
+    if len(p.redactions) == 0 {
+        return v
+    }
+    switch t := v.(type) {
+    case string:
+        return p.redactString(t, count)
+    case map[string]interface{}:
+        for k, child := range t {
+            t[k] = p.redactValue(child, count)
+        }
+    case []interface{}:
+        for i, child := range t {
+            t[i] = p.redactValue(child, count)
+        }
+    }
+    return v
+}
+
+// redactPath replaces the values steps select in a decoded JSON value
+func redactPath(v interface{}, steps []outputPathStep, count *int) interface{} {
+    if len(steps) == 0 {
+        *count++
+        return redactedValue
+    }
+    step, rest := steps[0], steps[1:]
+    switch t := v.(type) {
+    case map[string]interface{}:
+        for k, child := range t {
+            switch {
+            case step.wildcard || (step.index < 0 && k == step.key):
+                t[k] = redactPath(child, rest, count)
+            case step.descend:
+                t[k] = redactPath(child, steps, count)
+            }
+        }
+    case []interface{}:
+        for i, child := range t {
+            switch {
+            case step.wildcard || i == step.index:
+                t[i] = redactPath(child, rest, count)
+            case step.descend:
+                t[i] = redactPath(child, steps, count)
+            }
+        }
+    }
+    return v
+}
+
+// jsonSize is the length of v's JSON encoding
+func jsonSize(v interface{}) int {
+    encoded, _ := json.Marshal(v)
+    return len(encoded)
+}
+
+// shrinkJSON cuts the largest arrays and strings in v until its encoding
+// fits budget. Objects keep all their keys, so a result made of many small
+// fields may still be over budget.
+func shrinkJSON(v interface{}, budget int) (interface{}, []outputCut) {
+    cuts := map[string]*outputCut{}
+    root := v
+    for i := 0; i < outputMaxTrims; i++ {
+        var largest *trimCandidate
+        size := measureJSON(root, "", func(nv interface{}) { root = nv }, &largest)
+        if size <= budget || largest == nil {
+            break
+        }
+        largest.trim(size-budget, cuts)
+    }
+
+    out := make([]outputCut, 0, len(cuts))
+    for _, cut := range cuts {
+        out = append(out, *cut)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+    return root, out
+}
+
+// trimCandidate is an array or string that can be cut, and how to replace
+// it in its parent
+type trimCandidate struct {
+    pointer string
+    size    int
+    value   interface{}
+    set     func(interface{})
+}
+
+// measureJSON returns the encoded size of v and tracks the largest value
+// inside it that can be cut
+func measureJSON(v interface{}, pointer string, set func(interface{}), largest **trimCandidate) int {
+    size := 0
+    trimmable := false
+    switch t := v.(type) {
+    case map[string]interface{}:
+        size = 2
+        for k, child := range t {
+            k := k
+            key, _ := json.Marshal(k)
+            size += len(key) + 1 + measureJSON(child, jsonPointer(pointer, k), func(nv interface{}) { t[k] = nv }, largest)
+        }
+        if len(t) > 1 {
+            size += len(t) - 1
+        }
+    case []interface{}:
+        size = 2
+        for i, child := range t {
+            i := i
+            size += measureJSON(child, jsonPointer(pointer, strconv.Itoa(i)), func(nv interface{}) { t[i] = nv }, largest)
+        }
+        if len(t) > 1 {
+            size += len(t) - 1
+        }
+        trimmable = len(t) > 1
+    case string:
+        size = jsonSize(t)
+        trimmable = len(t) > outputMinString
+    default:
+        size = jsonSize(t)
+    }
+    if trimmable && (*largest == nil || size > (*largest).size) {
+        *largest = &trimCandidate{pointer: pointer, size: size, value: v, set: set}
+    }
+    return size
+}
+
+// trim cuts the candidate by about excess bytes, keeping at least one
+// item or outputMinString bytes
+func (c *trimCandidate) trim(excess int, cuts map[string]*outputCut) {
+    switch t := c.value.(type) {
+    case []interface{}:
+        keep := len(t) - (excess*len(t)+c.size-1)/c.size
+        if keep < 1 {
+            keep = 1
+        }
+        if keep >= len(t) {
+            keep = len(t) - 1
+        }
+        cut, ok := cuts[c.pointer]
+        if !ok {
+            cut = &outputCut{Path: c.pointer, Total: len(t), Unit: "items"}
+            cuts[c.pointer] = cut
+        }
+        cut.Kept = keep
+        c.set(t[:keep])
+    case string:
+        keep := len(t) - excess
+        if keep < outputMinString {
+            keep = outputMinString
+        }
+        if keep >= len(t) {
+            keep = len(t) / 2
+        }
+        cut, ok := cuts[c.pointer]
+        if !ok {
+            cut = &outputCut{Path: c.pointer, Total: len(t), Unit: "bytes"}
+            cuts[c.pointer] = cut
+        }
+        trimmed := cutString(t, keep)
+        cut.Kept = len(trimmed)
+        c.set(trimmed)
+    }
+}
+
+// cutString shortens s to at most n bytes without splitting a character,
+// ending it with a marker when anything was cut
+func cutString(s string, n int) string {
+    const marker = "…[truncated]"
+    if len(s) <= n {
+        return s
+    }
+    n -= len(marker)
+    if n < 0 {
+        n = 0
+    }
+    for n > 0 && !utf8.RuneStart(s[n]) {
+        n--
+    }
+    return s[:n] + marker
+}
+
+// truncationMarker tells the LLM what was cut from a result
+func truncationMarker(budget int, cuts []outputCut) string {
+    parts := make([]string, len(cuts))
+    for i, cut := range cuts {
+        parts[i] = cut.String()
+    }
+    return fmt.Sprintf("[truncated to fit %d bytes: %s]", budget, strings.Join(parts, "; "))
+}
+
+// fitContent keeps content blocks in order while they fit budget, cutting
+// the text block that crosses it and leaving out the rest. It returns the
+// original size and whether everything fit.
+func fitContent(blocks []ContentBlock, budget int) ([]ContentBlock, int, bool) {
+    total := 0
+    for _, block := range blocks {
+        total += contentSize(block)
+    }
+    if total <= budget {
+        return blocks, total, true
+    }
+
+    var out []ContentBlock
+    used := 0
+    for i, block := range blocks {
+        size := contentSize(block)
+        if used+size <= budget {
+            out = append(out, block)
+            used += size
+            continue
+        }
+        if block.Type == "text" && budget-used > outputMinString {
+            block.Text = cutString(block.Text, budget-used)
+            out = append(out, block)
+            i++
+        }
+        if omitted := len(blocks) - i; omitted > 0 {
+            out = append(out, ContentBlock{
+                Type: "text",
+                Text: fmt.Sprintf("[truncated to fit %d bytes: %d of %d content blocks left out]", budget, omitted, len(blocks)),
+            })
+        }
+        break
+    }
+    return out, total, false
+}
+
+func contentSize(block ContentBlock) int {
+    size := len(block.Text) + len(block.Data)
+    if block.Resource != nil {
+        size += jsonSize(block.Resource)
+    }
+    return size
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+    "encoding/json"
+    "reflect"
+    "strings"
+    "testing"
+    "unicode/utf8"
+)
+
+// decodeJSON decodes a test document the way tool results are decoded
+func decodeJSON(t *testing.T, s string) interface{} {
+    t.Helper()
+    var v interface{}
+    if err := json.Unmarshal([]byte(s), &v); err != nil {
+        t.Fatalf("decoding %s: %v", s, err)
+    }
+    return v
+}
+
+func TestParseOutputPath(t *testing.T) {
+    tests := []struct {
+        path    string
+        want    []outputPathStep
+        wantErr string
+    }{
+        {path: "$.a", want: []outputPathStep{{key: "a", index: -1}}},
+        {path: "$.a.b", want: []outputPathStep{{key: "a", index: -1}, {key: "b", index: -1}}},
+        {path: "$['a.b']", want: []outputPathStep{{key: "a.b", index: -1}}},
+        {path: `$["a"][2]`, want: []outputPathStep{{key: "a", index: -1}, {index: 2}}},
+        {path: "$.a[*]", want: []outputPathStep{{key: "a", index: -1}, {index: -1, wildcard: true}}},
+        {path: "$.*", want: []outputPathStep{{key: "*", index: -1, wildcard: true}}},
+        {path: "$..token", want: []outputPathStep{{key: "token", index: -1, descend: true}}},
+        {path: "a.b", wantErr: "must start with $"},
+        {path: "$", wantErr: "redacting the whole result is not supported"},
+        {path: "$.", wantErr: "empty key"},
+        {path: "$.a[1", wantErr: "unclosed ["},
+        {path: "$.a[-1]", wantErr: "invalid index"},
+        {path: "$a", wantErr: "unexpected"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.path, func(t *testing.T) {
+            got, err := parseOutputPath(tt.path)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("parseOutputPath(%q) error = %v, want %q", tt.path, err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("parseOutputPath(%q): %v", tt.path, err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("parseOutputPath(%q) = %+v, want %+v", tt.path, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestRedactPath(t *testing.T) {
+    tests := []struct {
+        name      string
+        path      string
+        doc       string
+        want      string
+        wantCount int
+    }{
+        {
+            name:      "key",
+            path:      "$.token",
+            doc:       `{"token":"secret","user":"ann"}`,
+            want:      `{"token":"[REDACTED]","user":"ann"}`,
+            wantCount: 1,
+        },
+        {
+            name:      "nested key",
+            path:      "$.auth.token",
+            doc:       `{"auth":{"token":"secret","type":"bearer"},"token":"kept"}`,
+            want:      `{"auth":{"token":"[REDACTED]","type":"bearer"},"token":"kept"}`,
+            wantCount: 1,
+        },
+        {
+            name:      "index",
+            path:      "$.keys[1]",
+            doc:       `{"keys":["a","b","c"]}`,
+            want:      `{"keys":["a","[REDACTED]","c"]}`,
+            wantCount: 1,
+        },
+        {
+            name:      "wildcard",
+            path:      "$.users[*].email",
+            doc:       `{"users":[{"email":"a@example.com","id":1},{"email":"b@example.com","id":2}]}`,
+            want:      `{"users":[{"email":"[REDACTED]","id":1},{"email":"[REDACTED]","id":2}]}`,
+            wantCount: 2,
+        },
+        {
+            name:      "descendant",
+            path:      "$..password",
+            doc:       `{"password":"a","db":{"password":"b","hosts":[{"password":"c"}]}}`,
+            want:      `{"db":{"hosts":[{"password":"[REDACTED]"}],"password":"[REDACTED]"},"password":"[REDACTED]"}`,
+            wantCount: 3,
+        },
+        {
+            name:      "replaces whole subtree",
+            path:      "$.credentials",
+            doc:       `{"credentials":{"user":"ann","key":"k"}}`,
+            want:      `{"credentials":"[REDACTED]"}`,
+            wantCount: 1,
+        },
+        {
+            name: "no match",
+            path: "$.missing",
+            doc:  `{"token":"secret"}`,
+            want: `{"token":"secret"}`,
+        },
+        {
+            name: "index on object",
+            path: "$[0]",
+            doc:  `{"0":"kept"}`,
+            want: `{"0":"kept"}`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            steps, err := parseOutputPath(tt.path)
+            if err != nil {
+                t.Fatalf("parseOutputPath(%q): %v", tt.path, err)
+            }
+            count := 0
+            got, _ := json.Marshal(redactPath(decodeJSON(t, tt.doc), steps, &count))
+            if string(got) != tt.want {
+                t.Fatalf("got %s, want %s", got, tt.want)
+            }
+            if count != tt.wantCount {
+                t.Fatalf("redacted %d values, want %d", count, tt.wantCount)
+            }
+        })
+    }
+}
+
+func TestShrinkJSON(t *testing.T) {
+    numbers := make([]string, 100)
+    for i := range numbers {
+        numbers[i] = "12345"
+    }
+
+    tests := []struct {
+        name     string
+        doc      string
+        budget   int
+        wantCuts []outputCut
+        wantFits bool
+    }{
+        {
+            name:     "fits",
+            doc:      `{"a":[1,2,3],"b":"short"}`,
+            budget:   100,
+            wantFits: true,
+        },
+        {
+            name:     "array",
+            doc:      `{"items":[` + strings.Join(numbers, ",") + `],"total":100}`,
+            budget:   200,
+            wantCuts: []outputCut{{Path: "/items", Total: 100, Unit: "items"}},
+            wantFits: true,
+        },
+        {
+            name:     "string",
+            doc:      `{"text":"` + strings.Repeat("x", 1000) + `"}`,
+            budget:   300,
+            wantCuts: []outputCut{{Path: "/text", Total: 1000, Unit: "bytes"}},
+            wantFits: true,
+        },
+        {
+            name:     "largest value is cut first",
+            doc:      `{"big":"` + strings.Repeat("x", 600) + `","small":"` + strings.Repeat("y", 100) + `"}`,
+            budget:   500,
+            wantCuts: []outputCut{{Path: "/big", Total: 600, Unit: "bytes"}},
+            wantFits: true,
+        },
+        {
+            name:     "nested array",
+            doc:      `{"data":{"rows":[` + strings.Join(numbers, ",") + `]}}`,
+            budget:   100,
+            wantCuts: []outputCut{{Path: "/data/rows", Total: 100, Unit: "items"}},
+            wantFits: true,
+        },
+        {
+            name:   "small fields cannot be cut",
+            doc:    `{"a":1,"b":2,"c":3,"d":4,"e":5}`,
+            budget: 10,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, cuts := shrinkJSON(decodeJSON(t, tt.doc), tt.budget)
+            size := jsonSize(got)
+            if fits := size <= tt.budget; fits != tt.wantFits {
+                t.Fatalf("size %d with budget %d, want fits = %v", size, tt.budget, tt.wantFits)
+            }
+            if len(cuts) != len(tt.wantCuts) {
+                t.Fatalf("cuts %v, want %v", cuts, tt.wantCuts)
+            }
+            for i, cut := range cuts {
+                want := tt.wantCuts[i]
+                if cut.Path != want.Path || cut.Total != want.Total || cut.Unit != want.Unit {
+                    t.Fatalf("cut %v, want %v", cut, want)
+                }
+                if cut.Kept <= 0 || cut.Kept >= cut.Total {
+                    t.Fatalf("cut %v keeps %d of %d", cut, cut.Kept, cut.Total)
+                }
+            }
+        })
+    }
+}
+
+func TestCutString(t *testing.T) {
+    const marker = "…[truncated]"
+
+    tests := []struct {
+        name string
+        s    string
+        n    int
+        want string
+    }{
+        {name: "fits", s: "hello", n: 5, want: "hello"},
+        {name: "ascii", s: strings.Repeat("a", 40), n: 20, want: strings.Repeat("a", 20-len(marker)) + marker},
+        {name: "budget below marker", s: strings.Repeat("a", 40), n: 3, want: marker},
+        {name: "does not split a character", s: strings.Repeat("é", 20), n: 20, want: strings.Repeat("é", (20-len(marker))/2) + marker},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := cutString(tt.s, tt.n)
+            if got != tt.want {
+                t.Fatalf("cutString(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+            }
+            if !utf8.ValidString(got) {
+                t.Fatalf("cutString(%q, %d) = %q is not valid UTF-8", tt.s, tt.n, got)
+            }
+        })
+    }
+}
+
+func TestProcessToolResult(t *testing.T) {
+    useConfig(t, func(cfg *MCPConfig) {
+        cfg.Output.Tools = map[string]OutputPolicy{
+            "lookup_*": {Paths: []string{"$..api_key"}, Patterns: []RedactionPattern{{Pattern: `\d{3}-\d{4}`, Replacement: "[PHONE]"}}},
+            "list_*":   {MaxBytes: 200},
+        }
+    })
+
+    tests := []struct {
+        name       string
+        tool       string
+        structured string
+        // outputSchema is the tool's, when it has one
+        outputSchema   string
+        wantText       string
+        wantRedactions int
+        wantTruncated  bool
+        wantDropped    bool
+    }{
+        {
+            name:       "no policy",
+            tool:       "other",
+            structured: `{"api_key":"k"}`,
+            wantText:   `"k"`,
+        },
+        {
+            name:           "paths and patterns",
+            tool:           "lookup_user",
+            structured:     `{"user":{"api_key":"k","phone":"555-1234"}}`,
+            wantText:       "[PHONE]",
+            wantRedactions: 2,
+        },
+        {
+            name:          "budget",
+            tool:          "list_rows",
+            structured:    `{"rows":["` + strings.Repeat("r", 500) + `"]}`,
+            wantText:      "[truncated to fit 200 bytes: /rows/0 kept",
+            wantTruncated: true,
+        },
+        {
+            name:           "redacted content still matching the schema",
+            tool:           "lookup_user",
+            structured:     `{"user":{"phone":"555-1234"}}`,
+            outputSchema:   `{"properties":{"user":{"properties":{"phone":{"type":"string"}}}}}`,
+            wantText:       "[PHONE]",
+            wantRedactions: 1,
+        },
+        {
+            name:           "redaction breaking the schema",
+            tool:           "lookup_user",
+            structured:     `{"user":{"api_key":42}}`,
+            outputSchema:   `{"properties":{"user":{"properties":{"api_key":{"type":"integer"}}}}}`,
+            wantText:       "[REDACTED]",
+            wantRedactions: 1,
+            wantDropped:    true,
+        },
+        {
+            name:          "truncation breaking the schema",
+            tool:          "list_rows",
+            structured:    `{"rows":["` + strings.Repeat("r", 500) + `"]}`,
+            outputSchema:  `{"properties":{"rows":{"items":{"minLength":500}}}}`,
+            wantText:      "[truncated to fit 200 bytes: /rows/0 kept",
+            wantTruncated: true,
+            wantDropped:   true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            result := ToolResult{StructuredContent: decodeJSON(t, tt.structured)}
+            result.Content = []ContentBlock{{Type: "text", Text: resultText(result)}}
+
+            tool := MCPTool{Name: tt.tool}
+            if tt.outputSchema != "" {
+                var schema Property
+                if err := json.Unmarshal([]byte(tt.outputSchema), &schema); err != nil {
+                    t.Fatalf("outputSchema: %v", err)
+                }
+                tool.OutputSchema = &schema
+            }
+
+            got := processToolResult(tool, result)
+            if len(got.Content) != 1 || !strings.Contains(got.Content[0].Text, tt.wantText) {
+                t.Fatalf("content %+v does not contain %q", got.Content, tt.wantText)
+            }
+            if redactions, _ := got.Meta["redactions"].(int); redactions != tt.wantRedactions {
+                t.Fatalf("_meta.redactions = %d, want %d", redactions, tt.wantRedactions)
+            }
+            if _, truncated := got.Meta["truncated"]; truncated != tt.wantTruncated {
+                t.Fatalf("_meta.truncated set = %v, want %v", truncated, tt.wantTruncated)
+            }
+            if dropped := got.StructuredContent == nil; dropped != tt.wantDropped || (got.Meta["structuredContentDropped"] == true) != tt.wantDropped {
+                t.Fatalf("structuredContent %v with _meta %v, want dropped = %v", got.StructuredContent, got.Meta, tt.wantDropped)
+            }
+        })
+    }
+}
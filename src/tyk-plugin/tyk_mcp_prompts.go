@@ -0,0 +1,312 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "text/template"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/sirupsen/logrus"
+)
+
+// PromptConfig is one version of a prompt template from the MCP config.
+// Several entries may share a name with different versions; prompts/list
+// advertises the highest version and prompts/get accepts "name@version" to
+// pin an older one.
+type PromptConfig struct {
+    Name        string           `json:"name"`
+    Version     string           `json:"version"`
+    Title       string           `json:"title"`
+    Description string           `json:"description"`
+    Roles       []string         `json:"roles"`
+    Arguments   []PromptArgument `json:"arguments"`
+    Embed       []PromptEmbed    `json:"embed"`
+    Messages    []PromptMessage  `json:"messages"`
+}
+
+// PromptArgument is a caller supplied prompt parameter
+type PromptArgument struct {
+    Name        string `json:"name"`
+    Description string `json:"description,omitempty"`
+    Required    bool   `json:"required,omitempty"`
+}
+
+// PromptEmbed runs a tool while the prompt is rendered and exposes its
+// structured result to the message templates under As
+type PromptEmbed struct {
+    Tool      string            `json:"tool"`
+    Arguments map[string]string `json:"arguments"`
+    As        string            `json:"as"`
+}
+
+// PromptMessage is a message template rendered with text/template. The
+// template data holds the prompt arguments plus every embedded result.
+type PromptMessage struct {
+    Role string `json:"role"`
+    Text string `json:"text"`
+}
+
+var promptTemplateFuncs = template.FuncMap{
+    "json": func(v interface{}) string {
+        encoded, err := json.MarshalIndent(v, "", "  ")
+        if err != nil {
+            return fmt.Sprint(v)
+        }
+        return string(encoded)
+    },
+    "default": func(def, v interface{}) interface{} {
+        if v == nil || v == "" {
+            return def
+        }
+        return v
+    },
+}
+
+// validatePrompts checks that every prompt has a name, a valid role on each
+// message and templates that parse. Embeds cannot use tools that require
+// approval: rendering a prompt would only queue a ticket.
+func validatePrompts(prompts []PromptConfig, approvals ApprovalsConfig) error {
+    seen := map[string]bool{}
+    for _, p := range prompts {
+        if p.Name == "" {
+            return fmt.Errorf("prompt without a name")
+        }
+        key := p.Name + "@" + p.Version
+        if seen[key] {
+            return fmt.Errorf("prompt %s is defined more than once", key)
+        }
+        seen[key] = true
+
+        if len(p.Messages) == 0 {
+            return fmt.Errorf("prompt %s has no messages", key)
+        }
+        for i, m := range p.Messages {
+            if m.Role != "user" && m.Role != "assistant" {
+                return fmt.Errorf("prompt %s message %d: role must be user or assistant", key, i)
+            }
+            if _, err := template.New(key).Funcs(promptTemplateFuncs).Parse(m.Text); err != nil {
+                return fmt.Errorf("prompt %s message %d: %w", key, i, err)
+            }
+        }
+        for i, e := range p.Embed {
+            if e.Tool == "" || e.As == "" {
+                return fmt.Errorf("prompt %s embed %d needs both tool and as", key, i)
+            }
+            gated := MCPToolsRegistry[e.Tool].RequiresApproval
+            for _, name := range approvals.Tools {
+                gated = gated || name == e.Tool
+            }
+            if gated {
+                return fmt.Errorf("prompt %s embed %d: %s requires approval and cannot be embedded", key, i, e.Tool)
+            }
+            for name, value := range e.Arguments {
+                if _, err := template.New(key).Funcs(promptTemplateFuncs).Parse(value); err != nil {
+                    return fmt.Errorf("prompt %s embed %d argument %s: %w", key, i, name, err)
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// compareVersions orders dotted numeric versions; non-numeric parts
+// compare as strings and a missing version sorts lowest
+func compareVersions(a, b string) int {
+    as, bs := strings.Split(a, "."), strings.Split(b, ".")
+    for i := 0; i < len(as) || i < len(bs); i++ {
+        var x, y string
+        if i < len(as) {
+            x = as[i]
+        }
+        if i < len(bs) {
+            y = bs[i]
+        }
+        xi, xerr := strconv.Atoi(x)
+        yi, yerr := strconv.Atoi(y)
+        switch {
+        case xerr == nil && yerr == nil && xi != yi:
+            if xi < yi {
+                return -1
+            }
+            return 1
+        case (xerr != nil || yerr != nil) && x != y:
+            if x < y {
+                return -1
+            }
+            return 1
+        }
+    }
+    return 0
+}
+
+// visiblePrompts returns the prompts caller may use, keyed by name, with
+// each name's versions sorted highest first
+func visiblePrompts(caller mcpCaller) map[string][]PromptConfig {
+    byName := map[string][]PromptConfig{}
+    for _, p := range currentConfig().Prompts {
+        if len(p.Roles) > 0 && !caller.HasAnyRole(p.Roles...) {
+            continue
+        }
+        byName[p.Name] = append(byName[p.Name], p)
+    }
+    for _, versions := range byName {
+        sort.Slice(versions, func(i, j int) bool {
+            return compareVersions(versions[i].Version, versions[j].Version) > 0
+        })
+    }
+    return byName
+}
+
+func handlePromptsList(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    visible := visiblePrompts(req.caller)
+
+    names := make([]string, 0, len(visible))
+    for name := range visible {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    prompts := make([]map[string]interface{}, 0, len(names))
+    for _, name := range names {
+        latest := visible[name][0]
+        versions := make([]string, 0, len(visible[name]))
+        for _, v := range visible[name] {
+            versions = append(versions, v.Version)
+        }
+
+        entry := map[string]interface{}{
+            "name":        latest.Name,
+            "description": latest.Description,
+            "arguments":   latest.Arguments,
+            "_meta": map[string]interface{}{
+                "version":  latest.Version,
+                "versions": versions,
+            },
+        }
+        if latest.Title != "" {
+            entry["title"] = latest.Title
+        }
+        prompts = append(prompts, entry)
+    }
+    return map[string]interface{}{"prompts": prompts}, nil
+}
+
+func handlePromptsGet(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    var p struct {
+        Name      string            `json:"name"`
+        Arguments map[string]string `json:"arguments"`
+    }
+    if rpcErr := decodeParams(params, &p); rpcErr != nil {
+        return nil, rpcErr
+    }
+
+    name, version := p.Name, ""
+    if i := strings.LastIndex(p.Name, "@"); i > 0 {
+        name, version = p.Name[:i], p.Name[i+1:]
+    }
+
+    versions, ok := visiblePrompts(req.caller)[name]
+    if !ok {
+        return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: "Unknown prompt: " + p.Name}
+    }
+    prompt := versions[0]
+    if version != "" {
+        found := false
+        for _, v := range versions {
+            if v.Version == version {
+                prompt, found = v, true
+                break
+            }
+        }
+        if !found {
+            return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: fmt.Sprintf("Unknown version %s of prompt %s", version, name)}
+        }
+    }
+
+    data := map[string]interface{}{}
+    for _, arg := range prompt.Arguments {
+        value, present := p.Arguments[arg.Name]
+        if arg.Required && (!present || value == "") {
+            return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: fmt.Sprintf("Missing required argument: %s", arg.Name)}
+        }
+        data[arg.Name] = value
+    }
+
+    // Embedded live data is rendered through the same tool pipeline as a
+    // tools/call, so validation and authorization apply. The render needs
+    // the result now, so the call never runs as a job.
+    embedRequest := req.r
+    if embedRequest != nil {
+        embedRequest = req.r.Clone(req.ctx)
+        embedRequest.Header.Del("Prefer")
+    }
+    for _, embed := range prompt.Embed {
+        args := map[string]interface{}{}
+        for key, tmpl := range embed.Arguments {
+            rendered, err := renderPromptTemplate(prompt.Name, tmpl, data)
+            if err != nil {
+                return nil, &jsonRPCError{Code: jsonRPCInternalError, Message: err.Error()}
+            }
+            args[key] = rendered
+        }
+
+        result, err := runTool(req.ctx, embedRequest, req.session, embed.Tool, args)
+        if err != nil {
+            return nil, &jsonRPCError{Code: jsonRPCInvalidParams, Message: fmt.Sprintf("Cannot embed %s: %v", embed.Tool, err)}
+        }
+        if result.IsError {
+            rpcErr := &jsonRPCError{Code: jsonRPCInternalError, Message: fmt.Sprintf("Cannot embed %s: %s", embed.Tool, resultText(result))}
+            if toolErr, ok := resultError(result); ok {
+                rpcErr.Data = toolErr
+            }
+            return nil, rpcErr
+        }
+        data[embed.As] = result.StructuredContent
+    }
+
+    messages := make([]map[string]interface{}, 0, len(prompt.Messages))
+    for _, m := range prompt.Messages {
+        text, err := renderPromptTemplate(prompt.Name, m.Text, data)
+        if err != nil {
+            return nil, &jsonRPCError{Code: jsonRPCInternalError, Message: err.Error()}
+        }
+        messages = append(messages, map[string]interface{}{
+            "role":    m.Role,
+            "content": ContentBlock{Type: "text", Text: text},
+        })
+    }
+
+    log.Get().WithFields(logrus.Fields{
+        "prompt":     prompt.Name,
+        "version":    prompt.Version,
+        "session_id": getSessionID(req.session),
+    }).Info("MCP prompt rendered")
+
+    return map[string]interface{}{
+        "description": prompt.Description,
+        "messages":    messages,
+        "_meta":       map[string]interface{}{"version": prompt.Version},
+    }, nil
+}
+
+func renderPromptTemplate(name, text string, data map[string]interface{}) (string, error) {
+    tmpl, err := template.New(name).Funcs(promptTemplateFuncs).Parse(text)
+    if err != nil {
+        return "", fmt.Errorf("prompt %s: %w", name, err)
+    }
+    var buf bytes.Buffer
+    if err := tmpl.Execute(&buf, data); err != nil {
+        return "", fmt.Errorf("prompt %s: %w", name, err)
+    }
+    return buf.String(), nil
+}
+
+func init() {
+    registerMCPMethod("prompts/list", handlePromptsList)
+    registerMCPMethod("prompts/get", handlePromptsGet)
+    mcpCapabilities["prompts"] = map[string]interface{}{"listChanged": true}
+}
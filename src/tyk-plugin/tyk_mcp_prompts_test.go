@@ -0,0 +1,209 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "sync/atomic"
+    "testing"
+
+    "github.com/TykTechnologies/tyk/user"
+)
+
+var testPrompts = []PromptConfig{
+    {
+        Name:      "triage",
+        Version:   "1.2",
+        Arguments: []PromptArgument{{Name: "target", Required: true}},
+        Messages:  []PromptMessage{{Role: "user", Text: "Triage {{.target}}"}},
+    },
+    {
+        Name:      "triage",
+        Version:   "1.10",
+        Arguments: []PromptArgument{{Name: "target", Required: true}, {Name: "tone"}},
+        Messages:  []PromptMessage{{Role: "user", Text: "Triage {{.target}} in a {{default \"calm\" .tone}} tone"}},
+    },
+    {
+        Name:     "escalate",
+        Roles:    []string{"responder"},
+        Messages: []PromptMessage{{Role: "assistant", Text: "Escalating."}},
+    },
+}
+
+func TestValidatePrompts(t *testing.T) {
+    message := []PromptMessage{{Role: "user", Text: "hi"}}
+
+    tests := []struct {
+        name    string
+        prompts []PromptConfig
+        wantErr string
+    }{
+        {name: "valid", prompts: testPrompts},
+        {name: "no name", prompts: []PromptConfig{{Messages: message}}, wantErr: "prompt without a name"},
+        {name: "duplicate version", prompts: []PromptConfig{{Name: "a", Version: "1", Messages: message}, {Name: "a", Version: "1", Messages: message}}, wantErr: "a@1 is defined more than once"},
+        {name: "no messages", prompts: []PromptConfig{{Name: "a"}}, wantErr: "has no messages"},
+        {name: "unknown role", prompts: []PromptConfig{{Name: "a", Messages: []PromptMessage{{Role: "system", Text: "hi"}}}}, wantErr: "role must be user or assistant"},
+        {name: "bad template", prompts: []PromptConfig{{Name: "a", Messages: []PromptMessage{{Role: "user", Text: "{{.x"}}}}, wantErr: "message 0"},
+        {name: "embed without as", prompts: []PromptConfig{{Name: "a", Messages: message, Embed: []PromptEmbed{{Tool: "sentraip_threat_check"}}}}, wantErr: "needs both tool and as"},
+        {name: "embed needing approval", prompts: []PromptConfig{{Name: "a", Messages: message, Embed: []PromptEmbed{{Tool: "gateway_list_blocks", As: "b"}}}}, wantErr: "requires approval"},
+        {name: "bad embed argument", prompts: []PromptConfig{{Name: "a", Messages: message, Embed: []PromptEmbed{{Tool: "sentraip_threat_check", As: "r", Arguments: map[string]string{"target": "{{"}}}}}, wantErr: "argument target"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := validatePrompts(tt.prompts, ApprovalsConfig{Tools: []string{"gateway_list_blocks"}})
+            if tt.wantErr == "" {
+                if err != nil {
+                    t.Fatalf("validatePrompts: %v", err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Fatalf("validatePrompts error = %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestCompareVersions(t *testing.T) {
+    tests := []struct {
+        a, b string
+        want int
+    }{
+        {a: "1.10", b: "1.2", want: 1},
+        {a: "1.2", b: "1.2.0", want: -1},
+        {a: "2", b: "2", want: 0},
+        {a: "", b: "0.1", want: -1},
+        {a: "1.0-beta", b: "1.0-alpha", want: 1},
+    }
+
+    for _, tt := range tests {
+        if got := compareVersions(tt.a, tt.b); got != tt.want {
+            t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+        }
+    }
+}
+
+func TestHandlePromptsList(t *testing.T) {
+    useConfig(t, func(cfg *MCPConfig) { cfg.Prompts = testPrompts })
+
+    tests := []struct {
+        name   string
+        caller mcpCaller
+        want   []string
+    }{
+        {name: "without roles", caller: mcpCaller{ID: "ann"}, want: []string{"triage@1.10"}},
+        {name: "responder", caller: mcpCaller{ID: "rob", Roles: []string{"Responder"}}, want: []string{"escalate@", "triage@1.10"}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            result, rpcErr := handlePromptsList(&mcpRequest{caller: tt.caller}, nil)
+            if rpcErr != nil {
+                t.Fatal(rpcErr)
+            }
+            got := []string{}
+            for _, p := range result.(map[string]interface{})["prompts"].([]map[string]interface{}) {
+                meta := p["_meta"].(map[string]interface{})
+                got = append(got, p["name"].(string)+"@"+meta["version"].(string))
+                if p["name"] == "triage" && !reflect.DeepEqual(meta["versions"], []string{"1.10", "1.2"}) {
+                    t.Fatalf("triage versions %v, want newest first", meta["versions"])
+                }
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("prompts %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestHandlePromptsGet(t *testing.T) {
+    useConfig(t, func(cfg *MCPConfig) { cfg.Prompts = testPrompts })
+
+    tests := []struct {
+        name      string
+        caller    mcpCaller
+        params    string
+        wantText  string
+        wantError string
+    }{
+        {name: "latest version", caller: mcpCaller{ID: "ann"}, params: `{"name":"triage","arguments":{"target":"example.com"}}`, wantText: "Triage example.com in a calm tone"},
+        {name: "pinned version", caller: mcpCaller{ID: "ann"}, params: `{"name":"triage@1.2","arguments":{"target":"example.com"}}`, wantText: "Triage example.com"},
+        {name: "unknown version", caller: mcpCaller{ID: "ann"}, params: `{"name":"triage@3"}`, wantError: "Unknown version 3 of prompt triage"},
+        {name: "missing argument", caller: mcpCaller{ID: "ann"}, params: `{"name":"triage","arguments":{"target":""}}`, wantError: "Missing required argument: target"},
+        {name: "hidden by role", caller: mcpCaller{ID: "ann"}, params: `{"name":"escalate"}`, wantError: "Unknown prompt: escalate"},
+        {name: "role grants", caller: mcpCaller{ID: "rob", Roles: []string{"responder"}}, params: `{"name":"escalate"}`, wantText: "Escalating."},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            result, rpcErr := handlePromptsGet(&mcpRequest{caller: tt.caller}, json.RawMessage(tt.params))
+            if tt.wantError != "" {
+                if rpcErr == nil || rpcErr.Code != jsonRPCInvalidParams || rpcErr.Message != tt.wantError {
+                    t.Fatalf("prompts/get error %v, want %q", rpcErr, tt.wantError)
+                }
+                return
+            }
+            if rpcErr != nil {
+                t.Fatal(rpcErr)
+            }
+            messages := result.(map[string]interface{})["messages"].([]map[string]interface{})
+            if text := messages[0]["content"].(ContentBlock).Text; text != tt.wantText {
+                t.Fatalf("rendered %q, want %q", text, tt.wantText)
+            }
+        })
+    }
+}
+
+func TestHandlePromptsGetEmbed(t *testing.T) {
+    var status atomic.Int32
+    hits := useEchoTool(t, &status)
+    currentConfig().Jobs.Tools = []string{"echo_items"}
+    currentConfig().Prompts = []PromptConfig{{
+        Name:      "lookup",
+        Arguments: []PromptArgument{{Name: "q", Required: true}},
+        Embed:     []PromptEmbed{{Tool: "echo_items", As: "echo", Arguments: map[string]string{"q": "{{.q}}!"}}},
+        Messages:  []PromptMessage{{Role: "user", Text: "Echoed {{.echo.data.q}}"}},
+    }}
+    ann := &user.SessionState{Alias: "ann"}
+
+    tests := []struct {
+        name      string
+        status    int
+        wantText  string
+        wantError string
+    }{
+        {name: "embedded result", status: http.StatusOK, wantText: "Echoed hi!"},
+        {name: "failed embed", status: http.StatusBadRequest, wantError: "Cannot embed echo_items"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            status.Store(int32(tt.status))
+            r := httptest.NewRequest(http.MethodPost, "/mcp", nil)
+            // An embed needs its result now, so it never runs as a job
+            r.Header.Set("Prefer", "respond-async")
+            req := &mcpRequest{ctx: r.Context(), r: r, session: ann, caller: callerFromSession(ann)}
+
+            result, rpcErr := handlePromptsGet(req, json.RawMessage(`{"name":"lookup","arguments":{"q":"hi"}}`))
+            if tt.wantError != "" {
+                if rpcErr == nil || !strings.HasPrefix(rpcErr.Message, tt.wantError) {
+                    t.Fatalf("prompts/get error %v, want %q", rpcErr, tt.wantError)
+                }
+                return
+            }
+            if rpcErr != nil {
+                t.Fatal(rpcErr)
+            }
+            messages := result.(map[string]interface{})["messages"].([]map[string]interface{})
+            if text := messages[0]["content"].(ContentBlock).Text; text != tt.wantText {
+                t.Fatalf("rendered %q, want %q", text, tt.wantText)
+            }
+        })
+    }
+    if hits.Load() != 2 {
+        t.Fatalf("upstream called %d times, want once per render", hits.Load())
+    }
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
+    "github.com/sirupsen/logrus"
+)
+
+// RateLimitsConfig sets per-tool rate limits and quotas, counted per
+// caller in Redis so every gateway shares them
+type RateLimitsConfig struct {
+    Enabled bool `json:"enabled"`
+    // Default applies to tools without an entry in Tools
+    Default ToolLimit            `json:"default"`
+    Tools   map[string]ToolLimit `json:"tools"`
+}
+
+// ToolLimit is the budget of one tool. Zero values mean no limit.
+type ToolLimit struct {
+    // Per is what a caller is counted by: "key", "user" or "org".
+    // Callers without one are counted by client IP.
+    Per string `json:"per"`
+    // Rate calls are allowed in any sliding Window
+    Rate   int64  `json:"rate"`
+    Window string `json:"window"`
+    // Daily and Monthly are quotas over UTC calendar days and months
+    Daily   int64 `json:"daily"`
+    Monthly int64 `json:"monthly"`
+}
+
+func (l ToolLimit) unlimited() bool {
+    return l.Rate <= 0 && l.Daily <= 0 && l.Monthly <= 0
+}
+
+// toolUsage is what a caller has used of a tool's limit
+type toolUsage struct {
+    Tool    string
+    Limit   ToolLimit
+    Window  time.Duration
+    Rate    int64
+    Daily   int64
+    Monthly int64
+    // Exceeded names the limit that refused the call, if any
+    Exceeded   string
+    RetryAfter time.Duration
+}
+
+// rateLimitError is returned by runTool when a call is over its limit
+type rateLimitError struct {
+    usage *toolUsage
+}
+
+func (e *rateLimitError) Error() string {
+    u := e.usage
+    switch u.Exceeded {
+    case "daily":
+        return fmt.Sprintf("daily quota of %d calls to %s exhausted", u.Limit.Daily, u.Tool)
+    case "monthly":
+        return fmt.Sprintf("monthly quota of %d calls to %s exhausted", u.Limit.Monthly, u.Tool)
+    }
+    return fmt.Sprintf("rate limit of %d calls to %s per %s exceeded", u.Limit.Rate, u.Tool, u.Window)
+}
+
+// rateLimitScript checks and records one call atomically. The sliding
+// window is a sorted set of call timestamps; quotas are plain counters.
+// With ARGV[9] set it only reports usage.
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local rate = tonumber(ARGV[3])
+local daily = tonumber(ARGV[4])
+local monthly = tonumber(ARGV[5])
+local peek = ARGV[9] == "1"
+
+local used = 0
+if rate > 0 then
+  redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+  used = redis.call("ZCARD", KEYS[1])
+end
+local dused = tonumber(redis.call("GET", KEYS[2]) or "0")
+local mused = tonumber(redis.call("GET", KEYS[3]) or "0")
+
+local exceeded = ""
+local retry = 0
+if rate > 0 and used >= rate then
+  exceeded = "rate"
+  local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+  retry = tonumber(oldest[2]) + window - now
+elseif daily > 0 and dused >= daily then
+  exceeded = "daily"
+elseif monthly > 0 and mused >= monthly then
+  exceeded = "monthly"
+end
+
+if exceeded == "" and not peek then
+  if rate > 0 then
+    redis.call("ZADD", KEYS[1], now, ARGV[6])
+    redis.call("PEXPIRE", KEYS[1], window)
+    used = used + 1
+  end
+  if daily > 0 then
+    dused = redis.call("INCR", KEYS[2])
+    redis.call("EXPIRE", KEYS[2], ARGV[7])
+  end
+  if monthly > 0 then
+    mused = redis.call("INCR", KEYS[3])
+    redis.call("EXPIRE", KEYS[3], ARGV[8])
+  end
+end
+return {exceeded, retry, used, dused, mused}
+`)
+
+// toolLimit returns the limit configured for a tool
+func toolLimit(toolName string) (ToolLimit, bool) {
+    cfg := currentConfig().RateLimits
+    if !cfg.Enabled {
+        return ToolLimit{}, false
+    }
+    limit, ok := cfg.Tools[toolName]
+    if !ok {
+        limit = cfg.Default
+    }
+    return limit, !limit.unlimited()
+}
+
+// rateLimitSubject identifies who a call is counted against
+func rateLimitSubject(limit ToolLimit, session *user.SessionState, r *http.Request) string {
+    clientIP := ""
+    if r != nil {
+        clientIP = getClientIP(r)
+    }
+    return limitSubject(limit, callerFromSession(session), keySubject(session), clientIP)
+}
+
+// keySubject is the subject of the session's key: a short hash, so the key
+// itself is never written to Redis
+func keySubject(session *user.SessionState) string {
+    if session == nil || session.KeyID == "" {
+        return ""
+    }
+    sum := sha256.Sum256([]byte(session.KeyID))
+    return "key:" + hex.EncodeToString(sum[:8])
+}
+
+// limitSubject picks the subject limit.Per counts by, falling back to the
+// client IP for callers without one
+func limitSubject(limit ToolLimit, caller mcpCaller, key, clientIP string) string {
+    switch limit.Per {
+    case "key":
+        if key != "" {
+            return key
+        }
+    case "org":
+        if caller.OrgID != "" {
+            return "org:" + caller.OrgID
+        }
+    default:
+        if !caller.Anonymous() {
+            return "user:" + caller.ID
+        }
+    }
+    if clientIP != "" {
+        return "ip:" + clientIP
+    }
+    return "anonymous"
+}
+
+// checkToolLimit counts a call to toolName, or with peek only reports the
+// current usage. It returns nil when the tool has no limit. Limits fail
+// open: if Redis cannot be reached the call is allowed.
+func checkToolLimit(ctx context.Context, toolName string, session *user.SessionState, r *http.Request, peek bool) (*toolUsage, error) {
+    limit, ok := toolLimit(toolName)
+    if !ok {
+        return nil, nil
+    }
+    return countToolCall(ctx, toolName, limit, rateLimitSubject(limit, session, r), peek)
+}
+
+// countToolCall is checkToolLimit for a caller whose subject is known
+func countToolCall(ctx context.Context, toolName string, limit ToolLimit, subject string, peek bool) (*toolUsage, error) {
+    usage := &toolUsage{Tool: toolName, Limit: limit, Window: durationOr(limit.Window, time.Minute)}
+    now := time.Now().UTC()
+    res, err := rateLimitScript.Run(ctx, redisClient(), rateLimitKeys(toolName, subject, now), rateLimitArgs(usage, now, peek)...).Slice()
+    if err != nil {
+        // A caller that went away is not a Redis outage
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        log.Get().WithError(err).WithField("tool_name", toolName).Warn("Rate limit check failed, allowing call")
+        return nil, nil
+    }
+
+    retryMs := usage.read(res)
+    switch usage.Exceeded {
+    case "":
+        return usage, nil
+    case "rate":
+        usage.RetryAfter = time.Duration(retryMs) * time.Millisecond
+    case "daily":
+        usage.RetryAfter = time.Until(nextDay(now))
+    case "monthly":
+        usage.RetryAfter = time.Until(nextMonth(now))
+    }
+
+    log.Get().WithFields(logrus.Fields{
+        "tool_name":   toolName,
+        "subject":     subject,
+        "limit":       usage.Exceeded,
+        "retry_after": usage.RetryAfter.String(),
+    }).Warn("MCP tool call rate limited")
+    return usage, &rateLimitError{usage}
+}
+
+// rateLimitKeys are the KEYS of a rateLimitScript run: the sliding window
+// and the current day's and month's quota counters
+func rateLimitKeys(toolName, subject string, now time.Time) []string {
+    prefix := "mcp-ratelimit:" + toolName + ":" + subject
+    return []string{
+        prefix + ":window",
+        prefix + ":d:" + now.Format("20060102"),
+        prefix + ":m:" + now.Format("200601"),
+    }
+}
+
+// rateLimitArgs are the ARGV of a rateLimitScript run
+func rateLimitArgs(usage *toolUsage, now time.Time, peek bool) []interface{} {
+    member := make([]byte, 6)
+    rand.Read(member)
+    peekArg := "0"
+    if peek {
+        peekArg = "1"
+    }
+    return []interface{}{
+        now.UnixMilli(),
+        usage.Window.Milliseconds(),
+        usage.Limit.Rate,
+        usage.Limit.Daily,
+        usage.Limit.Monthly,
+        strconv.FormatInt(now.UnixNano(), 36) + hex.EncodeToString(member),
+        int64(time.Until(nextDay(now)).Seconds()) + 3600,
+        int64(time.Until(nextMonth(now)).Seconds()) + 3600,
+        peekArg,
+    }
+}
+
+// read fills in the usage reported by rateLimitScript and returns the
+// milliseconds until the sliding window admits another call
+func (u *toolUsage) read(res []interface{}) int64 {
+    u.Exceeded, _ = res[0].(string)
+    retryMs, _ := res[1].(int64)
+    u.Rate, _ = res[2].(int64)
+    u.Daily, _ = res[3].(int64)
+    u.Monthly, _ = res[4].(int64)
+    return retryMs
+}
+
+// meta reports the remaining budget, for _meta in tool results and in
+// tools/list
+func (u *toolUsage) meta() map[string]interface{} {
+    meta := map[string]interface{}{}
+    if u.Limit.Rate > 0 {
+        meta["limit"] = u.Limit.Rate
+        meta["remaining"] = remaining(u.Limit.Rate, u.Rate)
+        meta["window"] = u.Window.String()
+    }
+    now := time.Now().UTC()
+    if u.Limit.Daily > 0 {
+        meta["daily"] = map[string]interface{}{
+            "limit":     u.Limit.Daily,
+            "remaining": remaining(u.Limit.Daily, u.Daily),
+            "reset":     nextDay(now).Format(time.RFC3339),
+        }
+    }
+    if u.Limit.Monthly > 0 {
+        meta["monthly"] = map[string]interface{}{
+            "limit":     u.Limit.Monthly,
+            "remaining": remaining(u.Limit.Monthly, u.Monthly),
+            "reset":     nextMonth(now).Format(time.RFC3339),
+        }
+    }
+    return meta
+}
+
+// setRateLimitHeaders reports the remaining budget on an HTTP response
+func setRateLimitHeaders(header http.Header, u *toolUsage) {
+    if u.Limit.Rate > 0 {
+        header.Set("X-RateLimit-Limit", strconv.FormatInt(u.Limit.Rate, 10))
+        header.Set("X-RateLimit-Remaining", strconv.FormatInt(remaining(u.Limit.Rate, u.Rate), 10))
+        header.Set("X-RateLimit-Window", u.Window.String())
+    }
+    if u.Limit.Daily > 0 {
+        header.Set("X-Quota-Daily-Remaining", strconv.FormatInt(remaining(u.Limit.Daily, u.Daily), 10))
+    }
+    if u.Limit.Monthly > 0 {
+        header.Set("X-Quota-Monthly-Remaining", strconv.FormatInt(remaining(u.Limit.Monthly, u.Monthly), 10))
+    }
+    if u.Exceeded != "" {
+        header.Set("Retry-After", strconv.FormatInt(retryAfterSeconds(u.RetryAfter), 10))
+    }
+}
+
+func retryAfterSeconds(d time.Duration) int64 {
+    seconds := int64((d + time.Second - 1) / time.Second)
+    if seconds < 1 {
+        seconds = 1
+    }
+    return seconds
+}
+
+func remaining(limit, used int64) int64 {
+    if used >= limit {
+        return 0
+    }
+    return limit - used
+}
+
+func nextDay(t time.Time) time.Time {
+    y, m, d := t.Date()
+    return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+func nextMonth(t time.Time) time.Time {
+    y, m, _ := t.Date()
+    return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// withRateLimitMeta adds each limited tool's remaining budget for the
+// calling caller to its _meta. Tools without a limit are skipped, and the
+// usage of the rest is read in one pipeline.
+func withRateLimitMeta(tools []MCPTool, session *user.SessionState, r *http.Request) []MCPTool {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    now := time.Now().UTC()
+    usages := map[int]*toolUsage{}
+    cmds := map[int]*redis.Cmd{}
+    var pipe redis.Pipeliner
+    for i, tool := range tools {
+        limit, ok := toolLimit(tool.Name)
+        if !ok {
+            continue
+        }
+        if pipe == nil {
+            if err := rateLimitScript.Load(ctx, redisClient()).Err(); err != nil {
+                log.Get().WithError(err).Warn("Rate limit usage lookup failed, listing tools without it")
+                return tools
+            }
+            pipe = redisClient().Pipeline()
+        }
+        usage := &toolUsage{Tool: tool.Name, Limit: limit, Window: durationOr(limit.Window, time.Minute)}
+        subject := rateLimitSubject(limit, session, r)
+        usages[i] = usage
+        cmds[i] = rateLimitScript.EvalSha(ctx, pipe, rateLimitKeys(tool.Name, subject, now), rateLimitArgs(usage, now, true)...)
+    }
+    if pipe == nil {
+        return tools
+    }
+    if _, err := pipe.Exec(ctx); err != nil {
+        log.Get().WithError(err).Warn("Rate limit usage lookup failed, listing tools without it")
+        return tools
+    }
+
+    for i, cmd := range cmds {
+        res, err := cmd.Slice()
+        if err != nil {
+            continue
+        }
+        usages[i].read(res)
+        meta := map[string]interface{}{}
+        for k, v := range tools[i].Meta {
+            meta[k] = v
+        }
+        meta["rateLimit"] = usages[i].meta()
+        tools[i].Meta = meta
+    }
+    return tools
+}
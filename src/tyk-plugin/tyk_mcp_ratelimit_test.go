@@ -0,0 +1,215 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/alicebob/miniredis/v2"
+)
+
+// useRedis is useConfig with Redis served by an in-memory server
+func useRedis(t *testing.T, edit func(cfg *MCPConfig)) (*mcpState, *miniredis.Miniredis) {
+    t.Helper()
+    server := miniredis.RunT(t)
+    state := useConfig(t, func(cfg *MCPConfig) {
+        cfg.Redis = RedisConfig{Addr: server.Addr()}
+        if edit != nil {
+            edit(cfg)
+        }
+    })
+    return state, server
+}
+
+func TestCheckToolLimit(t *testing.T) {
+    const tool = "sentraip_threat_check"
+
+    // Each call is made by caller (anonymous when empty) and is refused by
+    // the limit named in want, or allowed when want is empty
+    type call struct {
+        caller string
+        peek   bool
+        want   string
+    }
+    tests := []struct {
+        name  string
+        limit ToolLimit
+        calls []call
+    }{
+        {
+            name:  "rate",
+            limit: ToolLimit{Rate: 2, Window: "1m"},
+            calls: []call{{caller: "ann"}, {caller: "ann"}, {caller: "ann", want: "rate"}, {caller: "ann", want: "rate"}},
+        },
+        {
+            name:  "daily quota",
+            limit: ToolLimit{Daily: 1},
+            calls: []call{{caller: "ann"}, {caller: "ann", want: "daily"}},
+        },
+        {
+            name:  "monthly quota",
+            limit: ToolLimit{Monthly: 2, Daily: 5},
+            calls: []call{{caller: "ann"}, {caller: "ann"}, {caller: "ann", want: "monthly"}},
+        },
+        {
+            name:  "callers are counted apart",
+            limit: ToolLimit{Rate: 1},
+            calls: []call{{caller: "ann"}, {caller: "bob"}, {caller: "ann", want: "rate"}},
+        },
+        {
+            name:  "anonymous callers are counted by address",
+            limit: ToolLimit{Rate: 1},
+            calls: []call{{}, {want: "rate"}, {caller: "ann"}},
+        },
+        {
+            name:  "peeking does not count",
+            limit: ToolLimit{Rate: 1},
+            calls: []call{{caller: "ann", peek: true}, {caller: "ann", peek: true}, {caller: "ann"}, {caller: "ann", peek: true, want: "rate"}},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            useRedis(t, func(cfg *MCPConfig) {
+                cfg.RateLimits = RateLimitsConfig{Enabled: true, Tools: map[string]ToolLimit{tool: tt.limit}}
+            })
+            r := httptest.NewRequest("POST", "/mcp", nil)
+            r.RemoteAddr = "198.51.100.7:4321"
+
+            for i, c := range tt.calls {
+                var session *user.SessionState
+                if c.caller != "" {
+                    session = &user.SessionState{Alias: c.caller}
+                }
+                usage, err := checkToolLimit(context.Background(), tool, session, r, c.peek)
+                if usage == nil {
+                    t.Fatalf("call %d: no usage reported", i)
+                }
+                if usage.Exceeded != c.want {
+                    t.Fatalf("call %d: exceeded %q, want %q", i, usage.Exceeded, c.want)
+                }
+                var limitErr *rateLimitError
+                if (c.want != "") != errors.As(err, &limitErr) {
+                    t.Fatalf("call %d: error %v", i, err)
+                }
+                if c.want != "" && usage.RetryAfter <= 0 {
+                    t.Fatalf("call %d: retry after %v", i, usage.RetryAfter)
+                }
+            }
+        })
+    }
+}
+
+func TestCheckToolLimitUnlimited(t *testing.T) {
+    tests := []struct {
+        name   string
+        limits RateLimitsConfig
+    }{
+        {name: "disabled", limits: RateLimitsConfig{Tools: map[string]ToolLimit{"t": {Rate: 1}}}},
+        {name: "no limit", limits: RateLimitsConfig{Enabled: true, Tools: map[string]ToolLimit{"other": {Rate: 1}}}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            useRedis(t, func(cfg *MCPConfig) { cfg.RateLimits = tt.limits })
+            usage, err := checkToolLimit(context.Background(), "t", nil, nil, false)
+            if usage != nil || err != nil {
+                t.Fatalf("got %+v, %v, want no limit", usage, err)
+            }
+        })
+    }
+}
+
+func TestCheckToolLimitFailsOpen(t *testing.T) {
+    _, server := useRedis(t, func(cfg *MCPConfig) {
+        cfg.RateLimits = RateLimitsConfig{Enabled: true, Default: ToolLimit{Rate: 1}}
+    })
+    server.Close()
+
+    usage, err := checkToolLimit(context.Background(), "t", nil, nil, false)
+    if usage != nil || err != nil {
+        t.Fatalf("got %+v, %v, want the call allowed", usage, err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if _, err := checkToolLimit(ctx, "t", nil, nil, false); !errors.Is(err, context.Canceled) {
+        t.Fatalf("got %v with a cancelled context, want context.Canceled", err)
+    }
+}
+
+func TestWithRateLimitMeta(t *testing.T) {
+    _, server := useRedis(t, func(cfg *MCPConfig) {
+        cfg.RateLimits = RateLimitsConfig{Enabled: true, Tools: map[string]ToolLimit{"a": {Rate: 3}, "c": {Daily: 5}}}
+    })
+    session := &user.SessionState{Alias: "ann"}
+    checkToolLimit(context.Background(), "a", session, nil, false)
+
+    tools := withRateLimitMeta([]MCPTool{
+        {Name: "a", Meta: map[string]interface{}{"owner": "soc"}},
+        {Name: "b"},
+        {Name: "c"},
+    }, session, nil)
+    if meta, _ := tools[0].Meta["rateLimit"].(map[string]interface{}); meta["remaining"] != int64(2) || tools[0].Meta["owner"] != "soc" {
+        t.Fatalf("a has _meta %v, want 2 calls remaining and owner kept", tools[0].Meta)
+    }
+    if tools[1].Meta != nil {
+        t.Fatalf("unlimited tool has _meta %v", tools[1].Meta)
+    }
+    if meta, _ := tools[2].Meta["rateLimit"].(map[string]interface{}); meta["daily"] == nil {
+        t.Fatalf("c has _meta %v, want its daily quota", tools[2].Meta)
+    }
+
+    server.Close()
+    tools = withRateLimitMeta([]MCPTool{{Name: "a"}}, session, nil)
+    if tools[0].Meta != nil {
+        t.Fatalf("with Redis down a has _meta %v, want none", tools[0].Meta)
+    }
+}
+
+func TestRemaining(t *testing.T) {
+    tests := []struct {
+        limit, used, want int64
+    }{
+        {limit: 10, used: 3, want: 7},
+        {limit: 10, used: 10, want: 0},
+        {limit: 10, used: 12, want: 0},
+    }
+
+    for _, tt := range tests {
+        if got := remaining(tt.limit, tt.used); got != tt.want {
+            t.Errorf("remaining(%d, %d) = %d, want %d", tt.limit, tt.used, got, tt.want)
+        }
+    }
+}
+
+func TestQuotaPeriods(t *testing.T) {
+    tests := []struct {
+        now       time.Time
+        wantDay   time.Time
+        wantMonth time.Time
+    }{
+        {
+            now:       time.Date(2026, 1, 31, 23, 59, 0, 0, time.UTC),
+            wantDay:   time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+            wantMonth: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+        },
+        {
+            now:       time.Date(2026, 12, 15, 8, 0, 0, 0, time.UTC),
+            wantDay:   time.Date(2026, 12, 16, 0, 0, 0, 0, time.UTC),
+            wantMonth: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+        },
+    }
+
+    for _, tt := range tests {
+        if got := nextDay(tt.now); !got.Equal(tt.wantDay) {
+            t.Errorf("nextDay(%v) = %v, want %v", tt.now, got, tt.wantDay)
+        }
+        if got := nextMonth(tt.now); !got.Equal(tt.wantMonth) {
+            t.Errorf("nextMonth(%v) = %v, want %v", tt.now, got, tt.wantMonth)
+        }
+    }
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "sync"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// RedisConfig is the Redis the plugin keeps its own state in. It defaults to
+// the gateway's storage so no extra deployment is needed.
+type RedisConfig struct {
+    Addr     string `json:"addr"`
+    Password string `json:"password"`
+    DB       int    `json:"db"`
+}
+
+var (
+    redisMu   sync.Mutex
+    redisConn *redis.Client
+    redisFrom RedisConfig
+)
+
+func defaultRedisConfig() RedisConfig {
+    return RedisConfig{
+        Addr:     getEnv("TYK_GW_STORAGE_HOST", "tyk-redis") + ":" + getEnv("TYK_GW_STORAGE_PORT", "6379"),
+        Password: getEnv("TYK_GW_STORAGE_PASSWORD", ""),
+    }
+}
+
+// redisClient returns the shared client for the current config, replacing
+// it when the Redis settings change
+func redisClient() *redis.Client {
+    redisMu.Lock()
+    defer redisMu.Unlock()
+
+    cfg := currentConfig().Redis
+    if redisConn != nil && cfg == redisFrom {
+        return redisConn
+    }
+    if redisConn != nil {
+        redisConn.Close()
+    }
+    redisConn = redis.NewClient(&redis.Options{
+        Addr:     cfg.Addr,
+        Password: cfg.Password,
+        DB:       cfg.DB,
+    })
+    redisFrom = cfg
+    return redisConn
+}
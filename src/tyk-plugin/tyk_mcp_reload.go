@@ -0,0 +1,407 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/netip"
+    "os"
+    "reflect"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
+    "github.com/sirupsen/logrus"
+)
+
+// ReloadConfig controls how the configuration and tool registry are
+// reloaded while the gateway runs
+type ReloadConfig struct {
+    // Watch reloads when the config file or an OpenAPI source changes,
+    // checking every WatchInterval
+    Watch         bool   `json:"watch"`
+    WatchInterval string `json:"watch_interval"`
+    // Roles may reload through POST /mcp/reload
+    Roles []string `json:"roles"`
+}
+
+// mcpState is one generation of what a reload replaces: the configuration
+// and the tool registry built from it. It is not modified once active; a
+// reload builds a new state and swaps it in.
+type mcpState struct {
+    config MCPConfig
+    // tools serves the current version of each tool by name
+    tools map[string]MCPTool
+    // versions holds every registered version, by tool name and version
+    versions map[string]map[string]MCPTool
+    // operations maps generated tool versions (see toolKey) to the gateway
+    // route they call
+    operations map[string]gatewayOperation
+    // federated maps the tools of upstream MCP servers to where their
+    // calls go
+    federated map[string]federatedTool
+    // fingerprint identifies the files the state was loaded from
+    fingerprint string
+    generation  int64
+    loadedAt    time.Time
+}
+
+var (
+    activeState atomic.Pointer[mcpState]
+
+    // bootState serves until the first load, while the init functions run
+    bootState = &mcpState{config: defaultMCPConfig(), tools: MCPToolsRegistry}
+
+    // reloads serializes reloads and records the outcome of the last one
+    reloads struct {
+        sync.Mutex
+        lastAttempt time.Time
+        lastError   string
+    }
+)
+
+// currentState returns the active state. Callers that read it more than
+// once for one request should keep the pointer, so a reload in between
+// does not mix generations.
+func currentState() *mcpState {
+    if s := activeState.Load(); s != nil {
+        return s
+    }
+    return bootState
+}
+
+// currentConfig returns the active configuration
+func currentConfig() *MCPConfig {
+    return &currentState().config
+}
+
+func mcpConfigPath() string {
+    return getEnv("MCP_CONFIG_FILE", "/opt/tyk-gateway/mcp/config.yaml")
+}
+
+func openAPISources(cfg MCPConfig) string {
+    return getEnv("MCP_OPENAPI_SOURCES", cfg.AppsPath)
+}
+
+// newMCPState returns a state holding cfg and the built-in tools
+func newMCPState(cfg MCPConfig) *mcpState {
+    s := &mcpState{
+        config:     cfg,
+        tools:      map[string]MCPTool{},
+        versions:   map[string]map[string]MCPTool{},
+        operations: map[string]gatewayOperation{},
+        loadedAt:   time.Now(),
+    }
+    for _, tool := range MCPToolsRegistry {
+        s.register(tool)
+    }
+    return s
+}
+
+// buildMCPState loads the config file and the OpenAPI sources into a new
+// state. When strict, any problem fails the build; otherwise, as at
+// startup, an invalid config falls back to the defaults and unreadable
+// OpenAPI documents are skipped.
+func buildMCPState(strict bool) (*mcpState, error) {
+    path := mcpConfigPath()
+    cfg, err := loadMCPConfig(path)
+    if err == nil {
+        err = validateMCPConfig(cfg)
+    }
+    if err != nil {
+        if strict {
+            return nil, err
+        }
+        log.Get().WithError(err).Error("Failed to load MCP config, using defaults")
+        cfg = defaultMCPConfig()
+    }
+
+    sources := openAPISources(cfg)
+    fingerprint := sourceFingerprint(path, sources)
+    s := newMCPState(cfg)
+    for _, problem := range s.loadOpenAPITools(sources) {
+        if strict {
+            return nil, problem
+        }
+        log.Get().WithError(problem).Warn("Skipping OpenAPI document")
+    }
+    s.addFederatedTools()
+    if err := s.validate(); err != nil {
+        if strict {
+            return nil, err
+        }
+        log.Get().WithError(err).Error("Invalid MCP tool registry")
+    }
+    s.fingerprint = fingerprint
+    return s, nil
+}
+
+// validate checks what a reload could break: each tool needs a name and
+// an input schema, the config may only name tools that exist, and generated
+// tools cannot require approval
+func (s *mcpState) validate() error {
+    for name, versions := range s.versions {
+        for version, tool := range versions {
+            if tool.Name == "" || tool.InputSchema.Type != "object" {
+                return fmt.Errorf("tool %s@%s needs a name and an object input schema", name, version)
+            }
+        }
+    }
+    for _, name := range s.config.Approvals.Tools {
+        for version := range s.versions[name] {
+            if _, ok := s.operations[toolKey(name, version)]; ok {
+                return fmt.Errorf("approvals.tools lists %s, which is generated from OpenAPI and cannot require approval", name)
+            }
+        }
+    }
+    for _, prompt := range s.config.Prompts {
+        for _, embed := range prompt.Embed {
+            if _, ok := s.tools[embed.Tool]; !ok {
+                return fmt.Errorf("prompt %s embeds unknown tool %s", prompt.Name, embed.Tool)
+            }
+        }
+    }
+    return nil
+}
+
+// validateMCPConfig rejects settings that would otherwise be replaced by
+// their defaults at the point of use
+func validateMCPConfig(cfg MCPConfig) error {
+    durations := map[string]string{
+        "tool_timeouts.default":               cfg.ToolTimeouts.Default,
+        "jobs.timeout":                        cfg.Jobs.Timeout,
+        "approvals.ttl":                       cfg.Approvals.TTL,
+        "idempotency.window":                  cfg.Idempotency.Window,
+        "sentraip.upstream.base_delay":        cfg.SentraIP.Upstream.BaseDelay,
+        "sentraip.upstream.max_delay":         cfg.SentraIP.Upstream.MaxDelay,
+        "sentraip.upstream.max_retry_after":   cfg.SentraIP.Upstream.MaxRetryAfter,
+        "sentraip.upstream.open_for":          cfg.SentraIP.Upstream.OpenFor,
+        "federation.upstream.max_retry_after": cfg.Federation.Upstream.MaxRetryAfter,
+        "federation.upstream.open_for":        cfg.Federation.Upstream.OpenFor,
+        "reload.watch_interval":               cfg.Reload.WatchInterval,
+        "rate_limits.default.window":          cfg.RateLimits.Default.Window,
+    }
+    for tool, timeout := range cfg.ToolTimeouts.Tools {
+        durations["tool_timeouts.tools."+tool] = timeout
+    }
+    for tool, limit := range cfg.RateLimits.Tools {
+        durations["rate_limits.tools."+tool+".window"] = limit.Window
+    }
+    for _, server := range cfg.Federation.Servers {
+        durations["federation.servers."+server.Name+".refresh_interval"] = server.RefreshInterval
+    }
+    for key, value := range durations {
+        if value == "" {
+            continue
+        }
+        if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+            return fmt.Errorf("%s: invalid duration %q", key, value)
+        }
+    }
+    switch cfg.ToolAccess.Default {
+    case "", "allow", "deny":
+    default:
+        return fmt.Errorf("tool_access.default must be allow or deny, got %q", cfg.ToolAccess.Default)
+    }
+    switch cfg.ToolAccess.ExternalDefault {
+    case "", "allow", "deny":
+    default:
+        return fmt.Errorf("tool_access.external_default must be allow or deny, got %q", cfg.ToolAccess.ExternalDefault)
+    }
+    for _, proxy := range cfg.TrustedProxies {
+        if _, err := netip.ParsePrefix(proxy); err != nil {
+            if _, err := netip.ParseAddr(proxy); err != nil {
+                return fmt.Errorf("trusted_proxies: %q is not an address or CIDR block", proxy)
+            }
+        }
+    }
+    if err := validateOutputConfig(cfg.Output); err != nil {
+        return err
+    }
+    return validateFederation(cfg.Federation)
+}
+
+// sourceFingerprint identifies the current version of the config file and
+// the OpenAPI documents by their size and modification time. Mounted
+// ConfigMaps are updated by swapping a symlink, which changes both.
+func sourceFingerprint(configPath, sources string) string {
+    h := sha256.New()
+    stat := func(path string) {
+        info, err := os.Stat(path)
+        if err != nil {
+            fmt.Fprintf(h, "%s missing\n", path)
+            return
+        }
+        fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+    }
+    stat(configPath)
+    for _, source := range splitSources(sources) {
+        files, err := openAPISourceFiles(source)
+        if err != nil {
+            fmt.Fprintf(h, "%s unreadable\n", source)
+            continue
+        }
+        for _, file := range files {
+            stat(file)
+        }
+    }
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// reloadMCP builds a new state from the config file and OpenAPI sources
+// and activates it. If the new state is invalid the active one is kept
+// and the error returned.
+func reloadMCP(trigger string) (*mcpState, error) {
+    reloads.Lock()
+    defer reloads.Unlock()
+    reloads.lastAttempt = time.Now()
+
+    previous := currentState()
+    next, err := buildMCPState(true)
+    if err != nil {
+        reloads.lastError = err.Error()
+        log.Get().WithError(err).WithFields(logrus.Fields{
+            "trigger":    trigger,
+            "generation": previous.generation,
+        }).Error("MCP reload rejected, keeping the active configuration")
+        return previous, err
+    }
+    next.generation = previous.generation + 1
+    activeState.Store(next)
+    reloads.lastError = ""
+    syncFederation(next.config.Federation.Servers)
+
+    announceChanges(previous, next)
+    log.Get().WithFields(logrus.Fields{
+        "trigger":     trigger,
+        "generation":  next.generation,
+        "tools_count": len(next.tools),
+    }).Info("MCP configuration and tools reloaded")
+    return next, nil
+}
+
+// announceChanges tells MCP clients which lists a reload changed
+func announceChanges(previous, next *mcpState) {
+    if !reflect.DeepEqual(toolListing(previous), toolListing(next)) {
+        broadcastNotification("notifications/tools/list_changed", nil)
+    }
+    if !reflect.DeepEqual(previous.config.Prompts, next.config.Prompts) {
+        broadcastNotification("notifications/prompts/list_changed", nil)
+    }
+}
+
+// toolListing is what tools/list depends on, in comparable form
+func toolListing(s *mcpState) string {
+    encoded, _ := json.Marshal(map[string]interface{}{
+        "versions":  s.versions,
+        "access":    s.config.ToolAccess,
+        "approvals": s.config.Approvals.Tools,
+        "jobs":      s.config.Jobs.Tools,
+    })
+    return string(encoded)
+}
+
+// watchMCPSources reloads when the config file or an OpenAPI document
+// changes. A rejected version is not retried until the files change again.
+func watchMCPSources() {
+    rejected := ""
+    for {
+        cfg := currentConfig().Reload
+        time.Sleep(durationOr(cfg.WatchInterval, 10*time.Second))
+        if !cfg.Watch {
+            continue
+        }
+
+        state := currentState()
+        fingerprint := sourceFingerprint(mcpConfigPath(), openAPISources(state.config))
+        if fingerprint == state.fingerprint || fingerprint == rejected {
+            continue
+        }
+        if _, err := reloadMCP("watch"); err != nil {
+            rejected = fingerprint
+            continue
+        }
+        rejected = ""
+    }
+}
+
+// reloadStatus describes the active state for the reload API
+func reloadStatus(s *mcpState) map[string]interface{} {
+    reloads.Lock()
+    defer reloads.Unlock()
+    status := map[string]interface{}{
+        "generation":  s.generation,
+        "loaded_at":   s.loadedAt.Format(time.RFC3339),
+        "tools_count": len(s.tools),
+        "watch":       s.config.Reload.Watch,
+    }
+    if !reloads.lastAttempt.IsZero() {
+        status["last_attempt"] = reloads.lastAttempt.Format(time.RFC3339)
+    }
+    if reloads.lastError != "" {
+        status["last_error"] = reloads.lastError
+    }
+    return status
+}
+
+// handleReload serves GET /mcp/reload, the status of the active
+// configuration, and POST /mcp/reload, which reloads it on this gateway
+func handleReload(rw http.ResponseWriter, r *http.Request, session *user.SessionState) {
+    caller := callerFromSession(session)
+    roles := currentConfig().Reload.Roles
+    if caller.Anonymous() || !caller.HasAnyRole(roles...) {
+        writeJSON(rw, http.StatusForbidden, map[string]interface{}{
+            "error":   "forbidden",
+            "message": "reloading requires one of the roles: " + strings.Join(roles, ", "),
+        })
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        writeJSON(rw, http.StatusOK, reloadStatus(currentState()))
+    case http.MethodPost:
+        state, err := reloadMCP("api")
+        auditReload(r.Context(), caller, state, err)
+        if err != nil {
+            status := reloadStatus(state)
+            status["error"] = "reload_rejected"
+            status["message"] = err.Error()
+            writeJSON(rw, http.StatusUnprocessableEntity, status)
+            return
+        }
+        writeJSON(rw, http.StatusOK, reloadStatus(state))
+    default:
+        rw.Header().Set("Allow", "GET, POST")
+        writeJSON(rw, http.StatusMethodNotAllowed, map[string]interface{}{"error": "method_not_allowed"})
+    }
+}
+
+// auditReload records a reload requested through the API
+func auditReload(ctx context.Context, caller mcpCaller, state *mcpState, reloadErr error) {
+    event := auditEvent{
+        Action:  "reload",
+        Target:  "mcp-config",
+        Actor:   caller.ID,
+        Details: map[string]interface{}{"generation": state.generation, "tools_count": len(state.tools)},
+    }
+    if reloadErr != nil {
+        event.Action = "reload_rejected"
+        event.Details["error"] = reloadErr.Error()
+    }
+    _, err := redisClient().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        appendAudit(ctx, pipe, event)
+        return nil
+    })
+    if err != nil && !errors.Is(err, context.Canceled) {
+        log.Get().WithError(err).Warn("Failed to audit MCP reload")
+    }
+}
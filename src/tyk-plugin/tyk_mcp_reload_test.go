@@ -0,0 +1,86 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+// useConfig makes a state built from the default config, as changed by
+// edit, the active one for the rest of the test
+func useConfig(t *testing.T, edit func(cfg *MCPConfig)) *mcpState {
+    t.Helper()
+    cfg := defaultMCPConfig()
+    if edit != nil {
+        edit(&cfg)
+    }
+    state := newMCPState(cfg)
+    previous := activeState.Swap(state)
+    t.Cleanup(func() { activeState.Store(previous) })
+    return state
+}
+
+func TestValidateMCPConfig(t *testing.T) {
+    tests := []struct {
+        name    string
+        edit    func(cfg *MCPConfig)
+        wantErr string
+    }{
+        {
+            name: "defaults",
+        },
+        {
+            name:    "invalid duration",
+            edit:    func(cfg *MCPConfig) { cfg.Jobs.Timeout = "soon" },
+            wantErr: `jobs.timeout: invalid duration "soon"`,
+        },
+        {
+            name:    "negative duration",
+            edit:    func(cfg *MCPConfig) { cfg.Approvals.TTL = "-1m" },
+            wantErr: `approvals.ttl: invalid duration "-1m"`,
+        },
+        {
+            name: "per-tool window",
+            edit: func(cfg *MCPConfig) {
+                cfg.RateLimits.Tools = map[string]ToolLimit{"sentraip_threat_check": {Window: "1x"}}
+            },
+            wantErr: "rate_limits.tools.sentraip_threat_check.window",
+        },
+        {
+            name:    "unknown access default",
+            edit:    func(cfg *MCPConfig) { cfg.ToolAccess.Default = "maybe" },
+            wantErr: "tool_access.default must be allow or deny",
+        },
+        {
+            name:    "unknown external default",
+            edit:    func(cfg *MCPConfig) { cfg.ToolAccess.ExternalDefault = "yes" },
+            wantErr: "tool_access.external_default must be allow or deny",
+        },
+        {
+            name: "trusted proxy addresses and blocks",
+            edit: func(cfg *MCPConfig) { cfg.TrustedProxies = []string{"10.1.2.3", "fd00::/8"} },
+        },
+        {
+            name:    "trusted proxy hostname",
+            edit:    func(cfg *MCPConfig) { cfg.TrustedProxies = []string{"proxy.internal"} },
+            wantErr: `trusted_proxies: "proxy.internal" is not an address or CIDR block`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := defaultMCPConfig()
+            if tt.edit != nil {
+                tt.edit(&cfg)
+            }
+            err := validateMCPConfig(cfg)
+            switch {
+            case tt.wantErr == "" && err != nil:
+                t.Fatalf("unexpected error: %v", err)
+            case tt.wantErr != "" && err == nil:
+                t.Fatalf("expected error containing %q", tt.wantErr)
+            case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+                t.Fatalf("error %q does not contain %q", err, tt.wantErr)
+            }
+        })
+    }
+}
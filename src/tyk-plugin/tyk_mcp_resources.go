@@ -0,0 +1,474 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "regexp"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/sirupsen/logrus"
+)
+
+// MCPResource is a concrete resource returned by resources/list
+type MCPResource struct {
+    URI         string `json:"uri"`
+    Name        string `json:"name"`
+    Description string `json:"description,omitempty"`
+    MimeType    string `json:"mimeType,omitempty"`
+}
+
+// MCPResourceTemplate is a parameterised resource returned by
+// resources/templates/list
+type MCPResourceTemplate struct {
+    URITemplate string `json:"uriTemplate"`
+    Name        string `json:"name"`
+    Description string `json:"description,omitempty"`
+    MimeType    string `json:"mimeType,omitempty"`
+}
+
+// ResourceContents is one item of a resources/read result
+type ResourceContents struct {
+    URI      string `json:"uri"`
+    MimeType string `json:"mimeType,omitempty"`
+    Text     string `json:"text"`
+}
+
+// resourceProvider backs one resource template. list returns the concrete
+// resources worth advertising (it may be nil) and read fetches one resource
+// given the variables extracted from its URI.
+type resourceProvider struct {
+    Template MCPResourceTemplate
+    list     func() []MCPResource
+    read     func(ctx context.Context, r *http.Request, session *user.SessionState, vars map[string]string) (interface{}, error)
+
+    pattern *regexp.Regexp
+    vars    []string
+}
+
+// errResourceNotFound is returned by providers when the URI is well formed
+// but names nothing
+var errResourceNotFound = errors.New("resource not found")
+
+var (
+    resourceProviders []*resourceProvider
+
+    uriTemplateVar = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+    // resourceHashes remembers the last content hash of each subscribed
+    // URI so the poller only notifies on change
+    resourceHashes = struct {
+        sync.Mutex
+        byURI map[string][32]byte
+    }{byURI: map[string][32]byte{}}
+)
+
+// registerResourceProvider compiles the provider's URI template into a
+// matcher and adds it to the list consulted by resources/read
+func registerResourceProvider(p *resourceProvider) {
+    pattern := "^"
+    last := 0
+    for _, loc := range uriTemplateVar.FindAllStringSubmatchIndex(p.Template.URITemplate, -1) {
+        pattern += regexp.QuoteMeta(p.Template.URITemplate[last:loc[0]]) + `([^/]+)`
+        p.vars = append(p.vars, p.Template.URITemplate[loc[2]:loc[3]])
+        last = loc[1]
+    }
+    pattern += regexp.QuoteMeta(p.Template.URITemplate[last:]) + "$"
+    p.pattern = regexp.MustCompile(pattern)
+    resourceProviders = append(resourceProviders, p)
+}
+
+// matchResource finds the provider for uri and the template variables in it
+func matchResource(uri string) (*resourceProvider, map[string]string) {
+    for _, p := range resourceProviders {
+        m := p.pattern.FindStringSubmatch(uri)
+        if m == nil {
+            continue
+        }
+        vars := map[string]string{}
+        for i, name := range p.vars {
+            value, err := url.PathUnescape(m[i+1])
+            if err != nil {
+                return nil, nil
+            }
+            vars[name] = value
+        }
+        return p, vars
+    }
+    return nil, nil
+}
+
+// readResource resolves, authorizes and reads a resource. Reads share the
+// default tool deadline. r is nil when the subscription poller reads.
+func readResource(ctx context.Context, r *http.Request, uri string, caller mcpCaller, session *user.SessionState) (ResourceContents, *jsonRPCError) {
+    provider, vars := matchResource(uri)
+    if provider == nil {
+        return ResourceContents{}, &jsonRPCError{Code: mcpResourceNotFound, Message: "Resource not found", Data: map[string]string{"uri": uri}}
+    }
+    if !accessAllowed(currentConfig().Resources.Access, uri, caller) {
+        return ResourceContents{}, &jsonRPCError{Code: mcpForbidden, Message: "Access to resource denied", Data: map[string]string{"uri": uri}}
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, durationOr(currentConfig().ToolTimeouts.Default, 30*time.Second))
+    defer cancel()
+    data, err := provider.read(ctx, r, session, vars)
+    if errors.Is(err, errResourceNotFound) {
+        return ResourceContents{}, &jsonRPCError{Code: mcpResourceNotFound, Message: "Resource not found", Data: map[string]string{"uri": uri}}
+    }
+    if err == errToolForbidden {
+        return ResourceContents{}, &jsonRPCError{Code: mcpForbidden, Message: "Access to resource denied", Data: map[string]string{"uri": uri}}
+    }
+    if limited, ok := err.(*rateLimitError); ok {
+        return ResourceContents{}, &jsonRPCError{Code: jsonRPCRateLimited, Message: err.Error(), Data: map[string]interface{}{
+            "limit":      limited.usage.Exceeded,
+            "retryAfter": retryAfterSeconds(limited.usage.RetryAfter),
+        }}
+    }
+    if verrs, ok := err.(ValidationErrors); ok {
+        return ResourceContents{}, &jsonRPCError{Code: jsonRPCInvalidParams, Message: verrs.Error(), Data: map[string]interface{}{"errors": verrs}}
+    }
+    if err != nil {
+        var toolErr *ToolError
+        if errors.As(err, &toolErr) {
+            return ResourceContents{}, &jsonRPCError{Code: jsonRPCInternalError, Message: toolErr.Message, Data: toolErr}
+        }
+        return ResourceContents{}, &jsonRPCError{Code: jsonRPCInternalError, Message: err.Error()}
+    }
+
+    text, ok := data.(string)
+    if !ok {
+        encoded, err := json.MarshalIndent(data, "", "  ")
+        if err != nil {
+            return ResourceContents{}, &jsonRPCError{Code: jsonRPCInternalError, Message: "Failed to encode resource"}
+        }
+        text = string(encoded)
+    }
+
+    return ResourceContents{URI: uri, MimeType: provider.Template.MimeType, Text: text}, nil
+}
+
+func handleResourcesList(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    resources := []MCPResource{}
+    for _, p := range resourceProviders {
+        if p.list == nil {
+            continue
+        }
+        for _, res := range p.list() {
+            if accessAllowed(currentConfig().Resources.Access, res.URI, req.caller) {
+                resources = append(resources, res)
+            }
+        }
+    }
+    sort.Slice(resources, func(i, j int) bool { return resources[i].URI < resources[j].URI })
+    return map[string]interface{}{"resources": resources}, nil
+}
+
+func handleResourceTemplatesList(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    templates := make([]MCPResourceTemplate, 0, len(resourceProviders))
+    for _, p := range resourceProviders {
+        templates = append(templates, p.Template)
+    }
+    return map[string]interface{}{"resourceTemplates": templates}, nil
+}
+
+func handleResourcesRead(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    var p struct {
+        URI string `json:"uri"`
+    }
+    if rpcErr := decodeParams(params, &p); rpcErr != nil {
+        return nil, rpcErr
+    }
+
+    contents, rpcErr := readResource(req.ctx, req.r, p.URI, req.caller, req.session)
+    if rpcErr != nil {
+        return nil, rpcErr
+    }
+
+    log.Get().WithFields(logrus.Fields{
+        "uri":        p.URI,
+        "session_id": getSessionID(req.session),
+    }).Info("MCP resource read")
+
+    return map[string]interface{}{"contents": []ResourceContents{contents}}, nil
+}
+
+func handleResourcesSubscribe(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    var p struct {
+        URI string `json:"uri"`
+    }
+    if rpcErr := decodeParams(params, &p); rpcErr != nil {
+        return nil, rpcErr
+    }
+    if req.mcpSession == nil {
+        return nil, &jsonRPCError{Code: jsonRPCInvalidRequest, Message: "resources/subscribe requires an MCP session"}
+    }
+    if provider, _ := matchResource(p.URI); provider == nil {
+        return nil, &jsonRPCError{Code: mcpResourceNotFound, Message: "Resource not found", Data: map[string]string{"uri": p.URI}}
+    }
+    if !accessAllowed(currentConfig().Resources.Access, p.URI, req.caller) {
+        return nil, &jsonRPCError{Code: mcpForbidden, Message: "Access to resource denied", Data: map[string]string{"uri": p.URI}}
+    }
+
+    req.mcpSession.mu.Lock()
+    req.mcpSession.subscriptions[p.URI] = true
+    req.mcpSession.mu.Unlock()
+    return struct{}{}, nil
+}
+
+func handleResourcesUnsubscribe(req *mcpRequest, params json.RawMessage) (interface{}, *jsonRPCError) {
+    var p struct {
+        URI string `json:"uri"`
+    }
+    if rpcErr := decodeParams(params, &p); rpcErr != nil {
+        return nil, rpcErr
+    }
+    if req.mcpSession != nil {
+        req.mcpSession.mu.Lock()
+        delete(req.mcpSession.subscriptions, p.URI)
+        req.mcpSession.mu.Unlock()
+    }
+    return struct{}{}, nil
+}
+
+// notifyResourceUpdated tells the sessions subscribed to uri that it has
+// changed, without waiting for the next poll
+func notifyResourceUpdated(uri string) {
+    for _, s := range allMCPSessions() {
+        s.mu.Lock()
+        subscribed := s.subscriptions[uri]
+        s.mu.Unlock()
+        if subscribed {
+            s.notify("notifications/resources/updated", map[string]string{"uri": uri})
+        }
+    }
+}
+
+// pollSubscribedResources re-reads every subscribed URI on each tick and
+// sends notifications/resources/updated to the subscribers of any resource
+// whose content changed. Each URI is read once per tick, with the
+// credentials of its first subscriber.
+func pollSubscribedResources() {
+    interval := durationOr(currentConfig().Resources.PollInterval, time.Minute)
+    for range time.Tick(interval) {
+        subscribers := map[string][]*mcpSession{}
+        for _, s := range allMCPSessions() {
+            s.mu.Lock()
+            for uri := range s.subscriptions {
+                subscribers[uri] = append(subscribers[uri], s)
+            }
+            s.mu.Unlock()
+        }
+
+        resourceHashes.Lock()
+        for uri := range resourceHashes.byURI {
+            if _, live := subscribers[uri]; !live {
+                delete(resourceHashes.byURI, uri)
+            }
+        }
+        resourceHashes.Unlock()
+
+        for uri, sessions := range subscribers {
+            contents, rpcErr := readResource(context.Background(), nil, uri, sessions[0].Caller, sessions[0].TykSession)
+            if rpcErr != nil {
+                log.Get().WithError(rpcErr).WithField("uri", uri).Warn("Failed to refresh subscribed MCP resource")
+                continue
+            }
+
+            hash := sha256.Sum256([]byte(contents.Text))
+            resourceHashes.Lock()
+            previous, seen := resourceHashes.byURI[uri]
+            resourceHashes.byURI[uri] = hash
+            resourceHashes.Unlock()
+
+            if seen && previous != hash {
+                for _, s := range sessions {
+                    s.notify("notifications/resources/updated", map[string]string{"uri": uri})
+                }
+            }
+        }
+    }
+}
+
+// readThroughTool reads a resource backed by a tool. The read is held to
+// the same access policy, rate limits and output policy as calling the tool,
+// so a resource cannot be used to get round them.
+func readThroughTool(ctx context.Context, r *http.Request, session *user.SessionState, toolName string, params map[string]interface{}) (interface{}, error) {
+    tool, ok := currentState().resolveTool(toolName, "")
+    if !ok {
+        return nil, errResourceNotFound
+    }
+    if requiresApproval(tool) || !toolAccessFor(r).allows(toolName, callerFromSession(session)) {
+        return nil, errToolForbidden
+    }
+    params, err := validateToolArguments(tool.InputSchema, params)
+    if err != nil {
+        return nil, err
+    }
+    if normalize, ok := toolArgumentNormalizers[toolName]; ok {
+        if params, err = normalize(params); err != nil {
+            return nil, err
+        }
+    }
+    if _, err := checkToolLimit(ctx, toolName, session, r, false); err != nil {
+        return nil, err
+    }
+
+    result := invokeTool(ctx, r, session, tool, params)
+    if toolErr, ok := resultError(result); ok {
+        return nil, toolErr
+    }
+    return result.StructuredContent, nil
+}
+
+// tykAPIDefinition is an API definition file found in the gateway app path
+type tykAPIDefinition struct {
+    ID   string
+    Name string
+    Path string
+}
+
+// listAPIDefinitions indexes classic and OAS API definitions by API ID
+func listAPIDefinitions() map[string]tykAPIDefinition {
+    defs := map[string]tykAPIDefinition{}
+
+    files, err := openAPISourceFiles(currentConfig().AppsPath)
+    if err != nil {
+        return defs
+    }
+    for _, file := range files {
+        data, err := os.ReadFile(file)
+        if err != nil {
+            continue
+        }
+
+        var def struct {
+            APIID string `json:"api_id"`
+            Name  string `json:"name"`
+            Tyk   *struct {
+                Info struct {
+                    ID   string `json:"id"`
+                    Name string `json:"name"`
+                } `json:"info"`
+            } `json:"x-tyk-api-gateway"`
+        }
+        if decodeConfigDocument(data, file, &def) != nil {
+            continue
+        }
+
+        id, name := def.APIID, def.Name
+        if def.Tyk != nil {
+            id, name = def.Tyk.Info.ID, def.Tyk.Info.Name
+        }
+        if id != "" {
+            defs[id] = tykAPIDefinition{ID: id, Name: name, Path: file}
+        }
+    }
+    return defs
+}
+
+func init() {
+    registerResourceProvider(&resourceProvider{
+        Template: MCPResourceTemplate{
+            URITemplate: "sentraip://ip/{address}",
+            Name:        "SentraIP IP threat report",
+            Description: "Current SentraIP threat intelligence for an IP address",
+            MimeType:    "application/json",
+        },
+        read: func(ctx context.Context, r *http.Request, session *user.SessionState, vars map[string]string) (interface{}, error) {
+            return readThroughTool(ctx, r, session, "sentraip_threat_check", map[string]interface{}{"target": vars["address"], "type": "ip"})
+        },
+    })
+
+    registerResourceProvider(&resourceProvider{
+        Template: MCPResourceTemplate{
+            URITemplate: "sentraip://domain/{domain}",
+            Name:        "SentraIP domain threat report",
+            Description: "Current SentraIP threat intelligence for a domain",
+            MimeType:    "application/json",
+        },
+        read: func(ctx context.Context, r *http.Request, session *user.SessionState, vars map[string]string) (interface{}, error) {
+            return readThroughTool(ctx, r, session, "sentraip_threat_check", map[string]interface{}{"target": vars["domain"], "type": "domain"})
+        },
+    })
+
+    registerResourceProvider(&resourceProvider{
+        Template: MCPResourceTemplate{
+            URITemplate: "tyk://api/{api_id}/definition",
+            Name:        "Tyk API definition",
+            Description: "The API definition loaded by the gateway",
+            MimeType:    "application/json",
+        },
+        list: func() []MCPResource {
+            var out []MCPResource
+            for id, def := range listAPIDefinitions() {
+                out = append(out, MCPResource{
+                    URI:         fmt.Sprintf("tyk://api/%s/definition", url.PathEscape(id)),
+                    Name:        def.Name + " definition",
+                    Description: "API definition for " + def.Name,
+                    MimeType:    "application/json",
+                })
+            }
+            return out
+        },
+        read: func(ctx context.Context, r *http.Request, session *user.SessionState, vars map[string]string) (interface{}, error) {
+            def, ok := listAPIDefinitions()[vars["api_id"]]
+            if !ok {
+                return nil, errResourceNotFound
+            }
+            data, err := os.ReadFile(def.Path)
+            if err != nil {
+                return nil, err
+            }
+            var parsed interface{}
+            if err := decodeConfigDocument(data, def.Path, &parsed); err != nil {
+                return nil, fmt.Errorf("failed to parse API definition: %w", err)
+            }
+            return parsed, nil
+        },
+    })
+
+    registerResourceProvider(&resourceProvider{
+        Template: MCPResourceTemplate{
+            URITemplate: "tyk://api/{api_id}/analytics/{time_range}",
+            Name:        "Tyk API analytics snapshot",
+            Description: "Usage analytics for an API over 24h, 7d or 30d",
+            MimeType:    "application/json",
+        },
+        list: func() []MCPResource {
+            var out []MCPResource
+            for id, def := range listAPIDefinitions() {
+                out = append(out, MCPResource{
+                    URI:         fmt.Sprintf("tyk://api/%s/analytics/24h", url.PathEscape(id)),
+                    Name:        def.Name + " analytics (24h)",
+                    Description: "Last 24 hours of analytics for " + def.Name,
+                    MimeType:    "application/json",
+                })
+            }
+            return out
+        },
+        read: func(ctx context.Context, r *http.Request, session *user.SessionState, vars map[string]string) (interface{}, error) {
+            switch vars["time_range"] {
+            case "24h", "7d", "30d":
+            default:
+                return nil, errResourceNotFound
+            }
+            return readThroughTool(ctx, r, session, "tyk_api_analytics", map[string]interface{}{"api_id": vars["api_id"], "time_range": vars["time_range"]})
+        },
+    })
+
+    registerMCPMethod("resources/list", handleResourcesList)
+    registerMCPMethod("resources/templates/list", handleResourceTemplatesList)
+    registerMCPMethod("resources/read", handleResourcesRead)
+    registerMCPMethod("resources/subscribe", handleResourcesSubscribe)
+    registerMCPMethod("resources/unsubscribe", handleResourcesUnsubscribe)
+    mcpCapabilities["resources"] = map[string]interface{}{"subscribe": true, "listChanged": false}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+
+    "github.com/TykTechnologies/tyk/user"
+)
+
+// useAppsPath writes API definitions to a temporary apps path used by the
+// active config
+func useAppsPath(t *testing.T, files map[string]string) {
+    t.Helper()
+    dir := t.TempDir()
+    for name, data := range files {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    useConfig(t, func(cfg *MCPConfig) { cfg.AppsPath = dir })
+}
+
+func TestMatchResource(t *testing.T) {
+    tests := []struct {
+        uri          string
+        wantTemplate string
+        wantVars     map[string]string
+    }{
+        {uri: "sentraip://ip/203.0.113.7", wantTemplate: "sentraip://ip/{address}", wantVars: map[string]string{"address": "203.0.113.7"}},
+        {uri: "tyk://api/billing/definition", wantTemplate: "tyk://api/{api_id}/definition", wantVars: map[string]string{"api_id": "billing"}},
+        {uri: "tyk://api/a%20b/analytics/7d", wantTemplate: "tyk://api/{api_id}/analytics/{time_range}", wantVars: map[string]string{"api_id": "a b", "time_range": "7d"}},
+        {uri: "tyk://api/a/b/definition"},
+        {uri: "tyk://api/%zz/definition"},
+        {uri: "sentraip://ip/"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.uri, func(t *testing.T) {
+            provider, vars := matchResource(tt.uri)
+            if tt.wantTemplate == "" {
+                if provider != nil {
+                    t.Fatalf("matched %s, want no match", provider.Template.URITemplate)
+                }
+                return
+            }
+            if provider == nil || provider.Template.URITemplate != tt.wantTemplate {
+                t.Fatalf("matched %v, want %s", provider, tt.wantTemplate)
+            }
+            if !reflect.DeepEqual(vars, tt.wantVars) {
+                t.Fatalf("vars %v, want %v", vars, tt.wantVars)
+            }
+        })
+    }
+}
+
+func TestReadResource(t *testing.T) {
+    useAppsPath(t, map[string]string{
+        "billing.json": `{"api_id":"billing","name":"Billing","proxy":{"listen_path":"/billing/"}}`,
+        "notes.txt":    `not an api`,
+    })
+    admin := mcpCaller{ID: "ann", Roles: []string{"admin"}}
+
+    tests := []struct {
+        name     string
+        uri      string
+        caller   mcpCaller
+        wantCode int
+    }{
+        {name: "definition", uri: "tyk://api/billing/definition", caller: admin},
+        {name: "definition needs admin", uri: "tyk://api/billing/definition", caller: mcpCaller{ID: "bob"}, wantCode: mcpForbidden},
+        {name: "anonymous", uri: "tyk://api/billing/analytics/24h", wantCode: mcpForbidden},
+        {name: "unknown api", uri: "tyk://api/orders/definition", caller: admin, wantCode: mcpResourceNotFound},
+        {name: "unknown time range", uri: "tyk://api/billing/analytics/1y", caller: admin, wantCode: mcpResourceNotFound},
+        {name: "unknown scheme", uri: "file:///etc/passwd", caller: admin, wantCode: mcpResourceNotFound},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            contents, rpcErr := readResource(context.Background(), nil, tt.uri, tt.caller, nil)
+            if tt.wantCode != 0 {
+                if rpcErr == nil || rpcErr.Code != tt.wantCode {
+                    t.Fatalf("readResource error %v, want code %d", rpcErr, tt.wantCode)
+                }
+                return
+            }
+            if rpcErr != nil {
+                t.Fatalf("readResource: %v", rpcErr)
+            }
+            var def map[string]interface{}
+            if err := json.Unmarshal([]byte(contents.Text), &def); err != nil || def["api_id"] != "billing" {
+                t.Fatalf("contents %q, want the billing definition", contents.Text)
+            }
+            if contents.URI != tt.uri || contents.MimeType != "application/json" {
+                t.Fatalf("contents %+v", contents)
+            }
+        })
+    }
+}
+
+func TestHandleResourcesList(t *testing.T) {
+    useAppsPath(t, map[string]string{
+        "billing.json": `{"api_id":"billing","name":"Billing"}`,
+        "orders.yaml":  "openapi: 3.0.3\nx-tyk-api-gateway:\n  info:\n    id: orders\n    name: Orders\n",
+    })
+
+    tests := []struct {
+        name   string
+        caller mcpCaller
+        want   []string
+    }{
+        {name: "anonymous", want: []string{}},
+        {
+            name:   "identified",
+            caller: mcpCaller{ID: "bob"},
+            want:   []string{"sentraip://cache/stats", "tyk://api/billing/analytics/24h", "tyk://api/orders/analytics/24h"},
+        },
+        {
+            name:   "admin",
+            caller: mcpCaller{ID: "ann", Roles: []string{"admin"}},
+            want: []string{
+                "sentraip://cache/stats", "tyk://api/billing/analytics/24h",
+                "tyk://api/billing/definition", "tyk://api/orders/analytics/24h",
+                "tyk://api/orders/definition",
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            result, rpcErr := handleResourcesList(&mcpRequest{caller: tt.caller}, nil)
+            if rpcErr != nil {
+                t.Fatal(rpcErr)
+            }
+            got := []string{}
+            for _, res := range result.(map[string]interface{})["resources"].([]MCPResource) {
+                got = append(got, res.URI)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("resources %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestHandleResourcesSubscribe(t *testing.T) {
+    useConfig(t, nil)
+    ann := mcpCaller{ID: "ann"}
+
+    tests := []struct {
+        name       string
+        uri        string
+        caller     mcpCaller
+        noSession  bool
+        wantCode   int
+        wantNotify bool
+    }{
+        {name: "subscribe", uri: "sentraip://ip/203.0.113.7", caller: ann, wantNotify: true},
+        {name: "needs a session", uri: "sentraip://ip/203.0.113.7", caller: ann, noSession: true, wantCode: jsonRPCInvalidRequest},
+        {name: "unknown resource", uri: "sentraip://asn/64500", caller: ann, wantCode: mcpResourceNotFound},
+        {name: "denied", uri: "tyk://api/billing/definition", caller: ann, wantCode: mcpForbidden},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := &mcpRequest{caller: tt.caller}
+            if !tt.noSession {
+                req.mcpSession = newMCPSession(tt.caller, nil)
+                t.Cleanup(func() { deleteMCPSession(req.mcpSession.ID) })
+            }
+            params, _ := json.Marshal(map[string]string{"uri": tt.uri})
+
+            _, rpcErr := handleResourcesSubscribe(req, params)
+            if tt.wantCode != 0 {
+                if rpcErr == nil || rpcErr.Code != tt.wantCode {
+                    t.Fatalf("subscribe error %v, want code %d", rpcErr, tt.wantCode)
+                }
+                return
+            }
+            if rpcErr != nil {
+                t.Fatal(rpcErr)
+            }
+
+            notifyResourceUpdated(tt.uri)
+            select {
+            case n := <-req.mcpSession.outbox:
+                if n.Method != "notifications/resources/updated" {
+                    t.Fatalf("notification %s, want notifications/resources/updated", n.Method)
+                }
+            default:
+                t.Fatal("subscriber was not notified")
+            }
+
+            // Once unsubscribed, updates are no longer sent
+            if _, rpcErr := handleResourcesUnsubscribe(req, params); rpcErr != nil {
+                t.Fatal(rpcErr)
+            }
+            notifyResourceUpdated(tt.uri)
+            if len(req.mcpSession.outbox) != 0 {
+                t.Fatal("notified after unsubscribing")
+            }
+        })
+    }
+}
+
+func TestReadThroughToolPolicy(t *testing.T) {
+    ann := &user.SessionState{Alias: "ann"}
+
+    tests := []struct {
+        name     string
+        edit     func(cfg *MCPConfig)
+        uri      string
+        wantCode int
+    }{
+        {
+            name:     "tool needing approval",
+            edit:     func(cfg *MCPConfig) { cfg.Approvals.Tools = []string{"sentraip_threat_check"} },
+            uri:      "sentraip://ip/203.0.113.7",
+            wantCode: mcpForbidden,
+        },
+        {
+            name:     "tool access denied",
+            edit:     func(cfg *MCPConfig) { cfg.ToolAccess.Default = "deny" },
+            uri:      "sentraip://domain/example.com",
+            wantCode: mcpForbidden,
+        },
+        {
+            name:     "invalid target",
+            uri:      "sentraip://ip/10.0.0.1",
+            wantCode: jsonRPCInvalidParams,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            useConfig(t, tt.edit)
+            _, rpcErr := readResource(context.Background(), nil, tt.uri, callerFromSession(ann), ann)
+            if rpcErr == nil || rpcErr.Code != tt.wantCode {
+                t.Fatalf("readResource error %v, want code %d", rpcErr, tt.wantCode)
+            }
+        })
+    }
+}
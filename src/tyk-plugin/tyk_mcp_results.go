@@ -0,0 +1,155 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+)
+
+// Tool error codes carried in structuredContent.error.code
+const (
+    toolErrorExecutionFailed = "execution_failed"
+    toolErrorUpstream        = "upstream_error"
+    toolErrorInvalidOutput   = "invalid_output"
+    toolErrorNotFound        = "not_found"
+    toolErrorForbidden       = "forbidden"
+    toolErrorTimeout         = "timeout"
+    toolErrorCancelled       = "cancelled"
+    toolErrorRateLimited     = "rate_limited"
+)
+
+// ToolError is a failure while running a tool, as opposed to a bad request.
+// It is returned to the caller as a result with isError set, never as an
+// HTTP or JSON-RPC error.
+type ToolError struct {
+    Code    string      `json:"code"`
+    Message string      `json:"message"`
+    Details interface{} `json:"details,omitempty"`
+}
+
+func (e *ToolError) Error() string {
+    return e.Message
+}
+
+// ContentBlock is an MCP content item. The gateway's own tools produce
+// text; results of federated tools may also hold image, audio and resource
+// content, which is passed through.
+type ContentBlock struct {
+    Type string `json:"type"`
+    Text string `json:"text"`
+    // Data is base64 image or audio data
+    Data     string `json:"data,omitempty"`
+    MimeType string `json:"mimeType,omitempty"`
+    // URI and Name describe a resource_link
+    URI  string `json:"uri,omitempty"`
+    Name string `json:"name,omitempty"`
+    // Resource is an embedded resource
+    Resource    interface{} `json:"resource,omitempty"`
+    Annotations interface{} `json:"annotations,omitempty"`
+}
+
+// MarshalJSON leaves text out of blocks of other types
+func (b ContentBlock) MarshalJSON() ([]byte, error) {
+    type plain ContentBlock
+    if b.Type == "text" {
+        return json.Marshal(plain(b))
+    }
+    return json.Marshal(struct {
+        plain
+        Text string `json:"text,omitempty"`
+    }{plain(b), b.Text})
+}
+
+// ToolResult is the MCP CallToolResult returned for every tool call.
+//
+// On success structuredContent conforms to the tool's outputSchema and
+// content holds the same data rendered as text. On failure isError is true,
+// structuredContent is {"error": {"code", "message", "details"}} and content
+// holds a one-line description of the error.
+type ToolResult struct {
+    Content           []ContentBlock `json:"content"`
+    StructuredContent interface{}    `json:"structuredContent,omitempty"`
+    IsError           bool           `json:"isError"`
+    // Meta reports the caller's remaining rate limit for the tool
+    Meta map[string]interface{} `json:"_meta,omitempty"`
+
+    usage *toolUsage
+    // jobID is set when the call was started as a job
+    jobID string
+    // deprecated is set when the called tool version is deprecated
+    deprecated *ToolDeprecation
+    // replayed is set when the result was stored for an idempotency key
+    replayed bool
+}
+
+// buildToolResult turns a tool handler's return values into a ToolResult,
+// validating successful output against the tool's output schema
+func buildToolResult(tool MCPTool, structured map[string]interface{}, err error) ToolResult {
+    if err != nil {
+        var toolErr *ToolError
+        if !errors.As(err, &toolErr) {
+            toolErr = &ToolError{Code: toolErrorExecutionFailed, Message: err.Error()}
+        }
+        return toolErrorResult(toolErr)
+    }
+
+    content := normalizeJSONValue(structured)
+    if tool.OutputSchema != nil {
+        if err := validateToolOutput(*tool.OutputSchema, content); err != nil {
+            return toolErrorResult(&ToolError{
+                Code:    toolErrorInvalidOutput,
+                Message: fmt.Sprintf("tool %s returned output that does not match its outputSchema", tool.Name),
+                Details: err,
+            })
+        }
+    }
+
+    return ToolResult{
+        Content:           []ContentBlock{{Type: "text", Text: renderToolText(content)}},
+        StructuredContent: content,
+    }
+}
+
+func toolErrorResult(toolErr *ToolError) ToolResult {
+    return ToolResult{
+        Content: []ContentBlock{{
+            Type: "text",
+            Text: fmt.Sprintf("Error (%s): %s", toolErr.Code, toolErr.Message),
+        }},
+        StructuredContent: map[string]interface{}{"error": toolErr},
+        IsError:           true,
+    }
+}
+
+// withOutputAlternative widens an output schema to also admit alt, a result
+// returned in place of the tool's output. $defs stay at the root so
+// references inside the original schema still resolve.
+func withOutputAlternative(schema Property, alt Property) *Property {
+    defs := schema.Defs
+    schema.Defs = nil
+    return &Property{
+        Type:  "object",
+        OneOf: []Property{schema, alt},
+        Defs:  defs,
+    }
+}
+
+// validateToolOutput checks structured content against an output schema.
+// Defaults are not applied: output is reported exactly as produced.
+func validateToolOutput(schema Property, content interface{}) error {
+    v := schemaValidator{root: &schema}
+    if errs := v.validate("", schema, content, false, 0); len(errs) > 0 {
+        return errs
+    }
+    return nil
+}
+
+// renderToolText is the text rendering of structured content sent to the
+// LLM alongside it
+func renderToolText(content interface{}) string {
+    encoded, err := json.MarshalIndent(content, "", "  ")
+    if err != nil {
+        return fmt.Sprint(content)
+    }
+    return string(encoded)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "strings"
+)
+
+// propertyFields is Property without its methods, so encoding/json can do
+// the bulk of the work inside MarshalJSON and UnmarshalJSON
+type propertyFields Property
+
+// knownSchemaKeywords are the keywords with a dedicated Property field
+var knownSchemaKeywords = map[string]bool{
+    "$ref": true, "type": true, "title": true, "description": true, "enum": true,
+    "const": true, "default": true, "examples": true, "format": true, "pattern": true,
+    "minLength": true, "maxLength": true, "minimum": true, "maximum": true,
+    "exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+    "prefixItems": true, "items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+    "properties": true, "required": true, "additionalProperties": true,
+    "minProperties": true, "maxProperties": true,
+    "oneOf": true, "anyOf": true, "allOf": true, "not": true, "$defs": true,
+}
+
+// MarshalJSON writes boolean schemas as true/false, type unions as arrays,
+// keeps explicitly empty properties and required, and merges unknown
+// keywords back in
+func (p Property) MarshalJSON() ([]byte, error) {
+    if p.Bool != nil {
+        return json.Marshal(*p.Bool)
+    }
+
+    encoded, err := json.Marshal(propertyFields(p))
+    if err != nil {
+        return nil, err
+    }
+    emptyProperties := p.Properties != nil && len(p.Properties) == 0
+    emptyRequired := p.Required != nil && len(p.Required) == 0
+    if len(p.Types) == 0 && len(p.Extra) == 0 && !emptyProperties && !emptyRequired {
+        return encoded, nil
+    }
+
+    merged := map[string]json.RawMessage{}
+    if err := json.Unmarshal(encoded, &merged); err != nil {
+        return nil, err
+    }
+    for key, value := range p.Extra {
+        if _, exists := merged[key]; !exists {
+            merged[key] = value
+        }
+    }
+    if len(p.Types) > 0 {
+        types, err := json.Marshal(p.Types)
+        if err != nil {
+            return nil, err
+        }
+        merged["type"] = types
+    }
+    if emptyProperties {
+        merged["properties"] = json.RawMessage("{}")
+    }
+    if emptyRequired {
+        merged["required"] = json.RawMessage("[]")
+    }
+    return json.Marshal(merged)
+}
+
+// UnmarshalJSON accepts boolean schemas, "type" as a string or an array,
+// and keeps unrecognised keywords in Extra. Draft 4 and OpenAPI 3.0 forms
+// are read as their 2020-12 equivalents: boolean exclusiveMinimum and
+// exclusiveMaximum qualify minimum and maximum, an items array is a tuple
+// (prefixItems) with additionalItems covering the rest, and definitions
+// are $defs.
+func (p *Property) UnmarshalJSON(data []byte) error {
+    trimmed := bytes.TrimSpace(data)
+    if bytes.Equal(trimmed, []byte("true")) || bytes.Equal(trimmed, []byte("false")) {
+        *p = Property{Bool: boolPtr(trimmed[0] == 't')}
+        return nil
+    }
+
+    var raw map[string]json.RawMessage
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return fmt.Errorf("schema must be an object or a boolean: %w", err)
+    }
+
+    rewritten := false
+    var types []string
+    if t, ok := raw["type"]; ok && isJSONArray(t) {
+        if err := json.Unmarshal(t, &types); err != nil {
+            return fmt.Errorf("invalid type union: %w", err)
+        }
+        delete(raw, "type")
+        rewritten = true
+    }
+    for _, bound := range [][2]string{{"exclusiveMinimum", "minimum"}, {"exclusiveMaximum", "maximum"}} {
+        exclusive, ok := raw[bound[0]]
+        if !ok {
+            continue
+        }
+        var flag bool
+        if json.Unmarshal(exclusive, &flag) != nil {
+            continue
+        }
+        delete(raw, bound[0])
+        if limit, ok := raw[bound[1]]; ok && flag {
+            raw[bound[0]] = limit
+            delete(raw, bound[1])
+        }
+        rewritten = true
+    }
+    if items, ok := raw["items"]; ok && isJSONArray(items) {
+        if _, ok := raw["prefixItems"]; ok {
+            return fmt.Errorf("items array cannot be combined with prefixItems")
+        }
+        raw["prefixItems"] = items
+        delete(raw, "items")
+        if additional, ok := raw["additionalItems"]; ok {
+            raw["items"] = additional
+            delete(raw, "additionalItems")
+        }
+        rewritten = true
+    }
+    if definitions, ok := raw["definitions"]; ok {
+        merged := map[string]json.RawMessage{}
+        if err := json.Unmarshal(definitions, &merged); err != nil {
+            return fmt.Errorf("invalid definitions: %w", err)
+        }
+        if defs, ok := raw["$defs"]; ok {
+            if err := json.Unmarshal(defs, &merged); err != nil {
+                return fmt.Errorf("invalid $defs: %w", err)
+            }
+        }
+        defs, err := json.Marshal(merged)
+        if err != nil {
+            return err
+        }
+        raw["$defs"] = defs
+        delete(raw, "definitions")
+        rewritten = true
+    }
+    if rewritten {
+        stripped, err := json.Marshal(raw)
+        if err != nil {
+            return err
+        }
+        data = stripped
+    }
+
+    var fields propertyFields
+    if err := json.Unmarshal(data, &fields); err != nil {
+        return err
+    }
+    *p = Property(fields)
+    p.Types = types
+
+    for key, value := range raw {
+        // A literal null const or default cannot live in an interface{}
+        // field, so keep it verbatim
+        isNull := bytes.Equal(bytes.TrimSpace(value), []byte("null"))
+        if knownSchemaKeywords[key] && !(isNull && (key == "const" || key == "default")) {
+            continue
+        }
+        if p.Extra == nil {
+            p.Extra = map[string]json.RawMessage{}
+        }
+        p.Extra[key] = value
+    }
+    return nil
+}
+
+func isJSONArray(value json.RawMessage) bool {
+    return bytes.HasPrefix(bytes.TrimSpace(value), []byte("["))
+}
+
+// schemaTypes returns the allowed types of a schema, whether it was given
+// as a single type or a union
+func (p Property) schemaTypes() []string {
+    if len(p.Types) > 0 {
+        return p.Types
+    }
+    if p.Type != "" {
+        return []string{p.Type}
+    }
+    return nil
+}
+
+// resolveRef follows a local "#/$defs/..." reference against the root
+// schema. "#/definitions/..." resolves the same way, since definitions are
+// decoded into Defs.
+func resolveRef(root *InputSchema, ref string) (*Property, error) {
+    var name string
+    switch {
+    case strings.HasPrefix(ref, "#/$defs/"):
+        name = strings.TrimPrefix(ref, "#/$defs/")
+    case strings.HasPrefix(ref, "#/definitions/"):
+        name = strings.TrimPrefix(ref, "#/definitions/")
+    case ref == "#":
+        return root, nil
+    default:
+        return nil, fmt.Errorf("unsupported $ref %q (only local $defs are supported)", ref)
+    }
+
+    name = strings.ReplaceAll(strings.ReplaceAll(name, "~1", "/"), "~0", "~")
+    def, ok := root.Defs[name]
+    if !ok {
+        return nil, fmt.Errorf("unresolved $ref %q", ref)
+    }
+    return &def, nil
+}
+
+// walkSchema calls fn for s and every schema nested inside it
+func walkSchema(s *Property, fn func(*Property)) {
+    if s == nil {
+        return
+    }
+    fn(s)
+    for _, child := range []*Property{s.Items, s.AdditionalProperties, s.Not} {
+        walkSchema(child, fn)
+    }
+    for _, group := range []map[string]Property{s.Properties, s.Defs} {
+        for key, child := range group {
+            walkSchema(&child, fn)
+            group[key] = child
+        }
+    }
+    for _, list := range [][]Property{s.PrefixItems, s.OneOf, s.AnyOf, s.AllOf} {
+        for i := range list {
+            walkSchema(&list[i], fn)
+        }
+    }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "encoding/json"
+    "reflect"
+    "testing"
+)
+
+func TestPropertyJSON(t *testing.T) {
+    tests := []struct {
+        name string
+        in   string
+        // want is the re-encoded schema, when it differs from in. Key order
+        // is not compared.
+        want    string
+        wantErr bool
+    }{
+        {name: "true", in: `true`},
+        {name: "false", in: `false`},
+        {name: "plain", in: `{"description":"Target","type":"string"}`},
+        {name: "type union", in: `{"type":["string","null"]}`},
+        {name: "unknown keywords kept", in: `{"type":"string","x-order":3,"deprecated":true}`},
+        {name: "empty properties and required", in: `{"properties":{},"required":[],"type":"object"}`},
+        {name: "null const", in: `{"const":null}`},
+        {name: "null default", in: `{"default":null,"type":["string","null"]}`},
+        {name: "nested boolean", in: `{"additionalProperties":false,"properties":{"a":true}}`},
+        {name: "prefixItems", in: `{"items":false,"prefixItems":[{"type":"string"},{"type":"integer"}]}`},
+        {name: "draft 4 exclusive maximum", in: `{"exclusiveMaximum":true,"maximum":10}`, want: `{"exclusiveMaximum":10}`},
+        {name: "draft 4 inclusive minimum", in: `{"exclusiveMinimum":false,"minimum":1}`, want: `{"minimum":1}`},
+        {name: "draft 4 flag without bound", in: `{"exclusiveMinimum":true}`, want: `{}`},
+        {name: "2020-12 exclusive bound", in: `{"exclusiveMinimum":0}`},
+        {name: "draft 4 tuple", in: `{"additionalItems":false,"items":[{"type":"string"}]}`, want: `{"items":false,"prefixItems":[{"type":"string"}]}`},
+        {name: "definitions", in: `{"definitions":{"a":{"type":"string"}}}`, want: `{"$defs":{"a":{"type":"string"}}}`},
+        {name: "definitions merged into $defs", in: `{"$defs":{"a":{}},"definitions":{"b":{}}}`, want: `{"$defs":{"a":{},"b":{}}}`},
+        {name: "draft 4 open tuple", in: `{"items":[{"type":"string"}]}`, want: `{"prefixItems":[{"type":"string"}]}`},
+        {name: "tuple mixed with prefixItems", in: `{"items":[{}],"prefixItems":[{}]}`, wantErr: true},
+        {name: "not a schema", in: `"string"`, wantErr: true},
+        {name: "invalid type union", in: `{"type":["string",1]}`, wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var p Property
+            err := json.Unmarshal([]byte(tt.in), &p)
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("expected an error decoding %s", tt.in)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("decoding %s: %v", tt.in, err)
+            }
+
+            want := tt.want
+            if want == "" {
+                want = tt.in
+            }
+            got, err := json.Marshal(p)
+            if err != nil {
+                t.Fatalf("encoding: %v", err)
+            }
+            var gotValue, wantValue interface{}
+            json.Unmarshal(got, &gotValue)
+            json.Unmarshal([]byte(want), &wantValue)
+            if !reflect.DeepEqual(gotValue, wantValue) {
+                t.Fatalf("round trip of %s = %s, want %s", tt.in, got, want)
+            }
+        })
+    }
+}
+
+func TestResolveRef(t *testing.T) {
+    var root InputSchema
+    if err := json.Unmarshal([]byte(`{"$defs":{"port":{"type":"integer"},"a/b":{"type":"string"}},"definitions":{"x":{"type":"boolean"}}}`), &root); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        ref      string
+        wantType string
+        wantErr  bool
+    }{
+        {ref: "#/$defs/port", wantType: "integer"},
+        {ref: "#/$defs/a~1b", wantType: "string"},
+        {ref: "#/definitions/x", wantType: "boolean"},
+        {ref: "#/$defs/missing", wantErr: true},
+        {ref: "other.json#/$defs/port", wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.ref, func(t *testing.T) {
+            target, err := resolveRef(&root, tt.ref)
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("resolveRef(%q) found %+v, want an error", tt.ref, target)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("resolveRef(%q): %v", tt.ref, err)
+            }
+            if target.Type != tt.wantType {
+                t.Fatalf("resolveRef(%q) has type %q, want %q", tt.ref, target.Type, tt.wantType)
+            }
+        })
+    }
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/sirupsen/logrus"
+)
+
+// threatLookupTool is a single-target SentraIP tool: its argument holds a
+// target of one lookup type
+type threatLookupTool struct {
+    Tool     MCPTool
+    Argument string
+    Type     string
+}
+
+var threatLookupTools = map[string]threatLookupTool{
+    "sentraip_url_check": {
+        Argument: "url",
+        Type:     "url",
+        Tool: MCPTool{
+            Name:        "sentraip_url_check",
+            Title:       "SentraIP URL check",
+            Description: "Check the reputation of a URL using SentraIP",
+            InputSchema: threatLookupInputSchema("url", Property{
+                Type:        "string",
+                Description: "Absolute http or https URL to check",
+                Format:      "uri",
+                MinLength:   intPtr(1),
+                MaxLength:   intPtr(maxURLTargetLength),
+            }),
+            OutputSchema: threatLookupOutputSchema("url", nil),
+            Annotations:  externalLookupAnnotations,
+            Version:      "1.0.0",
+        },
+    },
+    "sentraip_hash_check": {
+        Argument: "hash",
+        Type:     "hash",
+        Tool: MCPTool{
+            Name:        "sentraip_hash_check",
+            Title:       "SentraIP file hash check",
+            Description: "Check the reputation of a file by its MD5, SHA1 or SHA256 hash using SentraIP",
+            InputSchema: threatLookupInputSchema("hash", Property{
+                Type:        "string",
+                Description: "Hex encoded MD5, SHA1 or SHA256 digest",
+                Pattern:     "^(?:[0-9a-fA-F]{32}|[0-9a-fA-F]{40}|[0-9a-fA-F]{64})$",
+            }),
+            OutputSchema: threatLookupOutputSchema("hash", map[string]Property{
+                "hash_type": {Type: "string", Enum: []interface{}{"md5", "sha1", "sha256"}},
+            }),
+            Annotations: externalLookupAnnotations,
+            Version:     "1.0.0",
+        },
+    },
+    "sentraip_asn_check": {
+        Argument: "asn",
+        Type:     "asn",
+        Tool: MCPTool{
+            Name:        "sentraip_asn_check",
+            Title:       "SentraIP ASN check",
+            Description: "Check the reputation of an autonomous system using SentraIP",
+            InputSchema: threatLookupInputSchema("asn", Property{
+                Type:        "string",
+                Description: "AS number, e.g. AS15169 or 15169",
+                Pattern:     "^(?:[aA][sS])?[0-9]{1,10}$",
+            }),
+            OutputSchema: threatLookupOutputSchema("asn", nil),
+            Annotations:  externalLookupAnnotations,
+            Version:      "1.0.0",
+        },
+    },
+    "sentraip_cidr_summary": {
+        Argument: "cidr",
+        Type:     "cidr",
+        Tool: MCPTool{
+            Name:        "sentraip_cidr_summary",
+            Title:       "SentraIP CIDR summary",
+            Description: "Summarize threat activity within a CIDR block using SentraIP",
+            InputSchema: threatLookupInputSchema("cidr", Property{
+                Type:        "string",
+                Description: "CIDR block, at most /8 for IPv4 or /16 for IPv6",
+                MinLength:   intPtr(3),
+                MaxLength:   intPtr(43),
+            }),
+            OutputSchema: threatLookupOutputSchema("cidr", nil),
+            Annotations:  externalLookupAnnotations,
+            Version:      "1.0.0",
+        },
+    },
+}
+
+func threatLookupInputSchema(argument string, target Property) InputSchema {
+    return InputSchema{
+        Type: "object",
+        Properties: map[string]Property{
+            argument: target,
+            "bypass_cache": {
+                Type:        "boolean",
+                Description: "Query SentraIP even if a cached result exists",
+                Default:     false,
+            },
+        },
+        Required: []string{argument},
+    }
+}
+
+func threatLookupOutputSchema(targetType string, extra map[string]Property) *Property {
+    schema := &Property{
+        Type: "object",
+        Properties: map[string]Property{
+            "target":    {Type: "string", Description: "Normalized target"},
+            "type":      {Type: "string", Const: targetType},
+            "data":      {Type: "object", Description: "Threat intelligence record returned by SentraIP"},
+            "timestamp": {Type: "string", Format: "date-time", Description: "When SentraIP was queried"},
+            "cache": {
+                Type: "object",
+                Properties: map[string]Property{
+                    "status": {Type: "string", Enum: []interface{}{"hit", "stale", "miss", "bypass"}},
+                },
+            },
+        },
+        Required: []string{"target", "type", "data", "timestamp"},
+    }
+    for name, property := range extra {
+        schema.Properties[name] = property
+    }
+    return schema
+}
+
+// threatToolForType names the tool behind a lookup type, for the
+// X-MCP-Tool header the OTEL enhancer traces
+func threatToolForType(targetType string) string {
+    for name, tool := range threatLookupTools {
+        if tool.Type == targetType {
+            return name
+        }
+    }
+    return "sentraip_threat_check"
+}
+
+func callSentraIPLookupTool(ctx context.Context, toolName string, params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
+    tool, ok := threatLookupTools[toolName]
+    if !ok {
+        return nil, fmt.Errorf("unknown tool: %s", toolName)
+    }
+    target, ok := params[tool.Argument].(string)
+    if !ok {
+        return nil, fmt.Errorf("missing or invalid '%s' parameter", tool.Argument)
+    }
+    bypass, _ := params["bypass_cache"].(bool)
+
+    record, cacheStatus, err := cachedLookupThreat(ctx, target, tool.Type, bypass)
+    if err != nil {
+        return nil, err
+    }
+    record["cache"] = map[string]interface{}{"status": cacheStatus}
+    if tool.Type == "hash" {
+        if normalized, ok := record["target"].(string); ok {
+            record["hash_type"] = hashTypes[len(normalized)]
+        }
+    }
+
+    log.Get().WithFields(logrus.Fields{
+        "tool_name":    toolName,
+        "cache_status": cacheStatus,
+        "session_id":   getSessionID(session),
+    }).Debug("SentraIP lookup served")
+    return record, nil
+}
+
+func init() {
+    for name, tool := range threatLookupTools {
+        tool := tool
+        MCPToolsRegistry[name] = tool.Tool
+        toolArgumentNormalizers[name] = func(params map[string]interface{}) (map[string]interface{}, error) {
+            target, _ := params[tool.Argument].(string)
+            normalized, err := normalizeTarget(target, tool.Type)
+            if err != nil {
+                return nil, ValidationErrors{{Pointer: "/" + tool.Argument, Message: err.Error()}}
+            }
+            params[tool.Argument] = normalized
+            return params, nil
+        }
+    }
+}
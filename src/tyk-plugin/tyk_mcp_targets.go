@@ -0,0 +1,293 @@
+package main
+
+import (
+    "fmt"
+    "net/netip"
+    "net/url"
+    "strconv"
+    "strings"
+
+    "golang.org/x/net/idna"
+    "golang.org/x/net/publicsuffix"
+)
+
+// nonPublicPrefixes are special purpose ranges (RFC 6890 and friends) not
+// covered by the netip predicates. Threat lookups for them only leak
+// internal addresses to the intelligence provider.
+var nonPublicPrefixes = []netip.Prefix{
+    netip.MustParsePrefix("0.0.0.0/8"),
+    netip.MustParsePrefix("100.64.0.0/10"),
+    netip.MustParsePrefix("192.0.0.0/24"),
+    netip.MustParsePrefix("192.0.2.0/24"),
+    netip.MustParsePrefix("198.18.0.0/15"),
+    netip.MustParsePrefix("198.51.100.0/24"),
+    netip.MustParsePrefix("203.0.113.0/24"),
+    netip.MustParsePrefix("240.0.0.0/4"),
+    netip.MustParsePrefix("100::/64"),
+    netip.MustParsePrefix("2001:db8::/32"),
+    netip.MustParsePrefix("fc00::/7"),
+}
+
+const maxURLTargetLength = 2048
+
+// domainProfile maps Unicode domains to their punycode form using the
+// rules browsers use for lookups
+var domainProfile = idna.New(
+    idna.MapForLookup(),
+    idna.BidiRule(),
+    idna.Transitional(false),
+    idna.StrictDomainName(true),
+)
+
+// targetError names what is wrong with a lookup target
+type targetError struct {
+    Target string
+    Reason string
+}
+
+func (e *targetError) Error() string {
+    return fmt.Sprintf("%q %s", e.Target, e.Reason)
+}
+
+// normalizeTarget parses a threat lookup target strictly and returns its
+// canonical form: the shortest textual form of an IP address, or the
+// lower-case ASCII (punycode) form of a registrable domain or subdomain
+func normalizeTarget(target, targetType string) (string, error) {
+    switch targetType {
+    case "ip":
+        return normalizeIPTarget(target)
+    case "domain":
+        return normalizeDomainTarget(target)
+    case "url":
+        return normalizeURLTarget(target)
+    case "hash":
+        return normalizeHashTarget(target)
+    case "asn":
+        return normalizeASNTarget(target)
+    case "cidr":
+        return normalizeCIDRTarget(target)
+    }
+    return "", fmt.Errorf("invalid type: %s (must be one of ip, domain, url, hash, asn, cidr)", targetType)
+}
+
+func normalizeIPTarget(target string) (string, error) {
+    addr, err := netip.ParseAddr(target)
+    if err != nil {
+        return "", &targetError{target, "is not a valid IPv4 or IPv6 address"}
+    }
+    if addr.Zone() != "" {
+        return "", &targetError{target, "has an IPv6 zone identifier, which is not allowed"}
+    }
+    addr = addr.Unmap()
+
+    if !currentConfig().SentraIP.AllowPrivateTargets {
+        if reason := nonPublicReason(addr); reason != "" {
+            return "", &targetError{target, "is " + reason}
+        }
+    }
+    return addr.String(), nil
+}
+
+// nonPublicReason says why addr is not a public unicast address, or returns
+// "" when it is one
+func nonPublicReason(addr netip.Addr) string {
+    switch {
+    case addr.IsLoopback():
+        return "a loopback address"
+    case addr.IsPrivate():
+        return "a private address"
+    case addr.IsLinkLocalUnicast():
+        return "a link-local address"
+    case addr.IsMulticast():
+        return "a multicast address"
+    case addr.IsUnspecified():
+        return "the unspecified address"
+    }
+    for _, prefix := range nonPublicPrefixes {
+        if prefix.Contains(addr) {
+            return "in reserved range " + prefix.String()
+        }
+    }
+    return ""
+}
+
+func normalizeDomainTarget(target string) (string, error) {
+    name := strings.TrimSuffix(target, ".")
+    if name == "" {
+        return "", &targetError{target, "is empty"}
+    }
+    if _, err := netip.ParseAddr(name); err == nil {
+        return "", &targetError{target, "is an IP address, use type 'ip'"}
+    }
+
+    ascii, err := domainProfile.ToASCII(name)
+    if err != nil {
+        return "", &targetError{target, "is not a valid domain name"}
+    }
+    ascii = strings.ToLower(ascii)
+    if len(ascii) > 253 || !strings.Contains(ascii, ".") {
+        return "", &targetError{target, "is not a fully qualified domain name"}
+    }
+
+    if currentConfig().SentraIP.AllowPrivateTargets {
+        return ascii, nil
+    }
+
+    suffix, icann := publicsuffix.PublicSuffix(ascii)
+    if !icann && !strings.Contains(suffix, ".") {
+        return "", &targetError{target, fmt.Sprintf("has unknown top-level domain %q", suffix)}
+    }
+    if suffix == ascii {
+        return "", &targetError{target, "is a public suffix, not a domain"}
+    }
+    return ascii, nil
+}
+
+// normalizeURLTarget accepts absolute http(s) URLs whose host passes the IP
+// or domain rules. The fragment and default ports are dropped.
+func normalizeURLTarget(target string) (string, error) {
+    if len(target) > maxURLTargetLength {
+        return "", &targetError{target, fmt.Sprintf("is longer than %d characters", maxURLTargetLength)}
+    }
+    u, err := url.Parse(target)
+    if err != nil || u.Host == "" {
+        return "", &targetError{target, "is not an absolute URL"}
+    }
+    scheme := strings.ToLower(u.Scheme)
+    if scheme != "http" && scheme != "https" {
+        return "", &targetError{target, "must use http or https"}
+    }
+    if u.User != nil {
+        return "", &targetError{target, "must not contain credentials"}
+    }
+
+    host := u.Hostname()
+    if _, err := netip.ParseAddr(host); err == nil {
+        host, err = normalizeIPTarget(host)
+        if err != nil {
+            return "", &targetError{target, "has a host that " + err.(*targetError).Reason}
+        }
+        if strings.Contains(host, ":") {
+            host = "[" + host + "]"
+        }
+    } else {
+        host, err = normalizeDomainTarget(host)
+        if err != nil {
+            return "", &targetError{target, "has a host that " + err.(*targetError).Reason}
+        }
+    }
+
+    port := u.Port()
+    if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+        port = ""
+    }
+    if port != "" {
+        host += ":" + port
+    }
+
+    u.Scheme, u.Host, u.Fragment, u.RawFragment = scheme, host, "", ""
+    return u.String(), nil
+}
+
+// hashTypes maps hex digest lengths to their algorithm
+var hashTypes = map[int]string{32: "md5", 40: "sha1", 64: "sha256"}
+
+func normalizeHashTarget(target string) (string, error) {
+    hash := strings.ToLower(target)
+    if _, ok := hashTypes[len(hash)]; !ok {
+        return "", &targetError{target, "is not an MD5, SHA1 or SHA256 hex digest (32, 40 or 64 characters)"}
+    }
+    for _, r := range hash {
+        if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+            return "", &targetError{target, "contains non-hexadecimal characters"}
+        }
+    }
+    return hash, nil
+}
+
+// normalizeASNTarget accepts "AS15169", "as15169" or "15169" and returns
+// the "AS15169" form. Private use and reserved numbers are refused unless
+// private targets are allowed.
+func normalizeASNTarget(target string) (string, error) {
+    digits := target
+    if len(digits) > 2 && strings.EqualFold(digits[:2], "as") {
+        digits = digits[2:]
+    }
+    asn, err := strconv.ParseUint(digits, 10, 32)
+    if err != nil || digits == "" || digits[0] == '+' {
+        return "", &targetError{target, "is not an AS number (expected AS1 to AS4294967295)"}
+    }
+
+    if !currentConfig().SentraIP.AllowPrivateTargets {
+        switch {
+        case asn == 0 || asn == 23456 || asn == 65535 || asn == 4294967295:
+            return "", &targetError{target, "is a reserved AS number"}
+        case asn >= 64496 && asn <= 64511, asn >= 65536 && asn <= 65551:
+            return "", &targetError{target, "is an AS number reserved for documentation"}
+        case asn >= 64512 && asn <= 65534, asn >= 4200000000:
+            return "", &targetError{target, "is a private use AS number"}
+        }
+    }
+    return "AS" + strconv.FormatUint(asn, 10), nil
+}
+
+// normalizeCIDRTarget returns the masked prefix. Blocks broader than /8
+// (IPv4) or /16 (IPv6) are refused as too broad to summarize.
+func normalizeCIDRTarget(target string) (string, error) {
+    prefix, err := netip.ParsePrefix(target)
+    if err != nil {
+        if strings.Contains(target, "%") {
+            return "", &targetError{target, "has an IPv6 zone identifier, which is not allowed"}
+        }
+        return "", &targetError{target, "is not a CIDR block such as 203.0.113.0/24"}
+    }
+    prefix = prefix.Masked()
+
+    minBits := 8
+    if prefix.Addr().Is6() {
+        minBits = 16
+    }
+    if prefix.Bits() < minBits {
+        return "", &targetError{target, fmt.Sprintf("is broader than /%d", minBits)}
+    }
+
+    if !currentConfig().SentraIP.AllowPrivateTargets {
+        if reason := nonPublicReason(prefix.Addr()); reason != "" {
+            return "", &targetError{target, "is " + reason}
+        }
+    }
+    return prefix.String(), nil
+}
+
+// threatLookupPath builds the gateway path of a SentraIP lookup. Targets go
+// in as single escaped path segments; URLs go in a query parameter and
+// CIDR blocks as address and prefix length segments.
+func threatLookupPath(target, targetType string) string {
+    switch targetType {
+    case "url":
+        return "/threat-intel/url?url=" + url.QueryEscape(target)
+    case "cidr":
+        if prefix, err := netip.ParsePrefix(target); err == nil {
+            return fmt.Sprintf("/threat-intel/cidr/%s/%d", url.PathEscape(prefix.Addr().String()), prefix.Bits())
+        }
+    }
+    return "/threat-intel/" + targetType + "/" + url.PathEscape(target)
+}
+
+// normalizeThreatCheckArgs canonicalizes the target of
+// sentraip_threat_check, reporting problems as argument validation errors
+func normalizeThreatCheckArgs(params map[string]interface{}) (map[string]interface{}, error) {
+    target, _ := params["target"].(string)
+    targetType, _ := params["type"].(string)
+
+    normalized, err := normalizeTarget(target, targetType)
+    if err != nil {
+        return nil, ValidationErrors{{Pointer: "/target", Message: err.Error()}}
+    }
+    params["target"] = normalized
+    return params, nil
+}
+
+func init() {
+    toolArgumentNormalizers["sentraip_threat_check"] = normalizeThreatCheckArgs
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "net/http"
     "os"
-    "strconv"
     "strings"
     "time"
 
@@ -18,29 +19,95 @@ import (
 
 // MCPTool represents an MCP tool definition
 type MCPTool struct {
-    Name        string      `json:"name"`
-    Description string      `json:"description"`
-    InputSchema InputSchema `json:"inputSchema"`
+    Name         string           `json:"name"`
+    Title        string           `json:"title,omitempty"`
+    Description  string           `json:"description"`
+    InputSchema  InputSchema      `json:"inputSchema"`
+    OutputSchema *Property        `json:"outputSchema,omitempty"`
+    Annotations  *ToolAnnotations `json:"annotations,omitempty"`
+    // Version is the tool's semantic version. Callers may pin one with
+    // name@version or the X-MCP-Tool-Version header.
+    Version string `json:"version,omitempty"`
+    // Versions lists every registered version when there is more than one
+    Versions   []string         `json:"versions,omitempty"`
+    Deprecated *ToolDeprecation `json:"deprecated,omitempty"`
+    // RequiresApproval queues calls for a human approver instead of
+    // running them
+    RequiresApproval bool `json:"requiresApproval,omitempty"`
+    // Async tools run as background jobs when the client asks
+    Async bool `json:"async,omitempty"`
+    // Meta carries per-caller details such as the remaining rate limit
+    Meta map[string]interface{} `json:"_meta,omitempty"`
 }
 
-// InputSchema represents the JSON schema for tool input
-type InputSchema struct {
-    Type       string              `json:"type"`
-    Properties map[string]Property `json:"properties"`
-    Required   []string            `json:"required"`
-}
+// InputSchema is the root JSON Schema describing a tool's arguments
+type InputSchema = Property
 
-// Property represents a schema property
+// Property is a JSON Schema (2020-12) node. It is used both for the root of
+// a tool's input schema and for every nested property, item and $def.
+// Keywords without a field are kept in Extra so schemas round-trip through
+// tools/list without loss, and Bool holds boolean schemas (true/false).
 type Property struct {
-    Type        string   `json:"type"`
-    Description string   `json:"description"`
-    Enum        []string `json:"enum,omitempty"`
+    Ref         string        `json:"$ref,omitempty"`
+    Type        string        `json:"type,omitempty"`
+    Types       []string      `json:"-"`
+    Title       string        `json:"title,omitempty"`
+    Description string        `json:"description,omitempty"`
+    Enum        []interface{} `json:"enum,omitempty"`
+    Const       interface{}   `json:"const,omitempty"`
+    Default     interface{}   `json:"default,omitempty"`
+    Examples    []interface{} `json:"examples,omitempty"`
+
+    // Strings
+    Format    string `json:"format,omitempty"`
+    Pattern   string `json:"pattern,omitempty"`
+    MinLength *int   `json:"minLength,omitempty"`
+    MaxLength *int   `json:"maxLength,omitempty"`
+
+    // Numbers and integers
+    Minimum          *float64 `json:"minimum,omitempty"`
+    Maximum          *float64 `json:"maximum,omitempty"`
+    ExclusiveMinimum *float64 `json:"exclusiveMinimum,omitempty"`
+    ExclusiveMaximum *float64 `json:"exclusiveMaximum,omitempty"`
+    MultipleOf       *float64 `json:"multipleOf,omitempty"`
+
+    // Arrays. Items applies to the elements after PrefixItems.
+    PrefixItems []Property `json:"prefixItems,omitempty"`
+    Items       *Property  `json:"items,omitempty"`
+    MinItems    *int       `json:"minItems,omitempty"`
+    MaxItems    *int       `json:"maxItems,omitempty"`
+    UniqueItems bool       `json:"uniqueItems,omitempty"`
+
+    // Objects
+    Properties           map[string]Property `json:"properties,omitempty"`
+    Required             []string            `json:"required,omitempty"`
+    AdditionalProperties *Property           `json:"additionalProperties,omitempty"`
+    MinProperties        *int                `json:"minProperties,omitempty"`
+    MaxProperties        *int                `json:"maxProperties,omitempty"`
+
+    // Composition
+    OneOf []Property `json:"oneOf,omitempty"`
+    AnyOf []Property `json:"anyOf,omitempty"`
+    AllOf []Property `json:"allOf,omitempty"`
+    Not   *Property  `json:"not,omitempty"`
+
+    Defs map[string]Property `json:"$defs,omitempty"`
+
+    Bool  *bool                      `json:"-"`
+    Extra map[string]json.RawMessage `json:"-"`
 }
 
-// MCPToolsRegistry holds all available MCP tools
+func intPtr(v int) *int           { return &v }
+func floatPtr(v float64) *float64 { return &v }
+func boolPtr(v bool) *bool        { return &v }
+
+// MCPToolsRegistry holds the built-in MCP tools. Calls are served from the
+// active state (see currentState), which adds the tools generated from
+// OpenAPI documents and is replaced on reload.
 var MCPToolsRegistry = map[string]MCPTool{
     "sentraip_threat_check": {
         Name:        "sentraip_threat_check",
+        Title:       "SentraIP threat check",
         Description: "Check IP address or domain reputation using SentraIP",
         InputSchema: InputSchema{
             Type: "object",
@@ -48,18 +115,44 @@ var MCPToolsRegistry = map[string]MCPTool{
                 "target": {
                     Type:        "string",
                     Description: "IP address or domain to check",
+                    MinLength:   intPtr(1),
+                    MaxLength:   intPtr(253),
                 },
                 "type": {
                     Type:        "string",
                     Description: "Type of target to check",
-                    Enum:        []string{"ip", "domain"},
+                    Enum:        []interface{}{"ip", "domain"},
+                },
+                "bypass_cache": {
+                    Type:        "boolean",
+                    Description: "Query SentraIP even if a cached result exists",
+                    Default:     false,
                 },
             },
             Required: []string{"target", "type"},
         },
+        OutputSchema: &Property{
+            Type: "object",
+            Properties: map[string]Property{
+                "target":    {Type: "string"},
+                "type":      {Type: "string", Enum: []interface{}{"ip", "domain"}},
+                "data":      {Type: "object", Description: "Threat intelligence record returned by SentraIP"},
+                "timestamp": {Type: "string", Format: "date-time", Description: "When SentraIP was queried"},
+                "cache": {
+                    Type: "object",
+                    Properties: map[string]Property{
+                        "status": {Type: "string", Enum: []interface{}{"hit", "stale", "miss", "bypass"}},
+                    },
+                },
+            },
+            Required: []string{"target", "type", "data", "timestamp"},
+        },
+        Annotations: externalLookupAnnotations,
+        Version:     "1.0.0",
     },
     "tyk_api_analytics": {
         Name:        "tyk_api_analytics",
+        Title:       "Tyk API analytics",
         Description: "Get API usage analytics from Tyk Gateway",
         InputSchema: InputSchema{
             Type: "object",
@@ -71,13 +164,61 @@ var MCPToolsRegistry = map[string]MCPTool{
                 "time_range": {
                     Type:        "string",
                     Description: "Time range (24h, 7d, 30d)",
+                    Enum:        []interface{}{"24h", "7d", "30d"},
+                    Default:     "24h",
                 },
             },
             Required: []string{"api_id"},
         },
+        OutputSchema: &Property{
+            Type: "object",
+            Properties: map[string]Property{
+                "api_id":              {Type: "string"},
+                "time_range":          {Type: "string"},
+                "total_requests":      {Type: "integer", Minimum: floatPtr(0)},
+                "successful_requests": {Type: "integer", Minimum: floatPtr(0)},
+                "error_requests":      {Type: "integer", Minimum: floatPtr(0)},
+                "window_start":        {Type: "string", Format: "date-time"},
+                "window_end":          {Type: "string", Format: "date-time"},
+                "avg_response_time":   {Type: "number", Description: "Average request latency in milliseconds"},
+                "error_rate":          {Type: "number", Minimum: floatPtr(0), Maximum: floatPtr(1)},
+                "latency_percentiles": {
+                    Type:        "object",
+                    Description: "Latency percentiles in milliseconds, as histogram bucket upper bounds",
+                    Properties: map[string]Property{
+                        "p50": {Type: "integer"},
+                        "p95": {Type: "integer"},
+                        "p99": {Type: "integer"},
+                    },
+                },
+                "top_endpoints": {
+                    Type: "array",
+                    Items: &Property{
+                        Type: "object",
+                        Properties: map[string]Property{
+                            "method":   {Type: "string"},
+                            "path":     {Type: "string"},
+                            "requests": {Type: "integer"},
+                        },
+                        Required: []string{"path", "requests"},
+                    },
+                },
+                "status_codes": {
+                    Type:                 "object",
+                    Description:          "Request count per HTTP status code",
+                    AdditionalProperties: &Property{Type: "integer"},
+                },
+                "timestamp": {Type: "string", Format: "date-time"},
+            },
+            Required: []string{"api_id", "time_range", "total_requests", "error_rate", "timestamp"},
+        },
+        Annotations: gatewayReadAnnotations,
+        Version:     "1.0.0",
+        Async:       true,
     },
     "claude_context_search": {
         Name:        "claude_context_search",
+        Title:       "Claude conversation search",
         Description: "Search previous conversations and context",
         InputSchema: InputSchema{
             Type: "object",
@@ -85,14 +226,65 @@ var MCPToolsRegistry = map[string]MCPTool{
                 "query": {
                     Type:        "string",
                     Description: "Search query",
+                    MinLength:   intPtr(1),
                 },
                 "limit": {
-                    Type:        "string",
+                    Type:        "integer",
                     Description: "Number of results",
+                    Minimum:     floatPtr(1),
+                    Maximum:     floatPtr(100),
+                    Default:     10,
+                },
+                "since": {
+                    Type:        "string",
+                    Description: "Only messages at or after this time",
+                    Format:      "date-time",
+                },
+                "until": {
+                    Type:        "string",
+                    Description: "Only messages at or before this time",
+                    Format:      "date-time",
+                },
+                "tool": {
+                    Type:        "string",
+                    Description: "Only assistant messages that used this tool",
+                },
+                "user_id": {
+                    Type:        "string",
+                    Description: "Search another user's conversations (admin only)",
                 },
             },
             Required: []string{"query"},
         },
+        OutputSchema: &Property{
+            Type: "object",
+            Properties: map[string]Property{
+                "query": {Type: "string"},
+                "limit": {Type: "integer"},
+                "results": {
+                    Type: "array",
+                    Items: &Property{
+                        Type: "object",
+                        Properties: map[string]Property{
+                            "conversation_id": {Type: "string"},
+                            "message_id":      {Type: "string"},
+                            "role":            {Type: "string", Enum: []interface{}{"user", "assistant"}},
+                            "snippet":         {Type: "string", Description: "Matched text with query terms wrapped in **"},
+                            "tools":           {Type: "array", Items: &Property{Type: "string"}},
+                            "timestamp":       {Type: "string", Format: "date-time"},
+                            "relevance":       {Type: "number", Description: "BM25 score"},
+                        },
+                        Required: []string{"conversation_id", "snippet"},
+                    },
+                },
+                "total_matches":  {Type: "integer", Minimum: floatPtr(0)},
+                "search_time_ms": {Type: "integer", Minimum: floatPtr(0)},
+                "timestamp":      {Type: "string", Format: "date-time"},
+            },
+            Required: []string{"query", "results", "total_matches"},
+        },
+        Annotations: gatewayReadAnnotations,
+        Version:     "1.0.0",
     },
 }
 
@@ -109,6 +301,36 @@ func MCPToolsMiddleware(rw http.ResponseWriter, r *http.Request) {
         "api_id": spec.APIID,
     }).Info("MCP tools request received")
     
+    // Handle the MCP Streamable HTTP (JSON-RPC) endpoint
+    if r.URL.Path == "/mcp" {
+        handleMCPEndpoint(rw, r, session)
+        return
+    }
+    
+    // Handle the job API
+    if r.URL.Path == "/mcp/jobs" || strings.HasPrefix(r.URL.Path, "/mcp/jobs/") {
+        handleJobs(rw, r, session)
+        return
+    }
+    
+    // Handle the upstream health report
+    if r.URL.Path == "/mcp/health" && r.Method == "GET" {
+        handleHealth(rw, r, session)
+        return
+    }
+    
+    // Handle the reload API
+    if r.URL.Path == "/mcp/reload" {
+        handleReload(rw, r, session)
+        return
+    }
+    
+    // Handle the approval queue API
+    if r.URL.Path == "/mcp/approvals" || strings.HasPrefix(r.URL.Path, "/mcp/approvals/") {
+        handleApprovals(rw, r, session)
+        return
+    }
+    
     // Handle MCP tools listing
     if r.RequestURI == "/mcp/tools" && r.Method == "GET" {
         handleToolsList(rw, r, session)
@@ -126,10 +348,7 @@ func MCPToolsMiddleware(rw http.ResponseWriter, r *http.Request) {
 }
 
 func handleToolsList(rw http.ResponseWriter, r *http.Request, session *user.SessionState) {
-    tools := make([]MCPTool, 0, len(MCPToolsRegistry))
-    for _, tool := range MCPToolsRegistry {
-        tools = append(tools, tool)
-    }
+    tools := withRateLimitMeta(visibleTools(listTools(), callerFromSession(session), r), session, r)
     
     response := map[string]interface{}{
         "tools":     tools,
@@ -148,13 +367,6 @@ func handleToolsList(rw http.ResponseWriter, r *http.Request, session *user.Sess
 }
 
 func handleToolExecution(rw http.ResponseWriter, r *http.Request, session *user.SessionState, toolName string) {
-    _, exists := MCPToolsRegistry[toolName]
-    if !exists {
-        log.Get().WithField("tool_name", toolName).Error("MCP tool not found")
-        http.Error(rw, fmt.Sprintf(`{"error":"tool_not_found","message":"Tool not found: %s"}`, toolName), http.StatusNotFound)
-        return
-    }
-    
     // Parse request body
     body, err := io.ReadAll(r.Body)
     if err != nil {
@@ -170,39 +382,226 @@ func handleToolExecution(rw http.ResponseWriter, r *http.Request, session *user.
         return
     }
     
-    // Execute the tool
-    result, err := executeMCPTool(toolName, params, session)
+    // _meta carries MCP request metadata, not tool arguments
+    metaKey := ""
+    if meta, ok := params["_meta"].(map[string]interface{}); ok {
+        metaKey, _ = meta["idempotencyKey"].(string)
+        delete(params, "_meta")
+    }
+    
+    result, err := runToolOnce(r.Context(), r, session, toolName, params, idempotencyKey(r, metaKey))
+    if limited, ok := err.(*rateLimitError); ok {
+        setRateLimitHeaders(rw.Header(), limited.usage)
+        writeJSON(rw, http.StatusTooManyRequests, map[string]interface{}{
+            "error":       "rate_limited",
+            "message":     err.Error(),
+            "limit":       limited.usage.Exceeded,
+            "retry_after": retryAfterSeconds(limited.usage.RetryAfter),
+        })
+        return
+    }
+    if err == errToolForbidden {
+        http.Error(rw, fmt.Sprintf(`{"error":"forbidden","message":"Tool not permitted: %s"}`, toolName), http.StatusForbidden)
+        return
+    }
+    if err == errToolNotFound {
+        http.Error(rw, fmt.Sprintf(`{"error":"tool_not_found","message":"Tool not found: %s"}`, toolName), http.StatusNotFound)
+        return
+    }
+    if verrs, ok := err.(ValidationErrors); ok {
+        writeJSON(rw, http.StatusBadRequest, map[string]interface{}{
+            "error":   "invalid_params",
+            "message": err.Error(),
+            "errors":  verrs,
+        })
+        return
+    }
+    if status, code, ok := idempotencyErrorStatus(err); ok {
+        if err == errIdempotencyInProgress {
+            rw.Header().Set("Retry-After", "1")
+        }
+        writeJSON(rw, status, map[string]interface{}{"error": code, "message": err.Error()})
+        return
+    }
     if err != nil {
-        log.Get().WithError(err).WithField("tool_name", toolName).Error("MCP tool execution failed")
-        http.Error(rw, fmt.Sprintf(`{"error":"execution_failed","message":"%s"}`, err.Error()), http.StatusInternalServerError)
+        log.Get().WithError(err).WithField("tool_name", toolName).Error("MCP tool call failed")
+        writeJSON(rw, http.StatusInternalServerError, map[string]interface{}{
+            "error":   toolErrorExecutionFailed,
+            "message": err.Error(),
+        })
         return
     }
     
-    rw.Header().Set("Content-Type", "application/json")
-    rw.WriteHeader(http.StatusOK)
-    json.NewEncoder(rw).Encode(result)
+    if result.replayed {
+        rw.Header().Set("Idempotent-Replayed", "true")
+    }
+    if result.usage != nil {
+        setRateLimitHeaders(rw.Header(), result.usage)
+    }
+    if result.deprecated != nil {
+        setDeprecationHeaders(rw.Header(), result.deprecated)
+    }
+    if result.jobID != "" {
+        rw.Header().Set("Location", "/mcp/jobs/"+result.jobID)
+        rw.Header().Set("Preference-Applied", "respond-async")
+        writeJSON(rw, http.StatusAccepted, result)
+        return
+    }
+    writeJSON(rw, http.StatusOK, result)
+}
+
+// errToolNotFound is returned by runTool for names missing from the registry
+var errToolNotFound = errors.New("tool not found")
+
+// runTool validates and executes a tool call for either transport. Bad
+// requests come back as errToolNotFound or ValidationErrors; failures while
+// running the tool are reported in the result with isError, so callers
+// only have one shape to handle. The call stops when ctx is done.
+func runTool(ctx context.Context, r *http.Request, session *user.SessionState, toolName string, params map[string]interface{}) (ToolResult, error) {
+    tool, exists := currentState().resolveTool(toolName, versionPin(r))
+    if !exists {
+        log.Get().WithField("tool_name", toolName).Error("MCP tool not found")
+        return ToolResult{}, errToolNotFound
+    }
+    toolName = tool.Name
+    if tool.Deprecated != nil {
+        log.Get().WithFields(logrus.Fields{
+            "tool_name":    toolName,
+            "tool_version": tool.Version,
+            "replaced_by":  tool.Deprecated.ReplacedBy,
+        }).Warn("Deprecated MCP tool version called")
+    }
+    if !toolAccessFor(r).allows(toolName, callerFromSession(session)) {
+        log.Get().WithFields(logrus.Fields{
+            "tool_name":  toolName,
+            "session_id": getSessionID(session),
+        }).Warn("MCP tool call denied by tool access policy")
+        return ToolResult{}, errToolForbidden
+    }
+    
+    // Validate against the tool's input schema before dispatch
+    params, err := validateToolArguments(tool.InputSchema, params)
+    if err != nil {
+        log.Get().WithError(err).WithField("tool_name", toolName).Warn("MCP tool arguments failed validation")
+        return ToolResult{}, err
+    }
+    if normalize, ok := toolArgumentNormalizers[toolName]; ok {
+        if params, err = normalize(params); err != nil {
+            log.Get().WithError(err).WithField("tool_name", toolName).Warn("MCP tool arguments failed validation")
+            return ToolResult{}, err
+        }
+    }
+    
+    // A call queued for approval is counted when it runs
+    usage, err := checkToolLimit(ctx, toolName, session, r, requiresApproval(tool))
+    if err != nil {
+        return ToolResult{}, err
+    }
+    
+    var result ToolResult
+    switch {
+    case requiresApproval(tool):
+        if result, err = queueForApproval(r, tool, params, session); err != nil {
+            return result, err
+        }
+    case runsAsJob(tool, r, session):
+        if result, err = startJob(ctx, r, session, tool, params); err != nil {
+            return result, err
+        }
+    default:
+        result = invokeTool(ctx, r, session, tool, params)
+    }
+    if usage != nil {
+        result.usage = usage
+        if result.Meta == nil {
+            result.Meta = map[string]interface{}{}
+        }
+        result.Meta["rateLimit"] = usage.meta()
+    }
+    if tool.Deprecated != nil {
+        result.deprecated = tool.Deprecated
+        if result.Meta == nil {
+            result.Meta = map[string]interface{}{}
+        }
+        result.Meta["deprecated"] = tool.Deprecated
+    }
+    return result, nil
+}
+
+// invokeTool executes a tool call whose arguments have been validated,
+// within the tool's configured deadline
+func invokeTool(ctx context.Context, r *http.Request, session *user.SessionState, tool MCPTool, params map[string]interface{}) ToolResult {
+    return invokeToolWithin(ctx, r, session, tool, params, toolTimeout(tool.Name))
+}
+
+func invokeToolWithin(ctx context.Context, r *http.Request, session *user.SessionState, tool MCPTool, params map[string]interface{}, timeout time.Duration) ToolResult {
+    toolName := tool.Name
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    
+    var result ToolResult
+    if target, ok := currentState().federated[toolName]; ok {
+        var err error
+        if result, err = callFederatedTool(ctx, target, tool, params, session); err != nil {
+            if ctx.Err() != nil {
+                err = contextToolError(ctx, toolName, timeout)
+            }
+            result = buildToolResult(tool, nil, err)
+        }
+    } else {
+        structured, err := executeMCPTool(ctx, tool, params, session, r)
+        if err != nil && ctx.Err() != nil {
+            err = contextToolError(ctx, toolName, timeout)
+        }
+        result = buildToolResult(tool, structured, err)
+    }
+    result = processToolResult(tool, result)
+    
+    if result.IsError {
+        log.Get().WithFields(logrus.Fields{
+            "tool_name":  toolName,
+            "session_id": getSessionID(session),
+            "error":      result.StructuredContent,
+        }).Error("MCP tool execution failed")
+        return result
+    }
     
     log.Get().WithFields(logrus.Fields{
         "tool_name":     toolName,
         "session_id":    getSessionID(session),
         "params_count":  len(params),
     }).Info("MCP tool executed successfully")
+    return result
 }
 
-func executeMCPTool(toolName string, params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
+func executeMCPTool(ctx context.Context, tool MCPTool, params map[string]interface{}, session *user.SessionState, r *http.Request) (map[string]interface{}, error) {
+    toolName := tool.Name
     switch toolName {
     case "sentraip_threat_check":
-        return callSentraIPAPI(params, session)
+        return callSentraIPAPI(ctx, params, session)
+    case "sentraip_bulk_threat_check":
+        return bulkThreatCheck(ctx, params, session)
+    case "sentraip_url_check", "sentraip_hash_check", "sentraip_asn_check", "sentraip_cidr_summary":
+        return callSentraIPLookupTool(ctx, toolName, params, session)
     case "tyk_api_analytics":
-        return getTykAnalytics(params, session)
+        return getTykAnalytics(ctx, params, session)
     case "claude_context_search":
-        return searchClaudeContext(params, session)
+        return searchClaudeContext(ctx, params, session)
+    case "gateway_block_target":
+        return blockTarget(ctx, params, session)
+    case "gateway_unblock_target":
+        return unblockTarget(ctx, params, session)
+    case "gateway_list_blocks":
+        return listBlocks(ctx, params, session)
     default:
+        if op, ok := currentState().operations[toolKey(toolName, tool.Version)]; ok {
+            return callGatewayOperation(ctx, op, params, session, r.Header.Get("Authorization"))
+        }
         return nil, fmt.Errorf("unknown tool: %s", toolName)
     }
 }
 
-func callSentraIPAPI(params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
+func callSentraIPAPI(ctx context.Context, params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
     target, ok := params["target"].(string)
     if !ok {
         return nil, fmt.Errorf("missing or invalid 'target' parameter")
@@ -213,43 +612,59 @@ func callSentraIPAPI(params map[string]interface{}, session *user.SessionState)
         return nil, fmt.Errorf("missing or invalid 'type' parameter")
     }
     
-    var endpoint string
-    switch targetType {
-    case "ip":
-        endpoint = fmt.Sprintf("/threat-intel/ip/%s", target)
-    case "domain":
-        endpoint = fmt.Sprintf("/threat-intel/domain/%s", target)
-    default:
-        return nil, fmt.Errorf("invalid type: %s (must be 'ip' or 'domain')", targetType)
+    bypass, _ := params["bypass_cache"].(bool)
+    record, cacheStatus, err := cachedLookupThreat(ctx, target, targetType, bypass)
+    if err != nil {
+        return nil, err
     }
+    record["cache"] = map[string]interface{}{"status": cacheStatus}
+    return record, nil
+}
+
+// lookupThreat queries SentraIP through the gateway for one target
+func lookupThreat(ctx context.Context, target, targetType string) (map[string]interface{}, error) {
+    // Never build an upstream path from an unchecked target
+    target, err := normalizeTarget(target, targetType)
+    if err != nil {
+        return nil, err
+    }
+    endpoint := threatLookupPath(target, targetType)
     
     // Get OAuth token (this would use the token from the OAuth middleware)
     token := os.Getenv("SENTRAIP_OAUTH_TOKEN") // In real implementation, get from token cache
     
     // Create HTTP request to SentraIP via Tyk Gateway
-    client := &http.Client{Timeout: 10 * time.Second}
-    req, err := http.NewRequest("GET", "http://tyk-gateway:8080/sentraip"+endpoint, nil)
+    req, err := http.NewRequestWithContext(ctx, "GET", gatewayURL()+"/sentraip"+endpoint, nil)
     if err != nil {
         return nil, fmt.Errorf("failed to create SentraIP request: %w", err)
     }
     
     req.Header.Set("Authorization", "Bearer "+token)
     req.Header.Set("User-Agent", "Tyk-MCP-Gateway/1.0")
-    req.Header.Set("X-MCP-Tool", "sentraip_threat_check")
+    toolName := threatToolForType(targetType)
+    req.Header.Set("X-MCP-Tool", toolName)
+    req.Header.Set("X-MCP-Tool-Version", toolVersion(currentState().tools[toolName]))
     
-    resp, err := client.Do(req)
+    resp, err := sentraIPClient.Do(req)
     if err != nil {
         return nil, fmt.Errorf("SentraIP API request failed: %w", err)
     }
     defer resp.Body.Close()
     
     if resp.StatusCode != http.StatusOK {
-        return map[string]interface{}{
-            "success": false,
-            "error":   fmt.Sprintf("SentraIP API error: %d", resp.StatusCode),
-            "target":  target,
-            "type":    targetType,
-        }, nil
+        details := map[string]interface{}{
+            "status_code": resp.StatusCode,
+            "target":      target,
+            "type":        targetType,
+        }
+        if wait := rateLimitReset(resp.Header, time.Now()); wait > 0 {
+            details["retry_after"] = retryAfterSeconds(wait)
+        }
+        return nil, &ToolError{
+            Code:    toolErrorUpstream,
+            Message: fmt.Sprintf("SentraIP API error: %d", resp.StatusCode),
+            Details: details,
+        }
     }
     
     var sentraipResponse map[string]interface{}
@@ -258,7 +673,6 @@ func callSentraIPAPI(params map[string]interface{}, session *user.SessionState)
     }
     
     return map[string]interface{}{
-        "success":   true,
         "data":      sentraipResponse,
         "target":    target,
         "type":      targetType,
@@ -266,7 +680,7 @@ func callSentraIPAPI(params map[string]interface{}, session *user.SessionState)
     }, nil
 }
 
-func getTykAnalytics(params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
+func getTykAnalytics(ctx context.Context, params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
     apiID, ok := params["api_id"].(string)
     if !ok {
         return nil, fmt.Errorf("missing or invalid 'api_id' parameter")
@@ -279,85 +693,99 @@ func getTykAnalytics(params map[string]interface{}, session *user.SessionState)
         }
     }
     
-    // In a real implementation, this would query actual Tyk analytics data
-    // For demo purposes, returning mock data
-    mockAnalytics := map[string]interface{}{
-        "api_id":              apiID,
-        "time_range":         timeRange,
-        "total_requests":     1523,
-        "successful_requests": 1492,
-        "error_requests":     31,
-        "avg_response_time":  245.7,
-        "error_rate":         0.02,
-        "top_endpoints": []map[string]interface{}{
-            {"path": "/v1/messages", "requests": 756},
-            {"path": "/threat-intel/ip", "requests": 432},
-            {"path": "/threat-intel/domain", "requests": 335},
-        },
-        "status_codes": map[string]int{
-            "200": 1492,
-            "400": 15,
-            "401": 8,
-            "500": 8,
-        },
-        "timestamp": time.Now().Format(time.RFC3339),
+    analytics, err := summarizeAnalytics(ctx, apiID, timeRange)
+    if err != nil {
+        return nil, err
     }
     
     log.Get().WithFields(logrus.Fields{
-        "api_id":     apiID,
-        "time_range": timeRange,
-        "session_id": getSessionID(session),
+        "api_id":         apiID,
+        "time_range":     timeRange,
+        "total_requests": analytics["total_requests"],
+        "session_id":     getSessionID(session),
     }).Info("Tyk analytics data served")
     
-    return mockAnalytics, nil
+    return analytics, nil
 }
 
-func searchClaudeContext(params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
+func searchClaudeContext(ctx context.Context, params map[string]interface{}, session *user.SessionState) (map[string]interface{}, error) {
     query, ok := params["query"].(string)
     if !ok {
         return nil, fmt.Errorf("missing or invalid 'query' parameter")
     }
     
     limit := 10
-    if l, exists := params["limit"]; exists {
-        if lStr, ok := l.(string); ok {
-            if parsedLimit, err := strconv.Atoi(lStr); err == nil && parsedLimit > 0 {
-                limit = parsedLimit
+    if l, ok := params["limit"].(float64); ok && l > 0 {
+        limit = int(l)
+    }
+    
+    caller := callerFromSession(session)
+    if caller.Anonymous() {
+        return nil, &ToolError{Code: toolErrorForbidden, Message: "conversation search requires an identified caller"}
+    }
+    
+    filter := searchFilter{UserID: caller.ID}
+    if userID, ok := params["user_id"].(string); ok && userID != "" && userID != caller.ID {
+        if !caller.HasAnyRole("admin") {
+            return nil, &ToolError{Code: toolErrorForbidden, Message: "only admins can search other users' conversations"}
+        }
+        filter.UserID = userID
+    }
+    if tool, ok := params["tool"].(string); ok {
+        filter.Tool = tool
+    }
+    for key, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+        if value, ok := params[key].(string); ok {
+            t, err := time.Parse(time.RFC3339, value)
+            if err != nil {
+                return nil, fmt.Errorf("invalid '%s' parameter: %w", key, err)
             }
+            *dst = t
         }
     }
     
-    // In a real implementation, this would search actual conversation history
-    // For demo purposes, returning mock search results
-    mockResults := map[string]interface{}{
-        "query": query,
-        "limit": limit,
-        "results": []map[string]interface{}{
-            {
-                "conversation_id": "conv_123abc",
-                "snippet":        fmt.Sprintf("Previous discussion about %s and API security best practices...", query),
-                "timestamp":      "2024-01-15T10:30:00Z",
-                "relevance":      0.95,
-            },
-            {
-                "conversation_id": "conv_456def",
-                "snippet":        fmt.Sprintf("User asked about %s implementation details...", query),
-                "timestamp":      "2024-01-14T15:45:00Z",
-                "relevance":      0.87,
-            },
-        },
-        "total_matches": 2,
-        "search_time_ms": 45,
-        "timestamp": time.Now().Format(time.RFC3339),
+    started := time.Now()
+    hits, total := conversations.search(query, filter, limit)
+    
+    results := make([]map[string]interface{}, 0, len(hits))
+    for _, hit := range hits {
+        tools := hit.Message.Tools
+        if tools == nil {
+            tools = []string{}
+        }
+        results = append(results, map[string]interface{}{
+            "conversation_id": hit.Message.ConversationID,
+            "message_id":      hit.Message.ID,
+            "role":            hit.Message.Role,
+            "snippet":         hit.Snippet,
+            "tools":           tools,
+            "timestamp":       hit.Message.Timestamp.Format(time.RFC3339),
+            "relevance":       hit.Score,
+        })
     }
     
     log.Get().WithFields(logrus.Fields{
-        "query":      query,
-        "limit":      limit,
-        "session_id": getSessionID(session),
+        "query":         query,
+        "limit":         limit,
+        "total_matches": total,
+        "session_id":    getSessionID(session),
     }).Info("Claude context search completed")
     
-    return mockResults, nil
+    return map[string]interface{}{
+        "query":          query,
+        "limit":          limit,
+        "results":        results,
+        "total_matches":  total,
+        "search_time_ms": time.Since(started).Milliseconds(),
+        "timestamp":      time.Now().Format(time.RFC3339),
+    }, nil
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+    rw.Header().Set("Content-Type", "application/json")
+    rw.WriteHeader(status)
+    json.NewEncoder(rw).Encode(v)
 }
 
 // getSessionID generates a session identifier for logging
@@ -369,5 +797,17 @@ func getSessionID(session *user.SessionState) string {
 }
 
 func init() {
-    log.Get().WithField("tools_count", len(MCPToolsRegistry)).Info("Tyk MCP Tools middleware loaded")
+    state, _ := buildMCPState(false)
+    activeState.Store(state)
+    syncFederation(state.config.Federation.Servers)
+    
+    go pollSubscribedResources()
+    go rollupAnalytics()
+    go consumeConversations()
+    go syncBlocklist()
+    go expireApprovals()
+    go expireJobs()
+    go watchMCPSources()
+
+    log.Get().WithField("tools_count", len(state.tools)).Info("Tyk MCP Tools middleware loaded")
 }
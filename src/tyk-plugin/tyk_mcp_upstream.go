@@ -0,0 +1,515 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/TykTechnologies/tyk/log"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/sirupsen/logrus"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/metric"
+)
+
+// UpstreamConfig controls retries and the circuit breaker of calls to an
+// upstream service. Durations are Go duration strings.
+type UpstreamConfig struct {
+    // MaxAttempts counts the first attempt; 1 disables retries
+    MaxAttempts int `json:"max_attempts"`
+    // BaseDelay doubles after each failed attempt, up to MaxDelay, and is
+    // jittered
+    BaseDelay string `json:"base_delay"`
+    MaxDelay  string `json:"max_delay"`
+    // MaxRetryAfter is the longest Retry-After or rate limit reset waited
+    // for; a longer one fails the call
+    MaxRetryAfter string `json:"max_retry_after"`
+    // FailureThreshold consecutive failures open a host's circuit
+    FailureThreshold int `json:"failure_threshold"`
+    // OpenFor is how long an open circuit rejects calls before probing
+    OpenFor string `json:"open_for"`
+    // HalfOpenProbes is how many calls may probe a half-open circuit at once
+    HalfOpenProbes int `json:"half_open_probes"`
+}
+
+// Circuit states, in the order reported by the circuit state metric
+const (
+    circuitClosed   = "closed"
+    circuitHalfOpen = "half_open"
+    circuitOpen     = "open"
+)
+
+var (
+    circuitStateValues = map[string]int64{circuitClosed: 0, circuitHalfOpen: 1, circuitOpen: 2}
+
+    errCircuitOpen = errors.New("circuit open")
+)
+
+// circuitBreaker tracks the health of one upstream host
+type circuitBreaker struct {
+    host     string
+    mu       sync.Mutex
+    state    string
+    failures int
+    openedAt time.Time
+    probes   int
+    // throttledUntil is when the host's rate limit allows calls again
+    throttledUntil time.Time
+    lastError      string
+}
+
+// resilientClient makes idempotent upstream calls with retries, backoff and
+// a circuit breaker per host
+type resilientClient struct {
+    name   string
+    config func() UpstreamConfig
+
+    mu       sync.Mutex
+    breakers map[string]*circuitBreaker
+
+    attempts metric.Int64Counter
+}
+
+// sentraIPClient makes the SentraIP lookups behind the threat tools
+var sentraIPClient = newResilientClient("sentraip", func() UpstreamConfig { return currentConfig().SentraIP.Upstream })
+
+func newResilientClient(name string, config func() UpstreamConfig) *resilientClient {
+    c := &resilientClient{name: name, config: config, breakers: map[string]*circuitBreaker{}}
+
+    meter := otel.Meter("tyk-mcp-gateway")
+    attempts, err := meter.Int64Counter(
+        "mcp.upstream.attempts",
+        metric.WithDescription("Upstream request attempts by host and outcome (success, retry, failure, rejected)"),
+    )
+    if err != nil {
+        log.Get().WithError(err).Warn("Failed to create upstream metrics")
+    }
+    c.attempts = attempts
+
+    _, err = meter.Int64ObservableGauge(
+        "mcp.upstream.circuit_state",
+        metric.WithDescription("Circuit breaker state per upstream host: 0 closed, 1 half open, 2 open"),
+        metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+            for host, status := range c.health() {
+                o.Observe(circuitStateValues[status.State], metric.WithAttributes(
+                    attribute.String("upstream", c.name),
+                    attribute.String("host", host),
+                ))
+            }
+            return nil
+        }),
+    )
+    if err != nil {
+        log.Get().WithError(err).Warn("Failed to create upstream circuit metrics")
+    }
+    return c
+}
+
+func (c *resilientClient) breaker(host string) *circuitBreaker {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    b, ok := c.breakers[host]
+    if !ok {
+        b = &circuitBreaker{host: host, state: circuitClosed}
+        c.breakers[host] = b
+    }
+    return b
+}
+
+func (c *resilientClient) record(ctx context.Context, host, outcome string) {
+    if c.attempts == nil {
+        return
+    }
+    c.attempts.Add(ctx, 1, metric.WithAttributes(
+        attribute.String("upstream", c.name),
+        attribute.String("host", host),
+        attribute.String("outcome", outcome),
+    ))
+}
+
+// Do sends req, retrying idempotent requests after transport errors, 429
+// and 502-504 responses. The returned response is the last one received,
+// which the caller must close; it may still be an error status.
+func (c *resilientClient) Do(req *http.Request) (*http.Response, error) {
+    ctx := req.Context()
+    cfg := c.config()
+    host := req.URL.Host
+    b := c.breaker(host)
+
+    attempts := cfg.MaxAttempts
+    if attempts < 1 || !idempotentMethod(req.Method) {
+        attempts = 1
+    }
+    maxRetryAfter := durationOr(cfg.MaxRetryAfter, 10*time.Second)
+
+    for attempt := 1; ; attempt++ {
+        if wait := b.throttled(); wait > 0 {
+            if wait > maxRetryAfter {
+                c.record(ctx, host, "rejected")
+                return nil, c.throttledError(host, wait)
+            }
+            if err := sleepContext(ctx, wait); err != nil {
+                return nil, err
+            }
+        }
+        if err := b.allow(cfg); err != nil {
+            c.record(ctx, host, "rejected")
+            return nil, c.openError(host, b)
+        }
+
+        attemptReq := req
+        if attempt > 1 {
+            attemptReq = req.Clone(ctx)
+            if req.GetBody != nil {
+                body, err := req.GetBody()
+                if err != nil {
+                    b.report(cfg, false, err.Error())
+                    return nil, err
+                }
+                attemptReq.Body = body
+            }
+        }
+
+        resp, err := upstreamClient.Do(attemptReq)
+        if ctx.Err() != nil {
+            // The caller gave up; that says nothing about the host
+            b.release()
+            if resp != nil {
+                resp.Body.Close()
+            }
+            return nil, ctx.Err()
+        }
+
+        retryable, failure := classifyUpstream(resp, err)
+        delay := backoffDelay(cfg, attempt)
+        if resp != nil {
+            if reset := rateLimitReset(resp.Header, time.Now()); reset > 0 {
+                b.throttle(reset)
+                if resp.StatusCode == http.StatusTooManyRequests {
+                    delay = reset
+                }
+            }
+        }
+        reason := ""
+        if failure {
+            reason = upstreamFailureReason(resp, err)
+        }
+        b.report(cfg, !failure, reason)
+
+        if !retryable || attempt >= attempts || delay > maxRetryAfter || !fitsDeadline(ctx, delay) {
+            outcome := "success"
+            if retryable || failure {
+                outcome = "failure"
+            }
+            c.record(ctx, host, outcome)
+            return resp, err
+        }
+
+        c.record(ctx, host, "retry")
+        log.Get().WithFields(logrus.Fields{
+            "upstream": c.name,
+            "host":     host,
+            "attempt":  attempt,
+            "delay":    delay.String(),
+            "reason":   upstreamFailureReason(resp, err),
+        }).Warn("Retrying upstream request")
+        if resp != nil {
+            io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+            resp.Body.Close()
+        }
+        if err := sleepContext(ctx, delay); err != nil {
+            return nil, err
+        }
+    }
+}
+
+func (c *resilientClient) openError(host string, b *circuitBreaker) error {
+    status := b.status(c.config())
+    return &ToolError{
+        Code:    toolErrorUpstream,
+        Message: fmt.Sprintf("%s is unavailable: circuit open for %s", c.name, host),
+        Details: map[string]interface{}{
+            "host":       host,
+            "circuit":    status.State,
+            "retry_at":   status.RetryAt,
+            "last_error": status.LastError,
+        },
+    }
+}
+
+func (c *resilientClient) throttledError(host string, wait time.Duration) error {
+    return &ToolError{
+        Code:    toolErrorUpstream,
+        Message: fmt.Sprintf("%s rate limit reached for %s", c.name, host),
+        Details: map[string]interface{}{
+            "host":        host,
+            "retry_after": retryAfterSeconds(wait),
+        },
+    }
+}
+
+// allow admits an attempt, or refuses it while the circuit is open. A
+// half-open circuit admits a limited number of probes.
+func (b *circuitBreaker) allow(cfg UpstreamConfig) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.state == circuitOpen && time.Since(b.openedAt) >= durationOr(cfg.OpenFor, 30*time.Second) {
+        b.state = circuitHalfOpen
+        b.probes = 0
+    }
+    switch b.state {
+    case circuitOpen:
+        return errCircuitOpen
+    case circuitHalfOpen:
+        limit := cfg.HalfOpenProbes
+        if limit < 1 {
+            limit = 1
+        }
+        if b.probes >= limit {
+            return errCircuitOpen
+        }
+        b.probes++
+    }
+    return nil
+}
+
+// report records the outcome of an admitted attempt
+func (b *circuitBreaker) report(cfg UpstreamConfig, success bool, reason string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.state == circuitHalfOpen && b.probes > 0 {
+        b.probes--
+    }
+    if success {
+        if b.state != circuitClosed {
+            log.Get().WithField("host", b.host).Info("Upstream circuit closed")
+        }
+        b.failures = 0
+        b.state = circuitClosed
+        return
+    }
+
+    b.failures++
+    b.lastError = reason
+    threshold := cfg.FailureThreshold
+    if threshold < 1 {
+        threshold = 5
+    }
+    if b.state == circuitHalfOpen || b.failures >= threshold {
+        if b.state != circuitOpen {
+            log.Get().WithFields(logrus.Fields{
+                "host":     b.host,
+                "failures": b.failures,
+                "reason":   reason,
+            }).Warn("Upstream circuit opened")
+        }
+        b.state = circuitOpen
+        b.openedAt = time.Now()
+    }
+}
+
+// release gives back an admitted attempt that ended without an outcome
+func (b *circuitBreaker) release() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.state == circuitHalfOpen && b.probes > 0 {
+        b.probes--
+    }
+}
+
+func (b *circuitBreaker) throttle(d time.Duration) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if until := time.Now().Add(d); until.After(b.throttledUntil) {
+        b.throttledUntil = until
+    }
+}
+
+func (b *circuitBreaker) throttled() time.Duration {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return time.Until(b.throttledUntil)
+}
+
+// circuitStatus is a host's entry in the health report
+type circuitStatus struct {
+    State               string `json:"state"`
+    ConsecutiveFailures int    `json:"consecutive_failures"`
+    LastError           string `json:"last_error,omitempty"`
+    OpenedAt            string `json:"opened_at,omitempty"`
+    // RetryAt is when an open circuit lets a probe through
+    RetryAt        string `json:"retry_at,omitempty"`
+    ThrottledUntil string `json:"throttled_until,omitempty"`
+}
+
+func (b *circuitBreaker) status(cfg UpstreamConfig) circuitStatus {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    status := circuitStatus{State: b.state, ConsecutiveFailures: b.failures, LastError: b.lastError}
+    if b.state == circuitOpen {
+        retryAt := b.openedAt.Add(durationOr(cfg.OpenFor, 30*time.Second))
+        if !time.Now().Before(retryAt) {
+            status.State = circuitHalfOpen
+        }
+        status.OpenedAt = b.openedAt.Format(time.RFC3339)
+        status.RetryAt = retryAt.Format(time.RFC3339)
+    }
+    if time.Now().Before(b.throttledUntil) {
+        status.ThrottledUntil = b.throttledUntil.Format(time.RFC3339)
+    }
+    return status
+}
+
+// health reports the circuit of every host the client has called
+func (c *resilientClient) health() map[string]circuitStatus {
+    c.mu.Lock()
+    hosts := make([]string, 0, len(c.breakers))
+    for host := range c.breakers {
+        hosts = append(hosts, host)
+    }
+    c.mu.Unlock()
+    sort.Strings(hosts)
+
+    cfg := c.config()
+    out := make(map[string]circuitStatus, len(hosts))
+    for _, host := range hosts {
+        out[host] = c.breaker(host).status(cfg)
+    }
+    return out
+}
+
+// classifyUpstream decides whether an attempt may be retried and whether
+// it counts against the host's circuit. Rate limiting is retried but is
+// not a failure: the host is healthy, only busy.
+func classifyUpstream(resp *http.Response, err error) (retryable, failure bool) {
+    if err != nil {
+        return true, true
+    }
+    switch resp.StatusCode {
+    case http.StatusTooManyRequests:
+        return true, false
+    case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+        return true, true
+    }
+    return false, resp.StatusCode >= 500
+}
+
+func upstreamFailureReason(resp *http.Response, err error) string {
+    if err != nil {
+        return err.Error()
+    }
+    return resp.Status
+}
+
+func idempotentMethod(method string) bool {
+    switch method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+        return true
+    }
+    return false
+}
+
+// backoffDelay is the jittered exponential delay after a failed attempt
+func backoffDelay(cfg UpstreamConfig, attempt int) time.Duration {
+    base := durationOr(cfg.BaseDelay, 200*time.Millisecond)
+    max := durationOr(cfg.MaxDelay, 5*time.Second)
+    delay := base << (attempt - 1)
+    if delay > max || delay <= 0 {
+        delay = max
+    }
+    // Equal jitter: half fixed, half random
+    return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// rateLimitReset reads how long the upstream asks us to wait, from
+// Retry-After (seconds or an HTTP date), or from an exhausted rate limit's
+// RateLimit-Reset / X-RateLimit-Reset (seconds, or a Unix time)
+func rateLimitReset(h http.Header, now time.Time) time.Duration {
+    if value := h.Get("Retry-After"); value != "" {
+        if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+            return time.Duration(seconds) * time.Second
+        }
+        if at, err := http.ParseTime(value); err == nil {
+            return at.Sub(now)
+        }
+    }
+
+    remaining := h.Get("RateLimit-Remaining")
+    if remaining == "" {
+        remaining = h.Get("X-RateLimit-Remaining")
+    }
+    if remaining != "0" {
+        return 0
+    }
+    reset := h.Get("RateLimit-Reset")
+    if reset == "" {
+        reset = h.Get("X-RateLimit-Reset")
+    }
+    seconds, err := strconv.ParseInt(reset, 10, 64)
+    if err != nil || seconds <= 0 {
+        return 0
+    }
+    // Values this large are Unix times rather than delays
+    if seconds > 1_000_000_000 {
+        return time.Unix(seconds, 0).Sub(now)
+    }
+    return time.Duration(seconds) * time.Second
+}
+
+// fitsDeadline reports whether ctx leaves time to wait d and try again
+func fitsDeadline(ctx context.Context, d time.Duration) bool {
+    deadline, ok := ctx.Deadline()
+    return !ok || time.Until(deadline) > d
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-timer.C:
+        return nil
+    }
+}
+
+// handleHealth serves GET /mcp/health: the circuit breaker of each
+// upstream host and the state of each federated MCP server. It answers 200
+// even when a circuit is open, so probes do not restart gateways over an
+// upstream outage.
+func handleHealth(rw http.ResponseWriter, r *http.Request, session *user.SessionState) {
+    status := "ok"
+    upstreams := map[string]interface{}{}
+    for _, client := range []*resilientClient{sentraIPClient, federationClient} {
+        hosts := client.health()
+        for _, host := range hosts {
+            if host.State != circuitClosed || host.ThrottledUntil != "" {
+                status = "degraded"
+            }
+        }
+        upstreams[client.name] = hosts
+    }
+    servers := federationStatus()
+    for _, server := range servers {
+        if _, failing := server["last_error"]; failing {
+            status = "degraded"
+        }
+    }
+    writeJSON(rw, http.StatusOK, map[string]interface{}{
+        "status":     status,
+        "upstreams":  upstreams,
+        "federation": servers,
+        "timestamp":  time.Now().Format(time.RFC3339),
+    })
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+    cfg := UpstreamConfig{FailureThreshold: 3, OpenFor: "1m", HalfOpenProbes: 2}
+
+    // Each step acts on the breaker, then checks its state
+    type step struct {
+        action    string // "allow", "fail", "succeed", "release" or "expire"
+        wantErr   error
+        wantState string
+    }
+    tests := []struct {
+        name  string
+        steps []step
+    }{
+        {
+            name: "failures below threshold stay closed",
+            steps: []step{
+                {action: "fail", wantState: circuitClosed},
+                {action: "fail", wantState: circuitClosed},
+                {action: "allow", wantState: circuitClosed},
+            },
+        },
+        {
+            name: "success resets the count",
+            steps: []step{
+                {action: "fail", wantState: circuitClosed},
+                {action: "fail", wantState: circuitClosed},
+                {action: "succeed", wantState: circuitClosed},
+                {action: "fail", wantState: circuitClosed},
+                {action: "fail", wantState: circuitClosed},
+            },
+        },
+        {
+            name: "threshold opens",
+            steps: []step{
+                {action: "fail", wantState: circuitClosed},
+                {action: "fail", wantState: circuitClosed},
+                {action: "fail", wantState: circuitOpen},
+                {action: "allow", wantErr: errCircuitOpen, wantState: circuitOpen},
+            },
+        },
+        {
+            name: "half open admits limited probes",
+            steps: []step{
+                {action: "fail"}, {action: "fail"}, {action: "fail", wantState: circuitOpen},
+                {action: "expire", wantState: circuitOpen},
+                {action: "allow", wantState: circuitHalfOpen},
+                {action: "allow", wantState: circuitHalfOpen},
+                {action: "allow", wantErr: errCircuitOpen, wantState: circuitHalfOpen},
+                {action: "release", wantState: circuitHalfOpen},
+                {action: "allow", wantState: circuitHalfOpen},
+            },
+        },
+        {
+            name: "probe success closes",
+            steps: []step{
+                {action: "fail"}, {action: "fail"}, {action: "fail", wantState: circuitOpen},
+                {action: "expire"},
+                {action: "allow", wantState: circuitHalfOpen},
+                {action: "succeed", wantState: circuitClosed},
+                {action: "allow", wantState: circuitClosed},
+            },
+        },
+        {
+            name: "probe failure reopens",
+            steps: []step{
+                {action: "fail"}, {action: "fail"}, {action: "fail", wantState: circuitOpen},
+                {action: "expire"},
+                {action: "allow", wantState: circuitHalfOpen},
+                {action: "fail", wantState: circuitOpen},
+                {action: "allow", wantErr: errCircuitOpen, wantState: circuitOpen},
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := &circuitBreaker{host: "sentraip.test", state: circuitClosed}
+            for i, s := range tt.steps {
+                var err error
+                switch s.action {
+                case "allow":
+                    err = b.allow(cfg)
+                case "fail":
+                    b.report(cfg, false, "status 503")
+                case "succeed":
+                    b.report(cfg, true, "")
+                case "release":
+                    b.release()
+                case "expire":
+                    b.openedAt = b.openedAt.Add(-time.Minute)
+                }
+                if !errors.Is(err, s.wantErr) {
+                    t.Fatalf("step %d (%s): error %v, want %v", i, s.action, err, s.wantErr)
+                }
+                if s.wantState != "" && b.state != s.wantState {
+                    t.Fatalf("step %d (%s): state %s, want %s", i, s.action, b.state, s.wantState)
+                }
+            }
+        })
+    }
+}
+
+func TestCircuitBreakerStatus(t *testing.T) {
+    cfg := UpstreamConfig{OpenFor: "1m"}
+
+    tests := []struct {
+        name      string
+        state     string
+        openedAt  time.Time
+        wantState string
+        wantRetry bool
+    }{
+        {name: "closed", state: circuitClosed, wantState: circuitClosed},
+        {name: "open", state: circuitOpen, openedAt: time.Now(), wantState: circuitOpen, wantRetry: true},
+        {name: "open past its time reports half open", state: circuitOpen, openedAt: time.Now().Add(-2 * time.Minute), wantState: circuitHalfOpen, wantRetry: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := &circuitBreaker{state: tt.state, openedAt: tt.openedAt}
+            status := b.status(cfg)
+            if status.State != tt.wantState {
+                t.Fatalf("state %s, want %s", status.State, tt.wantState)
+            }
+            if (status.RetryAt != "") != tt.wantRetry {
+                t.Fatalf("retry_at %q, want set = %v", status.RetryAt, tt.wantRetry)
+            }
+        })
+    }
+}
+
+func TestRateLimitReset(t *testing.T) {
+    now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+    tests := []struct {
+        name   string
+        header map[string]string
+        want   time.Duration
+    }{
+        {name: "none", want: 0},
+        {name: "retry after seconds", header: map[string]string{"Retry-After": "7"}, want: 7 * time.Second},
+        {name: "retry after date", header: map[string]string{"Retry-After": now.Add(90 * time.Second).Format(http.TimeFormat)}, want: 90 * time.Second},
+        {name: "reset without exhaustion", header: map[string]string{"RateLimit-Remaining": "3", "RateLimit-Reset": "20"}, want: 0},
+        {name: "reset delay", header: map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "20"}, want: 20 * time.Second},
+        {name: "legacy reset delay", header: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "5"}, want: 5 * time.Second},
+        {name: "reset unix time", header: map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "1767323105"}, want: 60 * time.Second},
+        {name: "invalid reset", header: map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "soon"}, want: 0},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            h := http.Header{}
+            for k, v := range tt.header {
+                h.Set(k, v)
+            }
+            if got := rateLimitReset(h, now); got != tt.want {
+                t.Fatalf("rateLimitReset = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestClassifyUpstream(t *testing.T) {
+    tests := []struct {
+        name          string
+        status        int
+        err           error
+        wantRetryable bool
+        wantFailure   bool
+    }{
+        {name: "transport error", err: errors.New("connection refused"), wantRetryable: true, wantFailure: true},
+        {name: "ok", status: http.StatusOK},
+        {name: "not found", status: http.StatusNotFound},
+        {name: "rate limited", status: http.StatusTooManyRequests, wantRetryable: true},
+        {name: "bad gateway", status: http.StatusBadGateway, wantRetryable: true, wantFailure: true},
+        {name: "unavailable", status: http.StatusServiceUnavailable, wantRetryable: true, wantFailure: true},
+        {name: "internal error", status: http.StatusInternalServerError, wantFailure: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var resp *http.Response
+            if tt.err == nil {
+                resp = &http.Response{StatusCode: tt.status}
+            }
+            retryable, failure := classifyUpstream(resp, tt.err)
+            if retryable != tt.wantRetryable || failure != tt.wantFailure {
+                t.Fatalf("classifyUpstream = (%v, %v), want (%v, %v)", retryable, failure, tt.wantRetryable, tt.wantFailure)
+            }
+        })
+    }
+}
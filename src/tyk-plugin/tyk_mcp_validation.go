@@ -0,0 +1,451 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net"
+    "net/mail"
+    "net/url"
+    "reflect"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+// ValidationError describes one argument that does not match a tool's
+// input schema. Pointer is an RFC 6901 JSON pointer into the arguments.
+type ValidationError struct {
+    Pointer string `json:"pointer"`
+    Message string `json:"message"`
+}
+
+// ValidationErrors is returned by validateToolArguments when one or more
+// arguments are invalid
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+    parts := make([]string, 0, len(e))
+    for _, v := range e {
+        pointer := v.Pointer
+        if pointer == "" {
+            pointer = "/"
+        }
+        parts = append(parts, fmt.Sprintf("%s: %s", pointer, v.Message))
+    }
+    return "invalid arguments: " + strings.Join(parts, "; ")
+}
+
+var (
+    hostnameRegex = regexp.MustCompile(`^(?i:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?)(?:\.(?i:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?))*$`)
+
+    // patternCache avoids recompiling schema patterns on every call
+    patternCache sync.Map
+)
+
+// toolArgumentNormalizers run after schema validation for checks a schema
+// cannot express. They return the arguments to execute with, or
+// ValidationErrors.
+var toolArgumentNormalizers = map[string]func(params map[string]interface{}) (map[string]interface{}, error){}
+
+// maxSchemaDepth bounds $ref recursion so a cyclic schema cannot loop forever
+const maxSchemaDepth = 32
+
+// validateToolArguments checks params against schema, filling in defaults
+// for missing optional properties at every level. It returns the arguments
+// to execute with.
+func validateToolArguments(schema InputSchema, params map[string]interface{}) (map[string]interface{}, error) {
+    if params == nil {
+        params = map[string]interface{}{}
+    }
+
+    v := schemaValidator{root: &schema}
+    errs := v.validate("", schema, params, true, 0)
+    if len(errs) > 0 {
+        return nil, errs
+    }
+    return params, nil
+}
+
+type schemaValidator struct {
+    root *InputSchema
+}
+
+// validate checks value against s. Defaults are only written when
+// applyDefaults is set, so tentative oneOf/anyOf branches leave the
+// arguments untouched.
+func (v schemaValidator) validate(pointer string, s Property, value interface{}, applyDefaults bool, depth int) ValidationErrors {
+    fail := func(format string, args ...interface{}) ValidationErrors {
+        return ValidationErrors{{Pointer: pointer, Message: fmt.Sprintf(format, args...)}}
+    }
+
+    if depth > maxSchemaDepth {
+        return fail("schema nesting is too deep")
+    }
+    if s.Bool != nil {
+        if !*s.Bool {
+            return fail("is not allowed")
+        }
+        return nil
+    }
+
+    var errs ValidationErrors
+
+    if s.Ref != "" {
+        target, err := resolveRef(v.root, s.Ref)
+        if err != nil {
+            return fail("%v", err)
+        }
+        errs = append(errs, v.validate(pointer, *target, value, applyDefaults, depth+1)...)
+    }
+
+    if types := s.schemaTypes(); len(types) > 0 {
+        matched := false
+        for _, t := range types {
+            if matchesType(t, value) {
+                matched = true
+                break
+            }
+        }
+        if !matched && !(value == nil && isNullable(s)) {
+            return append(errs, fail("must be of type %s, got %s", strings.Join(types, " or "), jsonTypeOf(value))...)
+        }
+    }
+
+    if len(s.Enum) > 0 {
+        matched := false
+        for _, allowed := range s.Enum {
+            if reflect.DeepEqual(normalizeJSONValue(allowed), value) {
+                matched = true
+                break
+            }
+        }
+        if !matched {
+            return append(errs, fail("must be one of %s", compactJSON(s.Enum))...)
+        }
+    }
+    if s.Const != nil && !reflect.DeepEqual(normalizeJSONValue(s.Const), value) {
+        return append(errs, fail("must be %s", compactJSON(s.Const))...)
+    }
+    if raw, ok := s.Extra["const"]; ok && strings.TrimSpace(string(raw)) == "null" && value != nil {
+        return append(errs, fail("must be null")...)
+    }
+
+    switch val := value.(type) {
+    case string:
+        errs = append(errs, v.validateString(pointer, s, val)...)
+    case float64:
+        errs = append(errs, v.validateNumber(pointer, s, val)...)
+    case []interface{}:
+        errs = append(errs, v.validateArray(pointer, s, val, applyDefaults, depth)...)
+    case map[string]interface{}:
+        errs = append(errs, v.validateObject(pointer, s, val, applyDefaults, depth)...)
+    }
+
+    for _, sub := range s.AllOf {
+        errs = append(errs, v.validate(pointer, sub, value, applyDefaults, depth+1)...)
+    }
+    if len(s.AnyOf) > 0 && v.countMatches(pointer, s.AnyOf, value, depth) == 0 {
+        errs = append(errs, fail("must match at least one schema in anyOf")...)
+    }
+    if len(s.OneOf) > 0 {
+        if n := v.countMatches(pointer, s.OneOf, value, depth); n != 1 {
+            errs = append(errs, fail("must match exactly one schema in oneOf, matched %d", n)...)
+        }
+    }
+    if s.Not != nil && len(v.validate(pointer, *s.Not, value, false, depth+1)) == 0 {
+        errs = append(errs, fail("must not match the schema in not")...)
+    }
+
+    return errs
+}
+
+func (v schemaValidator) countMatches(pointer string, schemas []Property, value interface{}, depth int) int {
+    matches := 0
+    for _, sub := range schemas {
+        if len(v.validate(pointer, sub, value, false, depth+1)) == 0 {
+            matches++
+        }
+    }
+    return matches
+}
+
+func (v schemaValidator) validateString(pointer string, s Property, value string) ValidationErrors {
+    fail := func(format string, args ...interface{}) ValidationErrors {
+        return ValidationErrors{{Pointer: pointer, Message: fmt.Sprintf(format, args...)}}
+    }
+
+    length := utf8.RuneCountInString(value)
+    if s.MinLength != nil && length < *s.MinLength {
+        return fail("must be at least %d characters long", *s.MinLength)
+    }
+    if s.MaxLength != nil && length > *s.MaxLength {
+        return fail("must be at most %d characters long", *s.MaxLength)
+    }
+    if s.Pattern != "" {
+        re, err := compilePattern(s.Pattern)
+        if err != nil {
+            return fail("schema pattern is invalid: %v", err)
+        }
+        if !re.MatchString(value) {
+            return fail("must match pattern %s", s.Pattern)
+        }
+    }
+    if s.Format != "" {
+        if err := checkFormat(s.Format, value); err != nil {
+            return fail("%v", err)
+        }
+    }
+    return nil
+}
+
+func (v schemaValidator) validateNumber(pointer string, s Property, value float64) ValidationErrors {
+    fail := func(format string, args ...interface{}) ValidationErrors {
+        return ValidationErrors{{Pointer: pointer, Message: fmt.Sprintf(format, args...)}}
+    }
+
+    if s.Minimum != nil && value < *s.Minimum {
+        return fail("must be >= %v", *s.Minimum)
+    }
+    if s.Maximum != nil && value > *s.Maximum {
+        return fail("must be <= %v", *s.Maximum)
+    }
+    if s.ExclusiveMinimum != nil && value <= *s.ExclusiveMinimum {
+        return fail("must be > %v", *s.ExclusiveMinimum)
+    }
+    if s.ExclusiveMaximum != nil && value >= *s.ExclusiveMaximum {
+        return fail("must be < %v", *s.ExclusiveMaximum)
+    }
+    if s.MultipleOf != nil && *s.MultipleOf > 0 {
+        if q := value / *s.MultipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+            return fail("must be a multiple of %v", *s.MultipleOf)
+        }
+    }
+    return nil
+}
+
+func (v schemaValidator) validateArray(pointer string, s Property, items []interface{}, applyDefaults bool, depth int) ValidationErrors {
+    var errs ValidationErrors
+
+    if s.MinItems != nil && len(items) < *s.MinItems {
+        errs = append(errs, ValidationError{Pointer: pointer, Message: fmt.Sprintf("must contain at least %d items", *s.MinItems)})
+    }
+    if s.MaxItems != nil && len(items) > *s.MaxItems {
+        errs = append(errs, ValidationError{Pointer: pointer, Message: fmt.Sprintf("must contain at most %d items", *s.MaxItems)})
+    }
+    if s.UniqueItems {
+        for i := range items {
+            for j := 0; j < i; j++ {
+                if reflect.DeepEqual(items[i], items[j]) {
+                    errs = append(errs, ValidationError{
+                        Pointer: jsonPointer(pointer, strconv.Itoa(i)),
+                        Message: fmt.Sprintf("duplicates item %d", j),
+                    })
+                    break
+                }
+            }
+        }
+    }
+    for i, item := range items {
+        var itemSchema *Property
+        switch {
+        case i < len(s.PrefixItems):
+            itemSchema = &s.PrefixItems[i]
+        case s.Items != nil:
+            itemSchema = s.Items
+        default:
+            continue
+        }
+        errs = append(errs, v.validate(jsonPointer(pointer, strconv.Itoa(i)), *itemSchema, item, applyDefaults, depth+1)...)
+    }
+    return errs
+}
+
+func (v schemaValidator) validateObject(pointer string, s Property, obj map[string]interface{}, applyDefaults bool, depth int) ValidationErrors {
+    var errs ValidationErrors
+
+    for _, name := range s.Required {
+        if value, ok := obj[name]; !ok || value == nil {
+            errs = append(errs, ValidationError{Pointer: jsonPointer(pointer, name), Message: "is required"})
+        }
+    }
+
+    for _, name := range sortedKeys(s.Properties) {
+        prop := s.Properties[name]
+        value, ok := obj[name]
+        if !ok || value == nil {
+            if applyDefaults && prop.Default != nil {
+                obj[name] = normalizeJSONValue(prop.Default)
+            }
+            continue
+        }
+        errs = append(errs, v.validate(jsonPointer(pointer, name), prop, value, applyDefaults, depth+1)...)
+    }
+
+    if s.AdditionalProperties != nil {
+        extra := make([]string, 0)
+        for name := range obj {
+            if _, declared := s.Properties[name]; !declared {
+                extra = append(extra, name)
+            }
+        }
+        sort.Strings(extra)
+        for _, name := range extra {
+            if s.AdditionalProperties.Bool != nil && !*s.AdditionalProperties.Bool {
+                errs = append(errs, ValidationError{Pointer: jsonPointer(pointer, name), Message: "is not a recognised property"})
+                continue
+            }
+            errs = append(errs, v.validate(jsonPointer(pointer, name), *s.AdditionalProperties, obj[name], applyDefaults, depth+1)...)
+        }
+    }
+
+    if s.MinProperties != nil && len(obj) < *s.MinProperties {
+        errs = append(errs, ValidationError{Pointer: pointer, Message: fmt.Sprintf("must have at least %d properties", *s.MinProperties)})
+    }
+    if s.MaxProperties != nil && len(obj) > *s.MaxProperties {
+        errs = append(errs, ValidationError{Pointer: pointer, Message: fmt.Sprintf("must have at most %d properties", *s.MaxProperties)})
+    }
+    return errs
+}
+
+// isNullable honours the OpenAPI 3.0 "nullable" keyword carried in Extra
+func isNullable(s Property) bool {
+    raw, ok := s.Extra["nullable"]
+    return ok && strings.TrimSpace(string(raw)) == "true"
+}
+
+func sortedKeys(m map[string]Property) []string {
+    keys := make([]string, 0, len(m))
+    for key := range m {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func compactJSON(v interface{}) string {
+    encoded, err := json.Marshal(v)
+    if err != nil {
+        return fmt.Sprint(v)
+    }
+    return string(encoded)
+}
+
+func matchesType(schemaType string, value interface{}) bool {
+    switch schemaType {
+    case "string":
+        _, ok := value.(string)
+        return ok
+    case "number":
+        _, ok := value.(float64)
+        return ok
+    case "integer":
+        f, ok := value.(float64)
+        return ok && f == math.Trunc(f) && !math.IsInf(f, 0)
+    case "boolean":
+        _, ok := value.(bool)
+        return ok
+    case "object":
+        _, ok := value.(map[string]interface{})
+        return ok
+    case "array":
+        _, ok := value.([]interface{})
+        return ok
+    case "null":
+        return value == nil
+    }
+    return true
+}
+
+func jsonTypeOf(value interface{}) string {
+    switch v := value.(type) {
+    case nil:
+        return "null"
+    case string:
+        return "string"
+    case bool:
+        return "boolean"
+    case float64:
+        if v == math.Trunc(v) {
+            return "integer"
+        }
+        return "number"
+    case map[string]interface{}:
+        return "object"
+    case []interface{}:
+        return "array"
+    }
+    return fmt.Sprintf("%T", value)
+}
+
+func checkFormat(format, value string) error {
+    switch format {
+    case "ipv4":
+        if ip := net.ParseIP(value); ip == nil || ip.To4() == nil || strings.Contains(value, ":") {
+            return fmt.Errorf("must be a valid IPv4 address")
+        }
+    case "ipv6":
+        if ip := net.ParseIP(value); ip == nil || !strings.Contains(value, ":") {
+            return fmt.Errorf("must be a valid IPv6 address")
+        }
+    case "hostname":
+        if len(value) > 253 || !hostnameRegex.MatchString(strings.TrimSuffix(value, ".")) {
+            return fmt.Errorf("must be a valid hostname")
+        }
+    case "date-time":
+        if _, err := time.Parse(time.RFC3339, value); err != nil {
+            return fmt.Errorf("must be an RFC 3339 date-time")
+        }
+    case "date":
+        if _, err := time.Parse("2006-01-02", value); err != nil {
+            return fmt.Errorf("must be a full-date (YYYY-MM-DD)")
+        }
+    case "uri":
+        if u, err := url.Parse(value); err != nil || !u.IsAbs() {
+            return fmt.Errorf("must be an absolute URI")
+        }
+    case "email":
+        if _, err := mail.ParseAddress(value); err != nil {
+            return fmt.Errorf("must be a valid email address")
+        }
+    }
+    // Unknown formats are annotations only, as in JSON Schema
+    return nil
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+    if cached, ok := patternCache.Load(pattern); ok {
+        return cached.(*regexp.Regexp), nil
+    }
+    re, err := regexp.Compile(pattern)
+    if err != nil {
+        return nil, err
+    }
+    patternCache.Store(pattern, re)
+    return re, nil
+}
+
+// normalizeJSONValue round-trips v through encoding/json so Go literals
+// such as int defaults look the same as decoded request arguments
+func normalizeJSONValue(v interface{}) interface{} {
+    encoded, err := json.Marshal(v)
+    if err != nil {
+        return v
+    }
+    var out interface{}
+    if err := json.Unmarshal(encoded, &out); err != nil {
+        return v
+    }
+    return out
+}
+
+// jsonPointer appends an escaped reference token to a JSON pointer
+func jsonPointer(base, token string) string {
+    token = strings.ReplaceAll(token, "~", "~0")
+    token = strings.ReplaceAll(token, "/", "~1")
+    return base + "/" + token
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+func TestValidateToolArguments(t *testing.T) {
+    tests := []struct {
+        name   string
+        schema string
+        args   string
+        // want is the arguments after defaults are applied, when valid
+        want string
+        // wantErr is the error's text, without the "invalid arguments: "
+        // prefix
+        wantErr string
+    }{
+        // Types
+        {name: "type", schema: `{"type":"string"}`, args: `{}`, wantErr: "/: must be of type string, got object"},
+        {name: "integer", schema: `{"properties":{"n":{"type":"integer"}}}`, args: `{"n":1.5}`, wantErr: "/n: must be of type integer, got number"},
+        {name: "type union", schema: `{"properties":{"v":{"type":["string","null"]}}}`, args: `{"v":true}`, wantErr: "/v: must be of type string or null, got boolean"},
+        {name: "nullable", schema: `{"properties":{"v":{"type":"string","nullable":true}},"required":[]}`, args: `{"v":null}`, want: `{"v":null}`},
+
+        // Generic keywords
+        {name: "enum", schema: `{"properties":{"t":{"enum":["ip","domain"]}}}`, args: `{"t":"url"}`, wantErr: `/t: must be one of ["ip","domain"]`},
+        {name: "const", schema: `{"properties":{"v":{"const":2}}}`, args: `{"v":3}`, wantErr: "/v: must be 2"},
+        {name: "const null", schema: `{"properties":{"v":{"const":null}}}`, args: `{"v":0}`, wantErr: "/v: must be null"},
+        {name: "boolean false schema", schema: `{"properties":{"v":false}}`, args: `{"v":1}`, wantErr: "/v: is not allowed"},
+
+        // Strings
+        {name: "minLength counts characters", schema: `{"properties":{"s":{"minLength":3}}}`, args: `{"s":"éé"}`, wantErr: "/s: must be at least 3 characters long"},
+        {name: "maxLength", schema: `{"properties":{"s":{"maxLength":2}}}`, args: `{"s":"abc"}`, wantErr: "/s: must be at most 2 characters long"},
+        {name: "pattern", schema: `{"properties":{"s":{"pattern":"^[a-z]+$"}}}`, args: `{"s":"A1"}`, wantErr: "/s: must match pattern ^[a-z]+$"},
+        {name: "pattern is unanchored", schema: `{"properties":{"s":{"pattern":"[0-9]"}}}`, args: `{"s":"a1b"}`, want: `{"s":"a1b"}`},
+        {name: "format ipv4", schema: `{"properties":{"s":{"format":"ipv4"}}}`, args: `{"s":"1.2.3"}`, wantErr: "/s: must be a valid IPv4 address"},
+        {name: "format date-time", schema: `{"properties":{"s":{"format":"date-time"}}}`, args: `{"s":"2026-10-18"}`, wantErr: "/s: must be an RFC 3339 date-time"},
+        {name: "unknown format", schema: `{"properties":{"s":{"format":"color"}}}`, args: `{"s":"red"}`, want: `{"s":"red"}`},
+        {name: "format email", schema: `{"properties":{"s":{"format":"email"}}}`, args: `{"s":"a@example.com"}`, want: `{"s":"a@example.com"}`},
+
+        // Numbers
+        {name: "minimum", schema: `{"properties":{"n":{"minimum":1}}}`, args: `{"n":0}`, wantErr: "/n: must be >= 1"},
+        {name: "maximum", schema: `{"properties":{"n":{"maximum":10}}}`, args: `{"n":10}`, want: `{"n":10}`},
+        {name: "exclusiveMinimum", schema: `{"properties":{"n":{"exclusiveMinimum":0}}}`, args: `{"n":0}`, wantErr: "/n: must be > 0"},
+        {name: "exclusiveMaximum", schema: `{"properties":{"n":{"exclusiveMaximum":10}}}`, args: `{"n":10}`, wantErr: "/n: must be < 10"},
+        {name: "draft 4 exclusiveMaximum", schema: `{"properties":{"n":{"maximum":10,"exclusiveMaximum":true}}}`, args: `{"n":10}`, wantErr: "/n: must be < 10"},
+        {name: "draft 4 inclusive", schema: `{"properties":{"n":{"minimum":1,"exclusiveMinimum":false}}}`, args: `{"n":1}`, want: `{"n":1}`},
+        {name: "multipleOf", schema: `{"properties":{"n":{"multipleOf":0.1}}}`, args: `{"n":0.3}`, want: `{"n":0.3}`},
+        {name: "not a multiple", schema: `{"properties":{"n":{"multipleOf":5}}}`, args: `{"n":12}`, wantErr: "/n: must be a multiple of 5"},
+
+        // Arrays
+        {name: "minItems", schema: `{"properties":{"a":{"minItems":2}}}`, args: `{"a":[1]}`, wantErr: "/a: must contain at least 2 items"},
+        {name: "maxItems", schema: `{"properties":{"a":{"maxItems":1}}}`, args: `{"a":[1,2]}`, wantErr: "/a: must contain at most 1 items"},
+        {name: "uniqueItems", schema: `{"properties":{"a":{"uniqueItems":true}}}`, args: `{"a":[1,2,1]}`, wantErr: "/a/2: duplicates item 0"},
+        {name: "items", schema: `{"properties":{"a":{"items":{"type":"string"}}}}`, args: `{"a":["x",2]}`, wantErr: "/a/1: must be of type string, got integer"},
+        {
+            name:    "prefixItems",
+            schema:  `{"properties":{"a":{"prefixItems":[{"type":"string"},{"type":"integer"}],"items":false}}}`,
+            args:    `{"a":["x",1,true]}`,
+            wantErr: "/a/2: is not allowed",
+        },
+        {
+            name:    "draft 4 tuple",
+            schema:  `{"properties":{"a":{"items":[{"type":"string"},{"type":"integer"}],"additionalItems":{"type":"boolean"}}}}`,
+            args:    `{"a":["x","y",true]}`,
+            wantErr: "/a/1: must be of type integer, got string",
+        },
+        {
+            name:   "tuple rest",
+            schema: `{"properties":{"a":{"items":[{"type":"string"}],"additionalItems":{"type":"boolean"}}}}`,
+            args:   `{"a":["x",true,false]}`,
+            want:   `{"a":["x",true,false]}`,
+        },
+
+        // Objects
+        {name: "required", schema: `{"properties":{"a":{}},"required":["a","b"]}`, args: `{"a":1}`, wantErr: "/b: is required"},
+        {name: "required null", schema: `{"required":["a"]}`, args: `{"a":null}`, wantErr: "/a: is required"},
+        {name: "additionalProperties false", schema: `{"properties":{"a":{}},"additionalProperties":false}`, args: `{"a":1,"z":2,"b":3}`, wantErr: "/b: is not a recognised property; /z: is not a recognised property"},
+        {name: "additionalProperties schema", schema: `{"additionalProperties":{"type":"number"}}`, args: `{"a":"x"}`, wantErr: "/a: must be of type number, got string"},
+        {name: "minProperties", schema: `{"minProperties":1}`, args: `{}`, wantErr: "/: must have at least 1 properties"},
+        {name: "maxProperties", schema: `{"maxProperties":1}`, args: `{"a":1,"b":2}`, wantErr: "/: must have at most 1 properties"},
+        {name: "escaped pointer", schema: `{"properties":{"a/b~c":{"type":"string"}}}`, args: `{"a/b~c":1}`, wantErr: "/a~1b~0c: must be of type string, got integer"},
+
+        // Defaults
+        {name: "default", schema: `{"properties":{"limit":{"type":"integer","default":10}}}`, args: `{}`, want: `{"limit":10}`},
+        {name: "nested default", schema: `{"properties":{"o":{"properties":{"d":{"default":"x"}}}}}`, args: `{"o":{}}`, want: `{"o":{"d":"x"}}`},
+        {name: "default does not override", schema: `{"properties":{"limit":{"default":10}}}`, args: `{"limit":3}`, want: `{"limit":3}`},
+
+        // Composition
+        {name: "anyOf", schema: `{"properties":{"v":{"anyOf":[{"type":"string"},{"type":"integer"}]}}}`, args: `{"v":true}`, wantErr: "/v: must match at least one schema in anyOf"},
+        {name: "oneOf none", schema: `{"properties":{"v":{"oneOf":[{"type":"string"},{"type":"integer"}]}}}`, args: `{"v":true}`, wantErr: "/v: must match exactly one schema in oneOf, matched 0"},
+        {name: "oneOf both", schema: `{"properties":{"v":{"oneOf":[{"type":"number"},{"type":"integer"}]}}}`, args: `{"v":1}`, wantErr: "/v: must match exactly one schema in oneOf, matched 2"},
+        {name: "allOf", schema: `{"properties":{"v":{"allOf":[{"minimum":1},{"maximum":2}]}}}`, args: `{"v":3}`, wantErr: "/v: must be <= 2"},
+        {name: "not matched", schema: `{"properties":{"v":{"not":{"type":"string"}}}}`, args: `{"v":"x"}`, wantErr: "/v: must not match the schema in not"},
+        {name: "oneOf branch defaults are not applied", schema: `{"properties":{"v":{"oneOf":[{"properties":{"d":{"default":1}}}]}}}`, args: `{"v":{}}`, want: `{"v":{}}`},
+
+        // References
+        {name: "ref", schema: `{"$defs":{"port":{"type":"integer","maximum":65535}},"properties":{"p":{"$ref":"#/$defs/port"}}}`, args: `{"p":70000}`, wantErr: "/p: must be <= 65535"},
+        {name: "cyclic ref", schema: `{"$defs":{"loop":{"$ref":"#/$defs/loop"}},"properties":{"v":{"$ref":"#/$defs/loop"}}}`, args: `{"v":1}`, wantErr: "/v: schema nesting is too deep"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var schema InputSchema
+            if err := json.Unmarshal([]byte(tt.schema), &schema); err != nil {
+                t.Fatalf("schema: %v", err)
+            }
+            var args map[string]interface{}
+            if err := json.Unmarshal([]byte(tt.args), &args); err != nil {
+                t.Fatalf("args: %v", err)
+            }
+
+            got, err := validateToolArguments(schema, args)
+            if tt.wantErr != "" {
+                if err == nil {
+                    t.Fatalf("expected error %q", tt.wantErr)
+                }
+                if msg := err.Error(); msg != "invalid arguments: "+tt.wantErr {
+                    t.Fatalf("error %q, want %q", msg, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if tt.want == "" {
+                return
+            }
+            if encoded, _ := json.Marshal(got); string(encoded) != tt.want {
+                t.Fatalf("arguments %s, want %s", encoded, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+)
+
+// ToolAnnotations are the MCP hints describing how a tool behaves. Unset
+// hints take the MCP defaults: not read-only, destructive, not idempotent
+// and open world.
+type ToolAnnotations struct {
+    ReadOnlyHint    *bool `json:"readOnlyHint,omitempty"`
+    DestructiveHint *bool `json:"destructiveHint,omitempty"`
+    IdempotentHint  *bool `json:"idempotentHint,omitempty"`
+    OpenWorldHint   *bool `json:"openWorldHint,omitempty"`
+}
+
+// ToolDeprecation marks a tool version as deprecated. It is still listed
+// and callable; calls report the deprecation alongside their result.
+type ToolDeprecation struct {
+    Message string `json:"message,omitempty"`
+    // ReplacedBy names the tool to use instead, optionally as name@version
+    ReplacedBy string `json:"replacedBy,omitempty"`
+    // Sunset is the date (YYYY-MM-DD) after which the version may be removed
+    Sunset string `json:"sunset,omitempty"`
+}
+
+// defaultToolVersion is the version of tools that do not declare one
+const defaultToolVersion = "1.0.0"
+
+// Annotations shared by the built-in tools
+var (
+    // externalLookupAnnotations is for read-only queries of outside services
+    externalLookupAnnotations = &ToolAnnotations{ReadOnlyHint: boolPtr(true), OpenWorldHint: boolPtr(true)}
+    // gatewayReadAnnotations is for read-only queries of gateway data
+    gatewayReadAnnotations = &ToolAnnotations{ReadOnlyHint: boolPtr(true), OpenWorldHint: boolPtr(false)}
+    // gatewayWriteAnnotations is for idempotent changes to gateway state
+    gatewayWriteAnnotations = &ToolAnnotations{
+        ReadOnlyHint:    boolPtr(false),
+        DestructiveHint: boolPtr(true),
+        IdempotentHint:  boolPtr(true),
+        OpenWorldHint:   boolPtr(false),
+    }
+)
+
+// register adds a version of a tool. The state serves the newest version
+// that is not deprecated; the others stay callable by pinning their
+// version.
+func (s *mcpState) register(tool MCPTool) {
+    if tool.Version == "" {
+        tool.Version = defaultToolVersion
+    }
+    versions := s.versions[tool.Name]
+    if versions == nil {
+        versions = map[string]MCPTool{}
+        s.versions[tool.Name] = versions
+    }
+    versions[tool.Version] = tool
+
+    var current MCPTool
+    for _, candidate := range versions {
+        if current.Name == "" || preferredVersion(candidate, current) {
+            current = candidate
+        }
+    }
+    s.tools[tool.Name] = current
+}
+
+// preferredVersion reports whether a should be served over b: versions in
+// use win over deprecated ones, then newer over older
+func preferredVersion(a, b MCPTool) bool {
+    if (a.Deprecated == nil) != (b.Deprecated == nil) {
+        return a.Deprecated == nil
+    }
+    return compareVersions(a.Version, b.Version) > 0
+}
+
+// resolveTool finds the tool version a call names. A version pinned in the
+// name as name@version takes precedence over pin, which comes from the
+// X-MCP-Tool-Version header. A pin matches whole leading components, so
+// "1" and "1.2" both match 1.2.3; the newest match wins.
+func (s *mcpState) resolveTool(name, pin string) (MCPTool, bool) {
+    if i := strings.LastIndex(name, "@"); i > 0 {
+        name, pin = name[:i], name[i+1:]
+    }
+    current, ok := s.tools[name]
+    if !ok || pin == "" {
+        return current, ok
+    }
+
+    var best MCPTool
+    bestVersion := ""
+    found := false
+    for version, tool := range s.versions[name] {
+        if versionMatches(version, pin) && (!found || compareVersions(version, bestVersion) > 0) {
+            best, bestVersion, found = tool, version, true
+        }
+    }
+    return best, found
+}
+
+// versionPin is the version a request pins its tool call to, if any
+func versionPin(r *http.Request) string {
+    if r == nil {
+        return ""
+    }
+    return strings.TrimSpace(r.Header.Get("X-MCP-Tool-Version"))
+}
+
+// toolKey identifies one version of a tool
+func toolKey(name, version string) string {
+    return name + "@" + version
+}
+
+func toolVersion(tool MCPTool) string {
+    if tool.Version == "" {
+        return defaultToolVersion
+    }
+    return tool.Version
+}
+
+// listedVersions returns every version of a tool, newest first, when there
+// is more than one
+func (s *mcpState) listedVersions(name string) []string {
+    if len(s.versions[name]) < 2 {
+        return nil
+    }
+    versions := make([]string, 0, len(s.versions[name]))
+    for version := range s.versions[name] {
+        versions = append(versions, version)
+    }
+    sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) > 0 })
+    return versions
+}
+
+func versionMatches(version, pin string) bool {
+    version = strings.TrimPrefix(version, "v")
+    pin = strings.TrimPrefix(pin, "v")
+    return version == pin || strings.HasPrefix(version, pin+".")
+}
+
+// setDeprecationHeaders marks an HTTP response as coming from a deprecated
+// tool version, in the style of RFC 8594
+func setDeprecationHeaders(header http.Header, d *ToolDeprecation) {
+    header.Set("Deprecation", "true")
+    if sunset, err := time.Parse("2006-01-02", d.Sunset); err == nil {
+        header.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+    }
+    if d.ReplacedBy != "" {
+        header.Set("Link", `</mcp/call/`+d.ReplacedBy+`>; rel="successor-version"`)
+    }
+}
@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestResolveTool(t *testing.T) {
+    s := newMCPState(defaultMCPConfig())
+    for _, version := range []string{"1.0.0", "1.2.0", "1.2.3", "2.0.0", "2.1.0"} {
+        tool := MCPTool{Name: "lookup", Version: version}
+        if version == "2.1.0" {
+            tool.Deprecated = &ToolDeprecation{}
+        }
+        s.register(tool)
+    }
+    s.register(MCPTool{Name: "plain"})
+
+    tests := []struct {
+        name        string
+        tool        string
+        pin         string
+        wantVersion string
+        wantOK      bool
+    }{
+        {name: "unpinned serves newest in use", tool: "lookup", wantVersion: "2.0.0", wantOK: true},
+        {name: "exact pin", tool: "lookup", pin: "1.2.0", wantVersion: "1.2.0", wantOK: true},
+        {name: "major pin takes newest match", tool: "lookup", pin: "1", wantVersion: "1.2.3", wantOK: true},
+        {name: "minor pin takes newest match", tool: "lookup", pin: "1.2", wantVersion: "1.2.3", wantOK: true},
+        {name: "pin reaches deprecated version", tool: "lookup", pin: "2.1", wantVersion: "2.1.0", wantOK: true},
+        {name: "v prefix", tool: "lookup", pin: "v1.0", wantVersion: "1.0.0", wantOK: true},
+        {name: "pin matches whole components only", tool: "lookup", pin: "1.2.", wantOK: false},
+        {name: "partial component", tool: "lookup", pin: "2.", wantOK: false},
+        {name: "unknown version", tool: "lookup", pin: "3", wantOK: false},
+        {name: "name suffix", tool: "lookup@1.0.0", wantVersion: "1.0.0", wantOK: true},
+        {name: "name suffix overrides pin", tool: "lookup@1", pin: "2", wantVersion: "1.2.3", wantOK: true},
+        {name: "unknown tool", tool: "missing", pin: "1", wantOK: false},
+        {name: "default version", tool: "plain", pin: "1", wantVersion: defaultToolVersion, wantOK: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tool, ok := s.resolveTool(tt.tool, tt.pin)
+            if ok != tt.wantOK {
+                t.Fatalf("resolveTool(%q, %q) ok = %v, want %v", tt.tool, tt.pin, ok, tt.wantOK)
+            }
+            if ok && tool.Version != tt.wantVersion {
+                t.Fatalf("resolveTool(%q, %q) = %s, want %s", tt.tool, tt.pin, tool.Version, tt.wantVersion)
+            }
+        })
+    }
+}
+
+func TestRegisterServesNewestInUse(t *testing.T) {
+    tests := []struct {
+        name     string
+        versions []MCPTool
+        want     string
+    }{
+        {
+            name:     "newest wins",
+            versions: []MCPTool{{Version: "1.9.0"}, {Version: "1.10.0"}, {Version: "1.2.0"}},
+            want:     "1.10.0",
+        },
+        {
+            name:     "deprecated loses to older",
+            versions: []MCPTool{{Version: "1.0.0"}, {Version: "2.0.0", Deprecated: &ToolDeprecation{}}},
+            want:     "1.0.0",
+        },
+        {
+            name:     "all deprecated",
+            versions: []MCPTool{{Version: "1.0.0", Deprecated: &ToolDeprecation{}}, {Version: "2.0.0", Deprecated: &ToolDeprecation{}}},
+            want:     "2.0.0",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newMCPState(defaultMCPConfig())
+            for _, tool := range tt.versions {
+                tool.Name = "lookup"
+                s.register(tool)
+            }
+            if got := s.tools["lookup"].Version; got != tt.want {
+                t.Fatalf("serving %s, want %s", got, tt.want)
+            }
+            if got := len(s.listedVersions("lookup")); got != len(tt.versions) {
+                t.Fatalf("listed %d versions, want %d", got, len(tt.versions))
+            }
+        })
+    }
+}
@@ -2,23 +2,31 @@ package main
 
 import (
     "context"
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
     "fmt"
     "io"
     "net"
     "net/http"
+    "net/netip"
+    "os"
+    "path/filepath"
     "regexp"
     "strconv"
     "strings"
     "time"
+    "unicode/utf8"
 
     "github.com/TykTechnologies/tyk/ctx"
     "github.com/TykTechnologies/tyk/log"
     "github.com/TykTechnologies/tyk/user"
+    "github.com/redis/go-redis/v9"
     "go.opentelemetry.io/otel"
     "go.opentelemetry.io/otel/attribute"
     "go.opentelemetry.io/otel/codes"
     "go.opentelemetry.io/otel/trace"
+    "gopkg.in/yaml.v3"
 )
 
 // ClaudeRequest represents Claude API request structure
@@ -52,12 +60,87 @@ type ClaudeResponse struct {
 var (
     tracer    = otel.Tracer("tyk-mcp-gateway")
     toolRegex = regexp.MustCompile(`tool:\s*(\w+)`)
+
+    // Conversation turns are published to a Redis stream that the MCP tools
+    // plugin indexes for claude_context_search. The stream, Redis and
+    // trusted proxies come from the MCP tools plugin's config file so both
+    // plugins agree.
+    mcpSettings         = loadMCPSettings()
+    conversationCapture = getEnv("MCP_CONVERSATION_CAPTURE", "true") == "true"
+    conversationRedis   = redis.NewClient(&redis.Options{
+        Addr:     mcpSettings.Redis.Addr,
+        Password: mcpSettings.Redis.Password,
+        DB:       mcpSettings.Redis.DB,
+    })
 )
 
+const maxCapturedMessageBytes = 16 * 1024
+
+// conversationIDKey holds the conversation ID on the request context for
+// the response hook, once X-Conversation-Id has been taken off the request
+type conversationIDKey struct{}
+
+// sharedMCPSettings is the part of the MCP tools plugin config the enhancer
+// shares: where conversations are published and which proxies to trust
+type sharedMCPSettings struct {
+    TrustedProxies []string `json:"trusted_proxies"`
+    Redis          struct {
+        Addr     string `json:"addr"`
+        Password string `json:"password"`
+        DB       int    `json:"db"`
+    } `json:"redis"`
+    Conversations struct {
+        Stream string `json:"stream"`
+    } `json:"conversations"`
+}
+
+// loadMCPSettings reads MCP_CONFIG_FILE with the same defaults as the MCP
+// tools plugin. A missing or unreadable file leaves the defaults.
+func loadMCPSettings() sharedMCPSettings {
+    var settings sharedMCPSettings
+    settings.TrustedProxies = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+    settings.Redis.Addr = getEnv("TYK_GW_STORAGE_HOST", "tyk-redis") + ":" + getEnv("TYK_GW_STORAGE_PORT", "6379")
+    settings.Redis.Password = getEnv("TYK_GW_STORAGE_PASSWORD", "")
+    settings.Conversations.Stream = "mcp-conversations"
+
+    path := getEnv("MCP_CONFIG_FILE", "/opt/tyk-gateway/mcp/config.yaml")
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            log.Get().WithError(err).Warn("Failed to read MCP config, using defaults")
+        }
+        return settings
+    }
+
+    loaded := settings
+    if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+        var raw interface{}
+        if err = yaml.Unmarshal(data, &raw); err == nil {
+            data, err = json.Marshal(raw)
+        }
+    }
+    if err == nil {
+        err = json.Unmarshal(data, &loaded)
+    }
+    if err != nil {
+        log.Get().WithError(err).Warn("Invalid MCP config, using defaults")
+        return settings
+    }
+    if loaded.Conversations.Stream == "" {
+        loaded.Conversations.Stream = settings.Conversations.Stream
+    }
+    return loaded
+}
+
 func main() {}
 
 // TykOTELPreMiddleware handles request tracing setup
 func TykOTELPreMiddleware(rw http.ResponseWriter, r *http.Request) {
+    // Tyk passes this same request to the response hook, so whatever is
+    // set on the copies below is written back to it at the end
+    gatewayReq := r
+    defer func() { *gatewayReq = *r }()
+    
     // Start timing
     r = r.WithContext(context.WithValue(r.Context(), "request.start_time", strconv.FormatInt(time.Now().UnixNano(), 10)))
     
@@ -94,6 +177,10 @@ func TykOTELPreMiddleware(rw http.ResponseWriter, r *http.Request) {
     
     // Claude AI specific tracing
     if strings.Contains(r.RequestURI, "/claude/") {
+        // X-Conversation-Id is for the gateway only and is not sent to Anthropic
+        conversationID := r.Header.Get("X-Conversation-Id")
+        r.Header.Del("X-Conversation-Id")
+        
         if body, err := io.ReadAll(r.Body); err == nil {
             // Restore body for downstream processing
             r.Body = io.NopCloser(strings.NewReader(string(body)))
@@ -107,6 +194,11 @@ func TykOTELPreMiddleware(rw http.ResponseWriter, r *http.Request) {
                     attribute.Int("claude.request_size", len(body)),
                 )
                 
+                if conversationID := captureConversationRequest(session, claudeReq, conversationID); conversationID != "" {
+                    attrs = append(attrs, attribute.String("claude.conversation_id", conversationID))
+                    r = r.WithContext(context.WithValue(r.Context(), conversationIDKey{}, conversationID))
+                }
+                
                 // Extract MCP context from Claude messages
                 if len(claudeReq.Messages) > 0 {
                     lastMessage := claudeReq.Messages[len(claudeReq.Messages)-1]
@@ -206,6 +298,8 @@ func TykOTELPostMiddleware(rw http.ResponseWriter, r *http.Request, res *http.Re
                     attribute.Int("claude.total_tokens", claudeResp.Usage.InputTokens+claudeResp.Usage.OutputTokens),
                 )
                 
+                captureConversationResponse(r, claudeResp)
+                
                 // Check if Claude used MCP tools
                 for _, content := range claudeResp.Content {
                     if content.Type == "tool_use" && content.Name != "" {
@@ -264,24 +358,50 @@ func TykOTELPostMiddleware(rw http.ResponseWriter, r *http.Request, res *http.Re
     }
 }
 
+// getClientIP resolves the caller address like the MCP tools plugin:
+// forwarding headers are only believed from a trusted proxy, and
+// X-Forwarded-For is read from the right, skipping trusted hops
 func getClientIP(r *http.Request) string {
-    // Check X-Forwarded-For header first
-    if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-        ips := strings.Split(xff, ",")
-        return strings.TrimSpace(ips[0])
+    remote := r.RemoteAddr
+    if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+        remote = ip
+    }
+    if !trustedHop(remote) {
+        return remote
     }
     
-    // Check X-Real-IP header
-    if xri := r.Header.Get("X-Real-IP"); xri != "" {
+    if xff := strings.Join(r.Header.Values("X-Forwarded-For"), ","); xff != "" {
+        hops := strings.Split(xff, ",")
+        for i := len(hops) - 1; i >= 0; i-- {
+            hop := strings.TrimSpace(hops[i])
+            if hop != "" && (i == 0 || !trustedHop(hop)) {
+                return hop
+            }
+        }
+    }
+    if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
         return xri
     }
-    
-    // Fall back to RemoteAddr
-    if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-        return ip
+    return remote
+}
+
+// trustedHop reports whether ip belongs to one of the trusted proxies
+func trustedHop(ip string) bool {
+    addr, err := netip.ParseAddr(ip)
+    if err != nil {
+        return false
     }
-    
-    return r.RemoteAddr
+    addr = addr.WithZone("").Unmap()
+    for _, proxy := range mcpSettings.TrustedProxies {
+        if prefix, err := netip.ParsePrefix(proxy); err == nil {
+            if prefix.Contains(addr) {
+                return true
+            }
+        } else if single, err := netip.ParseAddr(proxy); err == nil && single == addr {
+            return true
+        }
+    }
+    return false
 }
 
 func getSessionID(session *user.SessionState) string {
@@ -292,6 +412,108 @@ func getSessionID(session *user.SessionState) string {
     return "anonymous"
 }
 
+// conversationUserID identifies who owns a captured conversation, matching
+// the caller ID the MCP tools plugin uses: user_id metadata, alias, then key
+func conversationUserID(session *user.SessionState) string {
+    if session == nil {
+        return ""
+    }
+    if userID, ok := session.MetaData["user_id"]; ok && userID != nil && fmt.Sprint(userID) != "" {
+        return fmt.Sprint(userID)
+    }
+    if session.Alias != "" {
+        return session.Alias
+    }
+    return session.KeyID
+}
+
+// captureConversationRequest publishes the newest user message of a Claude
+// request and returns its conversation ID. Requests carry the whole
+// history, so the ID is taken from X-Conversation-Id or derived from the
+// owner and the first message.
+func captureConversationRequest(session *user.SessionState, claudeReq ClaudeRequest, conversationID string) string {
+    userID := conversationUserID(session)
+    if !conversationCapture || userID == "" || len(claudeReq.Messages) == 0 {
+        return ""
+    }
+    
+    if conversationID == "" {
+        sum := sha256.Sum256([]byte(userID + "\x00" + claudeReq.Messages[0].Content))
+        conversationID = "conv_" + hex.EncodeToString(sum[:8])
+    }
+    
+    last := claudeReq.Messages[len(claudeReq.Messages)-1]
+    if last.Role == "user" {
+        publishConversationTurn(conversationID, userID, "user", last.Content, nil)
+    }
+    return conversationID
+}
+
+// captureConversationResponse publishes Claude's reply and the tools it used
+func captureConversationResponse(r *http.Request, claudeResp ClaudeResponse) {
+    conversationID, _ := r.Context().Value(conversationIDKey{}).(string)
+    userID := conversationUserID(ctx.GetSession(r))
+    if !conversationCapture || conversationID == "" || userID == "" {
+        return
+    }
+    
+    var text []string
+    var tools []string
+    for _, content := range claudeResp.Content {
+        switch content.Type {
+        case "text":
+            text = append(text, content.Text)
+        case "tool_use":
+            tools = append(tools, content.Name)
+        }
+    }
+    publishConversationTurn(conversationID, userID, "assistant", strings.Join(text, "\n"), tools)
+}
+
+func publishConversationTurn(conversationID, userID, role, text string, tools []string) {
+    if strings.TrimSpace(text) == "" && len(tools) == 0 {
+        return
+    }
+    if len(text) > maxCapturedMessageBytes {
+        // Cut on a rune boundary so the stream only holds valid UTF-8
+        n := maxCapturedMessageBytes
+        for n > 0 && !utf8.RuneStart(text[n]) {
+            n--
+        }
+        text = text[:n]
+    }
+    
+    // Publishing must never slow down or fail the proxied request
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+        defer cancel()
+        
+        err := conversationRedis.XAdd(ctx, &redis.XAddArgs{
+            Stream: mcpSettings.Conversations.Stream,
+            MaxLen: 100000,
+            Approx: true,
+            Values: map[string]interface{}{
+                "conversation_id": conversationID,
+                "user_id":         userID,
+                "role":            role,
+                "text":            text,
+                "tools":           strings.Join(tools, ","),
+                "timestamp":       time.Now().UTC().Format(time.RFC3339Nano),
+            },
+        }).Err()
+        if err != nil {
+            log.Get().WithError(err).Warn("Failed to capture conversation turn")
+        }
+    }()
+}
+
+func getEnv(key, defaultValue string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return defaultValue
+}
+
 func getErrorDescription(statusCode int) string {
     errorMap := map[int]string{
         400: "bad_request",
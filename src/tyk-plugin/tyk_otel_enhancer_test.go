@@ -0,0 +1,91 @@
+package main
+
+import (
+    "context"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/TykTechnologies/tyk/apidef"
+    "github.com/TykTechnologies/tyk/ctx"
+    "github.com/TykTechnologies/tyk/user"
+    "github.com/alicebob/miniredis/v2"
+    "github.com/redis/go-redis/v9"
+)
+
+func TestConversationCaptureThroughHooks(t *testing.T) {
+    const request = `{"model":"claude-sonnet","max_tokens":256,"messages":[
+        {"role":"user","content":"Is 203.0.113.7 malicious?"},
+        {"role":"assistant","content":"Let me check."},
+        {"role":"user","content":"Also check example.com"}]}`
+    const response = `{"id":"msg_1","model":"claude-sonnet","content":[
+        {"type":"text","text":"Both look clean."},
+        {"type":"tool_use","name":"sentraip_threat_check","input":{"target":"example.com"}}]}`
+
+    tests := []struct {
+        name   string
+        header string
+        want   string
+    }{
+        {name: "client conversation id", header: "chat-42", want: "chat-42"},
+        {name: "derived conversation id", want: "conv_"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server := miniredis.RunT(t)
+            previous := conversationRedis
+            conversationRedis = redis.NewClient(&redis.Options{Addr: server.Addr()})
+            t.Cleanup(func() { conversationRedis = previous })
+
+            r := httptest.NewRequest(http.MethodPost, "/claude/v1/messages", strings.NewReader(request))
+            if tt.header != "" {
+                r.Header.Set("X-Conversation-Id", tt.header)
+            }
+            ctx.SetSession(r, &user.SessionState{Alias: "ann"}, "", false)
+            ctx.SetDefinition(r, &apidef.APIDefinition{Name: "claude"})
+
+            TykOTELPreMiddleware(httptest.NewRecorder(), r)
+            if r.Header.Get("X-Conversation-Id") != "" {
+                t.Fatal("X-Conversation-Id is still on the upstream request")
+            }
+            if body, _ := io.ReadAll(r.Body); string(body) != request {
+                t.Fatalf("upstream request body %q, want the original", body)
+            }
+
+            res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(response))}
+            TykOTELPostMiddleware(httptest.NewRecorder(), r, res)
+
+            // Turns are published in the background
+            var turns []redis.XMessage
+            for deadline := time.Now().Add(2 * time.Second); len(turns) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+                turns, _ = conversationRedis.XRange(context.Background(), mcpSettings.Conversations.Stream, "-", "+").Result()
+            }
+            if len(turns) != 2 {
+                t.Fatalf("captured %d turns, want 2", len(turns))
+            }
+
+            byRole := map[string]map[string]interface{}{}
+            for _, turn := range turns {
+                byRole[turn.Values["role"].(string)] = turn.Values
+            }
+            user, assistant := byRole["user"], byRole["assistant"]
+            if user == nil || assistant == nil {
+                t.Fatalf("turns %v, want one user and one assistant turn", turns)
+            }
+            if user["text"] != "Also check example.com" {
+                t.Fatalf("user turn %q, want the newest message", user["text"])
+            }
+            if assistant["text"] != "Both look clean." || assistant["tools"] != "sentraip_threat_check" {
+                t.Fatalf("assistant turn %v, want its text and tool", assistant)
+            }
+            id, _ := user["conversation_id"].(string)
+            if !strings.HasPrefix(id, tt.want) || assistant["conversation_id"] != id || user["user_id"] != "ann" {
+                t.Fatalf("turns are in conversations %q and %q, want both in %s*", id, assistant["conversation_id"], tt.want)
+            }
+        })
+    }
+}